@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dayCount is the number of commits on one day.
+type dayCount struct {
+	Date    string `json:"date"`
+	Commits int    `json:"commits"`
+}
+
+// authorActivity is one author's commits by day.
+type authorActivity struct {
+	Name    string     `json:"name"`
+	Email   string     `json:"email"`
+	Commits int        `json:"commits"`
+	Days    []dayCount `json:"days"`
+}
+
+// activity is the activity endpoint's response.
+type activity struct {
+	Days    []dayCount        `json:"days"`
+	Authors []*authorActivity `json:"authors"`
+}
+
+// aggregateActivity counts commits by author date, on the day it was in
+// the author's own time zone, overall and per author (grouped by email as
+// in aggregateContributors). Days without commits are left out.
+func aggregateActivity(commits []commitInfo) *activity {
+	total := make(map[string]int)
+	byEmail := make(map[string]*authorActivity)
+	perAuthor := make(map[string]map[string]int)
+	latest := make(map[string]commitInfo)
+	for _, c := range commits {
+		day := c.When.Format("2006-01-02")
+		total[day]++
+		key := strings.ToLower(c.Email)
+		a, ok := byEmail[key]
+		if !ok {
+			a = &authorActivity{Email: c.Email}
+			byEmail[key] = a
+			perAuthor[key] = make(map[string]int)
+		}
+		a.Commits++
+		perAuthor[key][day]++
+		if l, ok := latest[key]; !ok || !c.When.Before(l.When) {
+			latest[key] = c
+			a.Name = c.Author
+		}
+	}
+
+	out := &activity{Days: sortedDays(total), Authors: make([]*authorActivity, 0, len(byEmail))}
+	for key, a := range byEmail {
+		a.Days = sortedDays(perAuthor[key])
+		out.Authors = append(out.Authors, a)
+	}
+	sort.Slice(out.Authors, func(i, j int) bool {
+		if out.Authors[i].Commits != out.Authors[j].Commits {
+			return out.Authors[i].Commits > out.Authors[j].Commits
+		}
+		return out.Authors[i].Email < out.Authors[j].Email
+	})
+	return out
+}
+
+func sortedDays(counts map[string]int) []dayCount {
+	days := make([]dayCount, 0, len(counts))
+	for d, n := range counts {
+		days = append(days, dayCount{Date: d, Commits: n})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days
+}
+
+// activityHandler serves /graph/{id}/activity: commit counts per day,
+// overall and by author, for a contribution heatmap. since and until
+// narrow the range as they do for the graph JSON.
+func activityHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	commits, ok := commitsInRange(w, r, uploadID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aggregateActivity(commits))
+}
+
+// commitsInRange loads the commits whose author date is within ?since=
+// and ?until=, if given, or writes an error and reports false.
+func commitsInRange(w http.ResponseWriter, r *http.Request, uploadID int) ([]commitInfo, bool) {
+	v := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if s := v.Get("since"); s != "" {
+		if since, err = parseDateParam(s, false); err != nil {
+			http.Error(w, "since: "+err.Error(), 400)
+			return nil, false
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if until, err = parseDateParam(s, true); err != nil {
+			http.Error(w, "until: "+err.Error(), 400)
+			return nil, false
+		}
+	}
+	commits, err := loadCommits(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil, false
+	}
+	kept := commits[:0]
+	for _, c := range commits {
+		if !since.IsZero() && c.When.Before(since) || !until.IsZero() && !c.When.Before(until) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept, true
+}
+
+// commitTimes is when commits were made, by the author's own clock:
+// counts per hour of the day, per weekday from Monday, and per weekday
+// and hour for a punch card.
+type commitTimes struct {
+	Commits  int        `json:"commits"`
+	Hours    [24]int    `json:"hours"`
+	Weekdays [7]int     `json:"weekdays"`
+	Week     [7][24]int `json:"week"`
+}
+
+func (t *commitTimes) add(when time.Time) {
+	day := (int(when.Weekday()) + 6) % 7
+	t.Commits++
+	t.Hours[when.Hour()]++
+	t.Weekdays[day]++
+	t.Week[day][when.Hour()]++
+}
+
+// authorTimes is one author's commit times.
+type authorTimes struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	commitTimes
+}
+
+// aggregateTiming counts commit times by author date in the author's time
+// zone, overall and per author (grouped by email as in
+// aggregateContributors), busiest author first.
+func aggregateTiming(commits []commitInfo) (overall commitTimes, authors []*authorTimes) {
+	byEmail := make(map[string]*authorTimes)
+	for _, ct := range aggregateContributors(commits) {
+		a := &authorTimes{Name: ct.Name, Email: ct.Email}
+		byEmail[strings.ToLower(ct.Email)] = a
+		authors = append(authors, a)
+	}
+	for _, c := range commits {
+		overall.add(c.When)
+		byEmail[strings.ToLower(c.Email)].add(c.When)
+	}
+	if authors == nil {
+		authors = []*authorTimes{}
+	}
+	return overall, authors
+}
+
+// timingHandler serves /graph/{id}/timing: when commits are made, by hour
+// and weekday, overall and by author. since and until narrow the range as
+// for the activity endpoint.
+func timingHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	commits, ok := commitsInRange(w, r, uploadID)
+	if !ok {
+		return
+	}
+	overall, authors := aggregateTiming(commits)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"overall": overall, "authors": authors})
+}
+
+// weekOf returns the Monday starting t's week, by t's own calendar.
+func weekOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// series is one line of the frequency endpoint's chart.
+type series struct {
+	Name   string `json:"name"`
+	Email  string `json:"email,omitempty"`
+	Counts []int  `json:"counts"`
+}
+
+// frequency is the frequency endpoint's response: counts per week for
+// every week from the first commit's to the last's, empty weeks included.
+type frequency struct {
+	Weeks  []string `json:"weeks"`
+	Total  []int    `json:"total"`
+	Series []series `json:"series,omitempty"`
+}
+
+// weeklyFrequency counts commits per week, and per group if group is not
+// nil: group returns the key of a commit's series and how to label it, or
+// a key of "" to leave the commit out of every series. Series are ordered
+// by commit count.
+func weeklyFrequency(commits []commitInfo, group func(commitInfo) (string, series)) *frequency {
+	f := &frequency{Weeks: []string{}, Total: []int{}}
+	if len(commits) == 0 {
+		return f
+	}
+	first, last := weekOf(commits[0].When), weekOf(commits[0].When)
+	for _, c := range commits {
+		w := weekOf(c.When)
+		if w.Before(first) {
+			first = w
+		}
+		if w.After(last) {
+			last = w
+		}
+	}
+	n := int(last.Sub(first).Hours()/24/7) + 1
+	for i := 0; i < n; i++ {
+		f.Weeks = append(f.Weeks, first.AddDate(0, 0, 7*i).Format("2006-01-02"))
+	}
+	f.Total = make([]int, n)
+	byKey := make(map[string]*series)
+	totals := make(map[string]int)
+	for _, c := range commits {
+		i := int(weekOf(c.When).Sub(first).Hours() / 24 / 7)
+		f.Total[i]++
+		if group == nil {
+			continue
+		}
+		key, label := group(c)
+		if key == "" {
+			continue
+		}
+		s := byKey[key]
+		if s == nil {
+			s = &label
+			s.Counts = make([]int, n)
+			byKey[key] = s
+		}
+		s.Counts[i]++
+		totals[key]++
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if totals[keys[i]] != totals[keys[j]] {
+			return totals[keys[i]] > totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		f.Series = append(f.Series, *byKey[k])
+	}
+	return f
+}
+
+// frequencyHandler serves /graph/{id}/frequency: commits per week, with
+// ?by=author a series per author (grouped by email) and with ?by=branch a
+// series per branch, each commit going to the branch whose first-parent
+// line it is on.
+func frequencyHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by != "" && by != "author" && by != "branch" {
+		http.Error(w, "by must be author or branch", 400)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	commits := make([]commitInfo, 0, len(h.topo))
+	for _, c := range h.topo {
+		commits = append(commits, *h.commits[c])
+	}
+	var group func(commitInfo) (string, series)
+	switch by {
+	case "author":
+		authors := make(map[string]series)
+		for _, ct := range aggregateContributors(commits) {
+			authors[strings.ToLower(ct.Email)] = series{Name: ct.Name, Email: ct.Email}
+		}
+		group = func(c commitInfo) (string, series) {
+			key := strings.ToLower(c.Email)
+			return key, authors[key]
+		}
+	case "branch":
+		refs, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		branchOf, _ := h.newest(0).branches(refs)
+		group = func(c commitInfo) (string, series) {
+			return branchOf[c.Hash], series{Name: branchOf[c.Hash]}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(weeklyFrequency(commits, group))
+}
@@ -0,0 +1,240 @@
+package main
+
+// Instance administration: GET /admin (page), GET /api/v1/admin (stats)
+// and POST /api/v1/admin/uploads/{id}/{purge,retry}. Admins are API token
+// holders and signed-in users whose email is listed in GITVIS_ADMINS
+// (comma-separated).
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func isAdmin(r *http.Request) bool {
+	if _, ok := tokenFromRequest(r); ok {
+		return true
+	}
+	u := currentUser(r)
+	if u == nil || u.Email == "" {
+		return false
+	}
+	for _, e := range strings.Split(setting("GITVIS_ADMINS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(e), u.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	http.Error(w, "admin only", http.StatusForbidden)
+	return false
+}
+
+type adminUpload struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	UploadedAt string `json:"uploaded_at"`
+	Uploader   string `json:"uploader,omitempty"`
+	Visibility string `json:"visibility"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Retryable  bool   `json:"retryable"`
+	SizeBytes  int64  `json:"size_bytes"`
+	Nodes      int    `json:"nodes"`
+	Edges      int    `json:"edges"`
+}
+
+type adminStats struct {
+	Uploads   int             `json:"uploads"`
+	Users     int             `json:"users"`
+	DBBytes   int64           `json:"db_bytes"`
+	TempBytes int64           `json:"temp_bytes"`
+	Queued    int             `json:"queued"`
+	Ingesting int             `json:"ingesting"`
+	Failed    int             `json:"failed"`
+	Jobs      []progressEvent `json:"jobs"`
+	PerUpload []adminUpload   `json:"per_upload"`
+}
+
+func loadAdminStats(ctx context.Context) (*adminStats, error) {
+	s := &adminStats{Jobs: activeJobs(), PerUpload: make([]adminUpload, 0)}
+	var pages, pageSize int64
+	err := db.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM users),
+		(SELECT page_count FROM pragma_page_count()), (SELECT page_size FROM pragma_page_size())`).Scan(&s.Users, &pages, &pageSize)
+	if err != nil {
+		return nil, err
+	}
+	s.DBBytes = pages * pageSize
+
+	rows, err := db.QueryContext(ctx, `SELECT id, name, uploaded_at, uploader, visibility, status, error, archive, size_bytes,
+		(SELECT COUNT(*) FROM nodes WHERE upload_id=uploads.id),
+		(SELECT COUNT(*) FROM edges WHERE upload_id=uploads.id)
+		FROM uploads ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u adminUpload
+		var name, uploadedAt, uploader, status, errMsg, archive sql.NullString
+		if err := rows.Scan(&u.ID, &name, &uploadedAt, &uploader, &u.Visibility, &status, &errMsg, &archive,
+			&u.SizeBytes, &u.Nodes, &u.Edges); err != nil {
+			return nil, err
+		}
+		u.Name, u.UploadedAt, u.Uploader, u.Error = name.String, uploadedAt.String, uploader.String, errMsg.String
+		u.Status = status.String
+		if u.Status == "" {
+			// ingested before statuses were recorded
+			u.Status = "done"
+		}
+		if archive.Valid && u.Status == "failed" {
+			_, err := os.Stat(archive.String)
+			u.Retryable = err == nil
+		}
+		switch u.Status {
+		case "queued":
+			s.Queued++
+		case "ingesting":
+			s.Ingesting++
+		case "failed":
+			s.Failed++
+		}
+		s.PerUpload = append(s.PerUpload, u)
+	}
+	s.Uploads = len(s.PerUpload)
+	s.TempBytes = tempUsage()
+	return s, rows.Err()
+}
+
+// tempUsage totals the archives and extraction directories ingests leave
+// in the temp dir.
+func tempUsage() int64 {
+	var total int64
+	for _, pattern := range []string{"repo-*.zip", "gitvis-*"} {
+		matches, _ := filepath.Glob(filepath.Join(tempDir(), pattern))
+		for _, m := range matches {
+			filepath.Walk(m, func(_ string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					total += info.Size()
+				}
+				return nil
+			})
+		}
+	}
+	return total
+}
+
+// adminHandler serves /api/v1/admin and its actions; parts follow "admin".
+func adminHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		ctx, cancel := queryContext(r.Context())
+		defer cancel()
+		stats, err := loadAdminStats(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	case len(parts) == 3 && parts[0] == "uploads" && r.Method == "POST":
+		uploadID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.Error(w, "bad id", 400)
+			return
+		}
+		switch parts[2] {
+		case "purge":
+			found, err := deleteUpload(uploadID)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "retry":
+			retryIngest(w, r, uploadID)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// retryIngest re-runs a failed ingest from the archive it kept.
+func retryIngest(w http.ResponseWriter, r *http.Request, uploadID int) {
+	var status, archive sql.NullString
+	err := db.QueryRow("SELECT status, archive FROM uploads WHERE id=?", uploadID).Scan(&status, &archive)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if status.String != "failed" || !archive.Valid {
+		http.Error(w, "only failed ingests with a kept archive can be retried", http.StatusConflict)
+		return
+	}
+	if _, err := os.Stat(archive.String); err != nil {
+		http.Error(w, "archive is gone: "+err.Error(), http.StatusGone)
+		return
+	}
+	if isShuttingDown() {
+		uploadFailed(w, errShuttingDown)
+		return
+	}
+	// claim the upload, so that of two retries at once only one ingests
+	res, err := db.Exec("UPDATE uploads SET status='queued' WHERE id=? AND status='failed'", uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		http.Error(w, "the ingest is already being retried", http.StatusConflict)
+		return
+	}
+	j := newJob(uploadID)
+	go func() {
+		j.finish(ingestInto(context.WithoutCancel(r.Context()), archive.String, uploadID, j))
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job":    uploadID,
+		"events": sitePath(fmt.Sprintf("/ws/jobs/%d", uploadID)),
+	})
+}
+
+func adminPage(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	t, err := template.ParseFS(assets, "templates/admin.html")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, map[string]string{"CSRF": csrfToken(w, r), "Base": basePath})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// resolveCommit turns a ref name (short or full) or a commit hash, which
+// may be abbreviated to 4 or more characters, into a commit hash.
+func resolveCommit(ctx context.Context, uploadID int, s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("missing commit")
+	}
+	var tip string
+	err := db.QueryRowContext(ctx, `SELECT e.target FROM nodes n JOIN edges e ON e.upload_id=n.upload_id AND e.source=n.id AND e.rel='ref->commit'
+		WHERE n.upload_id=? AND n.type='ref' AND (n.label=? OR n.id=?) ORDER BY n.id LIMIT 1`, uploadID, s, s).Scan(&tip)
+	if err == nil {
+		return tip, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	if len(s) < 4 {
+		return "", fmt.Errorf("no ref or commit %q", s)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id FROM nodes WHERE upload_id=? AND type='commit' AND meta<>'' AND id>=? AND id<? LIMIT 2",
+		uploadID, s, s+"\xff")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return "", err
+		}
+		found = append(found, id)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no ref or commit %q", s)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("commit prefix %q is ambiguous", s)
+}
+
+// commitPair resolves the a and b query parameters, answering 400 itself
+// if either doesn't name a commit.
+func commitPair(w http.ResponseWriter, r *http.Request, uploadID int) (a, b string, ok bool) {
+	var err error
+	if a, err = resolveCommit(r.Context(), uploadID, r.URL.Query().Get("a")); err != nil {
+		http.Error(w, "a: "+err.Error(), 400)
+		return "", "", false
+	}
+	if b, err = resolveCommit(r.Context(), uploadID, r.URL.Query().Get("b")); err != nil {
+		http.Error(w, "b: "+err.Error(), 400)
+		return "", "", false
+	}
+	return a, b, true
+}
+
+// isAncestor reports whether a is b or one of its ancestors. The walk
+// down from b skips commits whose generation is below a's, since none of
+// those can lead to a; uploads ingested before generations were stored
+// are walked in full.
+func isAncestor(ctx context.Context, uploadID int, a, b string) (bool, error) {
+	var gen int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(json_extract(meta,'$.generation'),0) FROM nodes WHERE upload_id=? AND id=?",
+		uploadID, a).Scan(&gen)
+	if err != nil {
+		return false, err
+	}
+	var found int
+	err = db.QueryRowContext(ctx, `WITH RECURSIVE walk(id) AS (
+			SELECT ?
+			UNION
+			SELECT e.target FROM edges e JOIN walk w ON e.source=w.id
+			JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+			WHERE e.upload_id=? AND e.rel='parent' AND n.meta<>''
+			AND COALESCE(json_extract(n.meta,'$.generation'),?) >= ?
+		)
+		SELECT COUNT(*) FROM walk WHERE id=?`, b, uploadID, gen, gen, a).Scan(&found)
+	return found > 0, err
+}
+
+// ancestorHandler serves /graph/{id}/ancestor?a=X&b=Y: whether X is an
+// ancestor of Y, as git merge-base --is-ancestor answers it.
+func ancestorHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	a, b, ok := commitPair(w, r, uploadID)
+	if !ok {
+		return
+	}
+	yes, err := isAncestor(r.Context(), uploadID, a, b)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"a": a, "b": b, "ancestor": yes})
+}
+
+// mergeBases returns the best common ancestors of a and b, as git
+// merge-base --all finds them: common ancestors that aren't ancestors of
+// another common ancestor. Criss-cross merges can leave more than one;
+// unrelated histories leave none. They are listed newest first.
+func (h *history) mergeBases(a, b string) []string {
+	inA, inB := h.ancestors(a), h.ancestors(b)
+	// children come before parents in reverse topological order, so a
+	// commit is known to be covered by any common descendant when reached
+	covered := make(map[string]bool)
+	bases := []string{}
+	for i := len(h.topo) - 1; i >= 0; i-- {
+		c := h.topo[i]
+		common := inA[c] && inB[c]
+		if common && !covered[c] {
+			bases = append(bases, c)
+		}
+		if common || covered[c] {
+			for _, p := range h.parents[c] {
+				covered[p] = true
+			}
+		}
+	}
+	return bases
+}
+
+// ancestors returns c and every commit reachable from it.
+func (h *history) ancestors(c string) map[string]bool {
+	seen := map[string]bool{c: true}
+	stack := []string{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, p := range h.parents[c] {
+			if !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
+	}
+	return seen
+}
+
+// mergeBaseHandler serves /graph/{id}/merge-base?a=X&b=Y: where the
+// histories of X and Y diverged.
+func mergeBaseHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	a, b, ok := commitPair(w, r, uploadID)
+	if !ok {
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"a": a, "b": b, "merge_bases": h.mergeBases(a, b)})
+}
+
+// compareRefsDefaultLimit is how many commits of each side compare-refs
+// lists unless asked for more; the counts always cover them all.
+const compareRefsDefaultLimit = 100
+
+// commitSummary is a commit as compare-refs lists it.
+type commitSummary struct {
+	Hash    string `json:"hash"`
+	Message string `json:"message"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+}
+
+// compareRefsHandler serves /graph/{id}/compare-refs?base=main&head=X: how
+// far X has diverged from base, like git rev-list --left-right --count
+// base...X. ahead counts the commits head has that base lacks and behind
+// those base has that head lacks; each side lists at most ?limit= of them
+// (default 100, 0 for all), newest first. base defaults to the trunk
+// branch.
+func compareRefsHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	v := r.URL.Query()
+	baseName := v.Get("base")
+	if baseName == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if baseName = pickTrunk(branches); baseName == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	base, err := resolveCommit(r.Context(), uploadID, baseName)
+	if err != nil {
+		http.Error(w, "base: "+err.Error(), 400)
+		return
+	}
+	head, err := resolveCommit(r.Context(), uploadID, v.Get("head"))
+	if err != nil {
+		http.Error(w, "head: "+err.Error(), 400)
+		return
+	}
+	limit, ok := limitParam(w, r, compareRefsDefaultLimit)
+	if !ok {
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	ahead := h.only([]string{head}, []string{base})
+	behind := h.only([]string{base}, []string{head})
+	summarize := func(list []string) []commitSummary {
+		if limit > 0 && len(list) > limit {
+			list = list[:limit]
+		}
+		out := make([]commitSummary, 0, len(list))
+		for _, c := range list {
+			info := h.commits[c]
+			out = append(out, commitSummary{Hash: c, Message: info.Message, Author: info.Author, Date: info.When.Format(time.RFC3339)})
+		}
+		return out
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"base":           baseName,
+		"head":           v.Get("head"),
+		"base_commit":    base,
+		"head_commit":    head,
+		"ahead":          len(ahead),
+		"behind":         len(behind),
+		"merge_bases":    h.mergeBases(base, head),
+		"ahead_commits":  summarize(ahead),
+		"behind_commits": summarize(behind),
+	})
+}
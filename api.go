@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// openAPIHandler serves the OpenAPI document, with its server URL under
+// the base path.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if basePath == "" {
+		http.ServeFileFS(w, r, assets, "api/openapi.json")
+		return
+	}
+	doc, err := fs.ReadFile(assets, "api/openapi.json")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Write(bytes.Replace(doc, []byte(`"url": "/api/v1"`), []byte(`"url": "`+sitePath("/api/v1")+`"`), 1))
+}
+
+// upload is an uploads row as returned by the API.
+type upload struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	UploadedAt string `json:"uploaded_at"`
+	Visibility string `json:"visibility,omitempty"`
+	IssueURL   string `json:"issue_url,omitempty"`
+	// identifies the repository state by its refs
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// of the license files at the root of the trunk branch's tip
+	Licenses []string `json:"licenses,omitempty"`
+	Nodes    *int     `json:"nodes,omitempty"`
+	Edges    *int     `json:"edges,omitempty"`
+	// refs refreshes found rewritten, oldest first
+	Rewrites []refRewrite `json:"rewrites,omitempty"`
+}
+
+// apiV1Handler serves the versioned REST API:
+//
+//	/api/v1/openapi.json
+//	/api/v1/uploads                   GET lists, POST ingests (token required)
+//	/api/v1/uploads/{id}              GET, PATCH (owner), DELETE (token required)
+//	/api/v1/gallery                   public uploads
+//	/api/v1/usage                     the caller's upload usage and quota
+//	/api/v1/admin[/uploads/{id}/...]  instance stats and actions (admins)
+//	/api/v1/compare/{a}/{b}[/graph]   (same as /compare/{a}/{b}[/graph])
+//	/api/v1/combined?uploads=1,2      (same as /combined)
+//	/api/v1/uploads/{id}/graph        (same as /graph/{id}/json)
+//	/api/v1/uploads/{id}/{resource}   (any of graphResources)
+func apiV1Handler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "openapi.json":
+		openAPIHandler(w, r)
+	case len(parts) == 1 && parts[0] == "uploads":
+		switch r.Method {
+		case "GET":
+			listUploadsHandler(w, r)
+		case "POST":
+			if requireToken(w, r) && uploadLimiter.allow(w, r) {
+				createUploadHandler(w, r)
+			}
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	case len(parts) == 1 && parts[0] == "gallery":
+		galleryHandler(w, r)
+	case len(parts) == 1 && parts[0] == "usage":
+		usageHandler(w, r)
+	case parts[0] == "admin":
+		adminHandler(w, r, parts[1:])
+	case parts[0] == "compare":
+		compareHandler(w, r, parts[1:])
+	case len(parts) == 1 && parts[0] == "combined":
+		combinedHandler(w, r)
+	case len(parts) == 2 && parts[0] == "uploads":
+		if !viewable(w, r, parts[1]) {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			getUploadHandler(w, r, parts[1])
+		case "PATCH":
+			updateUploadHandler(w, r, parts[1])
+		case "DELETE":
+			if requireToken(w, r) {
+				deleteUploadHandler(w, r, parts[1])
+			}
+		default:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		}
+	case len(parts) > 2 && parts[0] == "uploads":
+		if !viewable(w, r, parts[1]) {
+			return
+		}
+		resource := strings.Join(parts[2:], "/")
+		if resource == "graph" {
+			resource = "json"
+		}
+		h, ok := lookupResource(resource)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listUploadsHandler lists the uploads eachListedUpload lets the request
+// list.
+func listUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	uploads := make([]upload, 0)
+	err := eachListedUpload(ctx, r, func(id int, name, uploadedAt sql.NullString) error {
+		uploads = append(uploads, upload{ID: id, Name: name.String, UploadedAt: uploadedAt.String})
+		return nil
+	})
+	if err == errListSignIn {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploads)
+}
+
+func getUploadHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	var u upload
+	var name, uploadedAt, issueURL, fingerprint, licenses sql.NullString
+	var nodes, edges int
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	err := db.QueryRowContext(ctx, `SELECT id,name,uploaded_at,visibility,issue_url,fingerprint,licenses,
+		(SELECT COUNT(*) FROM nodes WHERE upload_id=uploads.id),
+		(SELECT COUNT(*) FROM edges WHERE upload_id=uploads.id)
+		FROM uploads WHERE id=?`, idStr).Scan(&u.ID, &name, &uploadedAt, &u.Visibility, &issueURL, &fingerprint, &licenses, &nodes, &edges)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	u.Name, u.UploadedAt, u.IssueURL, u.Fingerprint = name.String, uploadedAt.String, issueURL.String, fingerprint.String
+	u.Nodes, u.Edges = &nodes, &edges
+	if licenses.Valid {
+		json.Unmarshal([]byte(licenses.String), &u.Licenses)
+	}
+	if u.Rewrites, err = loadRewrites(ctx, u.ID); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// createUploadHandler ingests an archive sent either as multipart form field
+// "repo" or as the raw request body (application/zip, name in ?name=). An
+// archive of a repository state the caller already uploaded is ingested
+// again and reported as duplicate_of that upload, or with ?duplicate=reuse
+// answered with that upload instead.
+func createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var src io.Reader = r.Body
+	name := r.URL.Query().Get("name")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, header, err := r.FormFile("repo")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		defer f.Close()
+		src = f
+		if name == "" {
+			name = header.Filename
+		}
+	}
+	if name == "" {
+		name = "upload.zip"
+	}
+	tmp, err := os.CreateTemp(tempDir(), "repo-*.zip")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer tmp.Close()
+	if _, err := saveUpload(tmp, src); err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	key := uploaderKey(r, 0)
+	existing, err := archiveDuplicate(tmp.Name(), key)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if existing != 0 && r.URL.Query().Get("duplicate") == "reuse" {
+		os.Remove(tmp.Name())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", sitePath(fmt.Sprintf("/api/v1/uploads/%d", existing)))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": existing, "graph": sitePath(fmt.Sprintf("/graph/%d", existing)), "reused": true})
+		return
+	}
+	extendForIngest(w)
+	uploadID, err := ingestZip(r.Context(), tmp.Name(), name, 0, key)
+	if err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	res := map[string]interface{}{"id": uploadID, "graph": sitePath(fmt.Sprintf("/graph/%d", uploadID))}
+	if existing != 0 {
+		res["duplicate_of"] = existing
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", sitePath(fmt.Sprintf("/api/v1/uploads/%d", uploadID)))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	found, err := deleteUpload(uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUpload removes an upload and everything stored for it, including
+// an archive kept from a failed ingest.
+func deleteUpload(uploadID int) (bool, error) {
+	var archive sql.NullString
+	db.QueryRow("SELECT archive FROM uploads WHERE id=?", uploadID).Scan(&archive)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		"DELETE FROM edges WHERE upload_id=?",
+		"DELETE FROM nodes WHERE upload_id=?",
+		"DELETE FROM related_uploads WHERE upload_id=?1 OR related_id=?1",
+		"DELETE FROM ref_history WHERE upload_id=?",
+		"DELETE FROM readmes WHERE upload_id=?",
+		"DELETE FROM thumbnails WHERE upload_id=?",
+		"DELETE FROM blob_texts WHERE upload_id=?",
+		"DELETE FROM tree_entries WHERE upload_id=?",
+	} {
+		if _, err := tx.Exec(q, uploadID); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.Exec("DELETE FROM uploads WHERE id=?", uploadID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	if archive.Valid {
+		os.Remove(archive.String)
+	}
+	return n > 0, nil
+}
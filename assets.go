@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// The templates, static files, schema and API description are built into
+// the binary, so it runs from any directory and deploys as one file.
+//
+//go:embed templates db_init.sql api/openapi.json all:static
+var embeddedAssets embed.FS
+
+// assets are the built-in files, overridden by those in GITVIS_ASSETS_DIR
+// (a checkout of this repository, say) when it is set. Those are read
+// afresh for each request, so edits to templates show without a rebuild.
+var assets fs.FS
+
+func assetsFS() fs.FS {
+	dir := setting("GITVIS_ASSETS_DIR")
+	if dir == "" {
+		return embeddedAssets
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		fatalf("GITVIS_ASSETS_DIR: %q is not a directory", dir)
+	}
+	return overlayFS{os.DirFS(dir)}
+}
+
+// overlayFS opens files in dir, or the built-in ones where dir has none.
+type overlayFS struct {
+	dir fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return embeddedAssets.Open(name)
+	}
+	return f, err
+}
+
+// staticFiles are the files served under /static/.
+func staticFiles() fs.FS {
+	sub, err := fs.Sub(assets, "static")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
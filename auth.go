@@ -0,0 +1,478 @@
+package main
+
+// Browser login via OAuth 2.0 / OpenID Connect. Providers are enabled by
+// environment variables:
+//
+//	GITVIS_GOOGLE_CLIENT_ID, GITVIS_GOOGLE_CLIENT_SECRET
+//	GITVIS_GITHUB_CLIENT_ID, GITVIS_GITHUB_CLIENT_SECRET
+//	GITVIS_OIDC_ISSUER, GITVIS_OIDC_CLIENT_ID, GITVIS_OIDC_CLIENT_SECRET
+//	GITVIS_BASE_URL  external URL used to build redirect URIs (default http://localhost:8080)
+//
+// With no provider configured the instance runs without accounts, as before.
+// ID tokens are not signature-checked: they are only read from the token
+// endpoint's TLS response, and identity comes from the userinfo endpoint.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "gitvis_session"
+	oauthCookie   = "gitvis_oauth"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+type oauthProvider struct {
+	Name         string
+	Title        string
+	ClientID     string
+	ClientSecret string
+	Scopes       string
+	Issuer       string // OIDC providers; endpoints are discovered
+
+	authURL, tokenURL, userURL string
+	discoverOnce               sync.Once
+	discoverErr                error
+}
+
+// account is a signed-in user.
+type account struct {
+	ID       int    `json:"id"`
+	Provider string `json:"provider"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+}
+
+var providers map[string]*oauthProvider
+
+func loadProviders() map[string]*oauthProvider {
+	ps := make(map[string]*oauthProvider)
+	if id := setting("GITVIS_GOOGLE_CLIENT_ID"); id != "" {
+		ps["google"] = &oauthProvider{
+			Name: "google", Title: "Google", ClientID: id, ClientSecret: setting("GITVIS_GOOGLE_CLIENT_SECRET"),
+			Scopes: "openid email profile", Issuer: "https://accounts.google.com",
+		}
+	}
+	if id := setting("GITVIS_GITHUB_CLIENT_ID"); id != "" {
+		ps["github"] = &oauthProvider{
+			Name: "github", Title: "GitHub", ClientID: id, ClientSecret: setting("GITVIS_GITHUB_CLIENT_SECRET"),
+			Scopes:  "read:user user:email",
+			authURL: "https://github.com/login/oauth/authorize", tokenURL: "https://github.com/login/oauth/access_token",
+			userURL: "https://api.github.com/user",
+		}
+	}
+	if issuer := setting("GITVIS_OIDC_ISSUER"); issuer != "" {
+		ps["oidc"] = &oauthProvider{
+			Name: "oidc", Title: "Single sign-on", ClientID: setting("GITVIS_OIDC_CLIENT_ID"),
+			ClientSecret: setting("GITVIS_OIDC_CLIENT_SECRET"), Scopes: "openid email profile",
+			Issuer: strings.TrimSuffix(issuer, "/"),
+		}
+	}
+	return ps
+}
+
+// authEnabled reports whether accounts are in use on this instance.
+func authEnabled() bool {
+	return len(providers) > 0
+}
+
+func baseURL() string {
+	if u := setting("GITVIS_BASE_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "http://localhost:8080"
+}
+
+var oauthClient = &http.Client{Timeout: 15 * time.Second}
+
+// discover fills in endpoints from the issuer's OIDC discovery document.
+func (p *oauthProvider) discover() error {
+	if p.Issuer == "" {
+		return nil
+	}
+	p.discoverOnce.Do(func() {
+		resp, err := oauthClient.Get(p.Issuer + "/.well-known/openid-configuration")
+		if err != nil {
+			p.discoverErr = err
+			return
+		}
+		defer resp.Body.Close()
+		var doc struct {
+			Issuer   string `json:"issuer"`
+			Auth     string `json:"authorization_endpoint"`
+			Token    string `json:"token_endpoint"`
+			UserInfo string `json:"userinfo_endpoint"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			p.discoverErr = fmt.Errorf("oidc discovery: %w", err)
+			return
+		}
+		if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer || doc.Auth == "" || doc.Token == "" || doc.UserInfo == "" {
+			p.discoverErr = errors.New("oidc discovery: incomplete or mismatched configuration")
+			return
+		}
+		p.authURL, p.tokenURL, p.userURL = doc.Auth, doc.Token, doc.UserInfo
+	})
+	return p.discoverErr
+}
+
+func (p *oauthProvider) redirectURI() string {
+	return baseURL() + "/auth/callback/" + p.Name
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// authHandler serves /auth/login/{provider}, /auth/callback/{provider},
+// /auth/logout and /auth/me.
+func authHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "me":
+		meHandler(w, r)
+	case len(parts) == 1 && parts[0] == "logout":
+		logoutHandler(w, r)
+	case len(parts) == 2 && parts[0] == "login":
+		loginHandler(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "callback":
+		callbackHandler(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	type providerLink struct {
+		Name  string `json:"name"`
+		Title string `json:"title"`
+		Login string `json:"login"`
+	}
+	links := make([]providerLink, 0, len(providers))
+	for _, p := range providers {
+		links = append(links, providerLink{p.Name, p.Title, sitePath("/auth/login/" + p.Name)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"auth":      authEnabled(),
+		"user":      currentUser(r),
+		"providers": links,
+	})
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request, name string) {
+	p, ok := providers[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := p.discover(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	state, nonce := randomToken(), randomToken()
+	next := r.URL.Query().Get("next")
+	if !localPath(next) {
+		next = sitePath("/")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oauthCookie, Value: strings.Join([]string{name, state, nonce, url.QueryEscape(next)}, "|"),
+		Path: sitePath("/auth/"), MaxAge: 600, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.redirectURI()},
+		"response_type": {"code"},
+		"scope":         {p.Scopes},
+		"state":         {state},
+	}
+	if p.Issuer != "" {
+		q.Set("nonce", nonce)
+	}
+	http.Redirect(w, r, p.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+func callbackHandler(w http.ResponseWriter, r *http.Request, name string) {
+	p, ok := providers[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(oauthCookie)
+	if err != nil {
+		http.Error(w, "login expired, please try again", 400)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthCookie, Path: sitePath("/auth/"), MaxAge: -1})
+	fields := strings.Split(c.Value, "|")
+	if len(fields) != 4 || fields[0] != name ||
+		subtle.ConstantTimeCompare([]byte(fields[1]), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, "state mismatch", 400)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, 400)
+		return
+	}
+	if err := p.discover(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	accessToken, err := p.exchange(r.URL.Query().Get("code"), fields[2])
+	if err != nil {
+		http.Error(w, "login failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	subject, email, displayName, err := p.userInfo(accessToken)
+	if err != nil {
+		http.Error(w, "login failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	userID, err := upsertUser(p.Name, subject, email, displayName)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := startSession(w, r, userID); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	next, _ := url.QueryUnescape(fields[3])
+	if !localPath(next) {
+		next = sitePath("/")
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// localPath reports whether next, where sign-in returns to, is a path on
+// this site. Browsers take //host and /\host to be other sites, and drop
+// tabs and newlines before deciding.
+func localPath(next string) bool {
+	if !strings.HasPrefix(next, "/") || strings.ContainsAny(next, "\\\t\r\n") {
+		return false
+	}
+	u, err := url.Parse(next)
+	return err == nil && u.Scheme == "" && u.Host == "" && !strings.HasPrefix(next, "//")
+}
+
+// exchange trades an authorization code for an access token. For OIDC
+// providers the ID token's nonce, audience and issuer are checked too.
+func (p *oauthProvider) exchange(code, nonce string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI()},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	req, _ := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if tok.Error != "" {
+		return "", fmt.Errorf("%s: %s", tok.Error, tok.Description)
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("no access token in response")
+	}
+	if p.Issuer != "" {
+		if err := p.checkIDToken(tok.IDToken, nonce); err != nil {
+			return "", err
+		}
+	}
+	return tok.AccessToken, nil
+}
+
+func (p *oauthProvider) checkIDToken(idToken, nonce string) error {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return errors.New("missing or malformed id_token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed id_token")
+	}
+	var claims struct {
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   int64           `json:"exp"`
+		Nonce string          `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return errors.New("malformed id_token")
+	}
+	var auds []string
+	if json.Unmarshal(claims.Aud, &auds) != nil {
+		var aud string
+		json.Unmarshal(claims.Aud, &aud)
+		auds = []string{aud}
+	}
+	audOK := false
+	for _, a := range auds {
+		audOK = audOK || a == p.ClientID
+	}
+	switch {
+	case strings.TrimSuffix(claims.Iss, "/") != p.Issuer:
+		return errors.New("id_token issuer mismatch")
+	case !audOK:
+		return errors.New("id_token audience mismatch")
+	case time.Now().Unix() > claims.Exp:
+		return errors.New("id_token expired")
+	case claims.Nonce != nonce:
+		return errors.New("id_token nonce mismatch")
+	}
+	return nil
+}
+
+// userInfo returns the provider's stable subject ID, email and display name.
+func (p *oauthProvider) userInfo(accessToken string) (subject, email, name string, err error) {
+	get := func(u string, v interface{}) error {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Accept", "application/json")
+		resp, err := oauthClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("%s: %s", u, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	if p.Name == "github" {
+		var u struct {
+			ID    int64  `json:"id"`
+			Login string `json:"login"`
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		}
+		if err := get(p.userURL, &u); err != nil {
+			return "", "", "", err
+		}
+		// the profile's email says nothing of whether it was verified, and
+		// private ones aren't on it, so take the verified primary address
+		// from the emails endpoint, or none
+		u.Email = ""
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if get("https://api.github.com/user/emails", &emails) == nil {
+			for _, e := range emails {
+				if e.Primary && e.Verified {
+					u.Email = e.Email
+				}
+			}
+		}
+		if u.Name == "" {
+			u.Name = u.Login
+		}
+		return fmt.Sprint(u.ID), u.Email, u.Name, nil
+	}
+
+	var u struct {
+		Sub   string `json:"sub"`
+		Email string `json:"email"`
+		// a boolean, though some providers send the string "true"
+		EmailVerified interface{} `json:"email_verified"`
+		Name          string      `json:"name"`
+	}
+	if err := get(p.userURL, &u); err != nil {
+		return "", "", "", err
+	}
+	if u.Sub == "" {
+		return "", "", "", errors.New("userinfo has no subject")
+	}
+	// an address the provider hasn't verified could be anyone's, and
+	// emails grant admin rights through GITVIS_ADMINS
+	if u.EmailVerified != true && u.EmailVerified != "true" {
+		u.Email = ""
+	}
+	return u.Sub, u.Email, u.Name, nil
+}
+
+func upsertUser(provider, subject, email, name string) (int, error) {
+	_, err := db.Exec(`INSERT INTO users(provider, subject, email, name) VALUES(?,?,?,?)
+		ON CONFLICT(provider, subject) DO UPDATE SET email=excluded.email, name=excluded.name`,
+		provider, subject, email, name)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = db.QueryRow("SELECT id FROM users WHERE provider=? AND subject=?", provider, subject).Scan(&id)
+	return id, err
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	token := randomToken()
+	expires := time.Now().Add(sessionTTL)
+	if _, err := db.Exec("INSERT INTO sessions(hash, user_id, expires_at) VALUES(?,?,?)",
+		hashToken(token), userID, expires.UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: sitePath("/"), Expires: expires,
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		db.Exec("DELETE FROM sessions WHERE hash=?", hashToken(c.Value))
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: sitePath("/"), MaxAge: -1})
+	http.Redirect(w, r, sitePath("/"), http.StatusSeeOther)
+}
+
+// currentUser returns the signed-in account for a request, or nil.
+func currentUser(r *http.Request) *account {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || !authEnabled() {
+		return nil
+	}
+	var a account
+	var email, name sql.NullString
+	err = db.QueryRow(`SELECT u.id, u.provider, u.email, u.name FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.hash=? AND s.expires_at > ?`, hashToken(c.Value), time.Now().UTC().Format(time.RFC3339)).
+		Scan(&a.ID, &a.Provider, &email, &name)
+	if err != nil {
+		return nil
+	}
+	a.Email, a.Name = email.String, name.String
+	return &a
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserInfoDropsUnverifiedEmail(t *testing.T) {
+	for _, tc := range []struct {
+		body, email string
+	}{
+		{`{"sub":"1","email":"admin@example.com","email_verified":true}`, "admin@example.com"},
+		{`{"sub":"1","email":"admin@example.com","email_verified":"true"}`, "admin@example.com"},
+		{`{"sub":"1","email":"admin@example.com","email_verified":false}`, ""},
+		{`{"sub":"1","email":"admin@example.com"}`, ""},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tc.body))
+		}))
+		p := &oauthProvider{Name: "oidc", userURL: srv.URL}
+		_, email, _, err := p.userInfo("token")
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if email != tc.email {
+			t.Errorf("%s: email %q, want %q", tc.body, email, tc.email)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for next, want := range map[string]bool{
+		"/graph/1":             true,
+		"/graph/1?view=x#top":  true,
+		"":                     false,
+		"graph/1":              false,
+		"https://evil.example": false,
+		"//evil.example":       false,
+		`/\evil.example`:       false,
+		"/\t/evil.example":     false,
+	} {
+		if got := localPath(next); got != want {
+			t.Errorf("localPath(%q) = %v, want %v", next, got, want)
+		}
+	}
+}
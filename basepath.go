@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// basePath is the path prefix the app is served under, such as /git-viz
+// behind a reverse proxy it shares a host with, or "" at the root.
+var basePath string
+
+func cleanBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	if strings.ContainsAny(p, "?#%\"'<>\\ ") {
+		fatalf("GITVIS_BASE_PATH: %q can't be used as a path prefix", p)
+	}
+	return "/" + p
+}
+
+// sitePath is the path the app's own path p, such as /graph/1, is linked
+// by.
+func sitePath(p string) string {
+	return basePath + p
+}
+
+// underBasePath serves h at basePath, handing it requests with the prefix
+// removed, so routes are the same with and without one. gRPC is served at
+// the root regardless, since clients call methods by fixed paths.
+func underBasePath(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	strip := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, basePath+"/"):
+			strip.ServeHTTP(w, r)
+		case r.URL.Path == basePath:
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, grpcServicePrefix):
+			h.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// blobTextMaxBytes is how much of a text blob is kept for the blob
+// endpoint; longer ones are cut there.
+const blobTextMaxBytes = 1 << 20
+
+// highlightNames are the names syntax highlighters (highlight.js and
+// Prism alike, mostly) know the languages of ingest.DetectLanguage by.
+// Others are named by their lower-cased language.
+var highlightNames = map[string]string{
+	"C++": "cpp", "Objective-C": "objectivec", "Objective-C++": "objectivec", "C#": "csharp",
+	"F#": "fsharp", "Visual Basic": "vbnet", "HTML": "xml", "Vue": "xml", "Svelte": "xml",
+	"Shell": "bash", "Batchfile": "dos", "Protocol Buffer": "protobuf", "TOML": "ini",
+	"reStructuredText": "plaintext", "TeX": "latex", "Starlark": "python",
+}
+
+// highlightName is the syntax highlighter's name for a language, or
+// "plaintext" for none.
+func highlightName(language string) string {
+	if language == "" {
+		return "plaintext"
+	}
+	if name, ok := highlightNames[language]; ok {
+		return name
+	}
+	return strings.ToLower(language)
+}
+
+// storeBlobTexts keeps the contents of the upload's text blobs, the first
+// 1 MiB of each, since the archive they came from is deleted after
+// ingest. Binary blobs are recorded without them. Those of an earlier
+// ingest of the upload are replaced.
+func storeBlobTexts(ctx context.Context, r *git.Repository, uploadID int) error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM nodes WHERE upload_id=? AND type='blob'", uploadID)
+	if err != nil {
+		return err
+	}
+	var blobs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM blob_texts WHERE upload_id=?", uploadID); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO blob_texts(upload_id, blob, text, binary, truncated) VALUES(?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range blobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		text, ok := blobText(r, plumbing.NewHash(id))
+		if !ok {
+			if _, err := stmt.ExecContext(ctx, uploadID, id, "", true, false); err != nil {
+				return err
+			}
+			continue
+		}
+		truncated := len(text) > blobTextMaxBytes
+		if truncated {
+			text = truncateText(text, blobTextMaxBytes)
+		}
+		if _, err := stmt.ExecContext(ctx, uploadID, id, text, false, truncated); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// truncateText cuts text to at most max bytes at a line end, so no line
+// is cut, or when the first max bytes hold no line end (minified code, say)
+// at a character boundary.
+func truncateText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	if i := strings.LastIndexByte(text[:max], '\n'); i >= 0 {
+		return text[:i+1]
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	return text[:max]
+}
+
+// blobHandler serves /graph/{id}/blob/{hash}: a blob's contents split
+// into lines, with its language and the name syntax highlighters know it
+// by. Binary blobs come without lines, and text past the first 1 MiB is
+// left out.
+func blobHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	hash := objectHash(r)
+	var label, meta, text string
+	var binary, truncated bool
+	err = db.QueryRowContext(r.Context(), `SELECT n.label, COALESCE(n.meta,'{}'), t.text, t.binary, t.truncated FROM nodes n
+		JOIN blob_texts t ON t.upload_id=n.upload_id AND t.blob=n.id
+		WHERE n.upload_id=? AND n.id=? AND n.type='blob'`, uploadID, hash).Scan(&label, &meta, &text, &binary, &truncated)
+	if err != nil {
+		http.Error(w, "no such blob", 404)
+		return
+	}
+	var m map[string]interface{}
+	json.Unmarshal([]byte(meta), &m)
+	language, _ := m["language"].(string)
+	resp := map[string]interface{}{
+		"blob":      hash,
+		"name":      label,
+		"size":      m["size"],
+		"language":  language,
+		"highlight": highlightName(language),
+		"binary":    binary,
+		"truncated": truncated,
+	}
+	if !binary {
+		lines := []string{}
+		if text != "" {
+			lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+		}
+		resp["lines"] = lines
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateText(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"short\n", 10, "short\n"},
+		{"one\ntwo\nthree\n", 10, "one\ntwo\n"},
+		// no line end to cut at
+		{"abcdefghijkl", 5, "abcde"},
+		// nor a character to split: é is two bytes
+		{"ééééé", 5, "éé"},
+	} {
+		if got := truncateText(tc.text, tc.max); got != tc.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tc.text, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestStoreBlobTextsKeepsLongLines(t *testing.T) {
+	setupTest(t)
+	// a minified file: over the limit, on one line
+	line := strings.Repeat("é", blobTextMaxBytes/2+10)
+	id, _, err := ingestSource(context.Background(), testRepo(t, "first", map[string]string{"app.min.js": line}), "a.zip", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text string
+	var truncated bool
+	err = db.QueryRow("SELECT text, truncated FROM blob_texts WHERE upload_id=? AND binary=0", id).Scan(&text, &truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(text) != blobTextMaxBytes || !utf8.ValidString(text) {
+		t.Errorf("kept %d bytes (valid UTF-8: %v, truncated: %v), want the first %d", len(text), utf8.ValidString(text), truncated, blobTextMaxBytes)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// authorShare is one author's part of the changes to a directory.
+type authorShare struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Changes int    `json:"changes"`
+}
+
+// busFactor is how few authors account for most of a directory's
+// changes: Authors is the smallest set, busiest first, whose changes add up
+// to more than half, and BusFactor its size.
+type busFactor struct {
+	Path      string        `json:"path"`
+	Changes   int           `json:"changes"`
+	BusFactor int           `json:"bus_factor"`
+	Authors   []authorShare `json:"authors"`
+}
+
+// busFactors counts file changes per author in every directory that had
+// any, a change to a file counting for each directory above it, and
+// returns the bus factor of the root and of each directory by path.
+// Authors are grouped by email as in aggregateContributors.
+func busFactors(commits []commitInfo) (repo busFactor, dirs []busFactor) {
+	authors := make(map[string]*contributor)
+	for _, ct := range aggregateContributors(commits) {
+		authors[strings.ToLower(ct.Email)] = ct
+	}
+	counts := make(map[string]map[string]int) // by directory, then author
+	for _, c := range commits {
+		key := strings.ToLower(c.Email)
+		for _, f := range c.Changed {
+			for d := path.Dir(f); ; d = path.Dir(d) {
+				if counts[d] == nil {
+					counts[d] = make(map[string]int)
+				}
+				counts[d][key]++
+				if d == "/" {
+					break
+				}
+			}
+		}
+	}
+
+	factor := func(dir string) busFactor {
+		b := busFactor{Path: dir, Authors: []authorShare{}}
+		for key, n := range counts[dir] {
+			b.Changes += n
+			b.Authors = append(b.Authors, authorShare{Name: authors[key].Name, Email: authors[key].Email, Changes: n})
+		}
+		sort.Slice(b.Authors, func(i, j int) bool {
+			if b.Authors[i].Changes != b.Authors[j].Changes {
+				return b.Authors[i].Changes > b.Authors[j].Changes
+			}
+			return b.Authors[i].Email < b.Authors[j].Email
+		})
+		sum := 0
+		for i, a := range b.Authors {
+			sum += a.Changes
+			if 2*sum > b.Changes {
+				b.Authors = b.Authors[:i+1]
+				break
+			}
+		}
+		b.BusFactor = len(b.Authors)
+		return b
+	}
+	repo = factor("/")
+	dirs = []busFactor{}
+	for d := range counts {
+		if d != "/" {
+			dirs = append(dirs, factor(d))
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Path < dirs[j].Path })
+	return repo, dirs
+}
+
+// busFactorHandler serves /graph/{id}/analytics/bus-factor.
+func busFactorHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	commits, err := loadCommits(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	repo, dirs := busFactors(commits)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"repository": repo, "directories": dirs})
+}
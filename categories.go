@@ -0,0 +1,144 @@
+package main
+
+// Commit categories from Conventional Commits style subjects, such as
+// "feat(api): add paging" or "fix!: drop the old flag". A file named by
+// GITVIS_COMMIT_CATEGORIES can add rules for teams with other conventions.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// conventionalSubject matches a Conventional Commits subject: a type, an
+// optional scope in parentheses and an optional "!" for a breaking change.
+var conventionalSubject = regexp.MustCompile(`^([A-Za-z]+)(?:\(([^)]*)\))?(!)?:(\s|$)`)
+
+// breakingFooter marks a breaking change in the body of a message.
+var breakingFooter = regexp.MustCompile(`(?m)^BREAKING[ -]CHANGE:`)
+
+// categoryRule puts commits whose subject matches pattern in category.
+type categoryRule struct {
+	category string
+	pattern  *regexp.Regexp
+}
+
+// categoryRulesPath is the file of extra rules, read on every ingest.
+var categoryRulesPath string
+
+// parseCategoryRules reads one rule per line, a category and a regular
+// expression separated by white space, such as
+//
+//	fix (?i)^(bug|hotfix)\b
+//
+// Blank lines and lines starting with "#" are skipped.
+func parseCategoryRules(src string) ([]categoryRule, error) {
+	var rules []categoryRule
+	sc := bufio.NewScanner(strings.NewReader(src))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: want a category and a pattern", n)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(line[i:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, categoryRule{category: strings.ToLower(line[:i]), pattern: re})
+	}
+	return rules, sc.Err()
+}
+
+// commitCategory classifies a commit message: the first of rules to match
+// its subject wins, then the Conventional Commits type. Scope and breaking
+// come from the Conventional Commits form only.
+func commitCategory(rules []categoryRule, message string) (category, scope string, breaking bool) {
+	subject, body, _ := strings.Cut(message, "\n")
+	subject = strings.TrimSpace(subject)
+	breaking = breakingFooter.MatchString(body)
+	if m := conventionalSubject.FindStringSubmatch(subject); m != nil {
+		category, scope = strings.ToLower(m[1]), m[2]
+		breaking = breaking || m[3] != ""
+	}
+	for _, r := range rules {
+		if r.pattern.MatchString(subject) {
+			category = r.category
+			break
+		}
+	}
+	return category, scope, breaking
+}
+
+// storeCategories records each commit's "category", with "scope" and
+// "breaking" where it has them, clearing them from commits that no longer
+// match after the rules changed.
+func storeCategories(ctx context.Context, uploadID int) error {
+	var rules []categoryRule
+	if categoryRulesPath != "" {
+		b, err := os.ReadFile(categoryRulesPath)
+		if err == nil {
+			rules, err = parseCategoryRules(string(b))
+		}
+		if err != nil {
+			// bad rules shouldn't fail every ingest
+			slog.WarnContext(ctx, "commit categories", "err", err)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id,label FROM nodes WHERE upload_id=? AND type='commit' AND meta<>''", uploadID)
+	if err != nil {
+		return err
+	}
+	messages := make(map[string]string)
+	for rows.Next() {
+		var id, label string
+		if err := rows.Scan(&id, &label); err != nil {
+			rows.Close()
+			return err
+		}
+		messages[id] = label
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// a merge patch, where null removes a key
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_patch(meta,?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, msg := range messages {
+		patch := map[string]interface{}{"category": nil, "scope": nil, "breaking": nil}
+		category, scope, breaking := commitCategory(rules, msg)
+		if category != "" {
+			patch["category"] = category
+		}
+		if scope != "" {
+			patch["scope"] = scope
+		}
+		if breaking {
+			patch["breaking"] = true
+		}
+		b, _ := json.Marshal(patch)
+		if _, err := stmt.ExecContext(ctx, string(b), uploadID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// changelogSections are the commit categories the changelog lists first,
+// in order, with their headings. Other categories follow alphabetically
+// under their own names, then commits with no category.
+var changelogSections = []struct{ category, title string }{
+	{"feat", "Features"},
+	{"fix", "Bug fixes"},
+	{"perf", "Performance"},
+	{"refactor", "Refactoring"},
+	{"docs", "Documentation"},
+	{"test", "Tests"},
+	{"build", "Build"},
+	{"ci", "Continuous integration"},
+	{"style", "Style"},
+	{"chore", "Chores"},
+	{"revert", "Reverts"},
+}
+
+// changelogEntry is one commit of the changelog.
+type changelogEntry struct {
+	Hash string `json:"hash"`
+	// the first line of the message, less its Conventional Commits prefix
+	Subject  string   `json:"subject"`
+	Scope    string   `json:"scope,omitempty"`
+	Breaking bool     `json:"breaking,omitempty"`
+	Author   string   `json:"author"`
+	Email    string   `json:"email"`
+	Date     string   `json:"date"`
+	Issues   []string `json:"issues,omitempty"`
+}
+
+// changelogSection is the changelog's commits of one category.
+type changelogSection struct {
+	Category string           `json:"category"`
+	Title    string           `json:"title"`
+	Commits  []changelogEntry `json:"commits"`
+}
+
+// changelog is the changelog endpoint's response.
+type changelog struct {
+	From     string             `json:"from,omitempty"`
+	To       string             `json:"to"`
+	Commits  int                `json:"commits"`
+	Sections []changelogSection `json:"sections"`
+	// the range's authors by commit count
+	Authors []*contributor `json:"authors"`
+}
+
+// buildChangelog groups the non-merge commits reachable from to but not
+// from from, newest first within each section, by category.
+func buildChangelog(h *history, from, to string) *changelog {
+	var exclude []string
+	if from != "" {
+		exclude = []string{from}
+	}
+	bySection := make(map[string]*changelogSection)
+	var commits []commitInfo
+	for _, c := range h.only([]string{to}, exclude) {
+		if len(h.parents[c]) > 1 {
+			continue
+		}
+		info := h.commits[c]
+		commits = append(commits, *info)
+		subject, _, _ := strings.Cut(info.Message, "\n")
+		subject = strings.TrimSpace(subject)
+		// the category came from the prefix unless a rule overrode it
+		if m := conventionalSubject.FindStringSubmatch(subject); m != nil && strings.ToLower(m[1]) == info.Category {
+			subject = strings.TrimSpace(subject[len(m[0]):])
+		}
+		s := bySection[info.Category]
+		if s == nil {
+			s = &changelogSection{Category: info.Category, Title: info.Category}
+			bySection[info.Category] = s
+		}
+		s.Commits = append(s.Commits, changelogEntry{
+			Hash: c, Subject: subject, Scope: info.Scope, Breaking: info.Breaking,
+			Author: info.Author, Email: info.Email, Date: info.When.Format("2006-01-02"), Issues: info.Issues,
+		})
+	}
+
+	out := &changelog{Commits: len(commits), Sections: []changelogSection{}, Authors: aggregateContributors(commits)}
+	for _, known := range changelogSections {
+		if s := bySection[known.category]; s != nil {
+			s.Title = known.title
+			out.Sections = append(out.Sections, *s)
+			delete(bySection, known.category)
+		}
+	}
+	other := bySection[""]
+	delete(bySection, "")
+	rest := make([]string, 0, len(bySection))
+	for cat := range bySection {
+		rest = append(rest, cat)
+	}
+	sort.Strings(rest)
+	for _, cat := range rest {
+		out.Sections = append(out.Sections, *bySection[cat])
+	}
+	if other != nil {
+		other.Title = "Other changes"
+		out.Sections = append(out.Sections, *other)
+	}
+	return out
+}
+
+// writeMarkdown renders the changelog as release notes, breaking changes
+// first, linking issues with the upload's template if it has one.
+func (cl *changelog) writeMarkdown(w io.Writer, issueURL string) {
+	if cl.From != "" {
+		fmt.Fprintf(w, "# Changes from %s to %s\n", cl.From, cl.To)
+	} else {
+		fmt.Fprintf(w, "# Changes up to %s\n", cl.To)
+	}
+	line := func(e changelogEntry) {
+		fmt.Fprint(w, "- ")
+		if e.Scope != "" {
+			fmt.Fprintf(w, "**%s:** ", e.Scope)
+		}
+		refs := []string{e.Hash[:7]}
+		for _, ref := range e.Issues {
+			if link := issueLink(issueURL, ref); link != "" {
+				ref = fmt.Sprintf("[%s](%s)", ref, link)
+			}
+			refs = append(refs, ref)
+		}
+		fmt.Fprintf(w, "%s (%s) — %s\n", e.Subject, strings.Join(refs, ", "), e.Author)
+	}
+
+	var breaking []changelogEntry
+	for _, s := range cl.Sections {
+		for _, e := range s.Commits {
+			if e.Breaking {
+				breaking = append(breaking, e)
+			}
+		}
+	}
+	if len(breaking) > 0 {
+		fmt.Fprint(w, "\n## Breaking changes\n\n")
+		for _, e := range breaking {
+			line(e)
+		}
+	}
+	for _, s := range cl.Sections {
+		fmt.Fprintf(w, "\n## %s\n\n", s.Title)
+		for _, e := range s.Commits {
+			line(e)
+		}
+	}
+	if len(cl.Authors) > 0 {
+		fmt.Fprint(w, "\n## Contributors\n\n")
+		for _, a := range cl.Authors {
+			fmt.Fprintf(w, "- %s (%d)\n", a.Name, a.Commits)
+		}
+	}
+}
+
+// changelogHandler serves /graph/{id}/changelog: the commits in ?to= (by
+// default the trunk branch) but not in ?from=, if given, grouped by
+// category with their authors, as JSON or with ?format=markdown as
+// release notes.
+func changelogHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	v := r.URL.Query()
+	format := v.Get("format")
+	if format != "" && format != "json" && format != "markdown" {
+		http.Error(w, "format must be json or markdown", 400)
+		return
+	}
+	to := v.Get("to")
+	if to == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if to = pickTrunk(branches); to == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	tip, err := resolveCommit(r.Context(), uploadID, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("to: %v", err), 400)
+		return
+	}
+	from, base := v.Get("from"), ""
+	if from != "" {
+		if base, err = resolveCommit(r.Context(), uploadID, from); err != nil {
+			http.Error(w, fmt.Sprintf("from: %v", err), 400)
+			return
+		}
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	cl := buildChangelog(h, base, tip)
+	cl.From, cl.To = from, to
+
+	if format == "markdown" {
+		var issueURL sql.NullString
+		if err := db.QueryRowContext(r.Context(), "SELECT issue_url FROM uploads WHERE id=?", uploadID).Scan(&issueURL); err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		cl.writeMarkdown(w, issueURL.String)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cl)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// patchID hashes the change a commit makes against its first parent, the
+// way git patch-id does: the changed paths and their added and removed
+// lines, with whitespace and line numbers left out, so the same change
+// applied elsewhere hashes the same. Binary files count by their blob
+// hashes. It is "" for a commit that changes no file.
+func patchID(r *git.Repository, from, to *object.Tree) string {
+	type change struct {
+		path      string
+		hash, old plumbing.Hash
+	}
+	var changes []change
+	diffTrees(r, from, to, "", func(p string, hash, prev plumbing.Hash, dir bool) {
+		if !dir {
+			changes = append(changes, change{p, hash, prev})
+		}
+	})
+	if len(changes) == 0 {
+		return ""
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	h := sha1.New()
+	for _, c := range changes {
+		fmt.Fprintf(h, "diff %s\n", c.path)
+		src, okSrc := blobText(r, c.old)
+		dst, okDst := blobText(r, c.hash)
+		if !okSrc || !okDst {
+			fmt.Fprintf(h, "binary %s %s\n", c.old, c.hash)
+			continue
+		}
+		for _, d := range diff.Do(src, dst) {
+			switch d.Type {
+			case diffmatchpatch.DiffInsert:
+				writePatchLines(h, "+", d.Text)
+			case diffmatchpatch.DiffDelete:
+				writePatchLines(h, "-", d.Text)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writePatchLines adds each line of text to h behind sign, with its
+// whitespace removed.
+func writePatchLines(h hash.Hash, sign, text string) {
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		h.Write([]byte(sign + strings.Join(strings.Fields(line), "") + "\n"))
+	}
+}
+
+// storeCherryPicks records each non-merge commit's "patch_id" and links
+// commits that make the same change, such as backports, with a
+// "cherry-pick-of" edge from each copy to the first committed of them.
+// Edges from an earlier ingest of the upload are replaced.
+func storeCherryPicks(ctx context.Context, r *git.Repository, uploadID int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]string)
+	byPatch := make(map[string][]string)
+	for _, c := range h.topo {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(h.parents[c]) > 1 {
+			continue
+		}
+		to, err := commitTree(r, c)
+		if err != nil {
+			continue
+		}
+		var from *object.Tree
+		if p := h.firstParent(c); p != "" {
+			from, _ = commitTree(r, p)
+		}
+		if id := patchID(r, from, to); id != "" {
+			ids[c] = id
+			byPatch[id] = append(byPatch[id], c)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM edges WHERE upload_id=? AND rel='cherry-pick-of'", uploadID); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.patch_id',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for c, id := range ids {
+		if _, err := stmt.ExecContext(ctx, id, uploadID, c); err != nil {
+			return err
+		}
+	}
+	link, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO edges(upload_id, source, target, rel) VALUES(?,?,?,'cherry-pick-of')")
+	if err != nil {
+		return err
+	}
+	defer link.Close()
+	for _, commits := range byPatch {
+		if len(commits) < 2 {
+			continue
+		}
+		// topo order breaks ties, so a parent counts as first
+		sort.SliceStable(commits, func(i, j int) bool {
+			return h.commits[commits[i]].Committed.Before(h.commits[commits[j]].Committed)
+		})
+		for _, c := range commits[1:] {
+			if _, err := link.ExecContext(ctx, uploadID, c, commits[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
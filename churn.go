@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// churnDefaultLimit is how many hot spots /graph/{id}/churn lists unless
+// asked for more.
+const churnDefaultLimit = 50
+
+// storeChurn counts how many commits changed each path, by diffing every
+// commit's tree against its parent's, and records the count as "churn" in
+// the meta of the blobs and trees that path held, with the path itself
+// and its dominant author as "owner" and "owner_email". Each commit gets
+// the files it changed as "changed". Merges are skipped,
+// since the commits they bring in are counted on their own. A blob or
+// tree found at several paths takes the busiest.
+func storeChurn(ctx context.Context, r *git.Repository, uploadID int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	churn := make(map[string]int)             // by path
+	paths := make(map[plumbing.Hash][]string) // where each version appeared
+	changed := make(map[string][]string)      // files, by commit
+	tallies := make(map[string]map[string]*authorTally)
+	for i, c := range h.topo {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(h.parents[c]) > 1 {
+			continue
+		}
+		to, err := commitTree(r, c)
+		if err != nil {
+			continue
+		}
+		var from *object.Tree
+		if p := h.firstParent(c); p != "" {
+			from, _ = commitTree(r, p)
+		}
+		changed[c] = []string{}
+		info := h.commits[c]
+		key := strings.ToLower(info.Email)
+		diffTrees(r, from, to, "", func(p string, hash, _ plumbing.Hash, dir bool) {
+			churn[p]++
+			if tallies[p] == nil {
+				tallies[p] = make(map[string]*authorTally)
+			}
+			t := tallies[p][key]
+			if t == nil {
+				t = &authorTally{email: info.Email}
+				tallies[p][key] = t
+			}
+			t.changes++
+			t.last, t.name = i, info.Author
+			if !hash.IsZero() {
+				paths[hash] = append(paths[hash], p)
+			}
+			if !dir {
+				changed[c] = append(changed[c], "/"+p)
+			}
+		})
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(COALESCE(NULLIF(meta,''),'{}'),'$.churn',?,'$.path',?,'$.owner',?,'$.owner_email',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for hash, ps := range paths {
+		best := ps[0]
+		for _, p := range ps[1:] {
+			if churn[p] > churn[best] || churn[p] == churn[best] && p < best {
+				best = p
+			}
+		}
+		owner := dominant(tallies[best])
+		if _, err := stmt.ExecContext(ctx, churn[best], "/"+best, owner.name, owner.email, uploadID, hash.String()); err != nil {
+			return err
+		}
+	}
+	files, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.changed',json(?)) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+	for c, list := range changed {
+		sort.Strings(list)
+		b, _ := json.Marshal(list)
+		if _, err := files.ExecContext(ctx, string(b), uploadID, c); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func commitTree(r *git.Repository, hash string) (*object.Tree, error) {
+	c, err := r.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	return c.Tree()
+}
+
+// diffTrees calls fn for every path whose content differs between from
+// (nil for an empty tree) and to, directories included, with its hash in
+// to, its hash in from and whether it is a directory. Added paths have a
+// zero hash in from and deleted ones a zero hash in to, and what was
+// below a deleted directory isn't reported at all. A path that changed
+// between file and directory is reported with a zero hash in from.
+// Unchanged subtrees are skipped without being read. The root itself is
+// reported as "".
+func diffTrees(r *git.Repository, from, to *object.Tree, dir string, fn func(path string, hash, prev plumbing.Hash, dir bool)) {
+	if from != nil && from.Hash == to.Hash {
+		return
+	}
+	if dir == "" {
+		var prev plumbing.Hash
+		if from != nil {
+			prev = from.Hash
+		}
+		fn("", to.Hash, prev, true)
+	}
+	old := make(map[string]object.TreeEntry)
+	if from != nil {
+		for _, e := range from.Entries {
+			old[e.Name] = e
+		}
+	}
+	for _, e := range to.Entries {
+		prev, existed := old[e.Name]
+		delete(old, e.Name)
+		if existed && prev.Hash == e.Hash {
+			continue
+		}
+		p := path.Join(dir, e.Name)
+		var prevHash plumbing.Hash
+		if existed && (prev.Mode == filemode.Dir) == (e.Mode == filemode.Dir) {
+			prevHash = prev.Hash
+		}
+		switch {
+		case e.Mode == filemode.Dir:
+			fn(p, e.Hash, prevHash, true)
+			sub, err := r.TreeObject(e.Hash)
+			if err != nil {
+				continue
+			}
+			var prevSub *object.Tree
+			if existed && prev.Mode == filemode.Dir {
+				prevSub, _ = r.TreeObject(prev.Hash)
+			}
+			diffTrees(r, prevSub, sub, p, fn)
+		case e.Mode.IsFile():
+			fn(p, e.Hash, prevHash, false)
+		}
+	}
+	for name, e := range old {
+		fn(path.Join(dir, name), plumbing.ZeroHash, e.Hash, e.Mode == filemode.Dir)
+	}
+}
+
+// hotspot is one path in the churn endpoint's list.
+type hotspot struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Changes int    `json:"changes"`
+}
+
+// churnHandler serves /graph/{id}/churn: the most often changed files
+// and directories, busiest first. ?type=blob or ?type=tree keeps one kind,
+// and ?limit=N (default 50, 0 for all) caps the list.
+func churnHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	limit, ok := limitParam(w, r, churnDefaultLimit)
+	if !ok {
+		return
+	}
+	typ := r.URL.Query().Get("type")
+	if typ != "" && typ != "blob" && typ != "tree" {
+		http.Error(w, "type must be blob or tree", 400)
+		return
+	}
+	q := `SELECT json_extract(meta,'$.path') AS p, type, MAX(json_extract(meta,'$.churn')) AS n FROM nodes
+		WHERE upload_id=? AND type IN ('blob','tree') AND json_extract(meta,'$.churn') IS NOT NULL`
+	args := []interface{}{uploadID}
+	if typ != "" {
+		q += " AND type=?"
+		args = append(args, typ)
+	}
+	q += " GROUP BY p, type ORDER BY n DESC, p"
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := db.QueryContext(r.Context(), q, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	spots := make([]hotspot, 0)
+	for rows.Next() {
+		var s hotspot
+		if err := rows.Scan(&s.Path, &s.Type, &s.Changes); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		spots = append(spots, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spots)
+}
@@ -0,0 +1,551 @@
+package main
+
+// Commands. gitvis serve, the default, runs the server; the other commands
+// work on the database directly and exit, for scripts and batch jobs that
+// don't want a server.
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+// cliUploader is who uploads made by commands are charged to. Quotas are
+// for the server's users, so they don't apply to it.
+const cliUploader = "cli"
+
+func runCommand(name string, args []string) error {
+	var run func(args []string) error
+	switch name {
+	case "serve":
+		run = runServeCommand
+	case "ingest":
+		run = runIngestCommand
+	case "export":
+		run = runExportCommand
+	case "uploads":
+		run = runUploadsCommand
+	case "token":
+		run = runTokenCommand
+	case "render":
+		// render keeps its graph in a scratch database of its own
+		return runRenderCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", name, commandUsage)
+	}
+	if err := openDB(setting("GITVIS_DB")); err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return run(args)
+}
+
+func runServeCommand(args []string) error {
+	if len(args) > 0 {
+		settings.usage()
+		return flag.ErrHelp
+	}
+	serve()
+	return nil
+}
+
+// commandFlags is the flag set for a command's own flags, whose usage shows
+// the command line synopsis.
+func commandFlags(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gitvis %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// interruptible is ctx cancelled on SIGINT or SIGTERM, so a command stops
+// what it is doing and cleans up, and the func that stops listening.
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runIngestCommand ingests each source given, a zip archive of a
+// repository, a repository directory or a URL to clone, printing the
+// upload each was stored as. A failure doesn't stop the rest.
+func runIngestCommand(args []string) error {
+	fs := commandFlags("ingest", "[--name NAME] [--duplicate reuse|upload] <path-or-url>...")
+	name := fs.String("name", "", "upload name (one source only; defaults to the file, directory or repository name)")
+	duplicate := fs.String("duplicate", "reuse", "for a repository state already ingested by this command: reuse its upload, or upload it again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *name != "" && fs.NArg() > 1 || *duplicate != "reuse" && *duplicate != "upload" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	ctx, stop := interruptible()
+	defer stop()
+	failed := 0
+	for _, src := range fs.Args() {
+		uploadName := *name
+		if uploadName == "" {
+			uploadName = sourceName(src)
+		}
+		id, reused, err := ingestSource(ctx, src, uploadName, *duplicate == "reuse")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", src, err)
+			failed++
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		note := ""
+		if reused {
+			note = "\t(already ingested)"
+		}
+		fmt.Printf("%d\t%s%s\n", id, src, note)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d ingests failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+// isRemote reports whether src names a repository to fetch rather than a
+// local path.
+func isRemote(src string) bool {
+	u, err := url.Parse(src)
+	return err == nil && (u.Host != "" || u.Scheme == "file") || strings.HasPrefix(src, "git@")
+}
+
+// sourceName is the upload name for src: a repository's name, as in
+// repo.zip for github.com/user/repo.git.
+func sourceName(src string) string {
+	base := strings.TrimSuffix(path.Base(strings.TrimRight(filepath.ToSlash(src), "/")), ".git")
+	if base == "" || base == "." || base == "/" {
+		base = "repo"
+	}
+	if !strings.HasSuffix(base, ".zip") {
+		base += ".zip"
+	}
+	return base
+}
+
+// ingestSource stores the graph of the repository src as a new upload, or
+// finds the upload this command already made of the same repository state
+// when reuse is set.
+func ingestSource(ctx context.Context, src, name string, reuse bool) (id int, reused bool, err error) {
+	tmp, err := os.CreateTemp(tempDir(), "repo-*.zip")
+	if err != nil {
+		return 0, false, err
+	}
+	defer tmp.Close()
+	if err := archiveSource(ctx, tmp, src); err != nil {
+		os.Remove(tmp.Name())
+		return 0, false, err
+	}
+	if reuse {
+		if existing, err := archiveDuplicate(tmp.Name(), cliUploader); err != nil || existing != 0 {
+			os.Remove(tmp.Name())
+			return existing, err == nil, err
+		}
+	}
+	// the archive is removed once ingested, and kept for a retry otherwise
+	id, err = ingestZip(ctx, tmp.Name(), name, 0, cliUploader)
+	return id, false, err
+}
+
+// archiveSource writes to w a zip archive of the repository src: src
+// itself if it is one, or the git directory of a local repository or of a
+// mirror clone of a remote one.
+func archiveSource(ctx context.Context, w io.Writer, src string) error {
+	if isRemote(src) {
+		if u, err := url.Parse(src); err == nil && strings.HasSuffix(u.Path, ".zip") {
+			return download(ctx, w, src)
+		}
+		dir, err := os.MkdirTemp(tempDir(), "gitvis-clone-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		slog.InfoContext(ctx, "cloning", "url", src)
+		if _, err := git.PlainCloneContext(ctx, dir, true, &git.CloneOptions{URL: src, Mirror: true}); err != nil {
+			return fmt.Errorf("clone: %w", err)
+		}
+		return zipDir(w, dir)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	r, err := git.PlainOpenWithOptions(src, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return err
+	}
+	if wt, err := r.Worktree(); err == nil {
+		// only the history is read, so the working tree is left out
+		return zipDir(w, filepath.Join(wt.Filesystem.Root(), ".git"))
+	}
+	return zipDir(w, src)
+}
+
+// download writes the body at src to w.
+func download(ctx context.Context, w io.Writer, src string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: %s", res.Status)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// zipDir writes a zip archive of the git directory dir to w, as .git/ so
+// the ingest finds it.
+func zipDir(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name, hdr.Method = path.Join(".git", filepath.ToSlash(rel)), zip.Deflate
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(zf, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// runExportCommand writes the graphs of the uploads given, by ID, in each
+// format asked for, as files named as the server's exports are downloaded,
+// printing their paths.
+func runExportCommand(args []string) error {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fs := commandFlags("export", "[--format FORMAT,...] [--out DIR|-] <upload-id>...")
+	format := fs.String("format", "json", "comma-separated formats: "+strings.Join(names, ", ")+", or csv for both CSV files")
+	out := fs.String("out", ".", "directory to write upload-{id}.{ext} files to, or - for standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var formats []string
+	for _, f := range strings.Split(*format, ",") {
+		switch f = strings.TrimSpace(f); {
+		case f == "csv":
+			formats = append(formats, "nodes.csv", "edges.csv")
+		case exportFormats[f].write != nil:
+			formats = append(formats, f)
+		default:
+			return fmt.Errorf("unknown format %q", f)
+		}
+	}
+	ids := make([]int, fs.NArg())
+	for i, a := range fs.Args() {
+		id, err := strconv.Atoi(a)
+		if err != nil {
+			fs.Usage()
+			return flag.ErrHelp
+		}
+		ids[i] = id
+	}
+	if len(ids) == 0 || *out == "-" && len(ids)*len(formats) > 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	ctx, stop := interruptible()
+	defer stop()
+	failed := 0
+	for _, id := range ids {
+		for _, f := range formats {
+			path, err := exportUpload(ctx, id, f, *out)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "upload %d: %v\n", id, err)
+				failed++
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				break
+			}
+			if path != "" {
+				fmt.Println(path)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads not exported", failed, len(ids))
+	}
+	return nil
+}
+
+// exportUpload writes upload id in format to a file in dir, or to standard
+// output for "-", returning the file's path.
+func exportUpload(ctx context.Context, id int, format, dir string) (string, error) {
+	var status sql.NullString
+	switch err := db.QueryRowContext(ctx, "SELECT status FROM uploads WHERE id=?", id).Scan(&status); {
+	case err == sql.ErrNoRows:
+		return "", errors.New("not found")
+	case err != nil:
+		return "", err
+	case status.String == "queued" || status.String == "ingesting":
+		return "", errors.New("still being ingested")
+	case status.String == "failed":
+		return "", errors.New("its ingest failed")
+	}
+	f := exportFormats[format]
+	if dir == "-" {
+		bw := bufio.NewWriterSize(os.Stdout, 64<<10)
+		if err := f.write(ctx, bw, id); err != nil {
+			return "", err
+		}
+		return "", bw.Flush()
+	}
+	path := filepath.Join(dir, fmt.Sprintf("upload-%d.%s", id, f.ext))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	bw := bufio.NewWriterSize(file, 64<<10)
+	err = f.write(ctx, bw, id)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// runUploadsCommand lists, deletes and prunes uploads, with everything
+// stored for them.
+func runUploadsCommand(args []string) error {
+	usage := errors.New("usage: gitvis uploads list | delete <id>... | prune --older-than AGE [--dry-run]")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return usage
+		}
+		s, err := loadAdminStats(context.Background())
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tUPLOADED\tSTATUS\tNODES\tEDGES\tSIZE\tUPLOADER")
+		for _, u := range s.PerUpload {
+			uploader := u.Uploader
+			if uploader == "" {
+				uploader = "-"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", u.ID, u.Name, u.UploadedAt, u.Status, u.Nodes, u.Edges, u.SizeBytes, uploader)
+		}
+		return tw.Flush()
+	case "delete":
+		if len(args) < 2 {
+			return usage
+		}
+		ids := make([]int, len(args)-1)
+		for i, a := range args[1:] {
+			id, err := strconv.Atoi(a)
+			if err != nil {
+				return usage
+			}
+			ids[i] = id
+		}
+		for _, id := range ids {
+			var status sql.NullString
+			if err := db.QueryRow("SELECT status FROM uploads WHERE id=?", id).Scan(&status); err == sql.ErrNoRows {
+				return fmt.Errorf("no upload with id %d", id)
+			} else if err != nil {
+				return err
+			}
+			if status.String == "queued" || status.String == "ingesting" {
+				return fmt.Errorf("upload %d is being ingested", id)
+			}
+			if _, err := deleteUpload(id); err != nil {
+				return err
+			}
+			fmt.Println("deleted", id)
+		}
+		return nil
+	case "prune":
+		fs := commandFlags("uploads prune", "--older-than AGE [--dry-run]")
+		olderThan := fs.String("older-than", "", "delete uploads made longer ago than this, such as 30d or 12h")
+		dryRun := fs.Bool("dry-run", false, "list the uploads that would be deleted")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *olderThan == "" || fs.NArg() > 0 {
+			fs.Usage()
+			return flag.ErrHelp
+		}
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return fmt.Errorf("--older-than: %v", err)
+		}
+		var ids []int
+		if *dryRun {
+			ids, err = expiredUploads(age)
+		} else {
+			ids, err = pruneUploads(age)
+		}
+		verb := "deleted"
+		if *dryRun {
+			verb = "would delete"
+		}
+		for _, id := range ids {
+			fmt.Println(verb, id)
+		}
+		return err
+	}
+	return usage
+}
+
+// runRenderCommand draws the graph of a local repository as DOT, SVG or
+// PNG, without a server or a database to set up: the repository is walked
+// into a scratch database in the temp dir, removed afterwards.
+func runRenderCommand(args []string) error {
+	fs := commandFlags("render", "[--format dot|svg|png] [--limit N] [--out FILE] <repo-dir>")
+	format := fs.String("format", "", "dot for the whole graph, or svg or png for the commit graph (default from --out's extension, else svg)")
+	limit := fs.Int("limit", renderDefaultLimit, "newest commits drawn in svg and png (0 for all)")
+	out := fs.String("out", "-", "file to write, or - for standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = "svg"
+		if ext := strings.TrimPrefix(filepath.Ext(*out), "."); ext == "dot" || ext == "png" {
+			*format = ext
+		}
+	}
+	if fs.NArg() != 1 || *limit < 0 || *format != "dot" && *format != "svg" && *format != "png" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	src := fs.Arg(0)
+	r, err := git.PlainOpenWithOptions(src, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	gitDir := src
+	if wt, err := r.Worktree(); err == nil {
+		gitDir = filepath.Join(wt.Filesystem.Root(), ".git")
+	}
+
+	scratch, err := os.MkdirTemp(tempDir(), "gitvis-render-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	if err := openDB(filepath.Join(scratch, "render.db")); err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	defer db.Close()
+	ctx, stop := interruptible()
+	defer stop()
+	name := strings.TrimSuffix(sourceName(src), ".zip")
+	uploadID, err := createUpload(name, 0, cliUploader, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := parseAndStoreRepo(ctx, gitDir, uploadID, nil); err != nil {
+		return fmt.Errorf("parse error: %w", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriterSize(w, 64<<10)
+	switch *format {
+	case "dot":
+		err = writeDOT(ctx, bw, uploadID)
+	default:
+		var l *commitLayout
+		if l, err = layoutCommits(ctx, uploadID, *limit); err != nil {
+			break
+		}
+		if *format == "svg" {
+			err = writeSVG(bw, l, name)
+		} else {
+			err = png.Encode(bw, drawPNG(l))
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil && *out != "-" {
+		os.Remove(*out)
+	}
+	return err
+}
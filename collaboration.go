@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// collaborationGraph links authors who changed the same files: one
+// "author" node per author (grouped by email as in aggregateContributors)
+// and one "collaborated" link per pair, weighted by how many files both
+// changed. Merges and uploads ingested before changed files were recorded
+// contribute nothing. Trailers add "co-authored", "signed-off" and
+// "reviewed" links from the person credited to the commit's author,
+// weighted by how many commits, and nodes for people only credited.
+func collaborationGraph(commits []commitInfo) ([]graphNode, []graphLink) {
+	authors := make(map[string]*contributor)
+	files := make(map[string]map[string]bool) // author keys by file
+	touched := make(map[string]map[string]bool)
+	for _, ct := range addCredits(aggregateContributors(commits), commits) {
+		authors[strings.ToLower(ct.Email)] = ct
+	}
+	credited := make(map[[3]string]int) // by kind, person and author
+	for _, c := range commits {
+		for _, t := range c.Trailers {
+			rel := strings.TrimSuffix(t.Kind, "-by")
+			credited[[3]string{rel, strings.ToLower(t.Email), strings.ToLower(c.Email)}]++
+		}
+	}
+	for _, c := range commits {
+		key := strings.ToLower(c.Email)
+		for _, f := range c.Changed {
+			if files[f] == nil {
+				files[f] = make(map[string]bool)
+			}
+			files[f][key] = true
+			if touched[key] == nil {
+				touched[key] = make(map[string]bool)
+			}
+			touched[key][f] = true
+		}
+	}
+
+	weight := make(map[[2]string]int)
+	for _, keys := range files {
+		list := make([]string, 0, len(keys))
+		for k := range keys {
+			list = append(list, k)
+		}
+		sort.Strings(list)
+		for i := range list {
+			for j := i + 1; j < len(list); j++ {
+				weight[[2]string{list[i], list[j]}]++
+			}
+		}
+	}
+
+	nodes := make([]graphNode, 0, len(authors))
+	for key, ct := range authors {
+		nodes = append(nodes, graphNode{
+			ID: "author:" + key, Type: "author", Label: ct.Name,
+			Extra: map[string]interface{}{"email": ct.Email, "commits": ct.Commits, "files": len(touched[key])},
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	links := make([]graphLink, 0, len(weight)+len(credited))
+	for pair, n := range weight {
+		links = append(links, graphLink{Source: "author:" + pair[0], Target: "author:" + pair[1], Rel: "collaborated", Weight: n})
+	}
+	for k, n := range credited {
+		links = append(links, graphLink{Source: "author:" + k[1], Target: "author:" + k[2], Rel: k[0], Weight: n})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Source != links[j].Source {
+			return links[i].Source < links[j].Source
+		}
+		if links[i].Target != links[j].Target {
+			return links[i].Target < links[j].Target
+		}
+		return links[i].Rel < links[j].Rel
+	})
+	return nodes, links
+}
+
+// collaborationJSON serves /graph/{id}/json?view=collaboration.
+func collaborationJSON(w http.ResponseWriter, r *http.Request, uploadID int) {
+	commits, err := loadCommits(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	nodes, links := collaborationGraph(commits)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+}
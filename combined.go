@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/example/gitvis/pkg/api"
+)
+
+// combinedMaxUploads caps how many uploads one combined graph merges.
+const combinedMaxUploads = 10
+
+// combinedGraph merges the graphs q selects from each of its uploads by
+// object hash. Each node and link lists the uploads holding it in
+// "uploads"; a node's other fields come from the first of them.
+func combinedGraph(ctx context.Context, queries []*graphQuery) ([]graphNode, []graphLink, error) {
+	nodes := make([]graphNode, 0)
+	nodeAt := make(map[string]int)
+	links := make([]graphLink, 0)
+	linkAt := make(map[[3]string]int)
+	for _, q := range queries {
+		rows, err := q.nodes(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var id, typ, label, metaStr string
+			if err := rows.Scan(&id, &typ, &label, &metaStr); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if i, ok := nodeAt[id]; ok {
+				nodes[i].Extra["uploads"] = append(nodes[i].Extra["uploads"].([]int), q.uploadID)
+				continue
+			}
+			n := api.MakeNode(id, typ, label, metaStr)
+			// each upload's layout is its own
+			n.X, n.Y = nil, nil
+			n.Extra["uploads"] = []int{q.uploadID}
+			nodeAt[id] = len(nodes)
+			nodes = append(nodes, n)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		add := func(l graphLink) {
+			key := [3]string{l.Source, l.Target, l.Rel}
+			i, ok := linkAt[key]
+			if !ok {
+				i = len(links)
+				linkAt[key] = i
+				links = append(links, l)
+			}
+			if u := links[i].Uploads; len(u) == 0 || u[len(u)-1] != q.uploadID {
+				links[i].Uploads = append(u, q.uploadID)
+			}
+		}
+		linkRows, err := q.edges(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for linkRows.Next() {
+			var l graphLink
+			if err := linkRows.Scan(&l.Source, &l.Target, &l.Rel); err != nil {
+				linkRows.Close()
+				return nil, nil, err
+			}
+			add(l)
+		}
+		linkRows.Close()
+		if err := linkRows.Err(); err != nil {
+			return nil, nil, err
+		}
+		bridges, err := q.bridges(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, l := range bridges {
+			add(l)
+		}
+	}
+	return nodes, links, nil
+}
+
+// combinedHandler serves /combined?uploads=1,2,3: the graphs of up to ten
+// uploads merged into one by object hash, for related repositories or
+// snapshots of one. The graph JSON's filters apply to each upload.
+func combinedHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, s := range strings.Split(r.URL.Query().Get("uploads"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "bad id", 400)
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > combinedMaxUploads {
+		http.Error(w, fmt.Sprintf("uploads must list 1 to %d upload IDs", combinedMaxUploads), 400)
+		return
+	}
+	var queries []*graphQuery
+	for _, id := range ids {
+		// unknown uploads would add nothing
+		if _, ok, err := lookupAccess(id); err != nil || !ok || !canView(r, id) {
+			http.NotFound(w, r)
+			return
+		}
+		q, err := parseGraphQuery(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		queries = append(queries, q)
+	}
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	nodes, links, err := combinedGraph(ctx, queries)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Commit times are stored in node meta as RFC 3339. Uploads ingested
+// before that have them as time.Time.String() wrote them, which names the
+// zone by its offset again for the zoneless times go-git reads, as in
+// "2024-05-01 12:00:00 +0200 +0200", or by its abbreviation.
+var legacyCommitTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 -0700",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+}
+
+// parseCommitTime reads a stored commit time. "" is the zero time, for
+// uploads ingested before the time was recorded.
+func parseCommitTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range legacyCommitTimeLayouts {
+		if t, lerr := time.Parse(layout, s); lerr == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// commitInfo is a commit node with its meta decoded.
+type commitInfo struct {
+	Hash    string
+	Message string
+	// the author's identity after the mailmap
+	Author string
+	Email  string
+	When   time.Time
+	// committer date; zero for uploads ingested before it was recorded
+	Committed time.Time
+
+	// diff stats; zero when the ingest didn't record them
+	Additions int
+	Deletions int
+	// lines in the commit's tree; nil when the ingest didn't count them
+	Lines *int
+
+	// files changed, from the churn pass; nil for merges and for uploads
+	// ingested before it
+	Changed []string
+	// people credited in trailers other than the author
+	Trailers []trailer
+	// issues the message refers to, as parseIssueRefs returns them
+	Issues []string
+	// from the categories pass; empty when it found none
+	Category string
+	Scope    string
+	Breaking bool
+}
+
+// loadCommits returns the fully stored commits of an upload. Parent
+// placeholders that were never walked (no meta) are skipped.
+func loadCommits(ctx context.Context, uploadID int) ([]commitInfo, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id,label,meta FROM nodes WHERE upload_id=? AND type='commit' AND meta<>''", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commits := make([]commitInfo, 0)
+	for rows.Next() {
+		var id, label, metaStr string
+		if err := rows.Scan(&id, &label, &metaStr); err != nil {
+			return nil, err
+		}
+		var meta struct {
+			Author    string    `json:"author"`
+			Email     string    `json:"email"`
+			MapAuthor string    `json:"mailmap_author"`
+			MapEmail  string    `json:"mailmap_email"`
+			Time      string    `json:"time"`
+			Committed string    `json:"committed"`
+			Additions int       `json:"additions"`
+			Deletions int       `json:"deletions"`
+			Lines     *int      `json:"lines"`
+			Changed   []string  `json:"changed"`
+			Trailers  []trailer `json:"trailers"`
+			Issues    []string  `json:"issues"`
+			Category  string    `json:"category"`
+			Scope     string    `json:"scope"`
+			Breaking  bool      `json:"breaking"`
+		}
+		if err := json.Unmarshal([]byte(metaStr), &meta); err != nil {
+			continue
+		}
+		when, err := parseCommitTime(meta.Time)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %w", id, err)
+		}
+		committed, err := parseCommitTime(meta.Committed)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %w", id, err)
+		}
+		if meta.MapEmail != "" {
+			meta.Author, meta.Email = meta.MapAuthor, meta.MapEmail
+		}
+		commits = append(commits, commitInfo{
+			Hash: id, Message: label, Author: meta.Author, Email: meta.Email, When: when, Committed: committed,
+			Additions: meta.Additions, Deletions: meta.Deletions, Lines: meta.Lines, Changed: meta.Changed, Trailers: meta.Trailers,
+			Issues: meta.Issues, Category: meta.Category, Scope: meta.Scope, Breaking: meta.Breaking,
+		})
+	}
+	return commits, rows.Err()
+}
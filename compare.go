@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/example/gitvis/pkg/api"
+)
+
+// compareDefaultLimit is how many commits of each side the comparison
+// lists unless asked for more; the counts always cover them all.
+const compareDefaultLimit = 100
+
+// objectDiff counts the objects of one type in either upload or both,
+// matched by hash.
+type objectDiff struct {
+	OnlyA  int `json:"only_a"`
+	OnlyB  int `json:"only_b"`
+	Shared int `json:"shared"`
+}
+
+// refDiff is a branch or tag as it stands in either upload. Status is
+// "same", "moved", "only_a" or "only_b".
+type refDiff struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	A      string `json:"a,omitempty"`
+	B      string `json:"b,omitempty"`
+	Status string `json:"status"`
+}
+
+// comparison is the compare endpoint's response.
+type comparison struct {
+	A       int        `json:"a"`
+	B       int        `json:"b"`
+	Commits objectDiff `json:"commits"`
+	Trees   objectDiff `json:"trees"`
+	Blobs   objectDiff `json:"blobs"`
+	Refs    []refDiff  `json:"refs"`
+	// the commits only one side has, newest first
+	OnlyACommits []string `json:"only_a_commits"`
+	OnlyBCommits []string `json:"only_b_commits"`
+}
+
+// compareRefs matches refs by kind and name.
+func compareRefs(a, b []refInfo) []refDiff {
+	byName := make(map[[2]string]*refDiff)
+	for _, r := range a {
+		byName[[2]string{r.Kind, r.Name}] = &refDiff{Name: r.Name, Kind: r.Kind, A: r.Tip, Status: "only_a"}
+	}
+	for _, r := range b {
+		d := byName[[2]string{r.Kind, r.Name}]
+		if d == nil {
+			byName[[2]string{r.Kind, r.Name}] = &refDiff{Name: r.Name, Kind: r.Kind, B: r.Tip, Status: "only_b"}
+			continue
+		}
+		d.B, d.Status = r.Tip, "moved"
+		if d.A == d.B {
+			d.Status = "same"
+		}
+	}
+	out := make([]refDiff, 0, len(byName))
+	for _, d := range byName {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// onlyIn lists the commits of h that other lacks, newest first in h's
+// topological order.
+func onlyIn(h, other *history) []string {
+	list := make([]string, 0)
+	for i := len(h.topo) - 1; i >= 0; i-- {
+		if c := h.topo[i]; other.commits[c] == nil {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// compareObjects counts the trees and blobs of uploads a and b by which
+// of them has each hash.
+func compareObjects(ctx context.Context, a, b int) (trees, blobs objectDiff, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT n.type,
+			SUM(n.upload_id=? AND NOT EXISTS(SELECT 1 FROM nodes m WHERE m.upload_id=? AND m.id=n.id)),
+			SUM(n.upload_id=? AND NOT EXISTS(SELECT 1 FROM nodes m WHERE m.upload_id=? AND m.id=n.id)),
+			SUM(n.upload_id=? AND EXISTS(SELECT 1 FROM nodes m WHERE m.upload_id=? AND m.id=n.id))
+		FROM nodes n WHERE n.upload_id IN (?,?) AND n.type IN ('tree','blob') GROUP BY n.type`,
+		a, b, b, a, a, b, a, b)
+	if err != nil {
+		return trees, blobs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var typ string
+		var d objectDiff
+		if err := rows.Scan(&typ, &d.OnlyA, &d.OnlyB, &d.Shared); err != nil {
+			return trees, blobs, err
+		}
+		if typ == "tree" {
+			trees = d
+		} else {
+			blobs = d
+		}
+	}
+	return trees, blobs, rows.Err()
+}
+
+// compareGraph is the combined commit graph of both uploads: every commit
+// and ref either has, with "side" set to "a", "b" or "both", and the
+// parent links of both. A ref that moved points at its commit on each
+// side.
+func compareGraph(ctx context.Context, a, b int, ha, hb *history, refs []refDiff) ([]graphNode, []graphLink, error) {
+	nodes := make([]graphNode, 0, len(ha.commits)+len(refs))
+	seen := make(map[string]bool)
+	for _, upload := range []int{a, b} {
+		rows, err := db.QueryContext(ctx, "SELECT id,label,meta FROM nodes WHERE upload_id=? AND type='commit' AND meta<>''", upload)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var id, label, metaStr string
+			if err := rows.Scan(&id, &label, &metaStr); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			n := api.MakeNode(id, "commit", label, metaStr)
+			// each upload's layout is its own
+			n.X, n.Y = nil, nil
+			switch {
+			case ha.commits[id] != nil && hb.commits[id] != nil:
+				n.Extra["side"] = "both"
+			case upload == a:
+				n.Extra["side"] = "a"
+			default:
+				n.Extra["side"] = "b"
+			}
+			nodes = append(nodes, n)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	links := make([]graphLink, 0)
+	linked := make(map[[2]string]bool)
+	for _, h := range []*history{ha, hb} {
+		for _, c := range h.topo {
+			for _, p := range h.parents[c] {
+				if !linked[[2]string{c, p}] {
+					linked[[2]string{c, p}] = true
+					links = append(links, graphLink{Source: c, Target: p, Rel: "parent"})
+				}
+			}
+		}
+	}
+	for _, d := range refs {
+		side := map[string]string{"same": "both", "moved": "both", "only_a": "a", "only_b": "b"}[d.Status]
+		extra := map[string]interface{}{"kind": d.Kind, "side": side}
+		if d.Status == "moved" {
+			extra["moved"] = true
+		}
+		id := "refs/heads/" + d.Name
+		if d.Kind == "tag" {
+			id = "refs/tags/" + d.Name
+		}
+		nodes = append(nodes, graphNode{ID: id, Type: "ref", Label: d.Name, Extra: extra})
+		for _, tip := range []string{d.A, d.B} {
+			if tip != "" && !linked[[2]string{id, tip}] {
+				linked[[2]string{id, tip}] = true
+				links = append(links, graphLink{Source: id, Target: tip, Rel: "ref->commit"})
+			}
+		}
+	}
+	return nodes, links, nil
+}
+
+// compareRoute serves /compare/{a}/{b}[/graph].
+func compareRoute(w http.ResponseWriter, r *http.Request) {
+	compareHandler(w, r, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/compare"), "/"), "/"))
+}
+
+// compareHandler compares two uploads by hash: with parts of {a}/{b}, the
+// commits, trees, blobs and refs each has that the other lacks, listing at
+// most ?limit= commits a side (default 100, 0 for all); with {a}/{b}/graph,
+// the combined commit graph, as nodes and links like the graph JSON.
+func compareHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) != 2 && !(len(parts) == 3 && parts[2] == "graph") {
+		http.NotFound(w, r)
+		return
+	}
+	a, errA := strconv.Atoi(parts[0])
+	b, errB := strconv.Atoi(parts[1])
+	if errA != nil || errB != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	for _, id := range []int{a, b} {
+		// unknown uploads would compare as empty
+		if _, ok, err := lookupAccess(id); err != nil || !ok || !canView(r, id) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	limit, ok := limitParam(w, r, compareDefaultLimit)
+	if !ok {
+		return
+	}
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+
+	ha, err := loadHistory(ctx, a)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	hb, err := loadHistory(ctx, b)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	refsA, err := loadRefs(ctx, a, "")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	refsB, err := loadRefs(ctx, b, "")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	refs := compareRefs(refsA, refsB)
+
+	if len(parts) == 3 {
+		nodes, links, err := compareGraph(ctx, a, b, ha, hb, refs)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+		return
+	}
+
+	cmp := comparison{A: a, B: b, Refs: refs, OnlyACommits: onlyIn(ha, hb), OnlyBCommits: onlyIn(hb, ha)}
+	cmp.Commits = objectDiff{OnlyA: len(cmp.OnlyACommits), OnlyB: len(cmp.OnlyBCommits)}
+	cmp.Commits.Shared = len(ha.commits) - cmp.Commits.OnlyA
+	if cmp.Trees, cmp.Blobs, err = compareObjects(ctx, a, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if limit > 0 && len(cmp.OnlyACommits) > limit {
+		cmp.OnlyACommits = cmp.OnlyACommits[:limit]
+	}
+	if limit > 0 && len(cmp.OnlyBCommits) > limit {
+		cmp.OnlyBCommits = cmp.OnlyBCommits[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmp)
+}
@@ -0,0 +1,290 @@
+package main
+
+// Configuration. Every setting can come from a command-line flag, an
+// environment variable, or a YAML config file named by --config (or
+// GITVIS_CONFIG), in that order of precedence:
+//
+//	gitvis --addr :9000 --quota-bytes 5G
+//	GITVIS_ADDR=:9000 GITVIS_QUOTA_BYTES=5G gitvis
+//	gitvis --config /etc/gitvis.yaml   # addr: ":9000", quota-bytes: 5G
+//
+// main reads the settings first, with loadConfig, then sets up the logger
+// and calls configure to build the variables that depend on them
+// (timeouts, quotas, rate limits), so those see the flags and the file.
+// Tests load their own settings the same way.
+// --print-config shows every setting in effect and where it came from.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settingDef is one setting: its flag and config file key, the variable
+// it may be set by, its default as shown to operators, and what it does.
+// Secrets are hidden by --print-config.
+type settingDef struct {
+	name, env, def, usage string
+	secret                bool
+}
+
+var settingDefs = []settingDef{
+	{name: "addr", env: "GITVIS_ADDR", def: ":8080", usage: "address to listen on"},
+	{name: "tls-cert", env: "GITVIS_TLS_CERT", usage: "TLS certificate file (PEM) to serve HTTPS with"},
+	{name: "tls-key", env: "GITVIS_TLS_KEY", usage: "private key file (PEM) of --tls-cert"},
+	{name: "tls-domains", env: "GITVIS_TLS_DOMAINS", usage: "comma-separated names to serve HTTPS for with Let's Encrypt certificates"},
+	{name: "tls-email", env: "GITVIS_TLS_EMAIL", usage: "contact email for the Let's Encrypt account"},
+	{name: "tls-cache", env: "GITVIS_TLS_CACHE", def: "./autocert", usage: "directory keeping Let's Encrypt certificates and keys"},
+	{name: "http-addr", env: "GITVIS_HTTP_ADDR", usage: "address for plain HTTP redirecting to HTTPS, such as :80"},
+	{name: "base-path", env: "GITVIS_BASE_PATH", usage: "path prefix to serve under behind a reverse proxy, such as /git-viz"},
+	{name: "db", env: "GITVIS_DB", def: "./gitvis.db", usage: "SQLite database file"},
+	{name: "temp-dir", env: "GITVIS_TEMP_DIR", def: os.TempDir(), usage: "directory for uploaded archives and extracted repositories"},
+	{name: "max-upload", env: "GITVIS_MAX_UPLOAD", def: "0", usage: "largest archive accepted, with an optional K/M/G suffix (0 for no limit)"},
+	{name: "ingest-workers", env: "GITVIS_INGEST_WORKERS", def: "0", usage: "ingests run at once; others queue (0 for no limit)"},
+	{name: "log-format", env: "GITVIS_LOG_FORMAT", def: "text", usage: "log as text or json"},
+	{name: "access-log", env: "GITVIS_ACCESS_LOG", def: "on", usage: "log every request (off to skip)"},
+	{name: "log-level", env: "GITVIS_LOG_LEVEL", def: "info", usage: "least severe level logged: debug, info, warn or error"},
+	{name: "otlp-endpoint", env: "GITVIS_OTLP_ENDPOINT", usage: "OpenTelemetry collector to send traces to over OTLP/HTTP, such as http://localhost:4318"},
+	{name: "otlp-headers", env: "GITVIS_OTLP_HEADERS", usage: "headers sent to the collector, as name=value pairs separated by commas", secret: true},
+	{name: "trace-sample", env: "GITVIS_TRACE_SAMPLE", def: "1", usage: "share of traces recorded, from 0 to 1"},
+	{name: "debug-endpoints", env: "GITVIS_DEBUG_ENDPOINTS", def: "off", usage: "serve pprof profiles and runtime stats under /debug/ to admins (on to enable)"},
+	{name: "assets-dir", env: "GITVIS_ASSETS_DIR", usage: "serve templates, static files and the schema from this directory instead of the built-in copies, for development"},
+	{name: "retention", env: "GITVIS_RETENTION", def: "0", usage: "delete uploads older than this, such as 90d or 12h (0 keeps them)"},
+	{name: "job-retention", env: "GITVIS_JOB_RETENTION", def: "10m", usage: "how long a finished ingest's progress stays available"},
+	{name: "read-timeout", env: "GITVIS_READ_TIMEOUT", def: "5m", usage: "reading a request, uploads included"},
+	{name: "write-timeout", env: "GITVIS_WRITE_TIMEOUT", def: "2m", usage: "writing a response"},
+	{name: "idle-timeout", env: "GITVIS_IDLE_TIMEOUT", def: "2m", usage: "idle keep-alive connections"},
+	{name: "query-timeout", env: "GITVIS_QUERY_TIMEOUT", def: "30s", usage: "database work for one API request"},
+	{name: "ingest-timeout", env: "GITVIS_INGEST_TIMEOUT", def: "30m", usage: "extracting and walking one archive"},
+	{name: "shutdown-timeout", env: "GITVIS_SHUTDOWN_TIMEOUT", def: "30s", usage: "waiting for requests and ingests to finish on SIGINT or SIGTERM"},
+	{name: "quota-uploads", env: "GITVIS_QUOTA_UPLOADS", def: "100", usage: "uploads per identity (0 for no limit)"},
+	{name: "quota-bytes", env: "GITVIS_QUOTA_BYTES", def: "1G", usage: "archive bytes per identity, with an optional K/M/G suffix (0 for no limit)"},
+	{name: "rate-upload", env: "GITVIS_RATE_UPLOAD", def: "10", usage: "ingests per minute per client (0 for no limit)"},
+	{name: "rate-api", env: "GITVIS_RATE_API", def: "600", usage: "other requests per minute per client (0 for no limit)"},
+	{name: "layout", env: "GITVIS_LAYOUT", def: "on", usage: "lay graphs out at ingest (off to skip)"},
+	{name: "mailmap", env: "GITVIS_MAILMAP", usage: "mailmap file applied to every upload"},
+	{name: "commit-categories", env: "GITVIS_COMMIT_CATEGORIES", usage: "file of commit category rules"},
+	{name: "secret-rules", env: "GITVIS_SECRET_RULES", usage: "file of extra secret scan rules"},
+	{name: "secret-entropy", env: "GITVIS_SECRET_ENTROPY", def: "3.5", usage: "bits per character a captured secret needs"},
+	{name: "admins", env: "GITVIS_ADMINS", usage: "comma-separated emails of admin users"},
+	{name: "base-url", env: "GITVIS_BASE_URL", def: "http://localhost:8080", usage: "external URL used to build sign-in redirect URIs"},
+	{name: "google-client-id", env: "GITVIS_GOOGLE_CLIENT_ID", usage: "Google sign-in client ID"},
+	{name: "google-client-secret", env: "GITVIS_GOOGLE_CLIENT_SECRET", usage: "Google sign-in client secret", secret: true},
+	{name: "github-client-id", env: "GITVIS_GITHUB_CLIENT_ID", usage: "GitHub sign-in client ID"},
+	{name: "github-client-secret", env: "GITVIS_GITHUB_CLIENT_SECRET", usage: "GitHub sign-in client secret", secret: true},
+	{name: "oidc-issuer", env: "GITVIS_OIDC_ISSUER", usage: "OpenID Connect issuer URL"},
+	{name: "oidc-client-id", env: "GITVIS_OIDC_CLIENT_ID", usage: "OpenID Connect client ID"},
+	{name: "oidc-client-secret", env: "GITVIS_OIDC_CLIENT_SECRET", usage: "OpenID Connect client secret", secret: true},
+	{name: "share-secret", env: "GITVIS_SHARE_SECRET", usage: "key signing share links (random and stored when unset)", secret: true},
+	{name: "csrf-secret", env: "GITVIS_CSRF_SECRET", usage: "key signing CSRF tokens (random and stored when unset)", secret: true},
+}
+
+// config is the settings in effect, by variable name, with where each
+// came from.
+type config struct {
+	values map[string]string
+	source map[string]string
+	file   string
+	// the command and its arguments, such as token create NAME
+	args        []string
+	printConfig bool
+	// usage prints the flags
+	usage func()
+}
+
+// settings are the settings in effect, loaded by main and then applied by
+// configure. Tests load their own.
+var settings *config
+
+// setting is the value in effect of the setting read from the variable
+// env: its default when nothing sets it, or "" for none.
+func setting(env string) string {
+	if settings != nil {
+		if v, ok := settings.values[env]; ok {
+			return v
+		}
+	}
+	return os.Getenv(env)
+}
+
+// configure sets up what depends on the settings once they are loaded,
+// stopping the program when one is invalid.
+func configure() {
+	assets = assetsFS()
+	basePath = cleanBasePath(setting("GITVIS_BASE_PATH"))
+	providers = loadProviders()
+	accessLogEnabled = setting("GITVIS_ACCESS_LOG") != "off"
+	debugEndpoints = setting("GITVIS_DEBUG_ENDPOINTS") == "on"
+	layoutEnabled = setting("GITVIS_LAYOUT") != "off"
+	mailmapPath = setting("GITVIS_MAILMAP")
+	categoryRulesPath = setting("GITVIS_COMMIT_CATEGORIES")
+	secretRulesPath = setting("GITVIS_SECRET_RULES")
+	secretEntropy = envFloat("GITVIS_SECRET_ENTROPY", 3.5)
+
+	readTimeout = envDuration("GITVIS_READ_TIMEOUT", 5*time.Minute)
+	writeTimeout = envDuration("GITVIS_WRITE_TIMEOUT", 2*time.Minute)
+	idleTimeout = envDuration("GITVIS_IDLE_TIMEOUT", 2*time.Minute)
+	queryTimeout = envDuration("GITVIS_QUERY_TIMEOUT", 30*time.Second)
+	ingestTimeout = envDuration("GITVIS_INGEST_TIMEOUT", 30*time.Minute)
+	shutdownTimeout = envDuration("GITVIS_SHUTDOWN_TIMEOUT", 30*time.Second)
+	jobRetention = envDuration("GITVIS_JOB_RETENTION", 10*time.Minute)
+	uploadRetention = envAge("GITVIS_RETENTION")
+
+	quotaUploads = envSize("GITVIS_QUOTA_UPLOADS", 100)
+	quotaBytes = envSize("GITVIS_QUOTA_BYTES", 1<<30)
+	maxUpload = envSize("GITVIS_MAX_UPLOAD", 0)
+	errUploadTooLarge = fmt.Errorf("archive over the %d-byte upload limit", maxUpload)
+	uploadLimiter = newRateLimiter("GITVIS_RATE_UPLOAD", 10)
+	apiLimiter = newRateLimiter("GITVIS_RATE_API", 600)
+	if n := envCount("GITVIS_INGEST_WORKERS", 0); n > 0 {
+		ingestSlots = make(chan struct{}, n)
+	}
+
+	otlpEndpoint = strings.TrimSuffix(setting("GITVIS_OTLP_ENDPOINT"), "/")
+	otlpHeaders = parseOTLPHeaders(setting("GITVIS_OTLP_HEADERS"))
+	traceSample = envFloat("GITVIS_TRACE_SAMPLE", 1)
+	if otlpEndpoint != "" {
+		go exportLoop()
+	}
+}
+
+// loadConfig reads the settings from the command line, the environment
+// and the config file, stopping the program when they are invalid.
+func loadConfig(args []string) *config {
+	c := &config{values: map[string]string{}, source: map[string]string{}}
+	fs := flag.NewFlagSet("gitvis", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\nEvery flag can also be set by the variable named in brackets or in the --config file.\n\n", commandUsage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("GITVIS_CONFIG"), "YAML config file of settings by flag name [GITVIS_CONFIG]")
+	fs.BoolVar(&c.printConfig, "print-config", false, "print the settings in effect and exit")
+	flags := make(map[string]*string, len(settingDefs))
+	for _, d := range settingDefs {
+		flags[d.name] = fs.String(d.name, "", fmt.Sprintf("%s [%s]", d.usage, d.env))
+		if d.def != "" {
+			fs.Lookup(d.name).DefValue = d.def
+		}
+	}
+	c.usage = fs.Usage
+	args, c.args = splitArgs(fs, args)
+	fs.Parse(args)
+
+	file := map[string]string{}
+	if c.file = *configFile; c.file != "" {
+		b, err := os.ReadFile(c.file)
+		if err != nil {
+			fatalf("config: %v", err)
+		}
+		if err := yaml.Unmarshal(b, &file); err != nil {
+			fatalf("config %s: %v", c.file, err)
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil || name == "config" || name == "print-config" {
+				fatalf("config %s: unknown setting %q", c.file, name)
+			}
+		}
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, d := range settingDefs {
+		if set[d.name] {
+			c.values[d.env], c.source[d.env] = *flags[d.name], "flag"
+		} else if v, ok := os.LookupEnv(d.env); ok {
+			c.values[d.env], c.source[d.env] = v, "env"
+		} else if v, ok := file[d.name]; ok {
+			c.values[d.env], c.source[d.env] = v, "file"
+		} else {
+			c.values[d.env], c.source[d.env] = d.def, "default"
+		}
+	}
+	if fi, err := os.Stat(c.values["GITVIS_TEMP_DIR"]); err != nil || !fi.IsDir() {
+		fatalf("GITVIS_TEMP_DIR: %q is not a directory", c.values["GITVIS_TEMP_DIR"])
+	}
+	if c.values["GITVIS_ADDR"] == "" || c.values["GITVIS_DB"] == "" {
+		fatalf("GITVIS_ADDR and GITVIS_DB can't be empty")
+	}
+	return c
+}
+
+// commandUsage introduces the commands; their own flags are in their usage.
+const commandUsage = `usage: gitvis [flags] [command [args]]
+
+Commands:
+
+  serve                     serve the web app and APIs (the default)
+  ingest <path-or-url>...   store the graphs of repositories, then exit
+  export <upload-id>...     write graphs to files as JSON, DOT, CSV and more
+  uploads ...               list, delete and prune uploads
+  render <repo-dir>         draw a repository's graph as DOT, SVG or PNG,
+                            without a server or database
+  token ...                 create, list and revoke API tokens
+`
+
+// splitArgs separates the settings flags in args from the command line
+// they come with, such as ingest --name x repo.zip, which keeps its own
+// flags. Settings flags can come before or after the command.
+func splitArgs(fs *flag.FlagSet, args []string) (flags, command []string) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return flags, append(command, args[i+1:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		f := fs.Lookup(name)
+		if !strings.HasPrefix(a, "-") || f == nil && len(command) > 0 {
+			command = append(command, a)
+			continue
+		}
+		// an unknown flag before any command is left for Parse to report
+		flags = append(flags, a)
+		if f == nil {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			flags = append(flags, args[i])
+		}
+	}
+	return flags, command
+}
+
+// writeConfig writes the settings in effect as a config file would hold
+// them, each commented with its source; secrets are hidden.
+func writeConfig(w io.Writer, c *config) {
+	if c.file != "" {
+		fmt.Fprintf(w, "# config file: %s\n", c.file)
+	}
+	for _, d := range settingDefs {
+		v := c.values[d.env]
+		if d.secret && v != "" {
+			v = "(hidden)"
+		}
+		b, _ := yaml.Marshal(map[string]string{d.name: v})
+		fmt.Fprintf(w, "%s  # %s\n", strings.TrimSuffix(string(b), "\n"), c.source[d.env])
+	}
+}
+
+// tempDir is where uploaded archives are kept and repositories extracted.
+func tempDir() string {
+	return setting("GITVIS_TEMP_DIR")
+}
+
+// envCount reads a non-negative whole number, or returns def.
+func envCount(name string, def int) int {
+	s := strings.TrimSpace(setting(name))
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		fatalf("%s: want a non-negative number, got %q", name, s)
+	}
+	return n
+}
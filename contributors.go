@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contributor is one author's aggregate over an upload's history.
+type contributor struct {
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	Commits     int       `json:"commits"`
+	FirstCommit time.Time `json:"first_commit"`
+	LastCommit  time.Time `json:"last_commit"`
+	Additions   int       `json:"additions,omitempty"`
+	Deletions   int       `json:"deletions,omitempty"`
+	// commits crediting them in a trailer
+	CoAuthored int `json:"co_authored,omitempty"`
+	SignedOff  int `json:"signed_off,omitempty"`
+	Reviewed   int `json:"reviewed,omitempty"`
+}
+
+// aggregateContributors groups commits by (case-insensitive) author email.
+// The name reported is the one used on the author's most recent commit.
+func aggregateContributors(commits []commitInfo) []*contributor {
+	byEmail := make(map[string]*contributor)
+	for _, c := range commits {
+		key := strings.ToLower(c.Email)
+		ct, ok := byEmail[key]
+		if !ok {
+			ct = &contributor{Email: c.Email, Name: c.Author, FirstCommit: c.When, LastCommit: c.When}
+			byEmail[key] = ct
+		}
+		ct.Commits++
+		ct.Additions += c.Additions
+		ct.Deletions += c.Deletions
+		if c.When.Before(ct.FirstCommit) {
+			ct.FirstCommit = c.When
+		}
+		if !c.When.Before(ct.LastCommit) {
+			ct.LastCommit = c.When
+			ct.Name = c.Author
+		}
+	}
+
+	out := make([]*contributor, 0, len(byEmail))
+	for _, ct := range byEmail {
+		out = append(out, ct)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Commits != out[j].Commits {
+			return out[i].Commits > out[j].Commits
+		}
+		return out[i].Email < out[j].Email
+	})
+	return out
+}
+
+func contributorsHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	commits, err := loadCommits(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addCredits(aggregateContributors(commits), commits))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	// couplingMaxFiles leaves out commits touching more files than this:
+	// imports, mass renames and reformats say nothing about coupling
+	couplingMaxFiles = 50
+	// couplingDefaultMin is how many commits two files must share, unless
+	// ?min_shared= says otherwise
+	couplingDefaultMin = 2
+)
+
+// couplingGraph links files that changed in the same commits: a "file"
+// node per file with its number of changes, and a "coupled" link per pair
+// that changed together in at least minShared commits, weighted by how
+// many. Files without a link are left out.
+func couplingGraph(commits []commitInfo, minShared int) ([]graphNode, []graphLink) {
+	changes := make(map[string]int)
+	shared := make(map[[2]string]int)
+	for _, c := range commits {
+		if len(c.Changed) > couplingMaxFiles {
+			continue
+		}
+		for i, a := range c.Changed {
+			changes[a]++
+			// Changed is sorted, so each pair comes out in one order
+			for _, b := range c.Changed[i+1:] {
+				shared[[2]string{a, b}]++
+			}
+		}
+	}
+
+	linked := make(map[string]bool)
+	links := make([]graphLink, 0)
+	for pair, n := range shared {
+		if n < minShared {
+			continue
+		}
+		linked[pair[0]], linked[pair[1]] = true, true
+		links = append(links, graphLink{Source: "file:" + pair[0], Target: "file:" + pair[1], Rel: "coupled", Weight: n})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Weight != links[j].Weight {
+			return links[i].Weight > links[j].Weight
+		}
+		if links[i].Source != links[j].Source {
+			return links[i].Source < links[j].Source
+		}
+		return links[i].Target < links[j].Target
+	})
+	nodes := make([]graphNode, 0, len(linked))
+	for f := range linked {
+		nodes = append(nodes, graphNode{
+			ID: "file:" + f, Type: "file", Label: path.Base(f),
+			Extra: map[string]interface{}{"path": f, "changes": changes[f]},
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, links
+}
+
+// couplingJSON serves /graph/{id}/json?view=coupling.
+func couplingJSON(w http.ResponseWriter, r *http.Request, uploadID int) {
+	minShared := couplingDefaultMin
+	if s := r.URL.Query().Get("min_shared"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "min_shared must be a positive number", 400)
+			return
+		}
+		minShared = n
+	}
+	commits, err := loadCommits(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	nodes, links := couplingGraph(commits, minShared)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+}
@@ -0,0 +1,74 @@
+package main
+
+// CSRF protection for browser requests. Each browser gets a random ID in
+// the gitvis_csrf cookie; pages embed an xsrftoken bound to that ID, and
+// state-changing requests must send it back in the csrf_token form field
+// or the X-CSRF-Token header. Requests carrying an API token are exempt:
+// a cross-site form can't set the Authorization header.
+
+import (
+	"net/http"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+const (
+	csrfCookie = "gitvis_csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+	csrfAction = "post"
+)
+
+func csrfKey() string {
+	return string(serverSecret("csrf", "GITVIS_CSRF_SECRET"))
+}
+
+// csrfToken returns a token for the page being rendered, setting the
+// browser's ID cookie first if it has none.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	id := ""
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		id = c.Value
+	} else {
+		id = randomToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    id,
+			Path:     sitePath("/"),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return xsrftoken.Generate(csrfKey(), id, csrfAction)
+}
+
+// validCSRF reports whether a request may change state.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if _, ok := tokenFromRequest(r); ok {
+		return true
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfField)
+	}
+	return token != "" && xsrftoken.Valid(token, csrfKey(), c.Value, csrfAction)
+}
+
+func csrfProtected(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validCSRF(r) {
+			http.Error(w, "missing or invalid CSRF token; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
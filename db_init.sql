@@ -4,14 +4,19 @@ CREATE TABLE IF NOT EXISTS uploads (
   uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
+-- objects are keyed per upload: uploads of the same repository, or of a
+-- fork, each keep their own copy of the commits, trees and blobs they share
 CREATE TABLE IF NOT EXISTS nodes (
-  id TEXT PRIMARY KEY,
+  id TEXT,
   upload_id INTEGER,
   type TEXT,
   label TEXT,
   meta TEXT,
+  PRIMARY KEY(upload_id, id),
   FOREIGN KEY(upload_id) REFERENCES uploads(id)
 );
+-- finds the other uploads holding an object, for related repositories
+CREATE INDEX IF NOT EXISTS nodes_id ON nodes(id);
 
 CREATE TABLE IF NOT EXISTS edges (
   id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -21,3 +26,103 @@ CREATE TABLE IF NOT EXISTS edges (
   rel TEXT,
   FOREIGN KEY(upload_id) REFERENCES uploads(id)
 );
+
+-- older databases stored one edge row per visit; collapse those before
+-- enforcing uniqueness
+DELETE FROM edges WHERE id NOT IN (
+  SELECT MIN(id) FROM edges GROUP BY upload_id, source, target, rel
+);
+CREATE UNIQUE INDEX IF NOT EXISTS edges_unique ON edges(upload_id, source, target, rel);
+
+-- uploads sharing commits, such as forks or snapshots of one repository,
+-- recorded both ways at ingest. divergence is a JSON array of the newest
+-- commits they share.
+CREATE TABLE IF NOT EXISTS related_uploads (
+  upload_id INTEGER NOT NULL,
+  related_id INTEGER NOT NULL,
+  shared_commits INTEGER NOT NULL,
+  divergence TEXT NOT NULL,
+  PRIMARY KEY(upload_id, related_id)
+);
+
+-- where each branch and tag pointed at each ingest of an upload; ingest
+-- counts from 1, the first upload, through its refreshes
+CREATE TABLE IF NOT EXISTS ref_history (
+  upload_id INTEGER NOT NULL,
+  ingest INTEGER NOT NULL,
+  ingested_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  kind TEXT NOT NULL,
+  name TEXT NOT NULL,
+  tip TEXT NOT NULL,
+  PRIMARY KEY(upload_id, ingest, kind, name)
+);
+
+-- the READMEs at the roots of an upload's commits, kept for the readme
+-- endpoint since archives are deleted after ingest
+CREATE TABLE IF NOT EXISTS readmes (
+  upload_id INTEGER NOT NULL,
+  blob TEXT NOT NULL,
+  text TEXT NOT NULL,
+  PRIMARY KEY(upload_id, blob)
+);
+
+-- the entries of an upload's trees as git has them; a tree or blob's node
+-- label is only the first name it was seen under
+CREATE TABLE IF NOT EXISTS tree_entries (
+  upload_id INTEGER NOT NULL,
+  tree TEXT NOT NULL,
+  name TEXT NOT NULL,
+  mode INTEGER NOT NULL,
+  hash TEXT NOT NULL,
+  PRIMARY KEY(upload_id, tree, name)
+);
+
+-- the contents of an upload's blobs for the blob endpoint, the first
+-- 1 MiB of text ones; binary ones have none
+CREATE TABLE IF NOT EXISTS blob_texts (
+  upload_id INTEGER NOT NULL,
+  blob TEXT NOT NULL,
+  text TEXT NOT NULL,
+  binary INTEGER NOT NULL DEFAULT 0,
+  truncated INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY(upload_id, blob)
+);
+
+-- PNG thumbnails of an upload's image blobs
+CREATE TABLE IF NOT EXISTS thumbnails (
+  upload_id INTEGER NOT NULL,
+  blob TEXT NOT NULL,
+  data BLOB NOT NULL,
+  PRIMARY KEY(upload_id, blob)
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  hash TEXT NOT NULL UNIQUE,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  last_used_at DATETIME,
+  revoked_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT,
+  name TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(provider, subject)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+  hash TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  expires_at DATETIME NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS secrets (
+  name TEXT PRIMARY KEY,
+  value TEXT NOT NULL
+);
@@ -0,0 +1,59 @@
+package main
+
+// Diagnostics for profiling the server in place, such as where a large
+// ingest's memory goes. With GITVIS_DEBUG_ENDPOINTS on, admins get Go's
+// pprof profiles under /debug/pprof/ and runtime stats as expvar JSON at
+// /debug/vars. They are off by default: profiles show the server's
+// internals, and a CPU profile or execution trace slows it while running.
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+var debugEndpoints bool
+
+// handleDebug mounts the diagnostics on mux when they are on.
+func handleDebug(mux *http.ServeMux) {
+	if !debugEndpoints {
+		return
+	}
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("ingests", expvar.Func(func() interface{} {
+		return map[string]int64{"queued": ingestsQueued.Load(), "running": ingestsRunning.Load()}
+	}))
+	expvar.Publish("db", expvar.Func(func() interface{} { return db.Stats() }))
+
+	// no pprof cmdline: the command line can hold secrets
+	mux.Handle("/debug/pprof/", adminOnly(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/profile", adminOnly(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", adminOnly(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", adminOnly(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/debug/vars", adminOnly(http.HandlerFunc(debugVars)))
+}
+
+func adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requireAdmin(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// debugVars serves the expvar variables, as expvar.Handler does, less the
+// command line it publishes.
+func debugVars(w http.ResponseWriter, r *http.Request) {
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key != "cmdline" {
+			vars[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(vars)
+}
@@ -0,0 +1,428 @@
+package main
+
+// Dependency extraction: package manifests (go.mod, package.json,
+// requirements.txt, Cargo.toml, Gemfile, composer.json) are parsed at
+// ingest, and the dependencies view draws what the projects of a commit's
+// tree depend on.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// dependency is a package a manifest names. Dev is set for those only
+// needed to develop or test the project, Indirect for those go.mod lists
+// only because another dependency needs them.
+type dependency struct {
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	Ecosystem string `json:"ecosystem"`
+	Dev       bool   `json:"dev,omitempty"`
+	Indirect  bool   `json:"indirect,omitempty"`
+}
+
+// manifestParser returns the dependencies a manifest's text lists.
+type manifestParser func(name, text string) []dependency
+
+// manifestParsers are the manifests read, by file name; see
+// manifestParserFor for requirements files.
+var manifestParsers = map[string]manifestParser{
+	"go.mod":        parseGoMod,
+	"package.json":  parsePackageJSON,
+	"Cargo.toml":    parseCargoToml,
+	"Gemfile":       parseGemfile,
+	"composer.json": parseComposerJSON,
+}
+
+// manifestParserFor returns the parser for a file name, or nil if it
+// isn't a manifest. Python projects split requirements across files like
+// requirements-dev.txt, so any requirements*.txt counts.
+func manifestParserFor(name string) manifestParser {
+	if p := manifestParsers[name]; p != nil {
+		return p
+	}
+	if strings.HasPrefix(name, "requirements") && strings.HasSuffix(name, ".txt") {
+		return parseRequirements
+	}
+	return nil
+}
+
+// parseGoMod reads the require directives of a go.mod, single or in a
+// block.
+func parseGoMod(_, text string) []dependency {
+	var deps []dependency
+	inBlock := false
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		indirect := strings.HasSuffix(line, "// indirect")
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case line == "require (":
+			inBlock = true
+			continue
+		case strings.HasPrefix(line, "require "):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "require "))
+		case !inBlock:
+			continue
+		}
+		if f := strings.Fields(line); len(f) == 2 {
+			deps = append(deps, dependency{Name: f[0], Version: f[1], Ecosystem: "go", Indirect: indirect})
+		}
+	}
+	return deps
+}
+
+// jsonDependencies lists a manifest's name-to-version map, sorted by name.
+func jsonDependencies(m map[string]string, ecosystem string, dev bool) []dependency {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	deps := make([]dependency, 0, len(names))
+	for _, n := range names {
+		deps = append(deps, dependency{Name: n, Version: m[n], Ecosystem: ecosystem, Dev: dev})
+	}
+	return deps
+}
+
+// parsePackageJSON reads an npm package.json's dependencies, with
+// devDependencies as dev ones.
+func parsePackageJSON(_, text string) []dependency {
+	var pkg struct {
+		Dependencies         map[string]string `json:"dependencies"`
+		OptionalDependencies map[string]string `json:"optionalDependencies"`
+		PeerDependencies     map[string]string `json:"peerDependencies"`
+		DevDependencies      map[string]string `json:"devDependencies"`
+	}
+	if json.Unmarshal([]byte(text), &pkg) != nil {
+		return nil
+	}
+	deps := jsonDependencies(pkg.Dependencies, "npm", false)
+	deps = append(deps, jsonDependencies(pkg.OptionalDependencies, "npm", false)...)
+	deps = append(deps, jsonDependencies(pkg.PeerDependencies, "npm", false)...)
+	return append(deps, jsonDependencies(pkg.DevDependencies, "npm", true)...)
+}
+
+// parseComposerJSON reads a PHP composer.json's require and require-dev,
+// leaving out the PHP version and extensions.
+func parseComposerJSON(_, text string) []dependency {
+	var pkg struct {
+		Require    map[string]string `json:"require"`
+		RequireDev map[string]string `json:"require-dev"`
+	}
+	if json.Unmarshal([]byte(text), &pkg) != nil {
+		return nil
+	}
+	var deps []dependency
+	for _, d := range append(jsonDependencies(pkg.Require, "packagist", false), jsonDependencies(pkg.RequireDev, "packagist", true)...) {
+		if d.Name != "php" && !strings.HasPrefix(d.Name, "ext-") {
+			deps = append(deps, d)
+		}
+	}
+	return deps
+}
+
+// requirement matches a requirements.txt line: a package, its extras and
+// a version specifier such as ">=2.0,<3".
+var requirement = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)\s*(?:\[[^\]]*\])?\s*(.*)$`)
+
+// parseRequirements reads a pip requirements file. Options such as -r and
+// -e lines are skipped, and files named for development or tests hold
+// dev dependencies.
+func parseRequirements(name, text string) []dependency {
+	dev := strings.Contains(name, "dev") || strings.Contains(name, "test")
+	var deps []dependency
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		// environment markers, as in pywin32; sys_platform == "win32"
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if m := requirement.FindStringSubmatch(line); m != nil {
+			deps = append(deps, dependency{Name: strings.ToLower(m[1]), Version: strings.ReplaceAll(m[2], " ", ""), Ecosystem: "pypi", Dev: dev})
+		}
+	}
+	return deps
+}
+
+var (
+	// cargoSection matches a Cargo.toml table header naming dependencies,
+	// target-specific ones included, or one dependency as its own table
+	cargoSection = regexp.MustCompile(`^\[(?:target\..+\.)?(dependencies|dev-dependencies|build-dependencies)(?:\.([A-Za-z0-9_-]+))?\]$`)
+	cargoEntry   = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+	cargoVersion = regexp.MustCompile(`version\s*=\s*"([^"]*)"`)
+)
+
+// parseCargoToml reads the dependency tables of a Rust Cargo.toml, with
+// dev-dependencies as dev ones. A dependency is given as a version string,
+// an inline table or a table of its own.
+func parseCargoToml(_, text string) []dependency {
+	var deps []dependency
+	section, dev := "", false
+	own := -1 // the dependency whose own table this is, if any
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section, own = "", -1
+			if m := cargoSection.FindStringSubmatch(line); m != nil {
+				section, dev = m[1], m[1] == "dev-dependencies"
+				if m[2] != "" {
+					deps = append(deps, dependency{Name: m[2], Ecosystem: "cargo", Dev: dev})
+					own = len(deps) - 1
+				}
+			}
+			continue
+		}
+		m := cargoEntry.FindStringSubmatch(line)
+		if section == "" || m == nil {
+			continue
+		}
+		if own >= 0 {
+			if m[1] == "version" {
+				deps[own].Version = strings.Trim(m[2], `"`)
+			}
+			continue
+		}
+		d := dependency{Name: m[1], Ecosystem: "cargo", Dev: dev}
+		if strings.HasPrefix(m[2], `"`) {
+			d.Version = strings.Trim(m[2], `"`)
+		} else if v := cargoVersion.FindStringSubmatch(m[2]); v != nil {
+			d.Version = v[1]
+		}
+		deps = append(deps, d)
+	}
+	return deps
+}
+
+var (
+	gemLine   = regexp.MustCompile(`^gem\s+['"]([^'"]+)['"](?:\s*,\s*['"]([^'"]+)['"])?`)
+	gemGroup  = regexp.MustCompile(`^group\s+(.*)\s+do$`)
+	devGroups = regexp.MustCompile(`:(?:development|test)\b`)
+)
+
+// parseGemfile reads the gem lines of a Ruby Gemfile; those in a
+// development or test group are dev dependencies.
+func parseGemfile(_, text string) []dependency {
+	var deps []dependency
+	dev := false
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if m := gemGroup.FindStringSubmatch(line); m != nil {
+			dev = devGroups.MatchString(m[1])
+			continue
+		}
+		if line == "end" {
+			dev = false
+			continue
+		}
+		if m := gemLine.FindStringSubmatch(line); m != nil {
+			deps = append(deps, dependency{Name: m[1], Version: m[2], Ecosystem: "rubygems", Dev: dev})
+		}
+	}
+	return deps
+}
+
+// storeDependencies parses the upload's manifest blobs and records what
+// they list as "dependencies" in their meta.
+func storeDependencies(ctx context.Context, r *git.Repository, uploadID int) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, label FROM nodes WHERE upload_id=? AND type='blob'", uploadID)
+	if err != nil {
+		return err
+	}
+	manifests := make(map[string]string)
+	for rows.Next() {
+		var id, label string
+		if err := rows.Scan(&id, &label); err != nil {
+			rows.Close()
+			return err
+		}
+		if manifestParserFor(label) != nil {
+			manifests[id] = label
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// a merge patch, where null removes the key
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_patch(COALESCE(NULLIF(meta,''),'{}'),?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, name := range manifests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		text, ok := blobText(r, plumbing.NewHash(id))
+		if !ok {
+			continue
+		}
+		patch := map[string]interface{}{"dependencies": nil}
+		if deps := manifestParserFor(name)(name, text); len(deps) > 0 {
+			patch["dependencies"] = deps
+		}
+		b, _ := json.Marshal(patch)
+		if _, err := stmt.ExecContext(ctx, string(b), uploadID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dependencyGraph draws what the projects in commit's tree depend on: a
+// "project" node per directory holding manifests, and a "package" node
+// per package they name, linked by "depends-on" or, for dev dependencies,
+// "dev-depends-on". A package carries the versions asked for, and is
+// "indirect" when no project needs it directly.
+func dependencyGraph(ctx context.Context, uploadID int, commit string) ([]graphNode, []graphLink, error) {
+	rows, err := db.QueryContext(ctx, `WITH RECURSIVE walk(id, type, path) AS (
+			SELECT target, 'tree', '' FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'
+			UNION
+			SELECT n.id, n.type, walk.path || '/' || n.label FROM walk
+			JOIN edges e ON e.upload_id=? AND e.source=walk.id AND e.rel IN ('tree->tree','tree->blob')
+			JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+			WHERE walk.type='tree'
+		)
+		SELECT DISTINCT walk.path, json_extract(n.meta,'$.dependencies') FROM walk
+		JOIN nodes n ON n.upload_id=? AND n.id=walk.id
+		WHERE walk.type='blob' AND json_extract(n.meta,'$.dependencies') IS NOT NULL
+		ORDER BY walk.path`, uploadID, commit, uploadID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	type pkg struct {
+		node     graphNode
+		versions map[string]bool
+		direct   bool
+	}
+	nodes, links := []graphNode{}, []graphLink{}
+	projects := make(map[string]int) // index in nodes
+	pkgs := make(map[string]*pkg)
+	var order []string
+	linked := make(map[[3]string]bool)
+	for rows.Next() {
+		var file, list string
+		if err := rows.Scan(&file, &list); err != nil {
+			return nil, nil, err
+		}
+		var deps []dependency
+		json.Unmarshal([]byte(list), &deps)
+		dir := path.Dir(file)
+		i, ok := projects[dir]
+		if !ok {
+			label := path.Base(dir)
+			if dir == "/" {
+				label = "/"
+			}
+			nodes = append(nodes, graphNode{ID: "project:" + dir, Type: "project", Label: label,
+				Extra: map[string]interface{}{"path": dir, "manifests": []string{}}})
+			i = len(nodes) - 1
+			projects[dir] = i
+		}
+		nodes[i].Extra["manifests"] = append(nodes[i].Extra["manifests"].([]string), file)
+		for _, d := range deps {
+			id := "package:" + d.Ecosystem + "/" + d.Name
+			p := pkgs[id]
+			if p == nil {
+				p = &pkg{node: graphNode{ID: id, Type: "package", Label: d.Name,
+					Extra: map[string]interface{}{"ecosystem": d.Ecosystem}}, versions: make(map[string]bool)}
+				pkgs[id] = p
+				order = append(order, id)
+			}
+			if d.Version != "" {
+				p.versions[d.Version] = true
+			}
+			p.direct = p.direct || !d.Indirect
+			l := graphLink{Source: "project:" + dir, Target: id, Rel: "depends-on"}
+			if d.Dev {
+				l.Rel = "dev-depends-on"
+			}
+			if key := [3]string{l.Source, l.Target, l.Rel}; !linked[key] {
+				linked[key] = true
+				links = append(links, l)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, id := range order {
+		p := pkgs[id]
+		versions := make([]string, 0, len(p.versions))
+		for v := range p.versions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		p.node.Extra["versions"] = versions
+		if !p.direct {
+			p.node.Extra["indirect"] = true
+		}
+		nodes = append(nodes, p.node)
+	}
+	return nodes, links, nil
+}
+
+// dependenciesJSON serves /graph/{id}/json?view=dependencies, for the tree
+// of the trunk branch's tip or of ?ref=, such as a release tag.
+func dependenciesJSON(w http.ResponseWriter, r *http.Request, uploadID int) {
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	commit, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	nodes, links, err := dependencyGraph(r.Context(), uploadID, commit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffMaxBytes bounds the patches of one diff response; files past it are
+// listed without theirs.
+const diffMaxBytes = 4 << 20
+
+// storedEntry is a tree entry as tree_entries records it.
+type storedEntry struct {
+	mode uint32
+	hash string
+}
+
+// storedTreeEntries reads the entries of a tree by name; tree "" is the
+// empty tree.
+func storedTreeEntries(ctx context.Context, uploadID int, tree string) (map[string]storedEntry, error) {
+	entries := make(map[string]storedEntry)
+	if tree == "" {
+		return entries, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name, mode, hash FROM tree_entries WHERE upload_id=? AND tree=?", uploadID, tree)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var e storedEntry
+		if err := rows.Scan(&name, &e.mode, &e.hash); err != nil {
+			return nil, err
+		}
+		entries[name] = e
+	}
+	return entries, rows.Err()
+}
+
+// fileChange is a file that differs between two trees; from is nil for a
+// file added and to for one deleted.
+type fileChange struct {
+	path     string
+	from, to *storedEntry
+}
+
+// diffStoredTrees finds the files that differ between the stored trees
+// from and to, either of which may be "" for the empty tree, descending
+// only into directories that differ.
+func diffStoredTrees(ctx context.Context, uploadID int, from, to, prefix string, changes *[]fileChange) error {
+	a, err := storedTreeEntries(ctx, uploadID, from)
+	if err != nil {
+		return err
+	}
+	b, err := storedTreeEntries(ctx, uploadID, to)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(a)+len(b))
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	for name := range names {
+		ea, inA := a[name]
+		eb, inB := b[name]
+		if inA && inB && ea == eb {
+			continue
+		}
+		aDir := inA && filemode.FileMode(ea.mode) == filemode.Dir
+		bDir := inB && filemode.FileMode(eb.mode) == filemode.Dir
+		if aDir || bDir {
+			fromSub, toSub := "", ""
+			if aDir {
+				fromSub = ea.hash
+			}
+			if bDir {
+				toSub = eb.hash
+			}
+			if err := diffStoredTrees(ctx, uploadID, fromSub, toSub, prefix+name+"/", changes); err != nil {
+				return err
+			}
+		}
+		c := fileChange{path: prefix + name}
+		if inA && !aDir {
+			c.from = &ea
+		}
+		if inB && !bDir {
+			c.to = &eb
+		}
+		if c.from != nil || c.to != nil {
+			*changes = append(*changes, c)
+		}
+	}
+	return nil
+}
+
+// storedPatch adapts a file's diff to go-git's patch interfaces, so its
+// unified encoder can write it.
+type storedPatch struct {
+	from, to fdiff.File
+	binary   bool
+	chunks   []fdiff.Chunk
+}
+
+func (p *storedPatch) FilePatches() []fdiff.FilePatch  { return []fdiff.FilePatch{p} }
+func (p *storedPatch) Message() string                 { return "" }
+func (p *storedPatch) IsBinary() bool                  { return p.binary }
+func (p *storedPatch) Files() (fdiff.File, fdiff.File) { return p.from, p.to }
+func (p *storedPatch) Chunks() []fdiff.Chunk           { return p.chunks }
+
+type storedFile struct {
+	path string
+	e    *storedEntry
+}
+
+func (f storedFile) Hash() plumbing.Hash     { return plumbing.NewHash(f.e.hash) }
+func (f storedFile) Mode() filemode.FileMode { return filemode.FileMode(f.e.mode) }
+func (f storedFile) Path() string            { return f.path }
+
+type storedChunk struct {
+	content string
+	op      fdiff.Operation
+}
+
+func (c storedChunk) Content() string       { return c.content }
+func (c storedChunk) Type() fdiff.Operation { return c.op }
+
+// diffFile is one file of the diff endpoint.
+type diffFile struct {
+	Path string `json:"path"`
+	// "added", "deleted" or "modified"
+	Status    string `json:"status"`
+	OldMode   string `json:"old_mode,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	OldBlob   string `json:"old_blob,omitempty"`
+	Blob      string `json:"blob,omitempty"`
+	Binary    bool   `json:"binary"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Patch     string `json:"patch,omitempty"`
+	// why there is no patch: "too large", "not stored" (uploads ingested
+	// before contents were kept) or "response limit"
+	Omitted string `json:"omitted,omitempty"`
+}
+
+// entryText is the text a tree entry diffs as: a blob's stored contents,
+// or for a submodule the commit it pins, as git shows it. ok is false when
+// nothing is stored.
+func entryText(ctx context.Context, uploadID int, e *storedEntry) (text string, binary, truncated, ok bool, err error) {
+	if e == nil {
+		return "", false, false, true, nil
+	}
+	if filemode.FileMode(e.mode) == filemode.Submodule {
+		return "Subproject commit " + e.hash + "\n", false, false, true, nil
+	}
+	err = db.QueryRowContext(ctx, "SELECT text, binary, truncated FROM blob_texts WHERE upload_id=? AND blob=?",
+		uploadID, e.hash).Scan(&text, &binary, &truncated)
+	if err == sql.ErrNoRows {
+		return "", false, false, false, nil
+	}
+	return text, binary, truncated, err == nil, err
+}
+
+// newDiffFile describes a changed file, without its patch.
+func newDiffFile(c fileChange) diffFile {
+	f := diffFile{Path: c.path, Status: "modified"}
+	switch {
+	case c.from == nil:
+		f.Status = "added"
+	case c.to == nil:
+		f.Status = "deleted"
+	}
+	if c.from != nil {
+		f.OldMode, f.OldBlob = fmt.Sprintf("%06o", c.from.mode), c.from.hash
+	}
+	if c.to != nil {
+		f.Mode, f.Blob = fmt.Sprintf("%06o", c.to.mode), c.to.hash
+	}
+	return f
+}
+
+// fileDiff describes a changed file with its patch, or why it has none.
+func fileDiff(ctx context.Context, uploadID int, c fileChange) (diffFile, error) {
+	f := newDiffFile(c)
+	src, srcBinary, srcCut, srcOK, err := entryText(ctx, uploadID, c.from)
+	if err != nil {
+		return f, err
+	}
+	dst, dstBinary, dstCut, dstOK, err := entryText(ctx, uploadID, c.to)
+	if err != nil {
+		return f, err
+	}
+	switch {
+	case !srcOK || !dstOK:
+		f.Omitted = "not stored"
+		return f, nil
+	case srcCut || dstCut:
+		f.Omitted = "too large"
+		return f, nil
+	}
+	p := &storedPatch{binary: srcBinary || dstBinary}
+	if c.from != nil {
+		p.from = storedFile{c.path, c.from}
+	}
+	if c.to != nil {
+		p.to = storedFile{c.path, c.to}
+	}
+	f.Binary = p.binary
+	if !p.binary {
+		for _, d := range diff.Do(src, dst) {
+			switch d.Type {
+			case diffmatchpatch.DiffEqual:
+				p.chunks = append(p.chunks, storedChunk{d.Text, fdiff.Equal})
+			case diffmatchpatch.DiffInsert:
+				p.chunks = append(p.chunks, storedChunk{d.Text, fdiff.Add})
+				f.Additions += lineCount(d.Text)
+			case diffmatchpatch.DiffDelete:
+				p.chunks = append(p.chunks, storedChunk{d.Text, fdiff.Delete})
+				f.Deletions += lineCount(d.Text)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := fdiff.NewUnifiedEncoder(&buf, fdiff.DefaultContextLines).Encode(p); err != nil {
+		return f, err
+	}
+	f.Patch = buf.String()
+	return f, nil
+}
+
+// diffHandler serves /graph/{id}/diff?from=&to=: the files that differ
+// between two commits (or branches or tags), each with a unified diff as
+// git writes it. Binary files are marked and not diffed, files of which
+// only the first 1 MiB is kept are listed without a patch, and once the
+// patches reach 4 MiB the rest are listed without theirs. ?format=patch
+// returns just the patches, as text.
+func diffHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	q := r.URL.Query()
+	from, err := resolveCommit(r.Context(), uploadID, q.Get("from"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("from: %v", err), 400)
+		return
+	}
+	to, err := resolveCommit(r.Context(), uploadID, q.Get("to"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("to: %v", err), 400)
+		return
+	}
+	var trees [2]string
+	for i, c := range []string{from, to} {
+		if err := db.QueryRowContext(r.Context(), "SELECT target FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'",
+			uploadID, c).Scan(&trees[i]); err != nil {
+			http.Error(w, fmt.Sprintf("commit %s has no tree", c), 404)
+			return
+		}
+	}
+	var changes []fileChange
+	if err := diffStoredTrees(r.Context(), uploadID, trees[0], trees[1], "", &changes); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+
+	files := make([]diffFile, 0, len(changes))
+	total, truncated := 0, false
+	for _, c := range changes {
+		if total >= diffMaxBytes {
+			truncated = true
+			f := newDiffFile(c)
+			f.Omitted = "response limit"
+			files = append(files, f)
+			continue
+		}
+		f, err := fileDiff(r.Context(), uploadID, c)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		total += len(f.Patch)
+		files = append(files, f)
+	}
+	if q.Get("format") == "patch" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, f := range files {
+			if f.Patch == "" {
+				fmt.Fprintf(w, "diff --git a/%s b/%s\n(%s)\n", f.Path, f.Path, f.Omitted)
+				continue
+			}
+			w.Write([]byte(f.Patch))
+		}
+		return
+	}
+	var additions, deletions int
+	for _, f := range files {
+		additions += f.Additions
+		deletions += f.Deletions
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":      from,
+		"to":        to,
+		"files":     files,
+		"additions": additions,
+		"deletions": deletions,
+		"truncated": truncated,
+	})
+}
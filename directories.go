@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// dirNode is a directory of the directories view while it is built.
+type dirNode struct {
+	label string
+	meta  map[string]interface{}
+}
+
+// directoryGraph rolls the tree of commit up into directories: one "dir"
+// node per directory path, with the files and size below it and the
+// number of commits that changed something below it as "changes", and
+// "contains" links from each directory to its subdirectories. depth limits
+// how far below the root it goes; -1 for no limit.
+func directoryGraph(ctx context.Context, uploadID int, commit string, depth int) ([]graphNode, []graphLink, error) {
+	var root string
+	err := db.QueryRowContext(ctx, "SELECT target FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'", uploadID, commit).Scan(&root)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs := make(map[string]*dirNode)
+	children := make(map[string][]string)
+	rows, err := db.QueryContext(ctx, `WITH RECURSIVE sub(id) AS (
+			SELECT ?
+			UNION
+			SELECT e.target FROM edges e JOIN sub ON e.source=sub.id WHERE e.upload_id=? AND e.rel='tree->tree'
+		)
+		SELECT n.id, n.label, n.meta, COALESCE(e.source,'') FROM sub
+		JOIN nodes n ON n.upload_id=? AND n.id=sub.id
+		LEFT JOIN edges e ON e.upload_id=n.upload_id AND e.target=n.id AND e.rel='tree->tree' AND e.source IN (SELECT id FROM sub)`,
+		root, uploadID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var id, label, metaStr, parent string
+		if err := rows.Scan(&id, &label, &metaStr, &parent); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if dirs[id] == nil {
+			d := &dirNode{label: label}
+			json.Unmarshal([]byte(metaStr), &d.meta)
+			dirs[id] = d
+		}
+		if parent != "" {
+			children[parent] = append(children[parent], id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// commits that changed each directory, counted by the churn pass
+	changes := make(map[string]int)
+	rows, err = db.QueryContext(ctx, `SELECT json_extract(meta,'$.path'), MAX(json_extract(meta,'$.churn')) FROM nodes
+		WHERE upload_id=? AND type='tree' AND json_extract(meta,'$.churn') IS NOT NULL GROUP BY 1`, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var p string
+		var n int
+		if err := rows.Scan(&p, &n); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		changes[p] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	nodes, links := []graphNode{}, []graphLink{}
+	// identical directories share a tree, so one tree can turn up at
+	// several paths; each is a node of its own
+	var walk func(id, p string, level int)
+	walk = func(id, p string, level int) {
+		d := dirs[id]
+		label := path.Base(p)
+		if p == "/" {
+			label = "/"
+		}
+		extra := map[string]interface{}{"path": p}
+		for _, k := range []string{"files", "size"} {
+			if v, ok := d.meta[k]; ok {
+				extra[k] = v
+			}
+		}
+		if n, ok := changes[p]; ok {
+			extra["changes"] = n
+		}
+		nodes = append(nodes, graphNode{ID: "dir:" + p, Type: "dir", Label: label, Extra: extra})
+		if depth >= 0 && level >= depth {
+			return
+		}
+		for _, c := range children[id] {
+			if dirs[c] == nil {
+				continue
+			}
+			cp := path.Join(p, dirs[c].label)
+			links = append(links, graphLink{Source: "dir:" + p, Target: "dir:" + cp, Rel: "contains"})
+			walk(c, cp, level+1)
+		}
+	}
+	walk(root, "/", 0)
+	return nodes, links, nil
+}
+
+// directoriesJSON serves /graph/{id}/json?view=directories, for the tree
+// of the trunk branch's tip or of ?ref=, to ?tree_depth= levels.
+func directoriesJSON(w http.ResponseWriter, r *http.Request, uploadID int) {
+	depth := -1
+	if s := r.URL.Query().Get("tree_depth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "tree_depth must be a non-negative number", 400)
+			return
+		}
+		depth = n
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	commit, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	nodes, links, err := directoryGraph(r.Context(), uploadID, commit, depth)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Ingest bookkeeping so a hash computed while the graph is changing never
+// gets cached: graphGen is bumped whenever an ingest starts or ends.
+var (
+	graphGenMu   sync.Mutex
+	graphGen     = make(map[int]int)
+	graphIngests = make(map[int]int)
+)
+
+// beginGraphChange marks an upload's graph as being rewritten; call the
+// returned function when done.
+func beginGraphChange(uploadID int) func() {
+	bump := func(delta int) {
+		graphGenMu.Lock()
+		defer graphGenMu.Unlock()
+		graphGen[uploadID]++
+		graphIngests[uploadID] += delta
+		db.Exec("UPDATE uploads SET graph_hash=NULL WHERE id=?", uploadID)
+	}
+	bump(1)
+	return func() { bump(-1) }
+}
+
+// graphHash returns a content hash of an upload's nodes and edges. It is
+// computed on first use and cached in uploads.graph_hash until the next
+// ingest into the upload clears it.
+func graphHash(ctx context.Context, uploadID int) (string, error) {
+	var cached sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT graph_hash FROM uploads WHERE id=?", uploadID).Scan(&cached); err != nil {
+		return "", err
+	}
+	if cached.Valid && cached.String != "" {
+		return cached.String, nil
+	}
+
+	graphGenMu.Lock()
+	gen, busy := graphGen[uploadID], graphIngests[uploadID] > 0
+	graphGenMu.Unlock()
+
+	h := sha256.New()
+	rows, err := db.QueryContext(ctx, "SELECT id,type,label,meta FROM nodes WHERE upload_id=? ORDER BY id", uploadID)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var id, typ, label, meta string
+		rows.Scan(&id, &typ, &label, &meta)
+		fmt.Fprintf(h, "n\x00%s\x00%s\x00%s\x00%s\n", id, typ, label, meta)
+	}
+	rows.Close()
+	// a cancelled scan must not be cached as the hash
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	rows, err = db.QueryContext(ctx, "SELECT source,target,rel FROM edges WHERE upload_id=? ORDER BY source,target,rel", uploadID)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var src, tgt, rel string
+		rows.Scan(&src, &tgt, &rel)
+		fmt.Fprintf(h, "e\x00%s\x00%s\x00%s\n", src, tgt, rel)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))[:32]
+	graphGenMu.Lock()
+	if !busy && graphGen[uploadID] == gen {
+		db.Exec("UPDATE uploads SET graph_hash=? WHERE id=?", sum, uploadID)
+	}
+	graphGenMu.Unlock()
+	return sum, nil
+}
+
+// notModified sets the ETag for an upload's graph response and, if the
+// request's If-None-Match already matches it, answers 304 and returns true.
+// The query string is folded into the tag since it selects the view.
+func notModified(w http.ResponseWriter, r *http.Request, uploadID int) bool {
+	sum, err := graphHash(r.Context(), uploadID)
+	if err != nil {
+		// no tag is better than failing the request
+		return false
+	}
+	if q := r.URL.RawQuery; q != "" {
+		qs := sha256.Sum256([]byte(q))
+		sum += "-" + hex.EncodeToString(qs[:4])
+	}
+	etag := `"` + sum + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// graphEvent is a change to an upload's stored graph. Kind is "node" (an
+// added or updated node), "link", "unlink" or "ingested" (an ingest finished).
+// Streams also carry a final "overflow" event when a listener fell behind.
+type graphEvent struct {
+	Kind string
+	Data interface{}
+}
+
+// graphSub is one event stream listener. lost is closed if the listener
+// falls so far behind that deltas had to be dropped.
+type graphSub struct {
+	ch       chan graphEvent
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+var (
+	graphSubsMu sync.Mutex
+	graphSubs   = make(map[int]map[*graphSub]struct{})
+)
+
+// watchingGraph reports whether anyone is subscribed to an upload's events,
+// so ingest can skip the extra work of computing deltas when nobody is.
+func watchingGraph(uploadID int) bool {
+	graphSubsMu.Lock()
+	defer graphSubsMu.Unlock()
+	return len(graphSubs[uploadID]) > 0
+}
+
+func publishGraphEvent(uploadID int, kind string, data interface{}) {
+	graphSubsMu.Lock()
+	defer graphSubsMu.Unlock()
+	for sub := range graphSubs[uploadID] {
+		select {
+		case sub.ch <- graphEvent{Kind: kind, Data: data}:
+		default:
+			sub.lostOnce.Do(func() { close(sub.lost) })
+		}
+	}
+}
+
+func subscribeGraph(uploadID int) *graphSub {
+	sub := &graphSub{ch: make(chan graphEvent, 1024), lost: make(chan struct{})}
+	graphSubsMu.Lock()
+	defer graphSubsMu.Unlock()
+	if graphSubs[uploadID] == nil {
+		graphSubs[uploadID] = make(map[*graphSub]struct{})
+	}
+	graphSubs[uploadID][sub] = struct{}{}
+	return sub
+}
+
+func unsubscribeGraph(uploadID int, sub *graphSub) {
+	graphSubsMu.Lock()
+	defer graphSubsMu.Unlock()
+	delete(graphSubs[uploadID], sub)
+	if len(graphSubs[uploadID]) == 0 {
+		delete(graphSubs, uploadID)
+	}
+}
+
+// graphEventsHandler serves GET /graph/{id}/events as a Server-Sent Events
+// stream of graph deltas.
+func graphEventsHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+
+	sub := subscribeGraph(uploadID)
+	defer unsubscribeGraph(uploadID, sub)
+	streaming(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-sub.lost:
+			// deltas were dropped; the client has to reload the full graph
+			fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-sub.ch:
+			data, _ := json.Marshal(ev.Data)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// refreshHandler serves POST /graph/{id}/refresh: a new archive of the same
+// repository is ingested into the existing upload in the background, and
+// the resulting deltas are published to the upload's event stream.
+func refreshHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != "POST" {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !uploadLimiter.allow(w, r) {
+		return
+	}
+	if isShuttingDown() {
+		uploadFailed(w, errShuttingDown)
+		return
+	}
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	var exists int
+	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM uploads WHERE id=?", uploadID).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if exists == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	f, _, err := r.FormFile("repo")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	defer f.Close()
+	tmp, err := os.CreateTemp(tempDir(), "repo-*.zip")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer tmp.Close()
+	size, err := saveUpload(tmp, f)
+	if err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	if err := resizeUpload(uploadID, size); err != nil {
+		uploadFailed(w, err)
+		return
+	}
+
+	j := newJob(uploadID)
+	zipPath := tmp.Name()
+	go func() {
+		j.finish(ingestInto(context.WithoutCancel(r.Context()), zipPath, uploadID, j))
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job":    uploadID,
+		"events": sitePath(fmt.Sprintf("/ws/jobs/%d", uploadID)),
+	})
+}
@@ -0,0 +1,619 @@
+package main
+
+// Graph exports, served as /graph/{id}/export/{format}. Each exporter
+// streams the stored nodes and edges in the target format.
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/gitvis/pkg/api"
+	"github.com/example/gitvis/pkg/store"
+)
+
+// nodeColors matches the colors of the graph page.
+var nodeColors = map[string]string{
+	"commit": "steelblue",
+	"tree":   "green",
+	"blob":   "orange",
+	"ref":    "purple",
+}
+
+// eachNode calls fn for every node of an upload, in id order.
+func eachNode(ctx context.Context, uploadID int, fn func(graphNode) error) error {
+	return graphStore.EachNode(ctx, uploadID, func(n store.Node) error {
+		return fn(api.MakeNode(n.ID, n.Type, n.Label, n.Meta))
+	})
+}
+
+// eachEdge calls fn for every edge of an upload, in insertion order.
+func eachEdge(ctx context.Context, uploadID int, fn func(graphLink) error) error {
+	return graphStore.EachEdge(ctx, uploadID, func(e store.Edge) error {
+		return fn(graphLink{Source: e.Source, Target: e.Target, Rel: e.Rel})
+	})
+}
+
+// exporter wraps the part common to every export: parsing the ID,
+// conditional GET, headers and a buffered writer. write runs after the
+// headers are sent, so its errors can only be logged.
+func exporter(ext, contentType string, write func(ctx context.Context, bw *bufio.Writer, uploadID int) error) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, idStr string) {
+		uploadID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "bad id", 400)
+			return
+		}
+		if notModified(w, r, uploadID) {
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="upload-%d.%s"`, uploadID, ext))
+		bw := bufio.NewWriterSize(w, 64<<10)
+		defer bw.Flush()
+		if err := write(r.Context(), bw, uploadID); err != nil {
+			slog.ErrorContext(r.Context(), "export", "format", ext, "upload_id", uploadID, "err", err)
+		}
+	}
+}
+
+// exportFormats are the formats the export command writes, by name, with
+// the extension of the files they are written to.
+var exportFormats = map[string]struct {
+	ext   string
+	write func(ctx context.Context, bw *bufio.Writer, uploadID int) error
+}{
+	"json":      {"json", writeJSON},
+	"dot":       {"dot", writeDOT},
+	"graphml":   {"graphml", writeGraphML},
+	"gexf":      {"gexf", writeGEXF},
+	"cytoscape": {"cyjs", writeCytoscape},
+	"mermaid": {"mmd", func(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+		return writeMermaid(ctx, bw, uploadID, 0)
+	}},
+	"nodes.csv": {"nodes.csv", writeNodesCSV},
+	"edges.csv": {"edges.csv", writeEdgesCSV},
+	"ndjson":    {"ndjson", writeNDJSON},
+	"cypher":    {"cypher", writeCypher},
+	"sqlite":    {"db", writeSQLite},
+}
+
+// uploadName returns an upload's name, or "upload {id}" if it has none.
+func uploadName(ctx context.Context, uploadID int) string {
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(name,'') FROM uploads WHERE id=?", uploadID).Scan(&name); err != nil || name == "" {
+		return fmt.Sprintf("upload %d", uploadID)
+	}
+	return name
+}
+
+// ---- Graphviz DOT ----
+
+var dotShapes = map[string]string{
+	"commit": "circle",
+	"tree":   "folder",
+	"blob":   "note",
+	"ref":    "cds",
+}
+
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", "")
+	return `"` + r.Replace(s) + `"`
+}
+
+func writeDOT(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	fmt.Fprintf(bw, "digraph %s {\n", dotQuote(uploadName(ctx, uploadID)))
+	bw.WriteString("  rankdir=RL;\n  node [style=filled, fontname=\"Helvetica\", fontsize=10, fontcolor=white];\n  edge [fontsize=8, color=\"#999999\"];\n")
+	err := eachNode(ctx, uploadID, func(n graphNode) error {
+		label := n.Label
+		if n.Type == "commit" {
+			// a full message makes an unreadable circle
+			label = n.ID[:7]
+		}
+		tooltip := n.Label
+		if a, ok := n.Extra["author"].(string); ok && a != "" {
+			tooltip += "\n" + a
+		}
+		_, err := fmt.Fprintf(bw, "  %s [label=%s, shape=%s, fillcolor=%s, tooltip=%s, type=%s];\n",
+			dotQuote(n.ID), dotQuote(label), dotShapes[n.Type], nodeColors[n.Type], dotQuote(tooltip), n.Type)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		_, err := fmt.Fprintf(bw, "  %s -> %s [rel=%s];\n", dotQuote(l.Source), dotQuote(l.Target), dotQuote(l.Rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = bw.WriteString("}\n")
+	return err
+}
+
+// ---- GraphML ----
+
+// graphMLKeys are the node attributes written as GraphML data, in order.
+var graphMLKeys = []struct{ id, name string }{
+	{"type", "type"},
+	{"label", "label"},
+	{"author", "author"},
+	{"email", "email"},
+	{"date", "date"},
+	{"filename", "filename"},
+	{"kind", "kind"},
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeGraphML(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	bw.WriteString(xml.Header)
+	bw.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://graphml.graphdrawing.org/xmlns http://graphml.graphdrawing.org/xmlns/1.0/graphml.xsd">` + "\n")
+	for _, k := range graphMLKeys {
+		fmt.Fprintf(bw, `  <key id="%s" for="node" attr.name="%s" attr.type="string"/>`+"\n", k.id, k.name)
+	}
+	bw.WriteString(`  <key id="rel" for="edge" attr.name="rel" attr.type="string"/>` + "\n")
+	fmt.Fprintf(bw, `  <graph id="upload-%d" edgedefault="directed">`+"\n", uploadID)
+	err := eachNode(ctx, uploadID, func(n graphNode) error {
+		fmt.Fprintf(bw, `    <node id="%s">`+"\n", xmlEscape(n.ID))
+		for _, k := range graphMLKeys {
+			v := ""
+			switch k.id {
+			case "type":
+				v = n.Type
+			case "label":
+				v = n.Label
+			default:
+				v, _ = n.Extra[k.id].(string)
+			}
+			if v != "" {
+				fmt.Fprintf(bw, `      <data key="%s">%s</data>`+"\n", k.id, xmlEscape(v))
+			}
+		}
+		_, err := bw.WriteString("    </node>\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	n := 0
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		n++
+		_, err := fmt.Fprintf(bw, `    <edge id="e%d" source="%s" target="%s"><data key="rel">%s</data></edge>`+"\n",
+			n, xmlEscape(l.Source), xmlEscape(l.Target), xmlEscape(l.Rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = bw.WriteString("  </graph>\n</graphml>\n")
+	return err
+}
+
+// ---- GEXF ----
+
+var gexfColors = map[string][3]int{
+	"commit": {70, 130, 180}, // steelblue
+	"tree":   {0, 128, 0},
+	"blob":   {255, 165, 0},
+	"ref":    {128, 0, 128},
+}
+
+// firstSeen dates every node of an upload: commits and refs by their own
+// date, trees and blobs by the earliest commit whose snapshot contains
+// them. The edges are held in memory while it works.
+func firstSeen(ctx context.Context, uploadID int) (map[string]time.Time, error) {
+	seen := make(map[string]time.Time)
+	commits, err := loadCommits(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, json_extract(meta,'$.date') FROM nodes WHERE upload_id=? AND type='ref'", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		var date sql.NullString
+		if err := rows.Scan(&id, &date); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, date.String); err == nil {
+			seen[id] = t
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	children := make(map[string][]string)
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		if l.Rel == "commit->tree" || l.Rel == "tree->tree" || l.Rel == "tree->blob" {
+			children[l.Source] = append(children[l.Source], l.Target)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// visiting commits oldest first, anything not yet dated first appeared
+	// in the current commit
+	sort.Slice(commits, func(i, j int) bool { return commits[i].When.Before(commits[j].When) })
+	for _, c := range commits {
+		if c.When.IsZero() {
+			continue
+		}
+		seen[c.Hash] = c.When
+		stack := append([]string(nil), children[c.Hash]...)
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = c.When
+			stack = append(stack, children[id]...)
+		}
+	}
+	return seen, nil
+}
+
+func writeGEXF(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	seen, err := firstSeen(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	start := func(id string) string {
+		if t, ok := seen[id]; ok {
+			return fmt.Sprintf(` start="%s"`, t.UTC().Format(time.RFC3339))
+		}
+		return ""
+	}
+
+	bw.WriteString(xml.Header)
+	bw.WriteString(`<gexf xmlns="http://gexf.net/1.3" xmlns:viz="http://gexf.net/1.3/viz" version="1.3">` + "\n")
+	fmt.Fprintf(bw, "  <meta><creator>git-viz</creator><description>%s</description></meta>\n", xmlEscape(uploadName(ctx, uploadID)))
+	bw.WriteString(`  <graph mode="dynamic" defaultedgetype="directed" timeformat="dateTime">` + "\n")
+	bw.WriteString(`    <attributes class="node">
+      <attribute id="type" title="type" type="string"/>
+      <attribute id="author" title="author" type="string"/>
+      <attribute id="email" title="email" type="string"/>
+      <attribute id="filename" title="filename" type="string"/>
+      <attribute id="kind" title="kind" type="string"/>
+    </attributes>
+    <attributes class="edge">
+      <attribute id="rel" title="rel" type="string"/>
+    </attributes>
+    <nodes>
+`)
+	err = eachNode(ctx, uploadID, func(n graphNode) error {
+		fmt.Fprintf(bw, `      <node id="%s" label="%s"%s><attvalues>`, xmlEscape(n.ID), xmlEscape(n.Label), start(n.ID))
+		fmt.Fprintf(bw, `<attvalue for="type" value="%s"/>`, n.Type)
+		for _, k := range []string{"author", "email", "filename", "kind"} {
+			if v, _ := n.Extra[k].(string); v != "" {
+				fmt.Fprintf(bw, `<attvalue for="%s" value="%s"/>`, k, xmlEscape(v))
+			}
+		}
+		bw.WriteString("</attvalues>")
+		if c, ok := gexfColors[n.Type]; ok {
+			fmt.Fprintf(bw, `<viz:color r="%d" g="%d" b="%d"/>`, c[0], c[1], c[2])
+		}
+		_, err := bw.WriteString("</node>\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString("    </nodes>\n    <edges>\n")
+	n := 0
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		n++
+		// an edge exists from the moment its source does
+		_, err := fmt.Fprintf(bw, `      <edge id="e%d" source="%s" target="%s"%s><attvalues><attvalue for="rel" value="%s"/></attvalues></edge>`+"\n",
+			n, xmlEscape(l.Source), xmlEscape(l.Target), start(l.Source), xmlEscape(l.Rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = bw.WriteString("    </edges>\n  </graph>\n</gexf>\n")
+	return err
+}
+
+// ---- Cytoscape.js ----
+
+// writeCytoscape emits {"elements":{"nodes":[...],"edges":[...]}}, which
+// cy.add(), cy.json() and Cytoscape desktop's .cyjs import all accept.
+// Node data carries the same fields as the graph JSON's extra.
+func writeCytoscape(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	enc := json.NewEncoder(bw)
+	bw.WriteString(`{"elements":{"nodes":[`)
+	first := true
+	err := eachNode(ctx, uploadID, func(n graphNode) error {
+		data := map[string]interface{}{"id": n.ID, "type": n.Type, "label": n.Label}
+		for k, v := range n.Extra {
+			if v != nil {
+				data[k] = v
+			}
+		}
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		return enc.Encode(map[string]interface{}{"data": data, "classes": n.Type})
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString(`],"edges":[`)
+	i := 0
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		i++
+		return enc.Encode(map[string]interface{}{"data": map[string]string{
+			"id": fmt.Sprintf("e%d", i), "source": l.Source, "target": l.Target, "rel": l.Rel,
+		}})
+	})
+	if err != nil {
+		return err
+	}
+	_, err = bw.WriteString("]}}\n")
+	return err
+}
+
+// ---- JSON ----
+
+// writeJSON writes the whole graph in the form of /graph/{id}/json, as
+// {"nodes": [...], "links": [...]}.
+func writeJSON(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	enc := json.NewEncoder(bw)
+	bw.WriteString(`{"nodes":[`)
+	n := 0
+	err := eachNode(ctx, uploadID, func(node graphNode) error {
+		if n++; n > 1 {
+			bw.WriteByte(',')
+		}
+		return enc.Encode(node)
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString(`],"links":[`)
+	n = 0
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		if n++; n > 1 {
+			bw.WriteByte(',')
+		}
+		return enc.Encode(l)
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString("]}\n")
+	return nil
+}
+
+// ---- CSV ----
+
+var nodeCSVColumns = []string{"id", "type", "label", "author", "email", "date", "filename", "kind"}
+
+func writeNodesCSV(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	cw := csv.NewWriter(bw)
+	cw.Write(nodeCSVColumns)
+	err := eachNode(ctx, uploadID, func(n graphNode) error {
+		rec := []string{n.ID, n.Type, n.Label}
+		for _, k := range nodeCSVColumns[3:] {
+			v, _ := n.Extra[k].(string)
+			rec = append(rec, v)
+		}
+		return cw.Write(rec)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeEdgesCSV(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	cw := csv.NewWriter(bw)
+	cw.Write([]string{"source", "target", "rel"})
+	err := eachEdge(ctx, uploadID, func(l graphLink) error {
+		return cw.Write([]string{l.Source, l.Target, l.Rel})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ---- NDJSON ----
+
+// writeNDJSON writes one {"node": ...} line per node, then one
+// {"edge": ...} line per edge, each in the JSON form of /graph/{id}/json.
+func writeNDJSON(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	enc := json.NewEncoder(bw)
+	err := eachNode(ctx, uploadID, func(n graphNode) error {
+		return enc.Encode(struct {
+			Node graphNode `json:"node"`
+		}{n})
+	})
+	if err != nil {
+		return err
+	}
+	return eachEdge(ctx, uploadID, func(l graphLink) error {
+		return enc.Encode(struct {
+			Edge graphLink `json:"edge"`
+		}{l})
+	})
+}
+
+// ---- Neo4j Cypher ----
+
+var cypherLabels = map[string]string{
+	"commit": "Commit",
+	"tree":   "Tree",
+	"blob":   "Blob",
+	"ref":    "Ref",
+}
+
+var cypherRels = map[string]string{
+	"parent":       "PARENT",
+	"commit->tree": "HAS_TREE",
+	"tree->tree":   "CONTAINS",
+	"tree->blob":   "CONTAINS",
+	"ref->commit":  "POINTS_TO",
+}
+
+// cypherBatch is how many statements go in one transaction.
+const cypherBatch = 1000
+
+func cypherQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`)
+	return "'" + r.Replace(s) + "'"
+}
+
+// cypherRel turns a rel name nobody mapped into a relationship type.
+func cypherRel(rel string) string {
+	if t, ok := cypherRels[rel]; ok {
+		return t
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, rel)
+}
+
+// writeCypher writes a script for cypher-shell. Every node also gets the
+// GitObject label, whose unique id makes the edge MATCHes index lookups.
+func writeCypher(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	fmt.Fprintf(bw, "// %s\n", strings.ReplaceAll(uploadName(ctx, uploadID), "\n", " "))
+	bw.WriteString("CREATE CONSTRAINT gitvis_id IF NOT EXISTS FOR (n:GitObject) REQUIRE n.id IS UNIQUE;\n")
+	n := 0
+	statement := func(format string, args ...interface{}) error {
+		if n%cypherBatch == 0 {
+			if n > 0 {
+				bw.WriteString(":commit\n")
+			}
+			bw.WriteString(":begin\n")
+		}
+		n++
+		_, err := fmt.Fprintf(bw, format, args...)
+		return err
+	}
+
+	err := eachNode(ctx, uploadID, func(node graphNode) error {
+		props := "id: " + cypherQuote(node.ID)
+		if node.Label != "" {
+			props += ", label: " + cypherQuote(node.Label)
+		}
+		keys := make([]string, 0, len(node.Extra))
+		for k := range node.Extra {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch v := node.Extra[k].(type) {
+			case string:
+				props += ", " + k + ": " + cypherQuote(v)
+			case float64:
+				props += fmt.Sprintf(", %s: %v", k, v)
+			}
+		}
+		label := cypherLabels[node.Type]
+		if label == "" {
+			label = "Object"
+		}
+		return statement("CREATE (:GitObject:%s {%s});\n", label, props)
+	})
+	if err != nil {
+		return err
+	}
+	err = eachEdge(ctx, uploadID, func(l graphLink) error {
+		return statement("MATCH (a:GitObject {id: %s}), (b:GitObject {id: %s}) CREATE (a)-[:%s]->(b);\n",
+			cypherQuote(l.Source), cypherQuote(l.Target), cypherRel(l.Rel))
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		_, err = bw.WriteString(":commit\n")
+	}
+	return err
+}
+
+// ---- SQLite ----
+
+// writeSQLite copies one upload into a fresh database file and streams it.
+// The tables keep the server's column names, minus who uploaded it.
+func writeSQLite(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+	dir, err := os.MkdirTemp(tempDir(), "export-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upload.db")
+
+	// ATTACH only applies to one connection, so hold on to it
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS export", path); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE export")
+	for _, stmt := range []string{
+		`CREATE TABLE export.uploads (id INTEGER PRIMARY KEY, name TEXT, uploaded_at DATETIME, graph_hash TEXT, size_bytes INTEGER)`,
+		`INSERT INTO export.uploads SELECT id, name, uploaded_at, graph_hash, size_bytes FROM uploads WHERE id=?1`,
+		`CREATE TABLE export.nodes (id TEXT PRIMARY KEY, upload_id INTEGER, type TEXT, label TEXT, meta TEXT)`,
+		`INSERT INTO export.nodes SELECT id, upload_id, type, label, meta FROM nodes WHERE upload_id=?1 ORDER BY id`,
+		`CREATE TABLE export.edges (id INTEGER PRIMARY KEY, upload_id INTEGER, source TEXT, target TEXT, rel TEXT)`,
+		`INSERT INTO export.edges SELECT id, upload_id, source, target, rel FROM edges WHERE upload_id=?1 ORDER BY id`,
+		`CREATE INDEX export.edges_source ON edges(source)`,
+		`CREATE INDEX export.edges_target ON edges(target)`,
+	} {
+		if _, err := conn.ExecContext(ctx, stmt, uploadID); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "DETACH DATABASE export"); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(bw, f)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// archiveFingerprint identifies the repository state archived at zipPath by
+// its refs: a hash of every ref's name and what it points at, read straight
+// from the archive so a re-upload can be spotted before it is parsed. It is
+// "" for an archive with no refs. The repository is found the way
+// parseAndStoreRepo finds it: a .git directory, else a bare repository.
+func archiveFingerprint(zipPath string) (string, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	// the shallowest of each kind, and a .git directory over a bare one
+	var dotGit, bare []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || path.Base(f.Name) != "HEAD" {
+			continue
+		}
+		prefix := strings.TrimSuffix(f.Name, "HEAD")
+		switch {
+		case path.Base(prefix) == ".git":
+			dotGit = append(dotGit, prefix)
+		// logs/HEAD and refs/remotes/*/HEAD aren't a repository's HEAD
+		case path.Base(prefix) == "logs" || strings.HasPrefix(prefix, "refs/") || strings.Contains(prefix, "/refs/"):
+		default:
+			bare = append(bare, prefix)
+		}
+	}
+	candidates := dotGit
+	if len(candidates) == 0 {
+		candidates = bare
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	dir := candidates[0]
+	for _, c := range candidates[1:] {
+		if len(c) < len(dir) {
+			dir = c
+		}
+	}
+
+	refs := make(map[string]string)
+	var loose []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.HasPrefix(f.Name, dir) {
+			continue
+		}
+		switch name := strings.TrimPrefix(f.Name, dir); {
+		case name == "packed-refs":
+			if err := readPackedRefs(f, refs); err != nil {
+				return "", err
+			}
+		case name == "HEAD" || strings.HasPrefix(name, "refs/"):
+			loose = append(loose, f)
+		}
+	}
+	// loose refs override packed ones
+	for _, f := range loose {
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		b, err := io.ReadAll(io.LimitReader(rc, 4096))
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		refs[strings.TrimPrefix(f.Name, dir)] = strings.TrimSpace(string(b))
+	}
+	if len(refs) == 0 {
+		return "", nil
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", name, refs[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readPackedRefs adds the refs of a packed-refs file to refs. Peeled tag
+// lines follow from their tag, so they are skipped.
+func readPackedRefs(f *zip.File, refs map[string]string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		if hash, name, ok := strings.Cut(line, " "); ok {
+			refs[name] = hash
+		}
+	}
+	return sc.Err()
+}
+
+// duplicateUpload returns the newest finished upload by uploader with the
+// given fingerprint, or 0 if there is none.
+func duplicateUpload(fingerprint, uploader string) (int, error) {
+	if fingerprint == "" {
+		return 0, nil
+	}
+	var id int
+	err := db.QueryRow("SELECT id FROM uploads WHERE fingerprint=? AND uploader=? AND status='done' ORDER BY id DESC LIMIT 1",
+		fingerprint, uploader).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// archiveDuplicate returns the upload by uploader that the archive at
+// zipPath would duplicate, or 0. An unreadable archive duplicates nothing;
+// its ingest reports why.
+func archiveDuplicate(zipPath, uploader string) (int, error) {
+	fingerprint, err := archiveFingerprint(zipPath)
+	if err != nil {
+		return 0, nil
+	}
+	return duplicateUpload(fingerprint, uploader)
+}
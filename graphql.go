@@ -0,0 +1,826 @@
+package main
+
+// A deliberately small GraphQL implementation: query operations with
+// fields, aliases, arguments, variables and __typename. No fragments,
+// directives, mutations or introspection.
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const graphqlSchema = `type Query {
+  uploads: [Upload!]!
+  upload(id: Int!): Upload
+}
+
+type Upload {
+  id: Int!
+  name: String
+  uploadedAt: String
+  commits(first: Int): [Commit!]!
+  commit(hash: String!): Commit
+  refs(kind: String): [Ref!]!
+  tree(hash: String!): Tree
+  blob(hash: String!): Blob
+}
+
+type Commit {
+  hash: String!
+  shortHash: String!
+  message: String
+  author: String
+  email: String
+  date: String
+  parents: [Commit!]!
+  tree: Tree
+}
+
+type Tree {
+  hash: String!
+  name: String
+  trees: [Tree!]!
+  blobs: [Blob!]!
+}
+
+type Blob {
+  hash: String!
+  name: String
+}
+
+type Ref {
+  name: String!
+  kind: String
+  target: Commit
+}
+`
+
+// ---- request handling ----
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("schema") != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, graphqlSchema)
+			return
+		}
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "bad variables: "+err.Error(), 400)
+				return
+			}
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body: "+err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	data, errs := executeGraphQL(r.WithContext(ctx), req)
+	out := map[string]interface{}{"data": data}
+	if len(errs) > 0 {
+		out["errors"] = errs
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func executeGraphQL(r *http.Request, req graphqlRequest) (interface{}, []graphqlError) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, []graphqlError{{Message: err.Error()}}
+	}
+	var op *gqlOperation
+	for _, o := range doc {
+		if req.OperationName == "" || o.name == req.OperationName {
+			op = o
+			break
+		}
+	}
+	if op == nil {
+		return nil, []graphqlError{{Message: "operation not found"}}
+	}
+	if op.kind != "query" {
+		return nil, []graphqlError{{Message: "only query operations are supported"}}
+	}
+	ex := &gqlExecutor{vars: req.Variables}
+	data := ex.selectFields(gqlRoot{r: r}, op.selections, nil)
+	return data, ex.errs
+}
+
+// ---- execution ----
+
+// gqlObject is any value that resolves fields of a named GraphQL type.
+type gqlObject interface {
+	typeName() string
+	resolve(field string, args map[string]interface{}) (interface{}, error)
+}
+
+// gqlFields keeps response keys in selection order.
+type gqlFields []gqlField
+
+type gqlField struct {
+	key   string
+	value interface{}
+}
+
+func (f gqlFields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, kv := range f {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(kv.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(kv.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlExecutor struct {
+	vars map[string]interface{}
+	errs []graphqlError
+}
+
+func (ex *gqlExecutor) selectFields(obj gqlObject, sels []*gqlSelection, path []interface{}) gqlFields {
+	out := make(gqlFields, 0, len(sels))
+	for _, sel := range sels {
+		key := sel.alias
+		if key == "" {
+			key = sel.name
+		}
+		fieldPath := append(append([]interface{}{}, path...), key)
+		if sel.name == "__typename" {
+			out = append(out, gqlField{key, obj.typeName()})
+			continue
+		}
+		args, err := ex.argValues(sel.args)
+		if err != nil {
+			ex.errs = append(ex.errs, graphqlError{Message: err.Error(), Path: fieldPath})
+			out = append(out, gqlField{key, nil})
+			continue
+		}
+		v, err := obj.resolve(sel.name, args)
+		if err != nil {
+			ex.errs = append(ex.errs, graphqlError{Message: err.Error(), Path: fieldPath})
+			out = append(out, gqlField{key, nil})
+			continue
+		}
+		out = append(out, gqlField{key, ex.complete(v, sel, fieldPath)})
+	}
+	return out
+}
+
+// complete turns a resolved value into its response shape.
+func (ex *gqlExecutor) complete(v interface{}, sel *gqlSelection, path []interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case gqlObject:
+		if len(sel.selections) == 0 {
+			ex.errs = append(ex.errs, graphqlError{Message: fmt.Sprintf("field %q of type %s must have a selection of subfields", sel.name, val.typeName()), Path: path})
+			return nil
+		}
+		return ex.selectFields(val, sel.selections, path)
+	case []gqlObject:
+		list := make([]interface{}, len(val))
+		for i, item := range val {
+			list[i] = ex.complete(item, sel, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	default:
+		if len(sel.selections) > 0 {
+			ex.errs = append(ex.errs, graphqlError{Message: fmt.Sprintf("field %q is a scalar and cannot have subfields", sel.name), Path: path})
+			return nil
+		}
+		return v
+	}
+}
+
+func (ex *gqlExecutor) argValues(args map[string]gqlValue) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(args))
+	for name, v := range args {
+		val, err := ex.value(v)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = val
+	}
+	return out, nil
+}
+
+func (ex *gqlExecutor) value(v gqlValue) (interface{}, error) {
+	switch v.kind {
+	case "variable":
+		val, ok := ex.vars[v.raw]
+		if !ok {
+			return nil, nil
+		}
+		return val, nil
+	case "list":
+		list := make([]interface{}, len(v.list))
+		for i, item := range v.list {
+			val, err := ex.value(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = val
+		}
+		return list, nil
+	case "int":
+		n, err := strconv.ParseInt(v.raw, 10, 64)
+		return float64(n), err
+	case "float":
+		return strconv.ParseFloat(v.raw, 64)
+	case "boolean":
+		return v.raw == "true", nil
+	case "null":
+		return nil, nil
+	}
+	// string and enum
+	return v.raw, nil
+}
+
+// argument accessors; JSON variables decode numbers as float64 so literals do too
+
+func argInt(args map[string]interface{}, name string) (int, bool) {
+	switch n := args[name].(type) {
+	case float64:
+		return int(n), true
+	case string:
+		i, err := strconv.Atoi(n)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func argString(args map[string]interface{}, name string) (string, bool) {
+	s, ok := args[name].(string)
+	return s, ok
+}
+
+// ---- resolvers ----
+
+// gqlRoot carries the request so upload visibility can be enforced.
+type gqlRoot struct {
+	r *http.Request
+}
+
+func (gqlRoot) typeName() string { return "Query" }
+
+func (root gqlRoot) resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "uploads":
+		list := make([]gqlObject, 0)
+		err := eachListedUpload(root.r.Context(), root.r, func(id int, name, uploadedAt sql.NullString) error {
+			list = append(list, gqlUpload{ctx: root.r.Context(), id: id, name: name, uploadedAt: uploadedAt})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return list, nil
+	case "upload":
+		id, ok := argInt(args, "id")
+		if !ok {
+			return nil, fmt.Errorf("argument \"id\" is required")
+		}
+		u := gqlUpload{ctx: root.r.Context()}
+		err := db.QueryRowContext(u.ctx, "SELECT id,name,uploaded_at FROM uploads WHERE id=?", id).Scan(&u.id, &u.name, &u.uploadedAt)
+		if err == sql.ErrNoRows || (err == nil && !canView(root.r, u.id)) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	return nil, fmt.Errorf("cannot query field %q on type Query", field)
+}
+
+type gqlUpload struct {
+	ctx        context.Context
+	id         int
+	name       sql.NullString
+	uploadedAt sql.NullString
+}
+
+func (gqlUpload) typeName() string { return "Upload" }
+
+func (u gqlUpload) resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "id":
+		return u.id, nil
+	case "name":
+		return nullString(u.name), nil
+	case "uploadedAt":
+		return nullString(u.uploadedAt), nil
+	case "commits":
+		q := "SELECT id,type,label,meta FROM nodes WHERE upload_id=? AND type='commit' AND meta<>'' ORDER BY id"
+		if n, ok := argInt(args, "first"); ok {
+			q += " LIMIT " + strconv.Itoa(n)
+		}
+		return gqlNodes(u.ctx, u.id, q, u.id)
+	case "commit", "tree", "blob":
+		hash, ok := argString(args, "hash")
+		if !ok {
+			return nil, fmt.Errorf("argument \"hash\" is required")
+		}
+		n, err := gqlNodeByID(u.ctx, u.id, hash)
+		if err != nil || n == nil || n.typ != field {
+			return nil, err
+		}
+		return n, nil
+	case "refs":
+		list, err := gqlNodes(u.ctx, u.id, "SELECT id,type,label,meta FROM nodes WHERE upload_id=? AND type='ref' ORDER BY id", u.id)
+		if err != nil {
+			return nil, err
+		}
+		kind, ok := argString(args, "kind")
+		if !ok {
+			return list, nil
+		}
+		filtered := make([]gqlObject, 0, len(list))
+		for _, o := range list {
+			if o.(*gqlNode).metaValue("kind") == kind {
+				filtered = append(filtered, o)
+			}
+		}
+		return filtered, nil
+	}
+	return nil, fmt.Errorf("cannot query field %q on type Upload", field)
+}
+
+func nullString(s sql.NullString) interface{} {
+	if !s.Valid {
+		return nil
+	}
+	return s.String
+}
+
+// gqlNode backs Commit, Tree, Blob and Ref, all of which are rows in nodes.
+type gqlNode struct {
+	ctx      context.Context
+	uploadID int
+	id       string
+	typ      string
+	label    string
+	meta     map[string]interface{}
+}
+
+func (n *gqlNode) typeName() string {
+	switch n.typ {
+	case "commit":
+		return "Commit"
+	case "tree":
+		return "Tree"
+	case "blob":
+		return "Blob"
+	case "ref":
+		return "Ref"
+	}
+	return "Node"
+}
+
+func (n *gqlNode) metaValue(key string) interface{} {
+	if v, ok := n.meta[key]; ok {
+		return v
+	}
+	return nil
+}
+
+func (n *gqlNode) resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch n.typ + "." + field {
+	case "commit.hash", "tree.hash", "blob.hash":
+		return n.id, nil
+	case "commit.shortHash":
+		return n.id[:7], nil
+	case "commit.message":
+		return n.label, nil
+	case "commit.author":
+		return n.metaValue("author"), nil
+	case "commit.email":
+		return n.metaValue("email"), nil
+	case "commit.date":
+		return n.metaValue("time"), nil
+	case "commit.parents":
+		return gqlTargets(n, "parent")
+	case "commit.tree":
+		return gqlTarget(n, "commit->tree")
+	case "tree.name", "blob.name":
+		return n.label, nil
+	case "tree.trees":
+		return gqlTargets(n, "tree->tree")
+	case "tree.blobs":
+		return gqlTargets(n, "tree->blob")
+	case "ref.name":
+		return n.label, nil
+	case "ref.kind":
+		return n.metaValue("kind"), nil
+	case "ref.target":
+		return gqlTarget(n, "ref->commit")
+	}
+	return nil, fmt.Errorf("cannot query field %q on type %s", field, n.typeName())
+}
+
+func gqlNodes(ctx context.Context, uploadID int, query string, args ...interface{}) ([]gqlObject, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]gqlObject, 0)
+	for rows.Next() {
+		n := &gqlNode{ctx: ctx, uploadID: uploadID}
+		var metaStr string
+		if err := rows.Scan(&n.id, &n.typ, &n.label, &metaStr); err != nil {
+			return nil, err
+		}
+		if metaStr != "" {
+			_ = json.Unmarshal([]byte(metaStr), &n.meta)
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+func gqlNodeByID(ctx context.Context, uploadID int, id string) (*gqlNode, error) {
+	list, err := gqlNodes(ctx, uploadID, "SELECT id,type,label,meta FROM nodes WHERE upload_id=? AND id=?", uploadID, id)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0].(*gqlNode), nil
+}
+
+// gqlTargets follows edges of one relationship out of n.
+func gqlTargets(n *gqlNode, rel string) ([]gqlObject, error) {
+	return gqlNodes(n.ctx, n.uploadID, `SELECT n.id,n.type,n.label,n.meta FROM nodes n
+		WHERE n.upload_id=? AND n.id IN (SELECT target FROM edges WHERE upload_id=? AND source=? AND rel=?)
+		ORDER BY n.label, n.id`, n.uploadID, n.uploadID, n.id, rel)
+}
+
+func gqlTarget(n *gqlNode, rel string) (interface{}, error) {
+	list, err := gqlTargets(n, rel)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+// ---- parsing ----
+
+type gqlOperation struct {
+	kind       string
+	name       string
+	selections []*gqlSelection
+}
+
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]gqlValue
+	selections []*gqlSelection
+}
+
+type gqlValue struct {
+	kind string // int, float, string, boolean, null, enum, variable, list
+	raw  string
+	list []gqlValue
+}
+
+type gqlToken struct {
+	kind string // name, punct, string, number, eof
+	text string
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+func parseGraphQL(src string) ([]*gqlOperation, error) {
+	p := &gqlParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var ops []*gqlOperation
+	for p.tok.kind != "eof" {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("syntax error: empty document")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query"}
+	if p.tok.kind == "name" {
+		switch p.tok.text {
+		case "query", "mutation", "subscription":
+			op.kind = p.tok.text
+		case "fragment":
+			return nil, fmt.Errorf("fragments are not supported")
+		default:
+			return nil, p.errorf("unexpected %q", p.tok.text)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == "name" {
+			op.name = p.tok.text
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("(") {
+			if err := p.skipVariableDefinitions(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sels
+	return op, nil
+}
+
+// skipVariableDefinitions consumes "($a: Int!, $b: [String] = ...)". Types
+// aren't checked; values are taken from the request's variables as-is.
+func (p *gqlParser) skipVariableDefinitions() error {
+	depth := 0
+	for {
+		if p.tok.kind == "eof" {
+			return p.errorf("unterminated variable definitions")
+		}
+		if p.isPunct("(") {
+			depth++
+		} else if p.isPunct(")") {
+			depth--
+			if depth == 0 {
+				return p.next()
+			}
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		sel, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return sels, p.next()
+}
+
+func (p *gqlParser) field() (*gqlSelection, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	sel := &gqlSelection{name: name}
+	if p.isPunct(":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		sel.alias = name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		sel.args = make(map[string]gqlValue)
+		for !p.isPunct(")") {
+			argName, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			sel.args[argName] = v
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	if p.isPunct("{") {
+		if sel.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) value() (gqlValue, error) {
+	t := p.tok
+	switch {
+	case t.kind == "punct" && t.text == "$":
+		if err := p.next(); err != nil {
+			return gqlValue{}, err
+		}
+		name, err := p.name()
+		return gqlValue{kind: "variable", raw: name}, err
+	case t.kind == "punct" && t.text == "[":
+		if err := p.next(); err != nil {
+			return gqlValue{}, err
+		}
+		v := gqlValue{kind: "list"}
+		for !p.isPunct("]") {
+			item, err := p.value()
+			if err != nil {
+				return gqlValue{}, err
+			}
+			v.list = append(v.list, item)
+		}
+		return v, p.next()
+	case t.kind == "string":
+		return gqlValue{kind: "string", raw: t.text}, p.next()
+	case t.kind == "number":
+		kind := "int"
+		if strings.ContainsAny(t.text, ".eE") {
+			kind = "float"
+		}
+		return gqlValue{kind: kind, raw: t.text}, p.next()
+	case t.kind == "name":
+		kind := "enum"
+		switch t.text {
+		case "true", "false":
+			kind = "boolean"
+		case "null":
+			kind = "null"
+		}
+		return gqlValue{kind: kind, raw: t.text}, p.next()
+	}
+	return gqlValue{}, p.errorf("unexpected %q in value", t.text)
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != "name" {
+		return "", p.errorf("expected name, found %q", p.tok.text)
+	}
+	n := p.tok.text
+	return n, p.next()
+}
+
+func (p *gqlParser) isPunct(s string) bool {
+	return p.tok.kind == "punct" && p.tok.text == s
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q, found %q", s, p.tok.text)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// next advances to the following token, skipping whitespace, commas and comments.
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+			continue
+		}
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		break
+	}
+	if p.pos >= len(p.src) {
+		p.tok = gqlToken{kind: "eof"}
+		return nil
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: "name", text: p.src[start:p.pos]}
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: "number", text: p.src[start:p.pos]}
+	case c == '"':
+		s, err := p.stringLiteral()
+		if err != nil {
+			return err
+		}
+		p.tok = gqlToken{kind: "string", text: s}
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{kind: "punct", text: "..."}
+	case strings.IndexByte("{}()[]:!$=@|&", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: "punct", text: string(c)}
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// stringLiteral reads a double-quoted string; JSON escape rules are close
+// enough to GraphQL's that encoding/json can decode it.
+func (p *gqlParser) stringLiteral() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '"':
+			p.pos++
+			var s string
+			if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+				return "", p.errorf("bad string literal")
+			}
+			return s, nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		}
+		p.pos++
+	}
+	return "", p.errorf("unterminated string")
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/gitvis/pkg/api"
+)
+
+// graphQuery selects part of an upload's graph from the query string of
+// a graph request. Node conditions are SQL over the nodes table's own
+// columns; when there are any, edges are kept only if both ends survive.
+// Commit conditions pick commits, and the trees, blobs and refs are then
+// cut down to those the kept commits reach.
+type graphQuery struct {
+	uploadID    int
+	nodeConds   []string
+	nodeArgs    []interface{}
+	edgeConds   []string
+	edgeArgs    []interface{}
+	commitConds []string
+	commitArgs  []interface{}
+	treeDepth   int // -1 for no limit
+	// path keeps only the trees and blobs at or below it, and the trees
+	// leading there, by name from the root
+	path []string
+
+	// kept selects the ids of the commits that pass, if any were filtered
+	kept     string
+	keptArgs []interface{}
+	// bridge asks for "ancestor" links across filtered-out commits
+	bridge bool
+	// firstParent follows only first parents, and merges are annotated
+	// with how many commits they brought in
+	firstParent bool
+}
+
+// graphModes are the values of ?mode=.
+var graphModes = map[string]bool{"": true, "full": true, "commits": true, "dirs": true, "first-parent": true}
+
+func parseGraphQuery(r *http.Request, uploadID int) (*graphQuery, error) {
+	q := &graphQuery{uploadID: uploadID, treeDepth: -1}
+	v := r.URL.Query()
+	mode := v.Get("mode")
+	if !graphModes[mode] {
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	if mode == "commits" {
+		// just the DAG: the trees and blobs are most of a graph's size
+		q.node("type='commit'")
+		q.edge("rel IN ('parent','cherry-pick-of','reverts')")
+	}
+	if mode == "first-parent" {
+		// the mainline of each branch; merges stand for what they brought in
+		q.firstParent = true
+		q.edge("rel<>'parent' OR id IN (SELECT MIN(id) FROM edges WHERE upload_id=? AND rel='parent' GROUP BY source)", uploadID)
+	}
+	if mode == "dirs" {
+		// trees stand in for the files below them; see expandHandler
+		q.node("type<>'blob'")
+	}
+	if s := v.Get("tree_depth"); s != "" {
+		depth, err := strconv.Atoi(s)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("tree_depth must be a non-negative number")
+		}
+		q.treeDepth = depth
+	}
+	if p := v.Get("path"); p != "" {
+		// services/payments/ keeps a monorepo team's slice
+		for _, name := range strings.Split(p, "/") {
+			if name != "" {
+				q.path = append(q.path, name)
+			}
+		}
+	}
+
+	dateCol := sqlCommitTime("json_extract(meta,'$.time')")
+	switch v.Get("date") {
+	case "", "author":
+	case "committer":
+		// older uploads only recorded the author date
+		dateCol = sqlCommitTime("COALESCE(json_extract(meta,'$.committed'), json_extract(meta,'$.time'))")
+	default:
+		return nil, fmt.Errorf("date must be author or committer")
+	}
+	if s := v.Get("since"); s != "" {
+		t, err := parseDateParam(s, false)
+		if err != nil {
+			return nil, fmt.Errorf("since: %v", err)
+		}
+		q.commit(dateCol+" >= ?", t.Unix())
+	}
+	if s := v.Get("until"); s != "" {
+		t, err := parseDateParam(s, true)
+		if err != nil {
+			return nil, fmt.Errorf("until: %v", err)
+		}
+		q.commit(dateCol+" < ?", t.Unix())
+	}
+	if a := v.Get("author"); a != "" {
+		// an email or a name, standing for every identity the mailmap
+		// merges it with; the surrounding commits are bridged over
+		identity := "lower(COALESCE(json_extract(meta,'$.mailmap_email'),json_extract(meta,'$.email')))"
+		q.commit(identity+` IN (SELECT `+identity+` FROM nodes WHERE upload_id=? AND type='commit' AND (
+			lower(json_extract(meta,'$.email'))=lower(?) OR lower(json_extract(meta,'$.author'))=lower(?) OR
+			lower(json_extract(meta,'$.mailmap_email'))=lower(?) OR lower(json_extract(meta,'$.mailmap_author'))=lower(?)))`,
+			uploadID, a, a, a, a)
+		q.bridge = true
+	}
+	if cats := v.Get("category"); cats != "" {
+		// feat,fix keeps either; the surrounding commits are bridged over
+		list := strings.Split(strings.ToLower(cats), ",")
+		args := make([]interface{}, len(list))
+		for i, c := range list {
+			args[i] = strings.TrimSpace(c)
+		}
+		q.commit("json_extract(meta,'$.category') IN (?"+strings.Repeat(",?", len(list)-1)+")", args...)
+		q.bridge = true
+	}
+	if lang := v.Get("language"); lang != "" {
+		// blobs of other languages go; trees stay, so the files keep a path
+		q.node("type<>'blob' OR lower(json_extract(meta,'$.language'))=lower(?)", lang)
+	}
+	if name := v.Get("ref"); name != "" {
+		// a short name like feature/x, or a full one like refs/heads/feature/x
+		var n int
+		err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM nodes WHERE upload_id=? AND type='ref' AND (label=? OR id=?)",
+			uploadID, name, name).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("no ref named %q", name)
+		}
+		q.history("SELECT id FROM nodes WHERE upload_id=? AND type='ref' AND (label=? OR id=?)", uploadID, name, name)
+	} else if q.firstParent {
+		q.history("SELECT id FROM nodes WHERE upload_id=? AND type='ref' AND json_extract(meta,'$.kind')='branch'", uploadID)
+	}
+
+	q.reachable()
+	return q, nil
+}
+
+// history keeps the commits reachable from the tips of the refs refs
+// selects, along first parents only in first-parent mode.
+func (q *graphQuery) history(refs string, args ...interface{}) {
+	step := `SELECT e.target FROM edges e JOIN history h ON e.source=h.id
+				WHERE e.upload_id=? AND e.rel='parent'`
+	if q.firstParent {
+		// edges go in in parent order, so the first parent has the lowest id
+		step = `SELECT (SELECT e.target FROM edges e WHERE e.upload_id=? AND e.rel='parent' AND e.source=h.id
+				ORDER BY e.id LIMIT 1) FROM history h`
+	}
+	q.commit(`id IN (
+			WITH RECURSIVE history(id) AS (
+				SELECT target FROM edges WHERE upload_id=? AND rel='ref->commit' AND source IN (`+refs+`)
+				UNION
+				`+step+`
+			)
+			SELECT id FROM history)`, append(append([]interface{}{q.uploadID}, args...), q.uploadID)...)
+}
+
+// parseDateParam accepts a day or an RFC 3339 time. A day given as an
+// end is the end of that day, so until=2023-06-30 includes June 30th.
+func parseDateParam(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("want YYYY-MM-DD or an RFC 3339 time, got %q", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// sqlCommitTime converts a stored commit time to Unix seconds: RFC 3339,
+// which SQLite reads as it is, or, for older uploads, what
+// time.Time.String() wrote, such as "2023-01-02 15:04:05 +0100 CET". Git
+// times have no fractional seconds, so its offset is always at the same
+// position.
+func sqlCommitTime(expr string) string {
+	return fmt.Sprintf("CAST(strftime('%%s', CASE WHEN substr(%[1]s,11,1)='T' THEN %[1]s "+
+		"ELSE substr(%[1]s,1,19) || substr(%[1]s,21,3) || ':' || substr(%[1]s,24,2) END) AS INTEGER)", expr)
+}
+
+// commit adds a condition on commit rows. Parent placeholders have no
+// meta, so they never match one.
+func (q *graphQuery) commit(cond string, args ...interface{}) {
+	q.commitConds = append(q.commitConds, cond)
+	q.commitArgs = append(q.commitArgs, args...)
+}
+
+// reachable turns the commit conditions, tree depth and path into node
+// conditions: refs must point at a kept commit, and trees and blobs be
+// within treeDepth levels of a kept commit's root tree and on or below
+// path. A root tree is at depth 0 and its entries at depth 1. Trees go by
+// their label, the name each was first seen under.
+func (q *graphQuery) reachable() {
+	if len(q.commitConds) > 0 {
+		conds := "meta<>''"
+		for _, c := range q.commitConds {
+			conds += " AND (" + c + ")"
+		}
+		q.node("type<>'commit' OR ("+conds+")", q.commitArgs...)
+		q.kept = "SELECT id FROM nodes WHERE upload_id=? AND type='commit' AND " + conds
+		q.keptArgs = append([]interface{}{q.uploadID}, q.commitArgs...)
+	}
+	kept, keptArgs := q.kept, q.keptArgs
+	if kept != "" {
+		q.node("type<>'ref' OR id IN (SELECT source FROM edges WHERE upload_id=? AND rel='ref->commit' AND target IN ("+kept+"))",
+			append([]interface{}{q.uploadID}, keptArgs...)...)
+	}
+	if kept == "" && q.treeDepth < 0 && len(q.path) == 0 {
+		return
+	}
+
+	roots := " FROM edges WHERE upload_id=? AND rel='commit->tree'"
+	args := []interface{}{q.uploadID}
+	if kept != "" {
+		roots += " AND source IN (" + kept + ")"
+		args = append(args, keptArgs...)
+	}
+	var cte string
+	if q.treeDepth < 0 && len(q.path) == 0 {
+		cte = `WITH RECURSIVE reach(id) AS (SELECT target` + roots + `
+			UNION
+			SELECT e.target FROM edges e JOIN reach r ON e.source=r.id
+			WHERE e.upload_id=? AND e.rel IN ('tree->tree','tree->blob'))`
+		args = append(args, q.uploadID)
+	} else {
+		// (id, depth) pairs, since a tree can be shallow under one commit
+		// and deep under another
+		step := `SELECT e.target, r.depth+1 FROM edges e JOIN reach r ON e.source=r.id
+			JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+			WHERE e.upload_id=? AND e.rel IN ('tree->tree','tree->blob')`
+		args = append(args, q.uploadID)
+		if q.treeDepth >= 0 {
+			step += " AND r.depth < ?"
+			args = append(args, q.treeDepth)
+		}
+		if len(q.path) > 0 {
+			// the entry at each level down to the path is the one it names
+			b, _ := json.Marshal(q.path)
+			step += " AND (r.depth >= ? OR n.label=json_extract(?, '$[' || r.depth || ']'))"
+			args = append(args, len(q.path), string(b))
+		}
+		cte = `WITH RECURSIVE reach(id, depth) AS (SELECT target, 0` + roots + `
+			UNION
+			` + step + `)`
+	}
+	q.node("type NOT IN ('tree','blob') OR id IN ("+cte+" SELECT id FROM reach)", args...)
+}
+
+// whole reports whether the query keeps every node and edge.
+func (q *graphQuery) whole() bool {
+	return len(q.nodeConds) == 0 && len(q.edgeConds) == 0
+}
+
+func (q *graphQuery) node(cond string, args ...interface{}) {
+	q.nodeConds = append(q.nodeConds, cond)
+	q.nodeArgs = append(q.nodeArgs, args...)
+}
+
+func (q *graphQuery) edge(cond string, args ...interface{}) {
+	q.edgeConds = append(q.edgeConds, cond)
+	q.edgeArgs = append(q.edgeArgs, args...)
+}
+
+func (q *graphQuery) nodeWhere() (string, []interface{}) {
+	where := "upload_id=?"
+	for _, c := range q.nodeConds {
+		where += " AND (" + c + ")"
+	}
+	return where, append([]interface{}{q.uploadID}, q.nodeArgs...)
+}
+
+func (q *graphQuery) nodes(ctx context.Context) (*sql.Rows, error) {
+	where, args := q.nodeWhere()
+	return db.QueryContext(ctx, "SELECT id,type,label,meta FROM nodes WHERE "+where, args...)
+}
+
+func (q *graphQuery) edges(ctx context.Context) (*sql.Rows, error) {
+	conds := []string{"upload_id=?"}
+	for _, c := range q.edgeConds {
+		conds = append(conds, "("+c+")")
+	}
+	args := append([]interface{}{q.uploadID}, q.edgeArgs...)
+	if len(q.nodeConds) > 0 {
+		where, nodeArgs := q.nodeWhere()
+		kept := "SELECT id FROM nodes WHERE " + where
+		conds = append(conds, "source IN ("+kept+")", "target IN ("+kept+")")
+		args = append(args, nodeArgs...)
+		args = append(args, nodeArgs...)
+	}
+	return db.QueryContext(ctx, "SELECT source,target,rel FROM edges WHERE "+strings.Join(conds, " AND "), args...)
+}
+
+// expandHandler serves /graph/{id}/expand?tree={hash}: the entries of one
+// tree, for opening a directory of a mode=dirs graph.
+func expandHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	tree := r.URL.Query().Get("tree")
+	var typ string
+	err = db.QueryRowContext(r.Context(), "SELECT type FROM nodes WHERE upload_id=? AND id=?", uploadID, tree).Scan(&typ)
+	if err == sql.ErrNoRows || err == nil && typ != "tree" {
+		http.Error(w, "no such tree", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT n.id,n.type,n.label,n.meta,e.rel FROM edges e
+		JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+		WHERE e.upload_id=? AND e.source=? AND e.rel IN ('tree->tree','tree->blob')
+		ORDER BY n.type DESC, n.label`, uploadID, tree)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	nodes, links := []graphNode{}, []graphLink{}
+	for rows.Next() {
+		var id, typ, label, metaStr, rel string
+		if err := rows.Scan(&id, &typ, &label, &metaStr, &rel); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		nodes = append(nodes, api.MakeNode(id, typ, label, metaStr))
+		links = append(links, graphLink{Source: tree, Target: id, Rel: rel})
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": nodes, "links": links})
+}
+
+// bridges links each kept commit to its nearest kept ancestors, where
+// the commits in between were filtered out, as "ancestor" links. Without
+// them a filtered history falls apart into unconnected commits.
+func (q *graphQuery) bridges(ctx context.Context) ([]graphLink, error) {
+	if !q.bridge || q.kept == "" {
+		return nil, nil
+	}
+	rows, err := db.QueryContext(ctx, q.kept, q.keptArgs...)
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		kept[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	h, err := loadHistory(ctx, q.uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	// nearest kept ancestors of each filtered-out commit, filled in
+	// parents first so every lookup is already done
+	nearest := make(map[string][]string)
+	for _, c := range h.topo {
+		if kept[c] {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, p := range h.parents[c] {
+			if kept[p] {
+				seen[p] = true
+				continue
+			}
+			for _, a := range nearest[p] {
+				seen[a] = true
+			}
+		}
+		for a := range seen {
+			nearest[c] = append(nearest[c], a)
+		}
+		sort.Strings(nearest[c])
+	}
+	var links []graphLink
+	for _, c := range h.topo {
+		if !kept[c] {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, p := range h.parents[c] {
+			if kept[p] {
+				// a plain parent link, already in the graph
+				seen[p] = true
+			}
+		}
+		for _, p := range h.parents[c] {
+			for _, a := range nearest[p] {
+				if !seen[a] {
+					seen[a] = true
+					links = append(links, graphLink{Source: c, Target: a, Rel: "ancestor"})
+				}
+			}
+		}
+	}
+	return links, nil
+}
+
+// annotations are extra node fields computed outside SQL, by node ID.
+func (q *graphQuery) annotations(ctx context.Context) (map[string]map[string]interface{}, error) {
+	if !q.firstParent {
+		return nil, nil
+	}
+	h, err := loadHistory(ctx, q.uploadID)
+	if err != nil {
+		return nil, err
+	}
+	notes := make(map[string]map[string]interface{})
+	for c, ps := range h.parents {
+		if len(ps) > 1 {
+			// what git log p1..c would list, besides c itself
+			n := len(h.only([]string{c}, ps[:1])) - 1
+			notes[c] = map[string]interface{}{"merged": n}
+		}
+	}
+	return notes, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// storeLineStats records diff stats on every commit, as git log --numstat
+// counts them against the first parent: "additions" and "deletions" for
+// ordinary commits, left out for merges as git leaves them out, and
+// "lines", the lines in the commit's whole tree, worked out from its first
+// parent's count so that merges are included. Binary files count no lines.
+func storeLineStats(ctx context.Context, r *git.Repository, uploadID int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	type stats struct{ added, deleted, lines int }
+	counted := make(map[string]stats, len(h.topo))
+	// topo has parents first, so a first parent's count is always there
+	for _, c := range h.topo {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		to, err := commitTree(r, c)
+		if err != nil {
+			continue
+		}
+		var s stats
+		p := h.firstParent(c)
+		from, _ := commitTree(r, p)
+		if from != nil {
+			s.lines = counted[p].lines
+		}
+		diffTrees(r, from, to, "", func(_ string, hash, prev plumbing.Hash, dir bool) {
+			if dir {
+				return
+			}
+			a, d := lineDiff(r, prev, hash)
+			s.added += a
+			s.deleted += d
+		})
+		s.lines += s.added - s.deleted
+		counted[c] = s
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.additions',?,'$.deletions',?,'$.lines',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	merge, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.lines',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer merge.Close()
+	for c, s := range counted {
+		if len(h.parents[c]) > 1 {
+			_, err = merge.ExecContext(ctx, s.lines, uploadID, c)
+		} else {
+			_, err = stmt.ExecContext(ctx, s.added, s.deleted, s.lines, uploadID, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// lineDiff counts the lines added and deleted going from the blob prev to
+// the blob hash, either of which may be zero for a file that is new or
+// gone.
+func lineDiff(r *git.Repository, prev, hash plumbing.Hash) (added, deleted int) {
+	src, ok := blobText(r, prev)
+	if !ok {
+		return 0, 0
+	}
+	dst, ok := blobText(r, hash)
+	if !ok {
+		return 0, 0
+	}
+	if src == "" || dst == "" {
+		return lineCount(dst), lineCount(src)
+	}
+	for _, d := range diff.Do(src, dst) {
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			added += lineCount(d.Text)
+		case diffmatchpatch.DiffDelete:
+			deleted += lineCount(d.Text)
+		}
+	}
+	return added, deleted
+}
+
+// blobText reads a blob as text; a zero hash reads as empty. It reports
+// false for blobs it can't read and for binary ones, which like git it
+// takes to be those with a NUL byte near the start.
+func blobText(r *git.Repository, hash plumbing.Hash) (string, bool) {
+	if hash.IsZero() {
+		return "", true
+	}
+	b, err := r.BlobObject(hash)
+	if err != nil {
+		return "", false
+	}
+	rd, err := b.Reader()
+	if err != nil {
+		return "", false
+	}
+	defer rd.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rd); err != nil {
+		return "", false
+	}
+	head := buf.Bytes()
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// lineCount counts lines, the last one whether or not it ends in a newline.
+func lineCount(s string) int {
+	n := strings.Count(s, "\n")
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		n++
+	}
+	return n
+}
+
+// growthPoint is one commit of the lines-of-code series.
+type growthPoint struct {
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	Lines     int    `json:"lines"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// growthHandler serves /graph/{id}/analytics/growth: the lines of code
+// after each commit on the first-parent line of the trunk branch, or of
+// ?ref=, oldest first. Merges have no stats of their own, so they show
+// the net change they brought into the line as additions or deletions.
+func growthHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	tip, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	points := make([]growthPoint, 0)
+	for c := tip; c != "" && h.commits[c] != nil; c = h.firstParent(c) {
+		info := h.commits[c]
+		if info.Lines == nil {
+			// ingested before lines were counted
+			continue
+		}
+		pt := growthPoint{
+			Commit: c, Date: info.When.Format(time.RFC3339), Lines: *info.Lines,
+			Additions: info.Additions, Deletions: info.Deletions,
+		}
+		if p := h.firstParent(c); len(h.parents[c]) > 1 && h.commits[p].Lines != nil {
+			if n := *info.Lines - *h.commits[p].Lines; n > 0 {
+				pt.Additions = n
+			} else {
+				pt.Deletions = -n
+			}
+		}
+		points = append(points, pt)
+	}
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ref": ref, "points": points})
+}
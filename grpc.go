@@ -0,0 +1,375 @@
+package main
+
+// gRPC service defined in proto/gitvis.proto. There is no generated code:
+// the handful of messages are encoded and decoded by hand, and the gRPC
+// wire framing is done on top of net/http's HTTP/2 support (h2c).
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const grpcServicePrefix = "/gitvis.v1.GitViz/"
+
+// gRPC status codes used here
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcExhausted       = 8
+	grpcInternal        = 13
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+	grpcUnauthenticated = 16
+)
+
+type grpcStatus struct {
+	code int
+	msg  string
+}
+
+func (s *grpcStatus) Error() string { return s.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcStatus{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requires POST over HTTP/2 with content-type application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+	// calls stream in either direction for as long as they need
+	streaming(w)
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, grpcServicePrefix) {
+	case "ListUploads":
+		err = grpcListUploads(w, r)
+	case "GetGraph":
+		err = grpcGetGraph(w, r)
+	case "Ingest":
+		if _, ok := tokenFromRequest(r); !ok {
+			err = grpcErrorf(grpcUnauthenticated, "a valid API token is required")
+			break
+		}
+		if uploadLimiter.perSec > 0 {
+			if ok, wait := uploadLimiter.take(clientKey(r)); !ok {
+				err = grpcErrorf(grpcExhausted, "rate limit exceeded, retry in %s", wait.Round(time.Second))
+				break
+			}
+		}
+		err = grpcIngest(w, r)
+	default:
+		err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		var st *grpcStatus
+		if errors.As(err, &st) {
+			code = st.code
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", msg)
+	}
+}
+
+func grpcListUploads(w http.ResponseWriter, r *http.Request) error {
+	if _, err := readGRPCMessage(r.Body); err != nil {
+		return err
+	}
+	var resp []byte
+	err := eachListedUpload(r.Context(), r, func(id int, name, uploadedAt sql.NullString) error {
+		var u []byte
+		u = pbAppendInt(u, 1, int64(id))
+		u = pbAppendString(u, 2, name.String)
+		u = pbAppendString(u, 3, uploadedAt.String)
+		resp = pbAppendBytes(resp, 1, u)
+		return nil
+	})
+	if err == errListSignIn {
+		return grpcErrorf(grpcUnauthenticated, "%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	return writeGRPCMessage(w, resp)
+}
+
+func grpcGetGraph(w http.ResponseWriter, r *http.Request) error {
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	var uploadID, chunkSize int64
+	err = pbRange(req, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			uploadID = int64(v)
+		case 2:
+			chunkSize = int64(v)
+		}
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+	chunkSize = min(chunkSize, grpcMaxChunk)
+	var exists int
+	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM uploads WHERE id=?", uploadID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 || !canView(r, int(uploadID)) {
+		return grpcErrorf(grpcNotFound, "upload %d not found", uploadID)
+	}
+
+	// nodes then edges, each flushed every chunkSize rows, or sooner if the
+	// message would outgrow what clients accept
+	stream := func(field int, query string, cols int) error {
+		rows, err := db.QueryContext(r.Context(), query, uploadID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var chunk []byte
+		n := int64(0)
+		vals := make([]string, cols)
+		ptrs := make([]interface{}, cols)
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(ptrs...); err != nil {
+				return err
+			}
+			var msg []byte
+			for i, v := range vals {
+				msg = pbAppendString(msg, i+1, v)
+			}
+			entry := pbAppendBytes(nil, field, msg)
+			if n > 0 && len(chunk)+len(entry) > grpcMaxMessage {
+				if err := writeGRPCMessage(w, chunk); err != nil {
+					return err
+				}
+				chunk, n = nil, 0
+			}
+			chunk = append(chunk, entry...)
+			if n++; n == chunkSize {
+				if err := writeGRPCMessage(w, chunk); err != nil {
+					return err
+				}
+				chunk, n = nil, 0
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n > 0 {
+			return writeGRPCMessage(w, chunk)
+		}
+		return nil
+	}
+	if err := stream(1, "SELECT id,type,label,meta FROM nodes WHERE upload_id=?", 4); err != nil {
+		return err
+	}
+	return stream(2, "SELECT source,target,rel FROM edges WHERE upload_id=?", 3)
+}
+
+func grpcIngest(w http.ResponseWriter, r *http.Request) error {
+	tmp, err := os.CreateTemp(tempDir(), "repo-*.zip")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	// ingestZip owns the archive once it has recorded the upload; until
+	// then a failure must not leave it in the temp dir
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	name := ""
+	var size int64
+	for {
+		msg, err := readGRPCMessage(r.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var werr error
+		err = pbRange(msg, func(field int, v uint64, b []byte) {
+			switch field {
+			case 1:
+				if name == "" {
+					name = string(b)
+				}
+			case 2:
+				if size += int64(len(b)); maxUpload > 0 && size > maxUpload {
+					werr = grpcErrorf(grpcExhausted, "%v", errUploadTooLarge)
+				}
+				if werr == nil {
+					_, werr = tmp.Write(b)
+				}
+			}
+		})
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+		if werr != nil {
+			return werr
+		}
+	}
+	if name == "" {
+		name = "grpc-upload.zip"
+	}
+
+	uploadID, err := ingestZip(r.Context(), tmp.Name(), name, 0, uploaderKey(r, 0))
+	handedOff = uploadID != 0
+	if qe, ok := err.(*quotaError); ok {
+		return grpcErrorf(grpcExhausted, "%s", qe.msg)
+	}
+	if err == errShuttingDown {
+		return grpcErrorf(grpcUnavailable, "%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	return writeGRPCMessage(w, pbAppendInt(nil, 1, int64(uploadID)))
+}
+
+// ---- gRPC framing ----
+
+// grpcMaxMessage bounds one message, as gRPC's own default does.
+const grpcMaxMessage = 4 << 20
+
+// grpcMaxChunk is the most nodes or edges GetGraph sends in one message.
+const grpcMaxChunk = 10000
+
+// readGRPCMessage reads one length-prefixed message; io.EOF means the
+// client closed its side of the stream.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, grpcErrorf(grpcInvalidArgument, "truncated message header")
+		}
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > grpcMaxMessage {
+		return nil, grpcErrorf(grpcExhausted, "message of %d bytes exceeds the %d byte limit", n, grpcMaxMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated message")
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// ---- protobuf encoding ----
+
+func pbAppendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func pbAppendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = pbAppendVarint(b, uint64(field)<<3)
+	return pbAppendVarint(b, uint64(v))
+}
+
+func pbAppendBytes(b []byte, field int, v []byte) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3|2)
+	b = pbAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbAppendString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return pbAppendBytes(b, field, []byte(v))
+}
+
+// pbRange calls fn for each field of an encoded message. Varint fields
+// arrive in v, length-delimited ones in b; fixed-width fields are skipped.
+func pbRange(msg []byte, fn func(field int, v uint64, b []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("malformed field tag")
+		}
+		msg = msg[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errors.New("malformed varint")
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1:
+			if len(msg) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			msg = msg[8:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return errors.New("truncated length-delimited field")
+			}
+			fn(field, 0, msg[n:n+int(l)])
+			msg = msg[n+int(l):]
+		case 5:
+			if len(msg) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			msg = msg[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return nil
+}
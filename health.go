@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// healthzHandler serves /healthz, which answers as long as the process
+// does.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyChecks are what /readyz checks before saying the instance can take
+// traffic.
+var readyChecks = []struct {
+	name  string
+	check func(ctx context.Context) error
+}{
+	{"db", func(ctx context.Context) error { return db.PingContext(ctx) }},
+	{"schema", schemaMigrated},
+	{"temp_dir", tempDirWritable},
+}
+
+// schemaMigrated checks that the database has every column initDB adds and
+// the nodes key it rebuilds.
+func schemaMigrated(ctx context.Context) error {
+	for _, c := range addedColumns {
+		var n int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`, c.table, c.column).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%s.%s is missing", c.table, c.column)
+		}
+	}
+	var pk int
+	if err := db.QueryRowContext(ctx, `SELECT pk FROM pragma_table_info('nodes') WHERE name='upload_id'`).Scan(&pk); err != nil {
+		return err
+	}
+	if pk == 0 {
+		return fmt.Errorf("nodes is not keyed by upload")
+	}
+	return nil
+}
+
+// tempDirWritable checks that archives can be saved in the temp dir.
+func tempDirWritable(ctx context.Context) error {
+	f, err := os.CreateTemp(tempDir(), "gitvis-ready-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// readyzHandler serves /readyz: 200 when the database answers, its schema
+// is up to date and the temp dir can be written, else 503, with the result
+// of each check.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	status, checks := "ok", make(map[string]string, len(readyChecks))
+	for _, c := range readyChecks {
+		checks[c.name] = "ok"
+		if err := c.check(ctx); err != nil {
+			status, checks[c.name] = "unavailable", err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// history is the commit DAG of an upload, for analyses that walk it.
+// Parent placeholders that were never walked are left out, so a commit's
+// parents are only those stored in full.
+type history struct {
+	commits  map[string]*commitInfo
+	parents  map[string][]string // in commit order: first parent first
+	children map[string][]string
+	topo     []string       // parents before children, oldest first among peers
+	index    map[string]int // position in topo
+}
+
+func loadHistory(ctx context.Context, uploadID int) (*history, error) {
+	list, err := loadCommits(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	h := &history{
+		commits:  make(map[string]*commitInfo, len(list)),
+		parents:  make(map[string][]string),
+		children: make(map[string][]string),
+	}
+	for i := range list {
+		h.commits[list[i].Hash] = &list[i]
+	}
+	// edges are inserted in ParentHashes order, so id order keeps the
+	// first parent first
+	rows, err := db.QueryContext(ctx, "SELECT source,target FROM edges WHERE upload_id=? AND rel='parent' ORDER BY id", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c, p string
+		if err := rows.Scan(&c, &p); err != nil {
+			return nil, err
+		}
+		if h.commits[c] == nil || h.commits[p] == nil {
+			continue
+		}
+		h.parents[c] = append(h.parents[c], p)
+		h.children[p] = append(h.children[p], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	h.topo = h.topoOrder()
+	h.index = make(map[string]int, len(h.topo))
+	for i, c := range h.topo {
+		h.index[c] = i
+	}
+	return h, nil
+}
+
+// topoOrder sorts commits so parents come before children, taking the
+// oldest ready commit first (Kahn's algorithm).
+func (h *history) topoOrder() []string {
+	pending := make(map[string]int, len(h.commits))
+	ready := &commitHeap{h: h}
+	for hash := range h.commits {
+		pending[hash] = len(h.parents[hash])
+		if pending[hash] == 0 {
+			ready.list = append(ready.list, hash)
+		}
+	}
+	heap.Init(ready)
+	order := make([]string, 0, len(h.commits))
+	for ready.Len() > 0 {
+		c := heap.Pop(ready).(string)
+		order = append(order, c)
+		for _, child := range h.children[c] {
+			if pending[child]--; pending[child] == 0 {
+				heap.Push(ready, child)
+			}
+		}
+	}
+	return order
+}
+
+// generations numbers each commit one more than its highest parent, so
+// roots are 1. A commit can only be an ancestor of commits with a higher
+// generation.
+func (h *history) generations() map[string]int {
+	gen := make(map[string]int, len(h.topo))
+	for _, c := range h.topo {
+		g := 0
+		for _, p := range h.parents[c] {
+			if gen[p] > g {
+				g = gen[p]
+			}
+		}
+		gen[c] = g + 1
+	}
+	return gen
+}
+
+// storeCommitOrder records each commit's topological position and
+// generation in its meta, after an ingest has stored the whole history.
+func storeCommitOrder(ctx context.Context, uploadID int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	gen := h.generations()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.topo',?,'$.generation',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, c := range h.topo {
+		if _, err := stmt.ExecContext(ctx, i, gen[c], uploadID, c); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// firstParent returns c's first parent, or "" for a root.
+func (h *history) firstParent(c string) string {
+	if p := h.parents[c]; len(p) > 0 {
+		return p[0]
+	}
+	return ""
+}
+
+// only returns the commits reachable from include but not from exclude,
+// as git log ^exclude include lists them, newest first in topological
+// order. Commits are visited children first, so each one's marks are
+// final when it is reached, and the walk stops once only excluded
+// commits are left to visit.
+func (h *history) only(include, exclude []string) []string {
+	const (
+		in  = 1
+		out = 2
+	)
+	mark := make(map[string]int)
+	queue := &indexHeap{h: h}
+	push := func(c string, m int) {
+		if _, ok := h.index[c]; !ok {
+			return
+		}
+		if mark[c] == 0 {
+			heap.Push(queue, c)
+		}
+		mark[c] |= m
+	}
+	for _, c := range include {
+		push(c, in)
+	}
+	for _, c := range exclude {
+		push(c, out)
+	}
+	var list []string
+	pending := 0 // queued commits not marked out
+	for _, c := range queue.list {
+		if mark[c] == in {
+			pending++
+		}
+	}
+	for queue.Len() > 0 && pending > 0 {
+		c := heap.Pop(queue).(string)
+		m := mark[c]
+		if m == in {
+			pending--
+			list = append(list, c)
+		}
+		for _, p := range h.parents[c] {
+			before := mark[p]
+			push(p, m)
+			switch {
+			case before == 0 && mark[p] == in:
+				pending++ // newly queued as included
+			case before == in && mark[p]&out != 0:
+				pending-- // an included commit turned out excluded
+			}
+		}
+	}
+	return list
+}
+
+// indexHeap pops the commit latest in topological order first.
+type indexHeap struct {
+	h    *history
+	list []string
+}
+
+func (q *indexHeap) Len() int           { return len(q.list) }
+func (q *indexHeap) Less(i, j int) bool { return q.h.index[q.list[i]] > q.h.index[q.list[j]] }
+func (q *indexHeap) Swap(i, j int)      { q.list[i], q.list[j] = q.list[j], q.list[i] }
+func (q *indexHeap) Push(x interface{}) { q.list = append(q.list, x.(string)) }
+func (q *indexHeap) Pop() interface{} {
+	x := q.list[len(q.list)-1]
+	q.list = q.list[:len(q.list)-1]
+	return x
+}
+
+type commitHeap struct {
+	h    *history
+	list []string
+}
+
+func (q *commitHeap) Len() int { return len(q.list) }
+func (q *commitHeap) Less(i, j int) bool {
+	a, b := q.h.commits[q.list[i]], q.h.commits[q.list[j]]
+	if !a.When.Equal(b.When) {
+		return a.When.Before(b.When)
+	}
+	return a.Hash < b.Hash
+}
+func (q *commitHeap) Swap(i, j int)      { q.list[i], q.list[j] = q.list[j], q.list[i] }
+func (q *commitHeap) Push(x interface{}) { q.list = append(q.list, x.(string)) }
+func (q *commitHeap) Pop() interface{} {
+	x := q.list[len(q.list)-1]
+	q.list = q.list[:len(q.list)-1]
+	return x
+}
+
+// window is the newest part of a history's topological order, for views
+// that limit how many commits they show.
+type window struct {
+	*history
+	order    []string
+	included map[string]bool
+}
+
+// newest returns the last limit commits in topological order, or all of
+// them if limit is 0.
+func (h *history) newest(limit int) *window {
+	order := h.topo
+	if limit > 0 && len(order) > limit {
+		order = order[len(order)-limit:]
+	}
+	w := &window{history: h, order: order, included: make(map[string]bool, len(order))}
+	for _, c := range order {
+		w.included[c] = true
+	}
+	return w
+}
+
+// parent returns parent i of c, or "" if it has none or it falls outside
+// the window.
+func (w *window) parent(c string, i int) string {
+	if ps := w.parents[c]; i < len(ps) && w.included[ps[i]] {
+		return ps[i]
+	}
+	return ""
+}
+
+// branches gives each commit in the window to one branch by walking first
+// parents down from branch tips, the trunk first and then the others by
+// name. Commits only reachable through merges of deleted branches get
+// numbered stand-in branches.
+func (w *window) branches(refs []refInfo) (branchOf map[string]string, trunk string) {
+	var branches []refInfo
+	for _, ref := range refs {
+		if ref.Kind == "branch" {
+			branches = append(branches, ref)
+		}
+	}
+	trunk = pickTrunk(branches)
+	sort.SliceStable(branches, func(i, j int) bool {
+		if (branches[i].Name == trunk) != (branches[j].Name == trunk) {
+			return branches[i].Name == trunk
+		}
+		return branches[i].Name < branches[j].Name
+	})
+
+	branchOf = make(map[string]string, len(w.order))
+	claim := func(tip, name string) {
+		for c := tip; c != "" && w.included[c] && branchOf[c] == ""; {
+			branchOf[c] = name
+			c = w.parent(c, 0)
+		}
+	}
+	for _, b := range branches {
+		claim(b.Tip, b.Name)
+	}
+	anon := 0
+	for i := len(w.order) - 1; i >= 0; i-- {
+		if branchOf[w.order[i]] == "" {
+			anon++
+			claim(w.order[i], fmt.Sprintf("unnamed-%d", anon))
+		}
+	}
+	if trunk == "" && len(w.order) > 0 {
+		trunk = branchOf[w.order[0]]
+	}
+	return branchOf, trunk
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// issueRef matches an issue or pull request reference in a commit
+// message: "#123", "GH-123" or "owner/repo#123". What comes before it
+// must not be part of a word, so "abc#1" and entities like "&#123;" are
+// not references.
+var issueRef = regexp.MustCompile(`(?:^|[^\w/&#-])(?:([\w.-]+/[\w.-]+)#|#|(?i:GH)-)(\d+)\b`)
+
+// parseIssueRefs returns the issues a commit message refers to, in order
+// of first mention, as "#123" for the repository's own (GH-123 being
+// another way to write it) and "owner/repo#123" for another's.
+func parseIssueRefs(message string) []string {
+	var refs []string
+	seen := make(map[string]bool)
+	for _, m := range issueRef.FindAllStringSubmatch(message, -1) {
+		ref := m[1] + "#" + strings.TrimLeft(m[2], "0")
+		if ref == m[1]+"#" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// validIssueURL reports whether s can be an upload's issue link template:
+// an http or https URL with "{n}" where the issue number goes, such as
+// https://github.com/owner/repo/issues/{n}.
+func validIssueURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.Contains(s, "{n}")
+}
+
+// issueLink makes a link to ref with an upload's issue link template, or
+// returns "" when there is no template. Another repository's issues take
+// the place of the owner/repo starting the template's path, as GitHub,
+// GitLab and Gitea lay out their URLs; the graph page does the same.
+func issueLink(tmpl, ref string) string {
+	if tmpl == "" {
+		return ""
+	}
+	repo, n, _ := strings.Cut(ref, "#")
+	if repo != "" {
+		m := templateRepo.FindStringSubmatch(tmpl)
+		if m == nil {
+			return ""
+		}
+		tmpl = m[1] + repo + m[2]
+	}
+	return strings.Replace(tmpl, "{n}", n, 1)
+}
+
+// templateRepo splits an issue link template around the owner/repo
+// starting its path.
+var templateRepo = regexp.MustCompile(`^(https?://[^/]+/)[^/]+/[^/]+(/.*)$`)
+
+// storeIssueRefs records the issues each commit message refers to as
+// "issues", clearing it from commits that refer to none.
+func storeIssueRefs(ctx context.Context, uploadID int) error {
+	rows, err := db.QueryContext(ctx, "SELECT id,label FROM nodes WHERE upload_id=? AND type='commit' AND meta<>''", uploadID)
+	if err != nil {
+		return err
+	}
+	refs := make(map[string][]string)
+	for rows.Next() {
+		var id, label string
+		if err := rows.Scan(&id, &label); err != nil {
+			rows.Close()
+			return err
+		}
+		refs[id] = parseIssueRefs(label)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	set, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.issues',json(?)) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer set.Close()
+	unset, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_remove(meta,'$.issues') WHERE upload_id=? AND id=? AND json_extract(meta,'$.issues') IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	defer unset.Close()
+	for id, list := range refs {
+		if len(list) == 0 {
+			_, err = unset.ExecContext(ctx, uploadID, id)
+		} else {
+			b, _ := json.Marshal(list)
+			_, err = set.ExecContext(ctx, string(b), uploadID, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
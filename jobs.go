@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// progressEvent is a snapshot of an ingest job, pushed to /ws/jobs/{id} listeners.
+type progressEvent struct {
+	Job       int    `json:"job"`
+	Phase     string `json:"phase"` // queued, extracting, walking, indexing, done, failed
+	Refs      int    `json:"refs"`
+	RefsTotal int    `json:"refs_total"`
+	Commits   int    `json:"commits"`
+	Trees     int    `json:"trees"`
+	// blobs the secret scan flagged
+	Secrets int `json:"secrets,omitempty"`
+	// branches and tags a refresh found rewritten
+	Rewritten []string `json:"rewritten,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Graph     string   `json:"graph,omitempty"`
+}
+
+// job tracks one running ingest. Its ID is the upload ID. A nil *job is
+// valid and ignores all updates, for ingests nobody is watching.
+type job struct {
+	mu   sync.Mutex
+	ev   progressEvent
+	subs map[chan progressEvent]struct{}
+	done bool
+}
+
+var (
+	// how long finished jobs stay around for late subscribers
+	jobRetention time.Duration
+
+	// ingestSlots holds a token per running ingest when GITVIS_INGEST_WORKERS
+	// caps them; further ingests wait in the "queued" phase
+	ingestSlots chan struct{}
+)
+
+// waitIngestSlot blocks until another ingest may start, or ctx is done. The
+// returned func frees the slot.
+func waitIngestSlot(ctx context.Context) (func(), error) {
+	if ingestSlots == nil {
+		ingestsRunning.Add(1)
+		return func() { ingestsRunning.Add(-1) }, nil
+	}
+	ingestsQueued.Add(1)
+	defer ingestsQueued.Add(-1)
+	select {
+	case ingestSlots <- struct{}{}:
+		ingestsRunning.Add(1)
+		return func() { ingestsRunning.Add(-1); <-ingestSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[int]*job)
+)
+
+func newJob(uploadID int) *job {
+	j := &job{
+		ev:   progressEvent{Job: uploadID, Phase: "queued"},
+		subs: make(map[chan progressEvent]struct{}),
+	}
+	jobsMu.Lock()
+	jobs[uploadID] = j
+	jobsMu.Unlock()
+	return j
+}
+
+// activeJobs returns the state of every ingest still running.
+func activeJobs() []progressEvent {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	list := make([]progressEvent, 0)
+	for _, j := range jobs {
+		j.mu.Lock()
+		if !j.done {
+			list = append(list, j.ev)
+		}
+		j.mu.Unlock()
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Job < list[b].Job })
+	return list
+}
+
+func lookupJob(id int) *job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[id]
+}
+
+// update applies fn to the job's state and publishes the result.
+func (j *job) update(fn func(ev *progressEvent)) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.done {
+		return
+	}
+	fn(&j.ev)
+	for ch := range j.subs {
+		// events are snapshots, so a slow listener can safely miss some
+		select {
+		case ch <- j.ev:
+		default:
+		}
+	}
+}
+
+func (j *job) phase(p string) {
+	j.update(func(ev *progressEvent) { ev.Phase = p })
+}
+
+// finish publishes the final state, closes all subscriptions and schedules
+// the job for removal.
+func (j *job) finish(err error) {
+	if j == nil {
+		return
+	}
+	j.update(func(ev *progressEvent) {
+		if err != nil {
+			ev.Phase = "failed"
+			ev.Error = err.Error()
+		} else {
+			ev.Phase = "done"
+			ev.Graph = sitePath(fmt.Sprintf("/graph/%d", ev.Job))
+		}
+	})
+	j.mu.Lock()
+	j.done = true
+	for ch := range j.subs {
+		close(ch)
+	}
+	j.subs = nil
+	id := j.ev.Job
+	j.mu.Unlock()
+
+	time.AfterFunc(jobRetention, func() {
+		jobsMu.Lock()
+		// a refresh or retry may have started a new job for the upload since
+		if jobs[id] == j {
+			delete(jobs, id)
+		}
+		jobsMu.Unlock()
+	})
+}
+
+// subscribe returns the current state and a channel of subsequent updates,
+// closed when the job finishes.
+func (j *job) subscribe() (progressEvent, chan progressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ch := make(chan progressEvent, 16)
+	if j.done {
+		close(ch)
+	} else {
+		j.subs[ch] = struct{}{}
+	}
+	return j.ev, ch
+}
+
+func (j *job) unsubscribe(ch chan progressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.subs[ch]; ok {
+		delete(j.subs, ch)
+		close(ch)
+	}
+}
+
+func (j *job) snapshot() progressEvent {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.ev
+}
+
+// jobSocketHandler serves GET /ws/jobs/{id}, sending one JSON progress
+// event per message until the job finishes.
+func jobSocketHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/ws/jobs/"))
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	j := lookupJob(id)
+	if j == nil || !canView(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		// the connection is hijacked, so lift the server's deadlines on it
+		ws.SetDeadline(time.Time{})
+		ev, ch := j.subscribe()
+		defer j.unsubscribe(ch)
+		if err := websocket.JSON.Send(ws, ev); err != nil {
+			return
+		}
+		for ev := range ch {
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				return
+			}
+		}
+		// the final event may have been dropped for a slow reader
+		websocket.JSON.Send(ws, j.snapshot())
+	}).ServeHTTP(w, r)
+}
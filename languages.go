@@ -0,0 +1,93 @@
+package main
+
+// The languages of a tree, from the languages ingest.DetectLanguage
+// recorded for its blobs as they were walked.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// languageShare is one language of the languages endpoint.
+type languageShare struct {
+	Language string  `json:"language"`
+	Files    int     `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Percent  float64 `json:"percent"`
+}
+
+// languagesHandler serves /graph/{id}/languages: the files and bytes of
+// each language in the tree of the trunk branch's tip, or of ?ref=, most
+// bytes first. Files of no known language aren't counted.
+func languagesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	commit, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	// a blob found at several paths counts once; identical files are rare
+	// enough not to matter here
+	rows, err := db.QueryContext(r.Context(), `WITH RECURSIVE reach(id) AS (
+			SELECT target FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'
+			UNION
+			SELECT e.target FROM edges e JOIN reach ON e.source=reach.id
+			WHERE e.upload_id=? AND e.rel IN ('tree->tree','tree->blob')
+		)
+		SELECT json_extract(n.meta,'$.language') AS lang, COUNT(*), COALESCE(SUM(json_extract(n.meta,'$.size')),0)
+		FROM reach JOIN nodes n ON n.upload_id=? AND n.id=reach.id
+		WHERE n.type='blob' AND lang IS NOT NULL GROUP BY lang`, uploadID, commit, uploadID, uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	langs := make([]languageShare, 0)
+	var total int64
+	for rows.Next() {
+		var l languageShare
+		if err := rows.Scan(&l.Language, &l.Files, &l.Bytes); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		total += l.Bytes
+		langs = append(langs, l)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i := range langs {
+		if total > 0 {
+			langs[i].Percent = float64(langs[i].Bytes*1000/total) / 10
+		}
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if langs[i].Bytes != langs[j].Bytes {
+			return langs[i].Bytes > langs[j].Bytes
+		}
+		return langs[i].Language < langs[j].Language
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(langs)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// largeFilesDefaultLimit is how many blobs the large files report lists
+// unless asked for more.
+const largeFilesDefaultLimit = 50
+
+// largeFile is one blob of the large files report.
+type largeFile struct {
+	Blob string `json:"blob"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// the oldest commit whose tree holds the blob, which added it
+	Commit  string `json:"commit,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Message string `json:"message,omitempty"`
+	// whether the trunk branch's tip still holds it; removing a file
+	// only there leaves it in the history
+	InTip bool `json:"in_tip"`
+}
+
+// blobCommits maps blobs to the commits whose trees hold them, walking
+// the upload's tree edges upwards from each blob.
+func blobCommits(ctx context.Context, uploadID int, blobs []string) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT source, target, rel FROM edges WHERE upload_id=? AND rel IN ('commit->tree','tree->tree','tree->blob')", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	containers := make(map[string][]string)
+	commitsOf := make(map[string][]string)
+	for rows.Next() {
+		var source, target, rel string
+		if err := rows.Scan(&source, &target, &rel); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if rel == "commit->tree" {
+			commitsOf[target] = append(commitsOf[target], source)
+		} else {
+			containers[target] = append(containers[target], source)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]string, len(blobs))
+	for _, b := range blobs {
+		seen := map[string]bool{b: true}
+		queue := []string{b}
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			found[b] = append(found[b], commitsOf[id]...)
+			for _, t := range containers[id] {
+				if !seen[t] {
+					seen[t] = true
+					queue = append(queue, t)
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// largeFilesHandler serves /graph/{id}/analytics/large-files: the biggest
+// blobs anywhere in the upload's history, biggest first, each with the
+// commit that added it and whether the trunk branch's tip still has it,
+// at most ?limit= of them (default 50, 0 for all) and none smaller than
+// ?min_bytes=. Blobs the tip no longer has are what rewriting the history
+// would remove. Files kept by Git LFS count as their pointers, which is
+// all the repository holds of them.
+func largeFilesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	limit, ok := limitParam(w, r, largeFilesDefaultLimit)
+	if !ok {
+		return
+	}
+	var minBytes int64
+	if s := r.URL.Query().Get("min_bytes"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "min_bytes must be a non-negative number", 400)
+			return
+		}
+		minBytes = n
+	}
+
+	// what the repository stores: an LFS pointer rather than the file
+	const stored = "COALESCE(json_extract(meta,'$.pointer_size'), json_extract(meta,'$.size'))"
+	var blobs int
+	var total int64
+	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*), COALESCE(SUM("+stored+"),0) FROM nodes WHERE upload_id=? AND type='blob'",
+		uploadID).Scan(&blobs, &total); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	query := `SELECT id, COALESCE(json_extract(meta,'$.path'), label), ` + stored + ` FROM nodes
+		WHERE upload_id=? AND type='blob' AND ` + stored + ` >= ?
+		ORDER BY ` + stored + ` DESC, id`
+	args := []interface{}{uploadID, minBytes}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	files := make([]largeFile, 0)
+	for rows.Next() {
+		var f largeFile
+		if err := rows.Scan(&f.Blob, &f.Path, &f.Size); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.Blob
+	}
+	holders, err := blobCommits(r.Context(), uploadID, ids)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	branches, err := loadRefs(r.Context(), uploadID, "branch")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	tip := ""
+	if trunk := pickTrunk(branches); trunk != "" {
+		if tip, err = resolveCommit(r.Context(), uploadID, trunk); err != nil {
+			http.Error(w, fmt.Sprintf("ref: %v", err), 500)
+			return
+		}
+	}
+	for i := range files {
+		f := &files[i]
+		first := ""
+		for _, c := range holders[f.Blob] {
+			if c == tip {
+				f.InTip = true
+			}
+			if _, ok := h.index[c]; ok && (first == "" || h.index[c] < h.index[first]) {
+				first = c
+			}
+		}
+		if first != "" {
+			info := h.commits[first]
+			f.Commit, f.Author, f.Date, f.Message = first, info.Author, info.When.Format(time.RFC3339), firstLine(info.Message)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"blobs": blobs, "bytes": total, "files": files})
+}
@@ -0,0 +1,217 @@
+package main
+
+// Node positions computed at ingest, so the graph page can draw large
+// uploads without running a force simulation over every node. Commits are
+// laid out in layers (a simple Sugiyama layout), each commit's trees and
+// blobs in rings around it, and refs just above the commits they point at.
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// layoutEnabled is cleared by GITVIS_LAYOUT=off, for instances that would
+// rather not spend the ingest time.
+var layoutEnabled bool
+
+const (
+	layoutStep   = 80 // distance between layers and between commits in a layer
+	layoutRing   = 40 // distance between the rings of a radial tree
+	layoutSweeps = 4  // crossing-reduction passes, each down then up
+)
+
+type point struct{ x, y float64 }
+
+// layeredLayout places commits in layers by generation, newest at the
+// top like git log, and orders each layer by the average position of its
+// neighbours in the layers before it to reduce crossings.
+func (h *history) layeredLayout() map[string]point {
+	gen := h.generations()
+	var layers [][]string
+	for _, c := range h.topo {
+		g := gen[c] - 1
+		for len(layers) <= g {
+			layers = append(layers, nil)
+		}
+		layers[g] = append(layers[g], c)
+	}
+	pos := make(map[string]int, len(h.topo))
+	for _, layer := range layers {
+		for i, c := range layer {
+			pos[c] = i
+		}
+	}
+	// reorder sorts a layer by the barycenter of each commit's neighbours;
+	// commits with none keep their place
+	reorder := func(layer []string, neighbours map[string][]string) {
+		key := make(map[string]float64, len(layer))
+		for _, c := range layer {
+			key[c] = float64(pos[c])
+			if ns := neighbours[c]; len(ns) > 0 {
+				sum := 0
+				for _, n := range ns {
+					sum += pos[n]
+				}
+				key[c] = float64(sum) / float64(len(ns))
+			}
+		}
+		sort.SliceStable(layer, func(i, j int) bool { return key[layer[i]] < key[layer[j]] })
+		for i, c := range layer {
+			pos[c] = i
+		}
+	}
+	for s := 0; s < layoutSweeps; s++ {
+		for g := 1; g < len(layers); g++ {
+			reorder(layers[g], h.parents)
+		}
+		for g := len(layers) - 2; g >= 0; g-- {
+			reorder(layers[g], h.children)
+		}
+	}
+
+	at := make(map[string]point, len(h.topo))
+	for g, layer := range layers {
+		for i, c := range layer {
+			at[c] = point{
+				x: float64(i)*layoutStep - float64(len(layer)-1)*layoutStep/2,
+				y: float64(len(layers)-1-g) * layoutStep,
+			}
+		}
+	}
+	return at
+}
+
+// radialLayout places a tree's contents in rings around center, one ring
+// per directory level, giving each entry a share of the half circle to the
+// right (away from the tree's commit) in proportion to the files below it. Entries already placed under an
+// earlier commit stay where they are.
+func radialLayout(root string, center point, entries map[string][]string, at map[string]point) {
+	// the part of the tree not placed yet, as a spanning tree
+	kids := make(map[string][]string)
+	at[root] = center
+	var claim func(id string)
+	claim = func(id string) {
+		for _, e := range entries[id] {
+			if _, ok := at[e]; ok {
+				continue
+			}
+			at[e] = center // claimed; moved below
+			kids[id] = append(kids[id], e)
+			claim(e)
+		}
+	}
+	claim(root)
+	leaves := make(map[string]int)
+	var count func(id string) int
+	count = func(id string) int {
+		n := 0
+		for _, k := range kids[id] {
+			n += count(k)
+		}
+		if n == 0 {
+			n = 1
+		}
+		leaves[id] = n
+		return n
+	}
+	count(root)
+	var place func(id string, depth int, from, to float64)
+	place = func(id string, depth int, from, to float64) {
+		for _, k := range kids[id] {
+			span := (to - from) * float64(leaves[k]) / float64(leaves[id])
+			a := from + span/2
+			r := float64(depth+1) * layoutRing
+			at[k] = point{center.x + r*math.Cos(a), center.y + r*math.Sin(a)}
+			place(k, depth+1, from, from+span)
+			from += span
+		}
+	}
+	place(root, 0, -math.Pi/2, math.Pi/2)
+}
+
+// storeLayout records x and y in the meta of every commit, tree, blob and
+// ref of an upload, after an ingest has stored the whole graph. Parent
+// placeholders are left without a position.
+func storeLayout(ctx context.Context, uploadID int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	at := h.layeredLayout()
+
+	rows, err := db.QueryContext(ctx, "SELECT source,target,rel FROM edges WHERE upload_id=? AND rel IN ('commit->tree','tree->tree','tree->blob') ORDER BY id", uploadID)
+	if err != nil {
+		return err
+	}
+	rootOf := make(map[string]string)
+	entries := make(map[string][]string)
+	for rows.Next() {
+		var s, t, rel string
+		if err := rows.Scan(&s, &t, &rel); err != nil {
+			rows.Close()
+			return err
+		}
+		if rel == "commit->tree" {
+			rootOf[s] = t
+		} else {
+			entries[s] = append(entries[s], t)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// oldest commits first, so a file shared by many commits sits with the
+	// one that introduced it; each root tree is set off to the right of
+	// its commit
+	for _, c := range h.topo {
+		root, ok := rootOf[c]
+		if !ok {
+			continue
+		}
+		if _, placed := at[root]; placed {
+			continue
+		}
+		radialLayout(root, point{at[c].x + layoutRing, at[c].y}, entries, at)
+	}
+
+	// refs stack up above the commit they point at
+	rows, err = db.QueryContext(ctx, "SELECT source,target FROM edges WHERE upload_id=? AND rel='ref->commit' ORDER BY source", uploadID)
+	if err != nil {
+		return err
+	}
+	stacked := make(map[string]int)
+	for rows.Next() {
+		var ref, tip string
+		if err := rows.Scan(&ref, &tip); err != nil {
+			rows.Close()
+			return err
+		}
+		if p, ok := at[tip]; ok {
+			stacked[tip]++
+			at[ref] = point{p.x, p.y - float64(stacked[tip])*layoutRing}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(COALESCE(NULLIF(meta,''),'{}'),'$.x',?,'$.y',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, p := range at {
+		if _, err := stmt.ExecContext(ctx, math.Round(p.x), math.Round(p.y), uploadID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,327 @@
+package main
+
+// License detection: license files (LICENSE, COPYING and the like) are
+// identified by their text, and source files by an SPDX-License-Identifier
+// header. The license texts recognized are the common ones; others are
+// reported as NOASSERTION, as SPDX does.
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// licenseHeaderBytes is how much of a file is searched for an SPDX
+// header, and of a license file for the license text's telltale lines.
+const licenseHeaderBytes = 4096
+
+// spdxHeader matches an SPDX-License-Identifier line, taking the license
+// expression up to the end of the line or of a comment.
+var spdxHeader = regexp.MustCompile(`(?m)SPDX-License-Identifier:[ \t]*([A-Za-z0-9.+() -]*[A-Za-z0-9.+)])`)
+
+// licenseTexts identify a license file by phrases its text has, checked
+// in order so that the LGPL and AGPL aren't taken for the GPL.
+var licenseTexts = []struct {
+	id      string
+	phrases []string
+}{
+	{"AGPL-3.0", []string{"GNU AFFERO GENERAL PUBLIC LICENSE"}},
+	{"LGPL-3.0", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"LGPL-2.1", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 2.1"}},
+	{"GPL-3.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"GPL-2.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 2"}},
+	{"Apache-2.0", []string{"Apache License", "Version 2.0"}},
+	{"MPL-2.0", []string{"Mozilla Public License", "2.0"}},
+	{"EPL-2.0", []string{"Eclipse Public License", "2.0"}},
+	{"BSL-1.0", []string{"Boost Software License"}},
+	{"CC0-1.0", []string{"CC0 1.0 Universal"}},
+	{"Unlicense", []string{"This is free and unencumbered software released into the public domain"}},
+	{"ISC", []string{"Permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"MIT", []string{"Permission is hereby granted, free of charge"}},
+	{"BSD-3-Clause", []string{"Redistribution and use in source and binary forms", "Neither the name"}},
+	{"BSD-2-Clause", []string{"Redistribution and use in source and binary forms"}},
+}
+
+// isLicenseFile reports whether a file name is one projects keep their
+// license in: LICENSE, LICENCE, COPYING or UNLICENSE, with or without a
+// text extension, or a variant like LICENSE-MIT or COPYING.LESSER.
+func isLicenseFile(name string) bool {
+	upper := strings.ToUpper(name)
+	switch path.Ext(upper) {
+	case ".MD", ".TXT", ".RST":
+		upper = strings.TrimSuffix(upper, path.Ext(upper))
+	}
+	switch upper {
+	case "LICENSE", "LICENCE", "COPYING", "UNLICENSE":
+		return true
+	}
+	for _, prefix := range []string{"LICENSE-", "LICENCE-", "LICENSE.", "COPYING."} {
+		if strings.HasPrefix(upper, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifyLicense names the license a license file holds by its SPDX ID,
+// or NOASSERTION for text it doesn't recognize.
+func identifyLicense(text string) string {
+	// line breaks fall anywhere in license texts
+	text = strings.Join(strings.Fields(text), " ")
+	for _, l := range licenseTexts {
+		all := true
+		for _, p := range l.phrases {
+			if !strings.Contains(text, p) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return l.id
+		}
+	}
+	return "NOASSERTION"
+}
+
+// blobHead reads up to n bytes from the start of a blob.
+func blobHead(r *git.Repository, hash plumbing.Hash, n int64) (string, bool) {
+	b, err := r.BlobObject(hash)
+	if err != nil {
+		return "", false
+	}
+	rd, err := b.Reader()
+	if err != nil {
+		return "", false
+	}
+	defer rd.Close()
+	head, err := io.ReadAll(io.LimitReader(rd, n))
+	if err != nil {
+		return "", false
+	}
+	return string(head), true
+}
+
+// storeLicenses records each blob's "license": what a license file holds
+// (with "license_file" set) or what a source file's SPDX header declares.
+// The licenses of the license files at the root of the trunk branch's tip
+// become the upload's "licenses".
+func storeLicenses(ctx context.Context, r *git.Repository, uploadID int) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, label FROM nodes WHERE upload_id=? AND type='blob'", uploadID)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for rows.Next() {
+		var id, label string
+		if err := rows.Scan(&id, &label); err != nil {
+			rows.Close()
+			return err
+		}
+		names[id] = label
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// a merge patch, where null removes a key
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_patch(COALESCE(NULLIF(meta,''),'{}'),?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		head, ok := blobHead(r, plumbing.NewHash(id), licenseHeaderBytes)
+		if !ok {
+			continue
+		}
+		patch := map[string]interface{}{"license": nil, "license_file": nil}
+		if isLicenseFile(name) {
+			patch["license"], patch["license_file"] = identifyLicense(head), true
+		} else if m := spdxHeader.FindStringSubmatch(head); m != nil {
+			patch["license"] = strings.TrimSpace(m[1])
+		}
+		b, _ := json.Marshal(patch)
+		if _, err := stmt.ExecContext(ctx, string(b), uploadID, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	var licenses []string
+	branches, err := loadRefs(ctx, uploadID, "branch")
+	if err != nil {
+		return err
+	}
+	if trunk := pickTrunk(branches); trunk != "" {
+		tip, err := resolveCommit(ctx, uploadID, trunk)
+		if err != nil {
+			return err
+		}
+		if licenses, err = rootLicenses(ctx, uploadID, tip); err != nil {
+			return err
+		}
+	}
+	var stored interface{}
+	if len(licenses) > 0 {
+		b, _ := json.Marshal(licenses)
+		stored = string(b)
+	}
+	_, err = db.ExecContext(ctx, "UPDATE uploads SET licenses=? WHERE id=?", stored, uploadID)
+	return err
+}
+
+// rootLicenses returns the distinct licenses of the license files at the
+// root of commit's tree, sorted.
+func rootLicenses(ctx context.Context, uploadID int, commit string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT json_extract(n.meta,'$.license') FROM edges t
+		JOIN edges e ON e.upload_id=t.upload_id AND e.source=t.target AND e.rel='tree->blob'
+		JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+		WHERE t.upload_id=? AND t.source=? AND t.rel='commit->tree' AND json_extract(n.meta,'$.license_file')
+		ORDER BY 1`, uploadID, commit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var licenses []string
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
+		}
+		licenses = append(licenses, l)
+	}
+	return licenses, rows.Err()
+}
+
+// licenseFile is a license file in the licenses summary.
+type licenseFile struct {
+	Path    string `json:"path"`
+	Blob    string `json:"blob"`
+	License string `json:"license"`
+}
+
+// licenseCount is how many files declare one license expression.
+type licenseCount struct {
+	License string `json:"license"`
+	Files   int    `json:"files"`
+}
+
+// licensesHandler serves /graph/{id}/licenses: for the tree of the trunk
+// branch's tip, or of ?ref=, the licenses of the license files at its
+// root, every license file in it (vendored code keeps its own), and how
+// many files declare each license in an SPDX header, most first.
+func licensesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	commit, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	licenses, err := rootLicenses(r.Context(), uploadID, commit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `WITH RECURSIVE reach(id) AS (
+			SELECT target FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'
+			UNION
+			SELECT e.target FROM edges e JOIN reach ON e.source=reach.id
+			WHERE e.upload_id=? AND e.rel IN ('tree->tree','tree->blob')
+		)
+		SELECT n.id, COALESCE(json_extract(n.meta,'$.path'), n.label), json_extract(n.meta,'$.license'),
+			COALESCE(json_extract(n.meta,'$.license_file'), 0)
+		FROM reach JOIN nodes n ON n.upload_id=? AND n.id=reach.id
+		WHERE n.type='blob'`, uploadID, commit, uploadID, uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	files := make([]licenseFile, 0)
+	counts := make(map[string]int)
+	total, declared := 0, 0
+	for rows.Next() {
+		var id, path string
+		var license sql.NullString
+		var isFile bool
+		if err := rows.Scan(&id, &path, &license, &isFile); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		switch {
+		case isFile:
+			files = append(files, licenseFile{Path: path, Blob: id, License: license.String})
+		case license.Valid:
+			counts[license.String]++
+			declared++
+			total++
+		default:
+			total++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	spdx := make([]licenseCount, 0, len(counts))
+	for l, n := range counts {
+		spdx = append(spdx, licenseCount{License: l, Files: n})
+	}
+	sort.Slice(spdx, func(i, j int) bool {
+		if spdx[i].Files != spdx[j].Files {
+			return spdx[i].Files > spdx[j].Files
+		}
+		return spdx[i].License < spdx[j].License
+	})
+	if licenses == nil {
+		licenses = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ref":            ref,
+		"licenses":       licenses,
+		"license_files":  files,
+		"spdx":           spdx,
+		"files":          total,
+		"without_header": total - declared,
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// branchLife is one branch of the branch lifetimes analysis.
+type branchLife struct {
+	Name   string `json:"name"`
+	Tip    string `json:"tip"`
+	Status string `json:"status"` // merged or unmerged
+	// where the branch left the trunk; absent for unrelated histories
+	Base string `json:"base,omitempty"`
+	// the trunk commit that brought the branch in, the branch's own tip
+	// when it was fast-forwarded
+	MergeCommit string `json:"merge_commit,omitempty"`
+	Created     string `json:"created"`
+	MergedAt    string `json:"merged_at,omitempty"`
+	LastCommit  string `json:"last_commit"`
+	Commits     int    `json:"commits"`
+	// whole days from creation to merge, or to now for unmerged branches
+	LifetimeDays int `json:"lifetime_days"`
+}
+
+// branchLifetimes works out when each branch other than trunk forked off
+// it and when, if ever, it came back. A branch is merged when the trunk
+// reaches its tip; the merge commit is the one on the trunk's first-parent
+// line that first did. The branch's commits are those its tip reaches and
+// the trunk didn't before then, and it was created with the oldest of them
+// by author date. Longest-lived first.
+func branchLifetimes(h *history, branches []refInfo, trunk string, now time.Time) []branchLife {
+	var trunkTip string
+	for _, b := range branches {
+		if b.Name == trunk {
+			trunkTip = b.Tip
+		}
+	}
+	// the first-parent commit each commit on the trunk landed with
+	landed := make(map[string]string)
+	for c := trunkTip; c != "" && h.commits[c] != nil; c = h.firstParent(c) {
+		var exclude []string
+		if p := h.firstParent(c); p != "" {
+			exclude = []string{p}
+		}
+		for _, x := range h.only([]string{c}, exclude) {
+			landed[x] = c
+		}
+	}
+
+	out := make([]branchLife, 0, len(branches))
+	for _, b := range branches {
+		if b.Name == trunk || h.commits[b.Tip] == nil {
+			continue
+		}
+		life := branchLife{Name: b.Name, Tip: b.Tip, Status: "unmerged"}
+		against := trunkTip
+		end := now
+		if m, ok := landed[b.Tip]; ok {
+			life.Status, life.MergeCommit = "merged", m
+			end = h.commits[m].When
+			life.MergedAt = end.Format(time.RFC3339)
+			against = h.firstParent(m)
+		}
+		var exclude []string
+		if against != "" {
+			exclude = []string{against}
+			if bases := h.mergeBases(b.Tip, against); len(bases) > 0 {
+				life.Base = bases[0]
+			}
+		}
+		own := h.only([]string{b.Tip}, exclude)
+		life.Commits = len(own)
+		created := h.commits[b.Tip].When
+		for _, c := range own {
+			if when := h.commits[c].When; when.Before(created) {
+				created = when
+			}
+		}
+		life.Created = created.Format(time.RFC3339)
+		life.LastCommit = h.commits[b.Tip].When.Format(time.RFC3339)
+		if end.After(created) {
+			life.LifetimeDays = int(end.Sub(created).Hours() / 24)
+		}
+		out = append(out, life)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LifetimeDays != out[j].LifetimeDays {
+			return out[i].LifetimeDays > out[j].LifetimeDays
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// branchLifetimesHandler serves /graph/{id}/analytics/branch-lifetimes.
+// ?status=merged or ?status=unmerged keeps one kind, and ?min_days=N the
+// branches that lived at least N days.
+func branchLifetimesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "merged" && status != "unmerged" {
+		http.Error(w, "status must be merged or unmerged", 400)
+		return
+	}
+	minDays := 0
+	if s := r.URL.Query().Get("min_days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "min_days must be a non-negative number", 400)
+			return
+		}
+		minDays = n
+	}
+	branches, err := loadRefs(r.Context(), uploadID, "branch")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	trunk := pickTrunk(branches)
+	if trunk == "" {
+		http.Error(w, "no branches", 404)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	list := make([]branchLife, 0)
+	for _, b := range branchLifetimes(h, branches, trunk, time.Now()) {
+		if (status == "" || b.Status == status) && b.LifetimeDays >= minDays {
+			list = append(list, b)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"trunk": trunk, "branches": list})
+}
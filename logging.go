@@ -0,0 +1,143 @@
+package main
+
+// Logging, with log/slog. Records go to stderr as text, or as JSON lines
+// with GITVIS_LOG_FORMAT=json, at GITVIS_LOG_LEVEL (debug, info, warn or
+// error; default info) and up. Records logged with a request's context
+// carry its request_id, and those of an ingest its upload_id, so the lines
+// about one failed upload can be found together.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// newLogger builds the logger the settings ask for.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(setting("GITVIS_LOG_LEVEL"))); err != nil {
+		fatalf("GITVIS_LOG_LEVEL: want debug, info, warn or error, got %q", setting("GITVIS_LOG_LEVEL"))
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch setting("GITVIS_LOG_FORMAT") {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		fatalf("GITVIS_LOG_FORMAT: want text or json, got %q", setting("GITVIS_LOG_FORMAT"))
+	}
+	return slog.New(contextHandler{h})
+}
+
+// fatalf logs a message and stops the program, for startup errors such as
+// bad settings.
+func fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log records carry attrs besides
+// those ctx already adds.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	old, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, append(old[:len(old):len(old)], attrs...))
+}
+
+// contextHandler adds the attributes of withLogAttrs to records logged
+// with a context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// requestID is the ID withRequestID gave the request ctx belongs to.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID gives every request an ID, echoed in the X-Request-ID
+// response header and logged with everything done for it: the client's
+// own X-Request-ID when it sends a plausible one, else a random one.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if len(id) == 0 || len(id) > 64 || strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		h.ServeHTTP(w, r.WithContext(withLogAttrs(ctx, slog.String("request_id", id))))
+	})
+}
+
+var accessLogEnabled bool
+
+// accessLogged logs every request h serves once it is done: its method,
+// path (without the query, which may hold share tokens), status, response
+// size, duration and client address.
+func accessLogged(h http.Handler) http.Handler {
+	if !accessLogEnabled {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.code(),
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+			"remote", remoteIP(r))
+	})
+}
+
+// remoteIP is the address of the client that sent r: the first one in
+// X-Forwarded-For when r came through a proxy on this host or a private
+// network, since that is where the proxy put it, else the peer's.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !(peer.IsLoopback() || peer.IsPrivate()) {
+		return host
+	}
+	first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+	if ip := net.ParseIP(strings.TrimSpace(first)); ip != nil {
+		return ip.String()
+	}
+	return host
+}
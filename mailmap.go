@@ -0,0 +1,169 @@
+package main
+
+// Identity merging with a .mailmap, so that someone who committed under
+// several names or emails counts as one person. The repository's own file
+// is read at the trunk tip, and GITVIS_MAILMAP can name a server-side file
+// whose entries take precedence over it.
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+// mailmapPath is the server-side mailmap, read on every ingest so edits
+// take effect with the next upload or refresh.
+var mailmapPath string
+
+// mailmapEntry is the identity a mailmap line maps to; an empty field is
+// left as the commit has it.
+type mailmapEntry struct {
+	name, email string
+}
+
+// mailmap holds entries by lowercased commit email and name, with an
+// empty name for entries that match any name.
+type mailmap map[[2]string]mailmapEntry
+
+// parse adds the entries of a file in git's mailmap format, replacing any
+// already there for the same commit identity:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+func (m mailmap) parse(src string) {
+	for _, line := range strings.Split(src, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		name1, email1, rest, ok := mailmapIdentity(line)
+		if !ok {
+			continue
+		}
+		name2, email2, _, ok := mailmapIdentity(rest)
+		if !ok {
+			// a name for an email, which stays as it is
+			m[[2]string{strings.ToLower(email1), ""}] = mailmapEntry{name: name1}
+			continue
+		}
+		m[[2]string{strings.ToLower(email2), strings.ToLower(name2)}] = mailmapEntry{name: name1, email: email1}
+	}
+}
+
+// mailmapIdentity takes an optional name and an email in angle brackets
+// off the front of s.
+func mailmapIdentity(s string) (name, email, rest string, ok bool) {
+	open := strings.IndexByte(s, '<')
+	if open < 0 {
+		return "", "", "", false
+	}
+	end := strings.IndexByte(s[open:], '>')
+	if end < 0 {
+		return "", "", "", false
+	}
+	name = strings.TrimSpace(s[:open])
+	email = strings.TrimSpace(s[open+1 : open+end])
+	return name, email, s[open+end+1:], true
+}
+
+// resolve maps a commit's identity the way git log's %aN and %aE do: an
+// entry for both the email and the name wins over one for the email alone.
+// Emails and names match regardless of case.
+func (m mailmap) resolve(name, email string) (string, string) {
+	e, ok := m[[2]string{strings.ToLower(email), strings.ToLower(name)}]
+	if !ok {
+		e, ok = m[[2]string{strings.ToLower(email), ""}]
+	}
+	if !ok {
+		return name, email
+	}
+	if e.name != "" {
+		name = e.name
+	}
+	if e.email != "" {
+		email = e.email
+	}
+	return name, email
+}
+
+// loadMailmap reads the repository's .mailmap at the trunk tip and then
+// the server-side one, whose entries take precedence.
+func loadMailmap(ctx context.Context, r *git.Repository, uploadID int) (mailmap, error) {
+	src, err := trunkFile(ctx, r, uploadID, ".mailmap")
+	if err != nil {
+		return nil, err
+	}
+	m := make(mailmap)
+	m.parse(src)
+	if mailmapPath != "" {
+		if b, err := os.ReadFile(mailmapPath); err == nil {
+			m.parse(string(b))
+		} else {
+			// a missing override shouldn't fail every ingest
+			slog.WarnContext(ctx, "mailmap", "err", err)
+		}
+	}
+	return m, nil
+}
+
+// storeMailmap records the identity m gives each commit's author as
+// "mailmap_author" and "mailmap_email", on the commits where it differs,
+// and clears them elsewhere so a refresh picks up an edited mailmap.
+// loadCommits prefers them, so every per-author count merges the
+// identities.
+func storeMailmap(ctx context.Context, uploadID int, m mailmap) error {
+	rows, err := db.QueryContext(ctx, `SELECT id, COALESCE(json_extract(meta,'$.author'),''), COALESCE(json_extract(meta,'$.email'),'')
+		FROM nodes WHERE upload_id=? AND type='commit' AND meta<>''`, uploadID)
+	if err != nil {
+		return err
+	}
+	mapped := make(map[string]mailmapEntry)
+	var unmapped []string
+	for rows.Next() {
+		var id, name, email string
+		if err := rows.Scan(&id, &name, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		if n, e := m.resolve(name, email); n != name || e != email {
+			mapped[id] = mailmapEntry{name: n, email: e}
+		} else {
+			unmapped = append(unmapped, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	set, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.mailmap_author',?,'$.mailmap_email',?) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer set.Close()
+	for id, e := range mapped {
+		if _, err := set.ExecContext(ctx, e.name, e.email, uploadID, id); err != nil {
+			return err
+		}
+	}
+	unset, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_remove(meta,'$.mailmap_author','$.mailmap_email') WHERE upload_id=? AND id=? AND json_extract(meta,'$.mailmap_email') IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	defer unset.Close()
+	for _, id := range unmapped {
+		if _, err := unset.ExecContext(ctx, uploadID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
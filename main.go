@@ -2,58 +2,218 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
+	"syscall"
 	"time"
 
-	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
-	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/example/gitvis/pkg/api"
+	"github.com/example/gitvis/pkg/ingest"
+	"github.com/example/gitvis/pkg/store"
 )
 
-var db *sql.DB
+var (
+	db *sql.DB
+	// graphStore keeps graphs in db
+	graphStore *store.Store
+	// graphAPI serves whole graphs from graphStore
+	graphAPI *api.Handler
+)
 
 func main() {
-	var err error
-	db, err = sql.Open("sqlite3", "./gitvis.db")
+	settings = loadConfig(os.Args[1:])
+	slog.SetDefault(newLogger())
+	configure()
+	if settings.printConfig {
+		writeConfig(os.Stdout, settings)
+		return
+	}
+	name, args := "serve", settings.args
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	err := runCommand(name, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	if err := initDB(); err != nil {
-		log.Fatal(err)
+}
+
+// openDB opens the database file name, creating and migrating its schema
+// as needed.
+func openDB(name string) error {
+	var err error
+	if db, err = sql.Open("sqlite3-counted", name); err != nil {
+		return err
+	}
+	graphStore = store.New(db)
+	graphAPI = api.NewHandler(graphStore)
+	return initDB()
+}
+
+// serve serves HTTP (and gRPC) until SIGINT or SIGTERM.
+func serve() {
+	if err := failInterruptedIngests(); err != nil {
+		fatalf("db: %v", err)
+	}
+	if uploadRetention > 0 {
+		go expireUploads()
 	}
+	// a mux of our own: net/http/pprof and expvar add their handlers to
+	// http.DefaultServeMux, which would serve them to anyone
+	mux := http.NewServeMux()
+	mux.Handle("/", compressed(http.HandlerFunc(uploadForm)))
+	mux.Handle("/upload", rateLimited(uploadLimiter, csrfProtected(http.HandlerFunc(uploadHandler))))
+	mux.Handle("/graph/", rateLimited(apiLimiter, csrfProtected(compressed(http.HandlerFunc(graphPageHandler))))) // /graph/{id}  and /graph/{id}/{resource}
+	mux.Handle("/compare/", rateLimited(apiLimiter, compressed(http.HandlerFunc(compareRoute))))
+	mux.Handle("/combined", rateLimited(apiLimiter, compressed(http.HandlerFunc(combinedHandler))))
+	mux.HandleFunc("/ws/jobs/", jobSocketHandler)
+	mux.Handle("/auth/", csrfProtected(http.HandlerFunc(authHandler)))
+	mux.Handle("/admin", compressed(http.HandlerFunc(adminPage)))
+	mux.Handle("/api/v1/", rateLimited(apiLimiter, csrfProtected(compressed(http.HandlerFunc(apiV1Handler)))))
+	mux.Handle("/api/graphql", rateLimited(apiLimiter, compressed(http.HandlerFunc(graphqlHandler))))
+	mux.Handle(grpcServicePrefix, rateLimited(apiLimiter, http.HandlerFunc(grpcHandler)))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.Handle("/metrics", compressed(http.HandlerFunc(metricsHandler)))
+	mux.Handle("/static/", compressed(http.StripPrefix("/static/", http.FileServerFS(staticFiles()))))
+	handleDebug(mux)
 
-	http.HandleFunc("/", uploadForm)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/graph/", graphPageHandler) // /graph/{id}  and /graph/{id}/json
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	// h2c lets gRPC clients speak cleartext HTTP/2 on the same port
+	addr := setting("GITVIS_ADDR")
+	srv := newServer(addr, h2c.NewHandler(withRequestID(accessLogged(underBasePath(withAPIToken(traced(measured(mux)))))), &http2.Server{IdleTimeout: idleTimeout}))
+	listen := configureTLS(srv)
+	go func() {
+		if err := listen(); err != http.ErrServerClosed {
+			fatalf("serve: %v", err)
+		}
+	}()
+	slog.Info("listening", "addr", addr)
 
-	log.Println("listening :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// a second signal kills the process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	shutdown(srv)
 }
 
 func initDB() error {
-	schema, err := os.ReadFile("db_init.sql")
+	schema, err := fs.ReadFile(assets, "db_init.sql")
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(string(schema))
+	if _, err = db.Exec(string(schema)); err != nil {
+		return err
+	}
+	for _, c := range addedColumns {
+		if err := addColumnIfMissing(c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+	if err := rekeyNodes(); err != nil {
+		return err
+	}
+	// charge uploads made before quotas existed to their owners
+	_, err = db.Exec("UPDATE uploads SET uploader='user:'||user_id WHERE uploader IS NULL AND user_id IS NOT NULL")
+	return err
+}
+
+// addedColumns are the columns added after the original schema; CREATE
+// TABLE IF NOT EXISTS won't add them to existing databases.
+var addedColumns = []struct{ table, column, decl string }{
+	{"uploads", "graph_hash", "TEXT"},
+	{"uploads", "user_id", "INTEGER REFERENCES users(id)"},
+	{"uploads", "visibility", "TEXT NOT NULL DEFAULT 'unlisted'"},
+	{"uploads", "uploader", "TEXT"},
+	{"uploads", "size_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"uploads", "status", "TEXT"},
+	{"uploads", "error", "TEXT"},
+	{"uploads", "archive", "TEXT"},
+	{"uploads", "issue_url", "TEXT"},
+	{"uploads", "fingerprint", "TEXT"},
+	{"uploads", "licenses", "TEXT"},
+	{"ref_history", "rewritten", "INTEGER NOT NULL DEFAULT 0"},
+	{"ref_history", "orphaned", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// rekeyNodes rebuilds a nodes table keyed by id alone, as databases made
+// before uploads could share objects have, with the (upload_id, id) key.
+// Under the old key a later upload took over the objects it shared with an
+// earlier one, its refs included.
+func rekeyNodes() error {
+	var pk int
+	if err := db.QueryRow(`SELECT pk FROM pragma_table_info('nodes') WHERE name='upload_id'`).Scan(&pk); err != nil || pk > 0 {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`CREATE TABLE nodes_rekeyed (
+			id TEXT,
+			upload_id INTEGER,
+			type TEXT,
+			label TEXT,
+			meta TEXT,
+			PRIMARY KEY(upload_id, id),
+			FOREIGN KEY(upload_id) REFERENCES uploads(id)
+		)`,
+		`INSERT INTO nodes_rekeyed(id, upload_id, type, label, meta) SELECT id, upload_id, type, label, meta FROM nodes`,
+		`DROP TABLE nodes`,
+		`ALTER TABLE nodes_rekeyed RENAME TO nodes`,
+		// dropped along with the old table
+		`CREATE INDEX nodes_id ON nodes(id)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addColumnIfMissing(table, column, decl string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
 	return err
 }
 
 func uploadForm(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "templates/upload.html")
+	t, err := template.ParseFS(assets, "templates/upload.html")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, map[string]string{"CSRF": csrfToken(w, r), "Base": basePath})
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,6 +221,15 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method", http.StatusMethodNotAllowed)
 		return
 	}
+	owner := 0
+	if authEnabled() {
+		u := currentUser(r)
+		if u == nil {
+			http.Error(w, "sign in to upload", http.StatusUnauthorized)
+			return
+		}
+		owner = u.ID
+	}
 	f, header, err := r.FormFile("repo")
 	if err != nil {
 		http.Error(w, err.Error(), 400)
@@ -68,49 +237,272 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer f.Close()
 	name := header.Filename
-	tmp, err := os.CreateTemp("", "repo-*.zip")
+	tmp, err := os.CreateTemp(tempDir(), "repo-*.zip")
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	defer tmp.Close()
-	if _, err := io.Copy(tmp, f); err != nil {
-		http.Error(w, err.Error(), 500)
+	size, err := saveUpload(tmp, f)
+	if err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	key := uploaderKey(r, owner)
+	// a repository state the uploader already uploaded can reuse that graph:
+	// duplicate=reuse takes it, duplicate=upload ingests again, and without
+	// either the page is asked, or the form without script reuses
+	duplicate := r.FormValue("duplicate")
+	existing := 0
+	if duplicate != "upload" {
+		if existing, err = archiveDuplicate(tmp.Name(), key); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	wantJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+	if existing != 0 {
+		os.Remove(tmp.Name())
+		switch {
+		case !wantJSON:
+			http.Redirect(w, r, sitePath(fmt.Sprintf("/graph/%d", existing)), http.StatusSeeOther)
+		case duplicate == "reuse":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":     existing,
+				"graph":  sitePath(fmt.Sprintf("/graph/%d", existing)),
+				"reused": true,
+			})
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":        "this repository state was already uploaded",
+				"duplicate_of": existing,
+				"graph":        sitePath(fmt.Sprintf("/graph/%d", existing)),
+			})
+		}
+		return
+	}
+	// script-driven uploads ask for JSON and watch progress on /ws/jobs/{id}
+	if wantJSON {
+		uploadID, err := createUpload(name, owner, key, size)
+		if err != nil {
+			uploadFailed(w, err)
+			return
+		}
+		j := newJob(uploadID)
+		// the handler's deferred Close runs before the goroutine reads the
+		// file, so hand it a path rather than the open handle; the job
+		// outlives the request, so it isn't cancelled with it
+		zipPath := tmp.Name()
+		go func() {
+			j.finish(ingestInto(context.WithoutCancel(r.Context()), zipPath, uploadID, j))
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job":    uploadID,
+			"graph":  sitePath(fmt.Sprintf("/graph/%d", uploadID)),
+			"events": sitePath(fmt.Sprintf("/ws/jobs/%d", uploadID)),
+		})
 		return
 	}
-	tmpPath := tmp.Name()
-	res, err := db.Exec("INSERT INTO uploads(name) VALUES(?)", name)
+
+	extendForIngest(w)
+	uploadID, err := ingestZip(r.Context(), tmp.Name(), name, owner, key)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		uploadFailed(w, err)
 		return
 	}
-	uploadID64, _ := res.LastInsertId()
-	uploadID := int(uploadID64)
+	http.Redirect(w, r, sitePath(fmt.Sprintf("/graph/%d", uploadID)), http.StatusSeeOther)
+}
 
-	extractDir := filepath.Join(os.TempDir(), fmt.Sprintf("gitvis-%d-%d", uploadID, time.Now().UnixNano()))
+// ingestZip records a new upload called name, owned by user ID owner (0 for
+// none) and charged to uploader, and stores the graph of the repository
+// archived at zipPath. If ctx is cancelled first (the client went away) the
+// partial upload is removed.
+func ingestZip(ctx context.Context, zipPath, name string, owner int, uploader string) (int, error) {
+	fi, err := os.Stat(zipPath)
+	if err != nil {
+		return 0, err
+	}
+	uploadID, err := createUpload(name, owner, uploader, fi.Size())
+	if err != nil {
+		return 0, err
+	}
+	if err := ingestInto(ctx, zipPath, uploadID, nil); err != nil {
+		if ctx.Err() != nil {
+			if _, derr := deleteUpload(uploadID); derr != nil {
+				slog.ErrorContext(ctx, "removing cancelled ingest", "upload_id", uploadID, "err", derr)
+			}
+		}
+		return uploadID, err
+	}
+	return uploadID, nil
+}
+
+// createUpload records a new upload, failing with a *quotaError if it would
+// take uploader over its quota. Commands have none.
+func createUpload(name string, owner int, uploader string, size int64) (int, error) {
+	var userID interface{}
+	visibility := "unlisted"
+	if owner != 0 {
+		userID, visibility = owner, "private"
+	}
+	if isShuttingDown() {
+		return 0, errShuttingDown
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if uploader != cliUploader {
+		if err := checkQuota(uploader, 1, size); err != nil {
+			return 0, err
+		}
+	}
+	res, err := db.Exec("INSERT INTO uploads(name, user_id, visibility, uploader, size_bytes) VALUES(?,?,?,?,?)",
+		name, userID, visibility, uploader, size)
+	if err != nil {
+		return 0, err
+	}
+	uploadID, _ := res.LastInsertId()
+	uploadsTotal.add(1)
+	return int(uploadID), nil
+}
+
+// ingestInto extracts the zip at zipPath and stores its graph under
+// uploadID, reporting progress to j (which may be nil). It stops early when
+// ctx is done or the ingest timeout passes, not counting the time spent
+// queued behind other ingests when GITVIS_INGEST_WORKERS caps them. The
+// archive is removed once ingested and kept after a failure so the ingest
+// can be retried. Each phase is logged with how long it took. Shutdown
+// waits for the ingest, and interrupts it if it runs too long.
+func ingestInto(ctx context.Context, zipPath string, uploadID int, j *job) (err error) {
+	ctx = withLogAttrs(ctx, slog.Int("upload_id", uploadID))
+	ctx, untrack, err := trackIngest(ctx)
+	if err != nil {
+		db.Exec("UPDATE uploads SET status='failed', error=?, archive=? WHERE id=?", err.Error(), zipPath, uploadID)
+		return err
+	}
+	defer untrack()
+	db.Exec("UPDATE uploads SET status='queued', error=NULL, archive=? WHERE id=?", zipPath, uploadID)
+	queued := time.Now()
+	release, err := waitIngestSlot(ctx)
+	if err != nil {
+		db.Exec("UPDATE uploads SET status='failed', error=? WHERE id=?", err.Error(), uploadID)
+		slog.ErrorContext(ctx, "ingest failed", "phase", "queued", "err", err)
+		return err
+	}
+	defer release()
+	slog.DebugContext(ctx, "ingest phase done", "phase", "queued", "duration", time.Since(queued))
+	ingestPhaseSeconds.observe(time.Since(queued).Seconds(), "queued")
+	ctx, cancel := context.WithTimeout(ctx, ingestTimeout)
+	defer cancel()
+	defer beginGraphChange(uploadID)()
+	db.Exec("UPDATE uploads SET status='ingesting', error=NULL, archive=? WHERE id=?", zipPath, uploadID)
+
+	start := time.Now()
+	ctx, ingestSpan := startSpan(ctx, "ingest", spanInternal)
+	ingestSpan.set("gitvis.upload_id", uploadID)
+	ingestCtx := ctx
+	phase, phaseStart := "", start
+	var phaseSpan *span
+	phaseDone := func(err error) {
+		slog.InfoContext(ctx, "ingest phase done", "phase", phase, "duration", time.Since(phaseStart))
+		ingestPhaseSeconds.observe(time.Since(phaseStart).Seconds(), phase)
+		phaseSpan.end(err)
+	}
+	enter := func(p string) {
+		if phase != "" {
+			phaseDone(nil)
+		}
+		phase, phaseStart = p, time.Now()
+		ctx, phaseSpan = startSpan(ingestCtx, "ingest "+p, spanInternal)
+		j.phase(p)
+	}
+	var fingerprint string
+	defer func() {
+		if err != nil && context.Cause(ctx) == errShuttingDown {
+			err = errShuttingDown
+		}
+		defer ingestSpan.end(err)
+		if err != nil {
+			phaseSpan.end(err)
+			db.Exec("UPDATE uploads SET status='failed', error=? WHERE id=?", err.Error(), uploadID)
+			slog.ErrorContext(ctx, "ingest failed", "phase", phase, "err", err, "duration", time.Since(start))
+			ingestsTotal.add(1, "failed")
+			ingestSeconds.observe(time.Since(start).Seconds(), "failed")
+			return
+		}
+		db.Exec("UPDATE uploads SET status='done', archive=NULL, fingerprint=NULLIF(?,'') WHERE id=?", fingerprint, uploadID)
+		os.Remove(zipPath)
+		phaseDone(nil)
+		slog.InfoContext(ctx, "ingest done", "duration", time.Since(start))
+		ingestsTotal.add(1, "done")
+		ingestSeconds.observe(time.Since(start).Seconds(), "done")
+	}()
+	enter("extracting")
+	if fingerprint, err = archiveFingerprint(zipPath); err != nil {
+		return err
+	}
+	extractDir := filepath.Join(tempDir(), fmt.Sprintf("gitvis-%d-%d", uploadID, time.Now().UnixNano()))
 	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return err
 	}
-	if err := unzipTo(tmpPath, extractDir); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	defer os.RemoveAll(extractDir)
+	if err := unzipTo(ctx, zipPath, extractDir); err != nil {
+		return err
 	}
-	if err := parseAndStoreRepo(extractDir, uploadID); err != nil {
-		http.Error(w, "parse error: "+err.Error(), 500)
-		return
+	enter("walking")
+	positions, err := parseAndStoreRepo(ctx, extractDir, uploadID, j)
+	if err != nil {
+		return fmt.Errorf("parse error: %w", err)
+	}
+	enter("indexing")
+	rewritten, err := storeRefHistory(ctx, uploadID, positions)
+	if err != nil {
+		return err
+	}
+	j.update(func(ev *progressEvent) { ev.Rewritten = rewritten })
+	if err := storeCommitOrder(ctx, uploadID); err != nil {
+		return err
+	}
+	if err := storeCategories(ctx, uploadID); err != nil {
+		return err
+	}
+	if err := storeIssueRefs(ctx, uploadID); err != nil {
+		return err
+	}
+	if err := storeRelated(ctx, uploadID); err != nil {
+		return err
+	}
+	if layoutEnabled {
+		if err := storeLayout(ctx, uploadID); err != nil {
+			return err
+		}
 	}
-	http.Redirect(w, r, fmt.Sprintf("/graph/%d", uploadID), http.StatusSeeOther)
+	publishGraphEvent(uploadID, "ingested", map[string]int{"upload": uploadID})
+	return nil
 }
 
-func unzipTo(zipPath, dest string) error {
+func unzipTo(ctx context.Context, zipPath, dest string) error {
 	r, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
+	// archives can come from anywhere, so none of them is extracted if one
+	// entry would land outside dest
+	for _, f := range r.File {
+		if _, err := zipEntryPath(dest, f.Name); err != nil {
+			return err
+		}
+	}
 	for _, f := range r.File {
-		outPath := filepath.Join(dest, f.Name)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		outPath, _ := zipEntryPath(dest, f.Name)
 		if f.FileInfo().IsDir() {
 			os.MkdirAll(outPath, f.Mode())
 			continue
@@ -136,115 +528,335 @@ func unzipTo(zipPath, dest string) error {
 	return nil
 }
 
-func parseAndStoreRepo(root string, uploadID int) error {
-	var repoPath string
-	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		// detect .git dir
-		if info.IsDir() && info.Name() == ".git" {
-			repoPath = p
-			return filepath.SkipDir
-		}
-		// detect bare repo by presence of HEAD file
-		if !info.IsDir() && info.Name() == "HEAD" && repoPath == "" {
-			repoPath = filepath.Dir(p)
+// zipEntryPath is where the archive entry name extracts to under dest. It
+// fails for absolute names and those climbing out with "..".
+func zipEntryPath(dest, name string) (string, error) {
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	if filepath.IsAbs(name) || strings.HasPrefix(slashed, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("archive entry %q: absolute path", name)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("archive entry %q: path leaves the archive", name)
 		}
-		return nil
-	})
-	if repoPath == "" {
-		// try root
-		repoPath = root
 	}
+	p := filepath.Join(dest, name)
+	if rel, err := filepath.Rel(dest, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %q: path leaves the archive", name)
+	}
+	return p, nil
+}
 
-	r, err := git.PlainOpen(repoPath)
+// parseAndStoreRepo stores the graph of the repository under root and
+// returns where its branches and tags point.
+func parseAndStoreRepo(ctx context.Context, root string, uploadID int, j *job) ([]refPosition, error) {
+	r, err := ingest.Open(root)
 	if err != nil {
-		// try DetectDotGit
-		r, err = git.PlainOpenWithOptions(repoPath, &git.PlainOpenOptions{DetectDotGit: true})
-		if err != nil {
-			return err
-		}
+		return nil, err
 	}
-
-	refs, err := r.References()
+	refs, err := ingest.Refs(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		// consider branches and tags
-		if !(ref.Name().IsBranch() || ref.Name().IsTag()) {
-			return nil
-		}
-		cIter, err := r.Log(&git.LogOptions{From: ref.Hash()})
-		if err != nil {
-			return nil
+	j.update(func(ev *progressEvent) { ev.RefsTotal = len(refs) })
+	sink := &uploadSink{uploadID: uploadID, j: j, positions: make([]refPosition, 0, len(refs))}
+	if err := ingest.Walk(ctx, r, refs, sink, ingestVisitors()...); err != nil {
+		return nil, err
+	}
+	positions := sink.positions
+	// the archive is gone after the ingest, so identities, churn,
+	// ownership and line counts are worked out now; owners and credits go
+	// by the mailmap, so it comes first
+	m, err := loadMailmap(ctx, r, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeMailmap(ctx, uploadID, m); err != nil {
+		return nil, err
+	}
+	if err := storeTrailers(ctx, uploadID, m); err != nil {
+		return nil, err
+	}
+	if err := storeChurn(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeLineStats(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeCherryPicks(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeReverts(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeCodeowners(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	flagged, err := countSecrets(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	j.update(func(ev *progressEvent) { ev.Secrets = flagged })
+	if err := storeLicenses(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeDependencies(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeReadmes(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeThumbnails(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	if err := storeBlobTexts(ctx, r, uploadID); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// uploadSink stores the graph the walk finds under an upload, reporting
+// progress to j, and collects where the refs point.
+type uploadSink struct {
+	uploadID  int
+	j         *job
+	commits   int // of the ref being walked
+	positions []refPosition
+}
+
+func (s *uploadSink) Node(id, typ, label string, meta map[string]interface{}) {
+	if typ == "commit" {
+		if s.commits++; s.commits%100 == 0 {
+			s.j.update(func(ev *progressEvent) { ev.Commits += 100 })
 		}
-		_ = cIter.ForEach(func(c *object.Commit) error {
-			// store commit node
-			meta := map[string]interface{}{
-				"author": c.Author.Name, "email": c.Author.Email, "time": c.Author.When.String(),
-			}
-			storeNode(c.Hash.String(), uploadID, "commit", strings.TrimSpace(c.Message), meta)
-			// parents
-			for _, p := range c.ParentHashes {
-				storeNodeIfMissing(p.String(), uploadID, "commit", "")
-				storeEdge(uploadID, c.Hash.String(), p.String(), "parent")
-			}
-			// commit->tree
-			tree, err := c.Tree()
-			if err == nil {
-				storeNodeIfMissing(tree.Hash.String(), uploadID, "tree", "/")
-				storeEdge(uploadID, c.Hash.String(), tree.Hash.String(), "commit->tree")
-				traverseTree(r, tree, uploadID)
-			}
-			return nil
-		})
-		return nil
+	}
+	// a blob that can't be read has no metadata, rather than null
+	var m interface{}
+	if meta != nil {
+		m = meta
+	}
+	storeNode(id, s.uploadID, typ, label, m)
+}
+
+func (s *uploadSink) NodeIfMissing(id, typ, label string) {
+	storeNodeIfMissing(id, s.uploadID, typ, label)
+}
+
+func (s *uploadSink) Edge(source, target, rel string) {
+	storeEdge(s.uploadID, source, target, rel)
+}
+
+func (s *uploadSink) TreeEntry(tree string, e object.TreeEntry) {
+	storeTreeEntry(s.uploadID, tree, e)
+}
+
+func (s *uploadSink) TreeSize(tree string, files int, size int64) {
+	s.j.update(func(ev *progressEvent) { ev.Trees++ })
+	storeTreeSize(tree, s.uploadID, files, size)
+}
+
+func (s *uploadSink) Ref(ref *plumbing.Reference, tag *object.Tag, tip *object.Commit, commits int) {
+	storeRef(ref, tag, tip, commits, s.uploadID)
+	s.positions = append(s.positions, refPosition{Kind: refKind(ref), Name: ref.Name().Short(), Tip: tip.Hash.String()})
+	s.j.update(func(ev *progressEvent) {
+		ev.Refs++
+		ev.Commits += commits % 100
 	})
-	return err
+	s.commits = 0
 }
 
-func traverseTree(r *git.Repository, t *object.Tree, uploadID int) {
-	for _, e := range t.Entries {
-		if e.Mode.IsFile() {
-			// store blob with filename in the label
-			storeNode(e.Hash.String(), uploadID, "blob", e.Name, nil)
-			storeEdge(uploadID, t.Hash.String(), e.Hash.String(), "tree->blob")
-		} else if e.Mode == filemode.Dir {
-			// try to load subtree by path
-			subtree, err := r.TreeObject(e.Hash)
-			if err == nil && subtree != nil {
-				storeNodeIfMissing(subtree.Hash.String(), uploadID, "tree", e.Name)
-				storeEdge(uploadID, t.Hash.String(), subtree.Hash.String(), "tree->tree")
-				traverseTree(r, subtree, uploadID)
-			}
+// storeRef records a branch or tag as a "ref" node pointing at its tip commit.
+// tag is the annotated tag object, or nil for branches and lightweight tags.
+func storeRef(ref *plumbing.Reference, tag *object.Tag, tip *object.Commit, count int, uploadID int) {
+	kind := refKind(ref)
+	meta := map[string]interface{}{
+		"kind": kind, "target": tip.Hash.String(),
+		"date": tip.Committer.When.Format(time.RFC3339), "commits": count,
+	}
+	if tag != nil {
+		meta["tag_date"] = tag.Tagger.When.Format(time.RFC3339)
+		meta["tag_message"] = strings.TrimSpace(tag.Message)
+	}
+	id := ref.Name().String()
+	storeNode(id, uploadID, "ref", ref.Name().Short(), meta)
+	// on refresh the ref may have moved; drop the edge to its old tip
+	rows, err := db.Query(`SELECT target FROM edges WHERE upload_id=? AND source=? AND rel='ref->commit' AND target<>?`,
+		uploadID, id, tip.Hash.String())
+	if err == nil {
+		var stale []string
+		for rows.Next() {
+			var t string
+			rows.Scan(&t)
+			stale = append(stale, t)
 		}
+		rows.Close()
+		for _, t := range stale {
+			db.Exec(`DELETE FROM edges WHERE upload_id=? AND source=? AND target=? AND rel='ref->commit'`, uploadID, id, t)
+			publishGraphEvent(uploadID, "unlink", graphLink{Source: id, Target: t, Rel: "ref->commit"})
+		}
+	}
+	storeEdge(uploadID, id, tip.Hash.String(), "ref->commit")
+}
+
+// storeTreeSize records a tree's totals without touching its label, which
+// is the name it was first seen under.
+func storeTreeSize(id string, uploadID int, files int, size int64) {
+	b, _ := json.Marshal(map[string]interface{}{"files": files, "size": size})
+	res, err := db.Exec(`UPDATE nodes SET meta=? WHERE id=? AND upload_id=? AND COALESCE(meta,'')<>?`, string(b), id, uploadID, string(b))
+	if err != nil || !watchingGraph(uploadID) {
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		var label string
+		db.QueryRow(`SELECT label FROM nodes WHERE id=? AND upload_id=?`, id, uploadID).Scan(&label)
+		publishGraphEvent(uploadID, "node", api.MakeNode(id, "tree", label, string(b)))
 	}
 }
 
 func storeNode(id string, uploadID int, typ, label string, meta interface{}) {
-	metaStr := ""
+	n := store.Node{ID: id, Type: typ, Label: label}
 	if meta != nil {
 		b, _ := json.Marshal(meta)
-		metaStr = string(b)
+		n.Meta = string(b)
+	}
+	changed := false
+	if watchingGraph(uploadID) {
+		old, err := graphStore.Node(uploadID, id)
+		changed = err != nil || old != n
+	}
+	err := graphStore.PutNode(uploadID, n)
+	if err == nil {
+		nodesWritten.add(1)
+	}
+	if err == nil && changed {
+		publishGraphEvent(uploadID, "node", api.MakeNode(id, typ, label, n.Meta))
 	}
-	_, _ = db.Exec(`INSERT OR REPLACE INTO nodes(id, upload_id, type, label, meta) VALUES(?,?,?,?,?)`,
-		id, uploadID, typ, label, metaStr)
 }
 
 func storeNodeIfMissing(id string, uploadID int, typ, label string) {
-	_, _ = db.Exec(`INSERT OR IGNORE INTO nodes(id, upload_id, type, label, meta) VALUES(?,?,?,?,?)`,
-		id, uploadID, typ, label, "")
+	added, err := graphStore.AddNode(uploadID, store.Node{ID: id, Type: typ, Label: label})
+	if err != nil || !added {
+		return
+	}
+	nodesWritten.add(1)
+	if watchingGraph(uploadID) {
+		publishGraphEvent(uploadID, "node", api.MakeNode(id, typ, label, ""))
+	}
 }
 
 func storeEdge(uploadID int, source, target, rel string) {
-	_, _ = db.Exec(`INSERT INTO edges(upload_id, source, target, rel) VALUES(?,?,?,?)`,
-		uploadID, source, target, rel)
+	added, err := graphStore.AddEdge(uploadID, store.Edge{Source: source, Target: target, Rel: rel})
+	if err != nil || !added {
+		return
+	}
+	edgesWritten.add(1)
+	if watchingGraph(uploadID) {
+		publishGraphEvent(uploadID, "link", graphLink{Source: source, Target: target, Rel: rel})
+	}
+}
+
+// graphResources are the per-upload endpoints, served as /graph/{id}/{name}
+// and under the versioned API as /api/v1/uploads/{id}/{name}.
+var graphResources = map[string]func(http.ResponseWriter, *http.Request, string){
+	"json":             graphJSONHandler,
+	"branches":         withQueryTimeout(branchesHandler),
+	"tags":             withQueryTimeout(tagsHandler),
+	"ref-history":      withQueryTimeout(refHistoryHandler),
+	"releases":         withQueryTimeout(releasesHandler),
+	"changelog":        withQueryTimeout(changelogHandler),
+	"contributors":     withQueryTimeout(contributorsHandler),
+	"activity":         withQueryTimeout(activityHandler),
+	"frequency":        withQueryTimeout(frequencyHandler),
+	"timing":           withQueryTimeout(timingHandler),
+	"events":           graphEventsHandler,
+	"refresh":          withToken(refreshHandler),
+	"share":            shareHandler,
+	"export/dot":       exporter("dot", "text/vnd.graphviz; charset=utf-8", writeDOT),
+	"export/graphml":   exporter("graphml", "application/xml; charset=utf-8", writeGraphML),
+	"export/gexf":      exporter("gexf", "application/xml; charset=utf-8", writeGEXF),
+	"export/cytoscape": exporter("cyjs", "application/json", writeCytoscape),
+	"export/mermaid":   mermaidHandler,
+	"export/nodes.csv": exporter("nodes.csv", "text/csv; charset=utf-8", writeNodesCSV),
+	"export/edges.csv": exporter("edges.csv", "text/csv; charset=utf-8", writeEdgesCSV),
+	"export/ndjson":    exporter("ndjson", "application/x-ndjson", writeNDJSON),
+	"export/cypher":    exporter("cypher", "text/plain; charset=utf-8", writeCypher),
+	"export/sqlite":    exporter("db", "application/vnd.sqlite3", writeSQLite),
+	"render.svg":       renderHandler("svg"),
+	"render.png":       renderHandler("png"),
+	"expand":           expandHandler,
+	"ancestor":         withQueryTimeout(ancestorHandler),
+	"merge-base":       withQueryTimeout(mergeBaseHandler),
+	"compare-refs":     withQueryTimeout(compareRefsHandler),
+	"diff":             withQueryTimeout(diffHandler),
+	"secrets":          withQueryTimeout(secretsHandler),
+	"related":          withQueryTimeout(relatedHandler),
+	"churn":            withQueryTimeout(churnHandler),
+	"languages":        withQueryTimeout(languagesHandler),
+	"licenses":         withQueryTimeout(licensesHandler),
+	"readme":           withQueryTimeout(readmeHandler),
+
+	// analyses over the whole history
+	"analytics/bus-factor":       withQueryTimeout(busFactorHandler),
+	"analytics/growth":           withQueryTimeout(growthHandler),
+	"analytics/branch-lifetimes": withQueryTimeout(branchLifetimesHandler),
+	"analytics/workflow":         withQueryTimeout(workflowHandler),
+	"analytics/stale-files":      withQueryTimeout(staleFilesHandler),
+	"analytics/large-files":      withQueryTimeout(largeFilesHandler),
+}
+
+// objectResources are the per-object endpoints, served as
+// /graph/{id}/{kind}/{hash}/{name} (or /graph/{id}/{kind}/{hash} for the
+// name "") and keyed "{kind}/{name}". Handlers find the hash with
+// objectHash.
+var objectResources = map[string]func(http.ResponseWriter, *http.Request, string){
+	"blob/":      withQueryTimeout(blobHandler),
+	"blob/thumb": withQueryTimeout(thumbHandler),
+	"tree/":      withQueryTimeout(treeHandler),
+}
+
+type objectHashKey struct{}
+
+// lookupResource finds the handler of a per-upload resource path, such as
+// "branches" or "blob/{hash}/thumb".
+func lookupResource(resource string) (func(http.ResponseWriter, *http.Request, string), bool) {
+	if h, ok := graphResources[resource]; ok {
+		return h, true
+	}
+	parts := strings.SplitN(resource, "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, false
+	}
+	name := ""
+	if len(parts) == 3 {
+		name = parts[2]
+	}
+	h, ok := objectResources[parts[0]+"/"+name]
+	if !ok {
+		return nil, false
+	}
+	hash := parts[1]
+	return func(w http.ResponseWriter, r *http.Request, idStr string) {
+		h(w, r.WithContext(context.WithValue(r.Context(), objectHashKey{}, hash)), idStr)
+	}, true
+}
+
+// objectHash is the {hash} of a per-object resource's path.
+func objectHash(r *http.Request) string {
+	hash, _ := r.Context().Value(objectHashKey{}).(string)
+	return hash
+}
+
+// graphViews are the values of ?view= on the graph JSON: graphs derived
+// from an upload's history rather than its stored objects.
+var graphViews = map[string]func(http.ResponseWriter, *http.Request, int){
+	"collaboration": collaborationJSON,
+	"directories":   directoriesJSON,
+	"coupling":      couplingJSON,
+	"dependencies":  dependenciesJSON,
 }
 
 func graphPageHandler(w http.ResponseWriter, r *http.Request) {
-	// expecting /graph/{id} or /graph/{id}/json
+	// expecting /graph/{id} or /graph/{id}/{resource}
 	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	if len(parts) < 2 {
 		http.NotFound(w, r)
@@ -255,115 +867,161 @@ func graphPageHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if !viewable(w, r, idStr) {
+		return
+	}
+
+	if len(parts) > 2 {
+		h, ok := lookupResource(strings.Join(parts[2:], "/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r, idStr)
+		return
+	}
 
-	if len(parts) == 3 && parts[2] == "json" {
-		graphJSONHandler(w, r, idStr)
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
 		return
 	}
 
-	// query the upload name
+	// query the upload name and its issue link template
 	var uploadName string
-	err := db.QueryRow(`SELECT name FROM uploads WHERE id = ?`, idStr).Scan(&uploadName)
+	var issueURL sql.NullString
+	err = db.QueryRow(`SELECT name, issue_url FROM uploads WHERE id = ?`, uploadID).Scan(&uploadName, &issueURL)
 	if err != nil {
 		uploadName = "(unknown)"
 	}
+	owner, visibility := "", ""
+	if a, ok, _ := lookupAccess(uploadID); ok {
+		visibility = a.Visibility
+		if a.Owner != 0 && isOwner(r, a) {
+			owner = "yes"
+		}
+	}
 
-	// render graph.html as a template, injecting RepoID
-	t, err := template.ParseFiles("templates/graph.html")
+	// render graph.html with html/template: the name comes from the uploaded
+	// file name and must be escaped for each context it lands in
+	t, err := template.ParseFS(assets, "templates/graph.html")
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
 	// inject RepoID and Name into the template
+	csrf := csrfToken(w, r)
 	t.Execute(w, map[string]string{
-		"RepoID": idStr,
-		"Name":   uploadName,
+		"CSRF":       csrf,
+		"Base":       basePath,
+		"RepoID":     idStr,
+		"Name":       uploadName,
+		"Owner":      owner,
+		"Visibility": visibility,
+		"IssueURL":   issueURL.String,
 	})
 }
 
+// graphNode and graphLink are the node/link shapes of the graph JSON.
+type (
+	graphNode = api.Node
+	graphLink = api.Link
+)
+
 func graphJSONHandler(w http.ResponseWriter, r *http.Request, idStr string) {
 	uploadID, err := strconv.Atoi(idStr)
 	if err != nil {
 		http.Error(w, "bad id", 400)
 		return
 	}
-
-	type Node struct {
-		ID    string                 `json:"id"`
-		Type  string                 `json:"type"`
-		Label string                 `json:"label,omitempty"`
-		Extra map[string]interface{} `json:"extra,omitempty"`
+	if view := r.URL.Query().Get("view"); view != "" {
+		h, ok := graphViews[view]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown view %q", view), 400)
+			return
+		}
+		if !notModified(w, r, uploadID) {
+			h(w, r, uploadID)
+		}
+		return
 	}
-	type Link struct {
-		Source string `json:"source"`
-		Target string `json:"target"`
-		Rel    string `json:"rel,omitempty"`
+	q, err := parseGraphQuery(r, uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if notModified(w, r, uploadID) {
+		return
+	}
+	if q.whole() {
+		graphAPI.ServeGraph(w, r, uploadID)
+		return
+	}
+
+	notes, err := q.annotations(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
 
-	// fetch nodes
-	rows, err := db.Query("SELECT id,type,label,meta FROM nodes WHERE upload_id=?", uploadID)
+	// Stream rows straight from the database instead of building both
+	// slices in memory; large repositories have millions of edges.
+	rows, err := q.nodes(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	defer rows.Close()
 
-	nodes := make([]Node, 0)
+	w.Header().Set("Content-Type", "application/json")
+	g := api.NewGraphWriter(w)
 	for rows.Next() {
 		var id, typ, label, metaStr string
 		rows.Scan(&id, &typ, &label, &metaStr)
-
-		var meta map[string]interface{}
-		if metaStr != "" {
-			_ = json.Unmarshal([]byte(metaStr), &meta)
+		node := api.MakeNode(id, typ, label, metaStr)
+		for k, v := range notes[id] {
+			node.Extra[k] = v
 		}
-
-		// Enhance node info
-		extra := make(map[string]interface{})
-		if typ == "commit" {
-			extra["message"] = meta["message"]
-			extra["author"] = meta["author"]
-			extra["email"] = meta["email"]
-			extra["date"] = meta["time"]
-			if label == "" {
-				label = id[:7]
-			}
-		} else if typ == "blob" {
-			extra["filename"] = label
-			if label == "" {
-				label = id[:7]
-			}
-		} else if typ == "tree" {
-			if label == "" {
-				label = id[:7]
-			}
+		if err := g.Node(node); err != nil {
+			// headers are gone; a truncated body is the only signal left
+			slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
+			return
 		}
-
-		nodes = append(nodes, Node{
-			ID:    id,
-			Type:  typ,
-			Label: label,
-			Extra: extra,
-		})
 	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
+		return
+	}
+	rows.Close()
 
-	// fetch edges
-	linkRows, err := db.Query("SELECT source,target,rel FROM edges WHERE upload_id=?", uploadID)
+	linkRows, err := q.edges(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
 		return
 	}
 	defer linkRows.Close()
 
-	links := make([]Link, 0)
 	for linkRows.Next() {
 		var s, t, rel string
 		linkRows.Scan(&s, &t, &rel)
-		links = append(links, Link{Source: s, Target: t, Rel: rel})
+		if err := g.Link(graphLink{Source: s, Target: t, Rel: rel}); err != nil {
+			slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
+			return
+		}
 	}
-
-	out := map[string]interface{}{"nodes": nodes, "links": links}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(out)
+	if err := linkRows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
+		return
+	}
+	linkRows.Close()
+	bridges, err := q.bridges(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
+		return
+	}
+	for _, l := range bridges {
+		g.Link(l)
+	}
+	g.Close()
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// setupTest loads the default settings and opens a fresh database.
+func setupTest(t *testing.T) {
+	t.Helper()
+	t.Setenv("GITVIS_TEMP_DIR", t.TempDir())
+	settings = loadConfig(nil)
+	configure()
+	if err := openDB(filepath.Join(t.TempDir(), "gitvis.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+// testRepo makes a repository of one commit adding files, by name.
+func testRepo(t *testing.T, message string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := &object.Signature{Name: "A", Email: "a@example.com", When: time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("", 2*3600))}
+	if _, err := wt.Commit(message, &git.CommitOptions{Author: sig, Committer: sig}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGraphPageEscapesUploadName(t *testing.T) {
+	setupTest(t)
+	const name = "<script>alert(1)</script>.zip"
+	id, _, err := ingestSource(context.Background(), testRepo(t, "first", map[string]string{"a.txt": "a"}), name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the issue link template lands in a JS string
+	if _, err := db.Exec("UPDATE uploads SET issue_url=? WHERE id=?", `"</script><script>alert(2)</script>`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	graphPageHandler(w, httptest.NewRequest("GET", "/graph/"+strconv.Itoa(id), nil))
+	body := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, body)
+	}
+	if want := "<h3>Repository: &lt;script&gt;alert(1)&lt;/script&gt;.zip</h3>"; !strings.Contains(body, want) {
+		t.Errorf("page lacks %q", want)
+	}
+	for _, raw := range []string{"<script>alert(1)", "<script>alert(2)", `"</script>`} {
+		if strings.Contains(body, raw) {
+			t.Errorf("page holds unescaped %q", raw)
+		}
+	}
+	if want := `let issueURL = "\u0022\u003c\/script\u003e\u003cscript\u003ealert(2)\u003c\/script\u003e";`; !strings.Contains(body, want) {
+		t.Errorf("page lacks %q", want)
+	}
+	if want := `const repoID = "` + strconv.Itoa(id) + `";`; !strings.Contains(body, want) {
+		t.Errorf("page lacks %q", want)
+	}
+}
+
+func TestUnzipToRejectsEscapingEntries(t *testing.T) {
+	for _, name := range []string{"../evil", "repo/../../evil", "/evil", `..\evil`} {
+		zipPath := filepath.Join(t.TempDir(), "repo.zip")
+		f, err := os.Create(zipPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for _, n := range []string{"repo/ok.txt", name} {
+			w, err := zw.Create(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("x"))
+		}
+		zw.Close()
+		f.Close()
+
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		if err := unzipTo(context.Background(), zipPath, dest); err == nil {
+			t.Errorf("%q: no error", name)
+		}
+		for _, p := range []string{filepath.Join(parent, "evil"), filepath.Join(dest, "repo", "ok.txt")} {
+			if _, err := os.Stat(p); err == nil {
+				t.Errorf("%q: extracted %s", name, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+// A small Markdown renderer for READMEs: the CommonMark blocks READMEs
+// use (headings, paragraphs, lists, block quotes, code, rules) plus
+// GitHub's tables, strikethrough and bare links, and the inline HTML
+// READMEs mix in. Its output goes through sanitizeHTML before it is
+// served, so only an allowlist of tags, attributes and URLs survives.
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+var (
+	mdFence    = regexp.MustCompile("^ {0,3}(```+|~~~+)\\s*([^`\\s]*)")
+	mdHeading  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:\s+(.*?))?(?:\s+#+)?\s*$`)
+	mdRule     = regexp.MustCompile(`^ {0,3}(?:(?:\*\s*){3,}|(?:-\s*){3,}|(?:_\s*){3,})$`)
+	mdSetext   = regexp.MustCompile(`^ {0,3}(=+|-+)\s*$`)
+	mdListItem = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])(\s+|$)(.*)$`)
+	// a block-level tag, or any tag alone on its line, starts raw HTML
+	mdHTMLBlock  = regexp.MustCompile(`^ {0,3}(?:<!--|</?(?i:address|article|aside|blockquote|center|details|dialog|div|dl|figure|footer|h[1-6]|header|hr|ol|p|picture|pre|section|summary|table|ul|script|style)(?:\s|/?>|$)|</?[A-Za-z][A-Za-z0-9-]*(?:\s[^<>]*)?/?>\s*$)`)
+	mdTableSep   = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(?:\|\s*:?-+:?\s*)*\|?\s*$`)
+	mdInlineTag  = regexp.MustCompile(`^(?:<!--[\s\S]*?-->|</?[A-Za-z][A-Za-z0-9-]*(?:\s[^<>]*)?/?>)`)
+	mdAutolink   = regexp.MustCompile(`^<((?:https?://|mailto:)[^<>\s]+)>`)
+	mdBareURL    = regexp.MustCompile(`^https?://[^\s<>()]*[^\s<>().,;:!?'"*_~]`)
+	mdLinkTarget = regexp.MustCompile(`^\(\s*<?([^\s()<>]*)>?(?:\s+"([^"]*)")?\s*\)`)
+)
+
+// renderMarkdown renders Markdown source as HTML, unsanitized.
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\t", "    ")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"))
+	return b.String()
+}
+
+// renderBlocks renders lines as a sequence of blocks.
+func renderBlocks(w *strings.Builder, lines []string) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			w.WriteString("<p>" + renderInline(strings.TrimSpace(strings.Join(para, "\n"))) + "</p>\n")
+			para = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+		case len(para) > 0 && mdSetext.MatchString(line):
+			level := 2
+			if trimmed[0] == '=' {
+				level = 1
+			}
+			fmt.Fprintf(w, "<h%d>%s</h%d>\n", level, renderInline(strings.TrimSpace(strings.Join(para, "\n"))), level)
+			para = nil
+		case mdFence.MatchString(line):
+			flush()
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, m[1]) && strings.Trim(t, m[1][:1]) == "" {
+					break
+				}
+				code = append(code, lines[i])
+			}
+			class := ""
+			if m[2] != "" {
+				class = ` class="language-` + html.EscapeString(m[2]) + `"`
+			}
+			w.WriteString("<pre><code" + class + ">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case mdHeading.MatchString(line):
+			flush()
+			m := mdHeading.FindStringSubmatch(line)
+			fmt.Fprintf(w, "<h%d>%s</h%d>\n", len(m[1]), renderInline(m[2]), len(m[1]))
+		case mdRule.MatchString(line):
+			flush()
+			w.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(q, " "))
+			}
+			i--
+			w.WriteString("<blockquote>\n")
+			renderBlocks(w, quoted)
+			w.WriteString("</blockquote>\n")
+		case len(para) == 0 && strings.HasPrefix(line, "    "):
+			var code []string
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			i--
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			w.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case mdListItem.MatchString(line):
+			flush()
+			i = renderList(w, lines, i) - 1
+		case len(para) == 0 && mdHTMLBlock.MatchString(line):
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				w.WriteString(lines[i] + "\n")
+			}
+		case len(para) == 0 && strings.Contains(line, "|") && i+1 < len(lines) && mdTableSep.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-"):
+			i = renderTable(w, lines, i) - 1
+		default:
+			// trailing spaces may be a line break
+			para = append(para, strings.TrimLeft(line, " "))
+		}
+	}
+	flush()
+}
+
+// renderList renders the list starting at lines[start] and returns the
+// index of the first line after it. An item runs on over lines indented
+// past its marker, and over blank lines when more of it follows.
+func renderList(w *strings.Builder, lines []string, start int) int {
+	first := mdListItem.FindStringSubmatch(lines[start])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if n := strings.TrimLeft(first[2][:len(first[2])-1], "0"); n != "" && n != "1" {
+			tag = `ol start="` + n + `"`
+		}
+	}
+	w.WriteString("<" + tag + ">\n")
+	i := start
+	for i < len(lines) {
+		m := mdListItem.FindStringSubmatch(lines[i])
+		if m == nil || (m[2][0] >= '0' && m[2][0] <= '9') != ordered {
+			break
+		}
+		indent := len(m[1]) + len(m[2]) + 1
+		item := []string{m[4]}
+		loose := false
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if strings.TrimSpace(l) == "" {
+				// a blank line ends the item unless it goes on indented
+				j := i + 1
+				for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+					j++
+				}
+				if j < len(lines) && leadingSpaces(lines[j]) >= indent {
+					loose = true
+					item = append(item, "")
+					continue
+				}
+				break
+			}
+			if leadingSpaces(l) >= indent {
+				item = append(item, l[indent:])
+				continue
+			}
+			// a new item, or a lazy continuation of this one's paragraph
+			if mdListItem.MatchString(l) || mdHeading.MatchString(l) || mdFence.MatchString(l) || mdRule.MatchString(l) {
+				break
+			}
+			item = append(item, strings.TrimSpace(l))
+		}
+		var b strings.Builder
+		renderBlocks(&b, item)
+		body := strings.TrimSuffix(b.String(), "\n")
+		if !loose && strings.HasPrefix(body, "<p>") {
+			// tight items hold their text without a paragraph around it
+			body = strings.Replace(strings.TrimPrefix(body, "<p>"), "</p>", "", 1)
+		}
+		w.WriteString("<li>" + body + "</li>\n")
+		// blank lines between items
+		for i < len(lines) && strings.TrimSpace(lines[i]) == "" && i+1 < len(lines) && mdListItem.MatchString(lines[i+1]) {
+			i++
+		}
+	}
+	w.WriteString("</" + strings.Fields(tag)[0] + ">\n")
+	return i
+}
+
+// leadingSpaces counts the spaces a line starts with.
+func leadingSpaces(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+// tableCells splits a table row into its cells.
+func tableCells(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+	cells := strings.Split(row, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+// renderTable renders the table whose header row is lines[start] and
+// returns the index of the first line after it.
+func renderTable(w *strings.Builder, lines []string, start int) int {
+	var aligns []string
+	for _, c := range tableCells(lines[start+1]) {
+		switch {
+		case strings.HasPrefix(c, ":") && strings.HasSuffix(c, ":"):
+			aligns = append(aligns, "center")
+		case strings.HasSuffix(c, ":"):
+			aligns = append(aligns, "right")
+		case strings.HasPrefix(c, ":"):
+			aligns = append(aligns, "left")
+		default:
+			aligns = append(aligns, "")
+		}
+	}
+	row := func(line, cell string) {
+		w.WriteString("<tr>")
+		for i, c := range tableCells(line) {
+			if i >= len(aligns) {
+				break
+			}
+			align := ""
+			if aligns[i] != "" {
+				align = ` align="` + aligns[i] + `"`
+			}
+			w.WriteString("<" + cell + align + ">" + renderInline(c) + "</" + cell + ">")
+		}
+		w.WriteString("</tr>\n")
+	}
+	w.WriteString("<table>\n<thead>\n")
+	row(lines[start], "th")
+	w.WriteString("</thead>\n<tbody>\n")
+	i := start + 2
+	for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && strings.Contains(lines[i], "|"); i++ {
+		row(lines[i], "td")
+	}
+	w.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// renderInline renders the inline Markdown of a block's text.
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && strings.ContainsRune("\\`*_{}[]()#+-.!|~<>\"'", rune(s[i+1])):
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+		case c == ' ' && strings.HasPrefix(rest, "  \n"):
+			b.WriteString("<br>\n")
+			i += 3
+		case c == '`':
+			run := len(rest) - len(strings.TrimLeft(rest, "`"))
+			fence := rest[:run]
+			if end := strings.Index(rest[run:], fence); end >= 0 {
+				code := strings.TrimSpace(strings.ReplaceAll(rest[run:run+end], "\n", " "))
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*run + end
+			} else {
+				b.WriteString(fence)
+				i += run
+			}
+		case c == '!' && strings.HasPrefix(rest, "!["):
+			if text, url, title, n, ok := parseLink(rest[1:]); ok {
+				b.WriteString(`<img src="` + html.EscapeString(url) + `" alt="` + html.EscapeString(text) + `"` + titleAttr(title) + ">")
+				i += 1 + n
+			} else {
+				b.WriteString("!")
+				i++
+			}
+		case c == '[':
+			if text, url, title, n, ok := parseLink(rest); ok {
+				b.WriteString(`<a href="` + html.EscapeString(url) + `"` + titleAttr(title) + ">" + renderInline(text) + "</a>")
+				i += n
+			} else {
+				b.WriteString("[")
+				i++
+			}
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(rest); m != nil {
+				b.WriteString(`<a href="` + html.EscapeString(m[1]) + `">` + html.EscapeString(m[1]) + "</a>")
+				i += len(m[0])
+			} else if m := mdInlineTag.FindString(rest); m != "" {
+				b.WriteString(m)
+				i += len(m)
+			} else {
+				b.WriteString("&lt;")
+				i++
+			}
+		case c == 'h' && (i == 0 || !isWordByte(s[i-1])) && mdBareURL.MatchString(rest):
+			url := mdBareURL.FindString(rest)
+			b.WriteString(`<a href="` + html.EscapeString(url) + `">` + html.EscapeString(url) + "</a>")
+			i += len(url)
+		case c == '*' || c == '_' || c == '~':
+			if out, n := renderEmphasis(s, i); n > 0 {
+				b.WriteString(out)
+				i += n
+			} else {
+				run := len(rest) - len(strings.TrimLeft(rest, string(c)))
+				b.WriteString(rest[:run])
+				i += run
+			}
+		default:
+			b.WriteString(html.EscapeString(rest[:1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// isWordByte reports whether c is a letter, digit or underscore.
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// renderEmphasis renders the emphasis opening at s[i], such as **bold**,
+// _italic_ or ~~struck~~, returning the HTML and how much of s it took,
+// or 0 when there is no closing delimiter.
+func renderEmphasis(s string, i int) (string, int) {
+	c := s[i]
+	rest := s[i:]
+	run := len(rest) - len(strings.TrimLeft(rest, string(c)))
+	if run > 3 || i+run >= len(s) || s[i+run] == ' ' || s[i+run] == '\n' {
+		return "", 0
+	}
+	// underscores inside words, as in snake_case, aren't emphasis
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return "", 0
+	}
+	if c == '~' && run != 2 {
+		return "", 0
+	}
+	delim := rest[:run]
+	for from := run; ; {
+		end := strings.Index(rest[from:], delim)
+		if end < 0 {
+			return "", 0
+		}
+		end += from
+		after := end + run
+		if rest[end-1] != ' ' && rest[end-1] != c && (after >= len(rest) || rest[after] != c) && (c != '_' || after >= len(rest) || !isWordByte(rest[after])) {
+			inner := renderInline(rest[run:end])
+			switch {
+			case c == '~':
+				inner = "<del>" + inner + "</del>"
+			case run == 1:
+				inner = "<em>" + inner + "</em>"
+			case run == 2:
+				inner = "<strong>" + inner + "</strong>"
+			default:
+				inner = "<em><strong>" + inner + "</strong></em>"
+			}
+			return inner, after
+		}
+		from = end + 1
+	}
+}
+
+// parseLink reads "[text](url "title")" at the start of s, returning its
+// parts and its length.
+func parseLink(s string) (text, url, title string, n int, ok bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				m := mdLinkTarget.FindStringSubmatch(s[i+1:])
+				if m == nil {
+					return "", "", "", 0, false
+				}
+				return s[1:i], m[1], m[2], i + 1 + len(m[0]), true
+			}
+		}
+	}
+	return "", "", "", 0, false
+}
+
+// titleAttr is a title attribute, or nothing for an empty title.
+func titleAttr(title string) string {
+	if title == "" {
+		return ""
+	}
+	return ` title="` + html.EscapeString(title) + `"`
+}
+
+// sanitizeAttrs are the attributes kept on each allowed tag.
+var sanitizeAttrs = map[string][]string{
+	"a": {"href", "title"}, "img": {"src", "alt", "title", "width", "height", "align"},
+	"p": {"align"}, "div": {"align"}, "h1": {"align"}, "h2": {"align"}, "h3": {"align"},
+	"h4": {}, "h5": {}, "h6": {}, "br": {}, "hr": {}, "em": {}, "strong": {}, "b": {}, "i": {},
+	"del": {}, "s": {}, "sub": {}, "sup": {}, "kbd": {}, "code": {"class"}, "pre": {},
+	"blockquote": {}, "ul": {}, "ol": {"start"}, "li": {}, "dl": {}, "dt": {}, "dd": {},
+	"table": {}, "thead": {}, "tbody": {}, "tr": {}, "th": {"align"}, "td": {"align"},
+	"details": {}, "summary": {}, "picture": {}, "span": {},
+}
+
+// sanitizeDropped are the tags whose content goes with them.
+var sanitizeDropped = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"noscript": true, "textarea": true, "template": true, "title": true, "svg": true, "math": true,
+}
+
+// safeURL reports whether a link or image URL may be kept: absolute web
+// links, and mail links for anchors. Relative ones point into the
+// repository, which isn't served, so they go too.
+func safeURL(u string, mail bool) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") || mail && strings.HasPrefix(u, "mailto:")
+}
+
+// sanitizeHTML keeps only allowlisted tags and attributes of src, with
+// safe URLs, dropping scripts, styles, event handlers and the like.
+// Text is re-escaped, so what comes out is well-formed for innerHTML.
+func sanitizeHTML(src string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(src))
+	skip := ""
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			return b.String()
+		}
+		tok := z.Token()
+		if skip != "" {
+			if tt == nethtml.EndTagToken && tok.Data == skip {
+				skip = ""
+			}
+			continue
+		}
+		switch tt {
+		case nethtml.TextToken:
+			b.WriteString(html.EscapeString(tok.Data))
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			if sanitizeDropped[tok.Data] {
+				if tt == nethtml.StartTagToken {
+					skip = tok.Data
+				}
+				continue
+			}
+			allowed, ok := sanitizeAttrs[tok.Data]
+			if !ok {
+				continue
+			}
+			var attrs strings.Builder
+			for _, a := range tok.Attr {
+				keep := false
+				for _, name := range allowed {
+					keep = keep || a.Key == name
+				}
+				switch {
+				case !keep:
+				case a.Key == "href" || a.Key == "src":
+					keep = safeURL(a.Val, a.Key == "href")
+				case a.Key == "class":
+					keep = strings.HasPrefix(a.Val, "language-") && !strings.ContainsAny(a.Val, " \t")
+				}
+				if keep {
+					attrs.WriteString(" " + a.Key + `="` + html.EscapeString(a.Val) + `"`)
+				}
+			}
+			if tok.Data == "img" && !strings.Contains(attrs.String(), ` src="`) {
+				// an image we can't show stands as its alt text
+				for _, a := range tok.Attr {
+					if a.Key == "alt" {
+						b.WriteString(html.EscapeString(a.Val))
+					}
+				}
+				continue
+			}
+			if tok.Data == "a" {
+				attrs.WriteString(` rel="nofollow noopener noreferrer"`)
+			}
+			b.WriteString("<" + tok.Data + attrs.String() + ">")
+		case nethtml.EndTagToken:
+			if _, ok := sanitizeAttrs[tok.Data]; ok {
+				b.WriteString("</" + tok.Data + ">")
+			}
+		}
+	}
+}
+
+// htmlText returns the text of an HTML fragment without its tags, with
+// white space collapsed.
+func htmlText(src string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(src))
+	for {
+		switch z.Next() {
+		case nethtml.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case nethtml.TextToken:
+			b.Write(z.Text())
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// trunkNames are tried in order when picking the branch drawn as the
+// gitGraph's main line.
+var trunkNames = []string{"main", "master", "trunk", "develop"}
+
+// mermaidHandler serves /graph/{id}/export/mermaid[?limit=N], a Mermaid
+// gitGraph of the commit history. limit keeps only the newest N commits in
+// topological order; older ones are dropped and their children drawn as
+// roots.
+func mermaidHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	limit, ok := limitParam(w, r, 0)
+	if !ok {
+		return
+	}
+	exporter("mmd", "text/plain; charset=utf-8", func(ctx context.Context, bw *bufio.Writer, uploadID int) error {
+		return writeMermaid(ctx, bw, uploadID, limit)
+	})(w, r, idStr)
+}
+
+// limitParam reads ?limit=N, answering 400 itself if it is malformed.
+func limitParam(w http.ResponseWriter, r *http.Request, def int) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		http.Error(w, "limit must be a non-negative number", 400)
+		return 0, false
+	}
+	return n, true
+}
+
+// writeMermaid lays the history out as gitGraph commands, each commit on
+// the branch window.branches gives it. gitGraph can only merge a branch's
+// current head, so a merge of an older commit of a branch comes out as a
+// merge of that branch at the time.
+func writeMermaid(ctx context.Context, bw *bufio.Writer, uploadID, limit int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	refs, err := loadRefs(ctx, uploadID, "")
+	if err != nil {
+		return err
+	}
+
+	win := h.newest(limit)
+	order, parent := win.order, win.parent
+	branchOf, trunk := win.branches(refs)
+	tags := make(map[string][]string)
+	for _, ref := range refs {
+		if ref.Kind == "tag" {
+			tags[ref.Tip] = append(tags[ref.Tip], ref.Name)
+		}
+	}
+
+	// a branch forks from the first parent of its oldest commit
+	forks := make(map[string][]string)
+	seen := map[string]bool{trunk: true}
+	for _, c := range order {
+		b := branchOf[c]
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		if p := parent(c, 0); p != "" {
+			forks[p] = append(forks[p], b)
+		}
+	}
+
+	if trunk != "main" {
+		fmt.Fprintf(bw, "%%%%{init: {'gitGraph': {'mainBranchName': %s}}}%%%%\n", mermaidQuote(trunk))
+	}
+	bw.WriteString("gitGraph\n")
+	created := map[string]bool{trunk: true}
+	heads := make(map[string]string)
+	cur := trunk
+	checkout := func(b string) {
+		if !created[b] {
+			fmt.Fprintf(bw, "  branch %s\n", mermaidQuote(b))
+			created[b] = true
+		} else if cur != b {
+			fmt.Fprintf(bw, "  checkout %s\n", mermaidQuote(b))
+		}
+		cur = b
+	}
+	for _, c := range order {
+		b := branchOf[c]
+		checkout(b)
+		attrs := "id: " + mermaidQuote(c[:7])
+		if t := tags[c]; len(t) > 0 {
+			sort.Slice(t, func(i, j int) bool { return tagLess(t[i], t[j]) })
+			attrs += " tag: " + mermaidQuote(strings.Join(t, ", "))
+		}
+		// gitGraph rejects merges into or from a branch without commits
+		if m := parent(c, 1); m != "" && branchOf[m] != b && heads[b] != "" && heads[branchOf[m]] != "" {
+			fmt.Fprintf(bw, "  merge %s %s\n", mermaidQuote(branchOf[m]), attrs)
+		} else {
+			fmt.Fprintf(bw, "  commit %s\n", attrs)
+		}
+		heads[b] = c
+		// create branches forking here while c is the current head
+		for _, fb := range forks[c] {
+			checkout(b)
+			checkout(fb)
+		}
+	}
+	return nil
+}
+
+func pickTrunk(branches []refInfo) string {
+	for _, name := range trunkNames {
+		for _, b := range branches {
+			if b.Name == name {
+				return name
+			}
+		}
+	}
+	best := ""
+	most := -1
+	for _, b := range branches {
+		if b.Commits > most || (b.Commits == most && b.Name < best) {
+			best, most = b.Name, b.Commits
+		}
+	}
+	return best
+}
+
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "'", "\n", " ").Replace(s) + `"`
+}
@@ -0,0 +1,365 @@
+package main
+
+// Metrics for Prometheus, served at /metrics in its text format: uploads
+// and ingests, how long ingests and their phases take, nodes and edges
+// written, the ingest queue, request latencies by route, and database
+// errors. The handful of metric types needed are kept here rather than
+// pulling in a client library.
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	uploadsTotal       = newCounter("gitvis_uploads_total", "Uploads created.")
+	ingestsTotal       = newCounter("gitvis_ingests_total", "Ingests finished, by result (done or failed).", "result")
+	ingestSeconds      = newHistogram("gitvis_ingest_duration_seconds", "Time from an ingest starting to it finishing, by result.", ingestBuckets, "result")
+	ingestPhaseSeconds = newHistogram("gitvis_ingest_phase_duration_seconds", "Time ingests spend in each phase, queued included.", ingestBuckets, "phase")
+	nodesWritten       = newCounter("gitvis_nodes_written_total", "Graph nodes written by ingests.")
+	edgesWritten       = newCounter("gitvis_edges_written_total", "Graph edges written by ingests.")
+	httpSeconds        = newHistogram("gitvis_http_request_duration_seconds", "Time to serve HTTP requests, by method, route and status code.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "method", "route", "code")
+	dbErrors = newCounter("gitvis_db_errors_total", "Failed database calls, by operation.", "op")
+
+	// ingests waiting for a GITVIS_INGEST_WORKERS slot, and those running
+	ingestsQueued, ingestsRunning atomic.Int64
+	ingestQueueDepth              = newGauge("gitvis_ingest_queue_depth", "Ingests waiting for a worker.", ingestsQueued.Load)
+	ingestsRunningGauge           = newGauge("gitvis_ingests_running", "Ingests running.", ingestsRunning.Load)
+)
+
+var ingestBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// metric is a metric family, written in the text format.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var metrics []metric
+
+// labelSet renders label values as the text format's {name="value",...}.
+func labelSet(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metrics: want %d label values, got %d", len(names), len(values)))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		fmt.Fprintf(&b, `%s="%s"`, name, v)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds one more label to a rendered label set.
+func withLabel(set, name, value string) string {
+	if set == "" {
+		return fmt.Sprintf(`{%s="%s"}`, name, value)
+	}
+	return fmt.Sprintf(`%s,%s="%s"}`, strings.TrimSuffix(set, "}"), name, value)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counter struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *counter) add(n float64, labelValues ...string) {
+	key := labelSet(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatFloat(c.values[k]))
+	}
+}
+
+// gauge reads its value when scraped.
+type gauge struct {
+	name, help string
+	value      func() int64
+}
+
+func newGauge(name, help string, value func() int64) *gauge {
+	g := &gauge{name: name, help: help, value: value}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *gauge) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogram) observe(v float64, labelValues ...string) {
+	key := labelSet(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(k, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, k, formatFloat(s.sum), h.name, k, s.count)
+	}
+}
+
+// metricsHandler serves /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, m := range metrics {
+		m.write(bw)
+	}
+}
+
+// measured times the requests mux serves, labelled by the ServeMux pattern
+// that routed them so that IDs and hashes in paths don't multiply series.
+func measured(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		// ServeHTTP sets the pattern it routed by
+		httpSeconds.observe(time.Since(start).Seconds(), r.Method, r.Pattern, strconv.Itoa(rec.code()))
+	})
+}
+
+// statusRecorder notes the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 && status >= 200 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Hijack lets WebSockets through; the response counts as switching
+// protocols.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// code is the response's status, 200 when the handler wrote nothing.
+func (s *statusRecorder) code() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// The database is opened through countingDriver, which counts the calls
+// that fail in gitvis_db_errors_total and traces the calls made in a trace.
+func init() {
+	sql.Register("sqlite3-counted", countingDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// countDBError counts err unless it is nil or only says the caller gave up.
+func countDBError(op string, err error) error {
+	if err != nil && !errors.Is(err, driver.ErrSkip) && !errors.Is(err, context.Canceled) {
+		dbErrors.add(1, op)
+	}
+	return err
+}
+
+type countingDriver struct {
+	driver.Driver
+}
+
+// sqliteConn is what database/sql uses of go-sqlite3's connections.
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+type sqliteStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+func (d countingDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if countDBError("open", err) != nil {
+		return nil, err
+	}
+	return countingConn{c.(sqliteConn)}, nil
+}
+
+type countingConn struct {
+	sqliteConn
+}
+
+// Statements run directly on a connection are traced too; prepared ones,
+// which ingests run once per row, aren't.
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	done := traceDB(ctx, "exec", query)
+	res, err := c.sqliteConn.ExecContext(ctx, query, args)
+	return res, done(countDBError("exec", err))
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	done := traceDB(ctx, "query", query)
+	rows, err := c.sqliteConn.QueryContext(ctx, query, args)
+	return rows, done(countDBError("query", err))
+}
+
+func (c countingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	s, err := c.sqliteConn.PrepareContext(ctx, query)
+	if countDBError("prepare", err) != nil {
+		return nil, err
+	}
+	return countingStmt{s.(sqliteStmt)}, nil
+}
+
+func (c countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.sqliteConn.BeginTx(ctx, opts)
+	if countDBError("begin", err) != nil {
+		return nil, err
+	}
+	return countingTx{tx}, nil
+}
+
+type countingStmt struct {
+	sqliteStmt
+}
+
+func (s countingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	res, err := s.sqliteStmt.ExecContext(ctx, args)
+	return res, countDBError("exec", err)
+}
+
+func (s countingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.sqliteStmt.QueryContext(ctx, args)
+	return rows, countDBError("query", err)
+}
+
+type countingTx struct {
+	driver.Tx
+}
+
+func (t countingTx) Commit() error {
+	return countDBError("commit", t.Tx.Commit())
+}
@@ -0,0 +1,200 @@
+package main
+
+// Who owns what: the author who changed a path most often, counted during
+// the churn pass, and the owners a CODEOWNERS file assigns to it.
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// codeownersPaths are where GitHub and GitLab look for CODEOWNERS, in the
+// order they look.
+var codeownersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS", ".gitlab/CODEOWNERS"}
+
+// authorTally counts one author's changes to a path.
+type authorTally struct {
+	name, email string
+	changes     int
+	last        int // topological position of the latest change
+}
+
+// dominant returns the author with the most changes, the most recent of
+// them on a tie.
+func dominant(tallies map[string]*authorTally) *authorTally {
+	var best *authorTally
+	for _, t := range tallies {
+		if best == nil || t.changes > best.changes || t.changes == best.changes && t.last > best.last {
+			best = t
+		}
+	}
+	return best
+}
+
+// codeownersRule is one pattern line of a CODEOWNERS file.
+type codeownersRule struct {
+	re     *regexp.Regexp
+	owners []string
+}
+
+// parseCodeowners reads CODEOWNERS rules. GitLab's [Section] headers are
+// skipped, and their rules read as if they were one list.
+func parseCodeowners(src string) []codeownersRule {
+	var rules []codeownersRule
+	for _, line := range strings.Split(src, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 && (i == 0 || line[i-1] != '\\') {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+			continue
+		}
+		rules = append(rules, codeownersRule{re: codeownersPattern(fields[0]), owners: fields[1:]})
+	}
+	return rules
+}
+
+// codeownersPattern converts a gitignore-style pattern to a regexp over
+// paths without a leading slash. A pattern with a slash before its end is
+// anchored at the root, one without matches at any depth, and a match on
+// a directory covers everything below it.
+func codeownersPattern(p string) *regexp.Regexp {
+	anchored := strings.Contains(strings.TrimSuffix(p, "/"), "/")
+	p = strings.Trim(p, "/")
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\' && i+1 < len(p):
+			i++
+			fallthrough
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("(?:/.*)?$")
+	return regexp.MustCompile(b.String())
+}
+
+// codeownersFor returns the owners of path, which starts with a slash:
+// those of the last rule that matches it, or nil.
+func codeownersFor(rules []codeownersRule, path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].re.MatchString(path) {
+			return rules[i].owners
+		}
+	}
+	return nil
+}
+
+// trunkFile reads the first of paths that exists at the tip of the trunk
+// branch, or returns "" if none does.
+func trunkFile(ctx context.Context, r *git.Repository, uploadID int, paths ...string) (string, error) {
+	refs, err := loadRefs(ctx, uploadID, "branch")
+	if err != nil {
+		return "", err
+	}
+	trunk := pickTrunk(refs)
+	var tip string
+	for _, ref := range refs {
+		if ref.Name == trunk {
+			tip = ref.Tip
+		}
+	}
+	if tip == "" {
+		return "", nil
+	}
+	c, err := r.CommitObject(plumbing.NewHash(tip))
+	if err != nil {
+		return "", nil
+	}
+	for _, p := range paths {
+		f, err := c.File(p)
+		if err != nil {
+			continue
+		}
+		rd, err := f.Reader()
+		if err != nil {
+			continue
+		}
+		b, err := io.ReadAll(rd)
+		rd.Close()
+		if err == nil {
+			return string(b), nil
+		}
+	}
+	return "", nil
+}
+
+// storeCodeowners reads CODEOWNERS from the tip of the trunk branch and
+// records each blob and tree's owners under it as "codeowners", going by
+// the path the churn pass gave the node. Uploads without the file are
+// left alone.
+func storeCodeowners(ctx context.Context, r *git.Repository, uploadID int) error {
+	src, err := trunkFile(ctx, r, uploadID, codeownersPaths...)
+	if err != nil {
+		return err
+	}
+	rules := parseCodeowners(src)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id,json_extract(meta,'$.path') FROM nodes WHERE upload_id=? AND type IN ('blob','tree') AND json_extract(meta,'$.path') IS NOT NULL", uploadID)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string][]string)
+	for rows.Next() {
+		var id, path string
+		if err := rows.Scan(&id, &path); err != nil {
+			rows.Close()
+			return err
+		}
+		if owners := codeownersFor(rules, path); len(owners) > 0 {
+			owned[id] = owners
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.codeowners',json(?)) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, owners := range owned {
+		b, _ := json.Marshal(owners)
+		if _, err := stmt.ExecContext(ctx, string(b), uploadID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
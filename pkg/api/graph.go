@@ -0,0 +1,113 @@
+// Package api holds the shapes gitvis's HTTP API answers in, and the
+// handler serving graphs in them, for programs that call it or serve
+// graphs the way it does.
+package api
+
+import "encoding/json"
+
+// Node and Link are the node and link shapes of the graph JSON.
+type Node struct {
+	ID    string                 `json:"id"`
+	Type  string                 `json:"type"`
+	Label string                 `json:"label,omitempty"`
+	Extra map[string]interface{} `json:"extra,omitempty"`
+	// position from the ingest's layout pass, if it ran
+	X *float64 `json:"x,omitempty"`
+	Y *float64 `json:"y,omitempty"`
+}
+
+type Link struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Rel    string `json:"rel,omitempty"`
+	Weight int    `json:"weight,omitempty"` // derived views only
+	// the uploads holding the link, in the combined graph only
+	Uploads []int `json:"uploads,omitempty"`
+}
+
+// pathStats copies what the churn and ownership passes recorded about a
+// blob or tree's path; uploads ingested before them have none of it.
+func pathStats(extra, meta map[string]interface{}) {
+	for _, k := range []string{"path", "churn", "owner", "owner_email", "codeowners"} {
+		if v, ok := meta[k]; ok {
+			extra[k] = v
+		}
+	}
+}
+
+// MakeNode converts a nodes row to its JSON form.
+func MakeNode(id, typ, label, metaStr string) Node {
+	var meta map[string]interface{}
+	if metaStr != "" {
+		_ = json.Unmarshal([]byte(metaStr), &meta)
+	}
+
+	// Enhance node info
+	extra := make(map[string]interface{})
+	if typ == "commit" {
+		extra["message"] = meta["message"]
+		extra["author"] = meta["author"]
+		extra["email"] = meta["email"]
+		extra["date"] = meta["time"]
+		// recorded after the walk, so missing while an ingest is running
+		if g, ok := meta["generation"]; ok {
+			extra["generation"] = g
+			extra["topo"] = meta["topo"]
+		}
+		for _, k := range []string{"additions", "deletions", "lines", "category", "scope", "breaking", "trailers", "issues", "rewritten", "reverts", "revert_exact"} {
+			if v, ok := meta[k]; ok {
+				extra[k] = v
+			}
+		}
+		if label == "" {
+			label = id[:7]
+		}
+	} else if typ == "blob" {
+		extra["filename"] = label
+		for _, k := range []string{"size", "kind", "lfs_oid", "pointer_size"} {
+			if v, ok := meta[k]; ok {
+				extra[k] = v
+			}
+		}
+		if lang, ok := meta["language"]; ok {
+			extra["language"] = lang
+		}
+		if secrets, ok := meta["secrets"]; ok {
+			extra["secrets"] = secrets
+		}
+		for _, k := range []string{"license", "license_file", "image"} {
+			if v, ok := meta[k]; ok {
+				extra[k] = v
+			}
+		}
+		pathStats(extra, meta)
+		if label == "" {
+			label = id[:7]
+		}
+	} else if typ == "tree" {
+		if label == "" {
+			label = id[:7]
+		}
+		// file count and total size below it; older uploads lack them
+		if files, ok := meta["files"]; ok {
+			extra["files"] = files
+			extra["size"] = meta["size"]
+		}
+		pathStats(extra, meta)
+	} else if typ == "ref" {
+		extra["kind"] = meta["kind"]
+		extra["date"] = meta["date"]
+	}
+
+	n := Node{
+		ID:    id,
+		Type:  typ,
+		Label: label,
+		Extra: extra,
+	}
+	if x, ok := meta["x"].(float64); ok {
+		y, _ := meta["y"].(float64)
+		n.X, n.Y = &x, &y
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/example/gitvis/pkg/store"
+)
+
+// GraphWriter streams a graph JSON document, {"nodes":[...],"links":[...]}:
+// every node, then every link, then Close. Large repositories have
+// millions of edges, so nothing is held in memory.
+type GraphWriter struct {
+	bw    *bufio.Writer
+	enc   *json.Encoder
+	nodes int
+	links int
+}
+
+func NewGraphWriter(w io.Writer) *GraphWriter {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	bw.WriteString(`{"nodes":[`)
+	return &GraphWriter{bw: bw, enc: json.NewEncoder(bw), links: -1}
+}
+
+// Node writes a node. It must not follow a link.
+func (g *GraphWriter) Node(n Node) error {
+	if g.nodes++; g.nodes > 1 {
+		g.bw.WriteByte(',')
+	}
+	return g.enc.Encode(n)
+}
+
+// Link writes a link.
+func (g *GraphWriter) Link(l Link) error {
+	if g.links < 0 {
+		g.bw.WriteString(`],"links":[`)
+	}
+	if g.links++; g.links > 0 {
+		g.bw.WriteByte(',')
+	}
+	return g.enc.Encode(l)
+}
+
+// Close ends the document and flushes it.
+func (g *GraphWriter) Close() error {
+	if g.links < 0 {
+		g.bw.WriteString(`],"links":[`)
+	}
+	g.bw.WriteString("]}\n")
+	return g.bw.Flush()
+}
+
+// Handler serves the graph JSON of the uploads in a store, as gitvis
+// serves /graph/{id}/json without filters or views.
+type Handler struct {
+	store *store.Store
+}
+
+func NewHandler(s *store.Store) *Handler {
+	return &Handler{store: s}
+}
+
+// ServeHTTP serves GET /{id}; mount it with http.StripPrefix.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.Atoi(strings.Trim(r.URL.Path, "/"))
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	h.ServeGraph(w, r, uploadID)
+}
+
+// ServeGraph writes the whole graph of an upload: all its nodes, then all
+// its links.
+func (h *Handler) ServeGraph(w http.ResponseWriter, r *http.Request, uploadID int) {
+	w.Header().Set("Content-Type", "application/json")
+	g := NewGraphWriter(w)
+	err := h.store.EachNode(r.Context(), uploadID, func(n store.Node) error {
+		return g.Node(MakeNode(n.ID, n.Type, n.Label, n.Meta))
+	})
+	if err == nil {
+		err = h.store.EachEdge(r.Context(), uploadID, func(e store.Edge) error {
+			return g.Link(Link{Source: e.Source, Target: e.Target, Rel: e.Rel})
+		})
+	}
+	if err != nil {
+		// headers are gone; a truncated body is the only signal left
+		slog.ErrorContext(r.Context(), "graph", "upload_id", uploadID, "err", err)
+		return
+	}
+	g.Close()
+}
@@ -0,0 +1,163 @@
+// Package graph builds a repository's graph in memory, as gitvis stores it
+// for an upload but without a database: the nodes and edges ingest.Walk
+// finds, with the metadata of its standard visitors.
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/example/gitvis/pkg/ingest"
+)
+
+// Node is a commit, tree, blob or ref. Meta is its metadata as the walk
+// records it, such as a commit's "author" and "time" or a blob's "size"
+// and "language", or nil; gitvis's graph JSON reshapes it into "extra".
+type Node struct {
+	ID, Type, Label string
+	Meta            map[string]interface{}
+}
+
+// Edge joins two nodes by ID. Rel is parent, commit->tree, tree->tree,
+// tree->blob or ref->commit.
+type Edge struct {
+	Source, Target, Rel string
+}
+
+// Graph is the graph of a repository, each node and edge once, in the order
+// the walk first reached them.
+type Graph struct {
+	Nodes []Node
+	Edges []Edge
+
+	index map[string]int
+	edges map[Edge]bool
+}
+
+// Node returns the node with an ID, or nil.
+func (g *Graph) Node(id string) *Node {
+	i, ok := g.index[id]
+	if !ok {
+		return nil
+	}
+	return &g.Nodes[i]
+}
+
+// Options set what Build walks.
+type Options struct {
+	// Refs are the branches and tags to walk, by full or short name, as
+	// refs/heads/main or v1.0; all of them when empty.
+	Refs []string
+	// Visitors run during the walk after ingest.Standard's, and can add
+	// to commit and blob metadata.
+	Visitors []ingest.Visitor
+	// Context stops the build early when done; context.Background if nil.
+	Context context.Context
+}
+
+// Build walks repo into a Graph. A ref of opts.Refs the repository
+// doesn't have is an error.
+func Build(repo *git.Repository, opts Options) (*Graph, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	refs, err := ingest.Refs(repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Refs) > 0 {
+		if refs, err = pickRefs(refs, opts.Refs); err != nil {
+			return nil, err
+		}
+	}
+	g := &Graph{index: make(map[string]int), edges: make(map[Edge]bool)}
+	visitors := append(ingest.Standard(), opts.Visitors...)
+	if err := ingest.Walk(ctx, repo, refs, (*sink)(g), visitors...); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// pickRefs are the refs of refs that names name, in the order named.
+func pickRefs(refs []*plumbing.Reference, names []string) ([]*plumbing.Reference, error) {
+	var picked []*plumbing.Reference
+	for _, name := range names {
+		found := false
+		for _, ref := range refs {
+			if ref.Name().String() == name || ref.Name().Short() == name {
+				picked = append(picked, ref)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no branch or tag %q", name)
+		}
+	}
+	return picked, nil
+}
+
+// sink adds what the walk finds to its Graph.
+type sink Graph
+
+func (s *sink) put(n Node, replace bool) {
+	if i, ok := s.index[n.ID]; ok {
+		if replace {
+			s.Nodes[i] = n
+		}
+		return
+	}
+	s.index[n.ID] = len(s.Nodes)
+	s.Nodes = append(s.Nodes, n)
+}
+
+func (s *sink) Node(id, typ, label string, meta map[string]interface{}) {
+	s.put(Node{ID: id, Type: typ, Label: label, Meta: meta}, true)
+}
+
+func (s *sink) NodeIfMissing(id, typ, label string) {
+	s.put(Node{ID: id, Type: typ, Label: label}, false)
+}
+
+func (s *sink) Edge(source, target, rel string) {
+	e := Edge{Source: source, Target: target, Rel: rel}
+	if s.edges[e] {
+		return
+	}
+	s.edges[e] = true
+	s.Edges = append(s.Edges, e)
+}
+
+func (s *sink) TreeEntry(string, object.TreeEntry) {}
+
+func (s *sink) TreeSize(tree string, files int, size int64) {
+	if i, ok := s.index[tree]; ok {
+		s.Nodes[i].Meta = map[string]interface{}{"files": files, "size": size}
+	}
+}
+
+// Ref adds a ref node, with the metadata gitvis's ingest gives it, and its
+// edge to the commit it points at.
+func (s *sink) Ref(ref *plumbing.Reference, tag *object.Tag, tip *object.Commit, commits int) {
+	kind := "branch"
+	if ref.Name().IsTag() {
+		kind = "tag"
+	}
+	meta := map[string]interface{}{
+		"kind": kind, "target": tip.Hash.String(),
+		"date": tip.Committer.When.Format(time.RFC3339), "commits": commits,
+	}
+	if tag != nil {
+		meta["tag_date"] = tag.Tagger.When.Format(time.RFC3339)
+		meta["tag_message"] = strings.TrimSpace(tag.Message)
+	}
+	s.Node(ref.Name().String(), "ref", ref.Name().Short(), meta)
+	s.Edge(ref.Name().String(), tip.Hash.String(), "ref->commit")
+}
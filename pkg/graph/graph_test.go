@@ -0,0 +1,153 @@
+package graph
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	"github.com/example/gitvis/pkg/ingest"
+)
+
+// testRepo makes a repository in memory: a commit adding README.md, and a
+// second adding main.go. Branch main points at the second, old at the
+// first. It returns the commits in order.
+func testRepo(t *testing.T) (*git.Repository, []plumbing.Hash) {
+	t.Helper()
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(typ plumbing.ObjectType, encode func(plumbing.EncodedObject) error) plumbing.Hash {
+		o := r.Storer.NewEncodedObject()
+		o.SetType(typ)
+		if err := encode(o); err != nil {
+			t.Fatal(err)
+		}
+		h, err := r.Storer.SetEncodedObject(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	blob := func(content string) plumbing.Hash {
+		return put(plumbing.BlobObject, func(o plumbing.EncodedObject) error {
+			w, err := o.Writer()
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			_, err = w.Write([]byte(content))
+			return err
+		})
+	}
+	sig := object.Signature{Name: "A", Email: "a@example.com", When: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	var commits []plumbing.Hash
+	commit := func(message string, entries ...object.TreeEntry) plumbing.Hash {
+		tree := &object.Tree{Entries: entries}
+		c := &object.Commit{
+			Author: sig, Committer: sig, Message: message,
+			TreeHash:     put(plumbing.TreeObject, tree.Encode),
+			ParentHashes: commits,
+		}
+		commits = append(commits, put(plumbing.CommitObject, c.Encode))
+		return commits[len(commits)-1]
+	}
+	readme := object.TreeEntry{Name: "README.md", Mode: filemode.Regular, Hash: blob("hello\n")}
+	mainGo := object.TreeEntry{Name: "main.go", Mode: filemode.Regular, Hash: blob("package main\n")}
+	first := commit("first", readme)
+	second := commit("second", readme, mainGo)
+	for name, h := range map[string]plumbing.Hash{"refs/heads/main": second, "refs/heads/old": first} {
+		if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r, commits
+}
+
+func count(g *Graph) map[string]int {
+	n := make(map[string]int)
+	for _, node := range g.Nodes {
+		n[node.Type]++
+	}
+	for _, e := range g.Edges {
+		n[e.Rel]++
+	}
+	return n
+}
+
+func TestBuild(t *testing.T) {
+	r, commits := testRepo(t)
+	g, err := Build(r, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"commit": 2, "tree": 2, "blob": 2, "ref": 2,
+		"parent": 1, "commit->tree": 2, "tree->blob": 3, "ref->commit": 2,
+	}
+	if got := count(g); !reflect.DeepEqual(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+
+	c := g.Node(commits[1].String())
+	if c == nil || c.Label != "second" || c.Meta["time"] != "2024-05-01T12:00:00Z" {
+		t.Errorf("second commit: %+v", c)
+	}
+	ref := g.Node("refs/heads/main")
+	if ref == nil || ref.Label != "main" || ref.Meta["target"] != commits[1].String() {
+		t.Errorf("main: %+v", ref)
+	}
+}
+
+func TestBuildRefs(t *testing.T) {
+	r, commits := testRepo(t)
+	g, err := Build(r, Options{Refs: []string{"old"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Nodes) != 4 || len(g.Edges) != 3 {
+		t.Errorf("%d nodes and %d edges, want 4 and 3: %v", len(g.Nodes), len(g.Edges), count(g))
+	}
+	if g.Node(commits[1].String()) != nil || g.Node("refs/heads/main") != nil {
+		t.Error("graph of old holds main's history")
+	}
+
+	if _, err := Build(r, Options{Refs: []string{"nope"}}); err == nil {
+		t.Error("no error for an unknown ref")
+	}
+}
+
+// messageLength records the length of each commit's message.
+type messageLength struct{ ingest.NopVisitor }
+
+func (messageLength) OnCommit(c *object.Commit, meta map[string]interface{}) error {
+	meta["message_length"] = len(c.Message)
+	return nil
+}
+
+func TestBuildVisitors(t *testing.T) {
+	r, commits := testRepo(t)
+	g, err := Build(r, Options{Visitors: []ingest.Visitor{messageLength{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := g.Node(commits[0].String()); c == nil || c.Meta["message_length"] != len("first") {
+		t.Errorf("first commit: %+v", c)
+	}
+	// the standard visitors still run
+	language := ""
+	for _, n := range g.Nodes {
+		if n.Label == "main.go" {
+			language, _ = n.Meta["language"].(string)
+		}
+	}
+	if language != "Go" {
+		t.Errorf("main.go language %q, want Go", language)
+	}
+}
@@ -0,0 +1,255 @@
+// Package ingest walks a git repository into the graph gitvis draws:
+// commit, tree, blob and ref nodes joined by parent, commit->tree,
+// tree->tree, tree->blob and ref->commit edges. It keeps nothing itself;
+// what it finds goes to a Sink, so a program can extract graphs without
+// gitvis's database or web app. Visitors see each object on the way and
+// can add to its node's metadata, as language detection does.
+package ingest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Sink receives the graph as Walk finds it. History shared by several refs
+// is walked once per ref, so the same node or edge can arrive more than
+// once.
+type Sink interface {
+	// Node reports a node with its metadata, which replaces any earlier.
+	Node(id, typ, label string, meta map[string]interface{})
+	// NodeIfMissing reports a node known only by reference so far, such as
+	// a commit's parent; it must not replace one already reported.
+	NodeIfMissing(id, typ, label string)
+	Edge(source, target, rel string)
+	// TreeEntry reports an entry of a tree, submodules included.
+	TreeEntry(tree string, e object.TreeEntry)
+	// TreeSize reports the files below a tree, subdirectories included,
+	// and their total size, once its entries are walked.
+	TreeSize(tree string, files int, size int64)
+	// Ref reports a branch or tag once its history is walked: tag is its
+	// annotated tag object or nil, tip the commit it points at and commits
+	// how many commits it reaches.
+	Ref(ref *plumbing.Reference, tag *object.Tag, tip *object.Commit, commits int)
+}
+
+// Visitor is called by Walk for each object it reaches, before the object's
+// node goes to the Sink. A commit or blob's meta is the metadata its node
+// will carry, which a visitor may add to; visitors run in the order given,
+// so later ones see what earlier ones added. Like the Sink, a visitor sees
+// history shared by several refs once per ref. An error stops the walk.
+type Visitor interface {
+	OnCommit(c *object.Commit, meta map[string]interface{}) error
+	// OnTree is called for a commit's root tree and each tree below it,
+	// before its entries.
+	OnTree(t *object.Tree) error
+	// OnBlob is called for each file entry whose blob can be read; meta
+	// starts with its size.
+	OnBlob(e object.TreeEntry, b *object.Blob, meta map[string]interface{}) error
+	// OnRef is called for a branch or tag once its history is walked, with
+	// its annotated tag object or nil, and the commit it points at.
+	OnRef(ref *plumbing.Reference, tag *object.Tag, tip *object.Commit) error
+}
+
+// NopVisitor does nothing. Embed it in a visitor to implement only the
+// methods it needs.
+type NopVisitor struct{}
+
+func (NopVisitor) OnCommit(*object.Commit, map[string]interface{}) error               { return nil }
+func (NopVisitor) OnTree(*object.Tree) error                                           { return nil }
+func (NopVisitor) OnBlob(object.TreeEntry, *object.Blob, map[string]interface{}) error { return nil }
+func (NopVisitor) OnRef(*plumbing.Reference, *object.Tag, *object.Commit) error        { return nil }
+
+// Standard are the visitors gitvis's own ingest runs: blob languages, Git
+// LFS pointers and, by the default rules, committed secrets.
+func Standard() []Visitor {
+	return []Visitor{Languages{}, LFSPointers{}, NewSecrets(DefaultSecretRules, DefaultSecretEntropy)}
+}
+
+// Open opens the repository under root: a .git directory, else a bare
+// repository, as unpacked from an archive of either.
+func Open(root string) (*git.Repository, error) {
+	var repoPath string
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// detect .git dir
+		if info.IsDir() && info.Name() == ".git" {
+			repoPath = p
+			return filepath.SkipDir
+		}
+		// detect bare repo by presence of HEAD file
+		if !info.IsDir() && info.Name() == "HEAD" && repoPath == "" {
+			repoPath = filepath.Dir(p)
+		}
+		return nil
+	})
+	if repoPath == "" {
+		// try root
+		repoPath = root
+	}
+
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		// try DetectDotGit
+		return git.PlainOpenWithOptions(repoPath, &git.PlainOpenOptions{DetectDotGit: true})
+	}
+	return r, nil
+}
+
+// Refs are the branches and tags of r, which Walk walks.
+func Refs(r *git.Repository) ([]*plumbing.Reference, error) {
+	iter, err := r.References()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsBranch() || ref.Name().IsTag() {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// Walk reports to sink the history reachable from each of refs, with
+// every commit's tree, calling visitors on the way. Refs that don't lead to
+// a commit are skipped. It stops early with ctx's error when ctx is done,
+// or with the first error a visitor returns.
+func Walk(ctx context.Context, r *git.Repository, refs []*plumbing.Reference, sink Sink, visitors ...Visitor) error {
+	w := &walker{r: r, sink: sink, visitors: visitors}
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// annotated tags point at a tag object; peel to the commit
+		tipHash := ref.Hash()
+		tag, err := r.TagObject(tipHash)
+		if err == nil {
+			tc, err := tag.Commit()
+			if err != nil {
+				continue
+			}
+			tipHash = tc.Hash
+		}
+		tip, err := r.CommitObject(tipHash)
+		if err != nil {
+			continue
+		}
+		cIter, err := r.Log(&git.LogOptions{From: tipHash})
+		if err != nil {
+			continue
+		}
+		// history that can't be read, as past a shallow clone's edge, ends
+		// the ref's walk rather than the ingest
+		count := 0
+		var visitErr error
+		cIter.ForEach(func(c *object.Commit) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			count++
+			visitErr = w.commit(c)
+			return visitErr
+		})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if visitErr != nil {
+			return visitErr
+		}
+		for _, v := range visitors {
+			if err := v.OnRef(ref, tag, tip); err != nil {
+				return err
+			}
+		}
+		sink.Ref(ref, tag, tip, count)
+	}
+	return nil
+}
+
+// walker is one Walk's repository, sink and visitors.
+type walker struct {
+	r        *git.Repository
+	sink     Sink
+	visitors []Visitor
+}
+
+func (w *walker) commit(c *object.Commit) error {
+	meta := map[string]interface{}{
+		"author": c.Author.Name, "email": c.Author.Email, "time": c.Author.When.Format(time.RFC3339),
+		"committed": c.Committer.When.Format(time.RFC3339),
+	}
+	for _, v := range w.visitors {
+		if err := v.OnCommit(c, meta); err != nil {
+			return err
+		}
+	}
+	w.sink.Node(c.Hash.String(), "commit", strings.TrimSpace(c.Message), meta)
+	for _, p := range c.ParentHashes {
+		w.sink.NodeIfMissing(p.String(), "commit", "")
+		w.sink.Edge(c.Hash.String(), p.String(), "parent")
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return nil
+	}
+	w.sink.NodeIfMissing(tree.Hash.String(), "tree", "/")
+	w.sink.Edge(c.Hash.String(), tree.Hash.String(), "commit->tree")
+	_, _, err = w.tree(tree)
+	return err
+}
+
+// tree reports a tree's contents and returns how many files it holds,
+// subdirectories included, and their total size.
+func (w *walker) tree(t *object.Tree) (files int, size int64, err error) {
+	for _, v := range w.visitors {
+		if err := v.OnTree(t); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, e := range t.Entries {
+		w.sink.TreeEntry(t.Hash.String(), e)
+		if e.Mode.IsFile() {
+			// blobs are labelled with their file name
+			var meta map[string]interface{}
+			if b, err := w.r.BlobObject(e.Hash); err == nil {
+				meta = map[string]interface{}{"size": b.Size}
+				for _, v := range w.visitors {
+					if err := v.OnBlob(e, b, meta); err != nil {
+						return 0, 0, err
+					}
+				}
+				if sz, ok := meta["size"].(int64); ok {
+					size += sz
+				}
+			}
+			files++
+			w.sink.Node(e.Hash.String(), "blob", e.Name, meta)
+			w.sink.Edge(t.Hash.String(), e.Hash.String(), "tree->blob")
+		} else if e.Mode == filemode.Dir {
+			subtree, err := w.r.TreeObject(e.Hash)
+			if err == nil && subtree != nil {
+				w.sink.NodeIfMissing(subtree.Hash.String(), "tree", e.Name)
+				w.sink.Edge(t.Hash.String(), subtree.Hash.String(), "tree->tree")
+				n, sz, err := w.tree(subtree)
+				if err != nil {
+					return 0, 0, err
+				}
+				files += n
+				size += sz
+			}
+		}
+	}
+	w.sink.TreeSize(t.Hash.String(), files, size)
+	return files, size, nil
+}
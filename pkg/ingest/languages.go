@@ -0,0 +1,97 @@
+package ingest
+
+// Language detection for blobs, by file name and, for scripts without an
+// extension, by the interpreter on their #! line. The tables cover the
+// common languages rather than everything linguist knows.
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var languageByExt = map[string]string{
+	".go": "Go", ".rs": "Rust", ".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++", ".cxx": "C++",
+	".hh": "C++", ".hpp": "C++", ".m": "Objective-C", ".mm": "Objective-C++", ".swift": "Swift",
+	".java": "Java", ".kt": "Kotlin", ".kts": "Kotlin", ".scala": "Scala", ".groovy": "Groovy",
+	".cs": "C#", ".fs": "F#", ".vb": "Visual Basic", ".py": "Python", ".pyi": "Python",
+	".rb": "Ruby", ".php": "PHP", ".pl": "Perl", ".pm": "Perl", ".lua": "Lua", ".r": "R",
+	".jl": "Julia", ".ex": "Elixir", ".exs": "Elixir", ".erl": "Erlang", ".hs": "Haskell",
+	".ml": "OCaml", ".mli": "OCaml", ".clj": "Clojure", ".dart": "Dart", ".zig": "Zig",
+	".js": "JavaScript", ".mjs": "JavaScript", ".cjs": "JavaScript", ".jsx": "JavaScript",
+	".ts": "TypeScript", ".tsx": "TypeScript", ".vue": "Vue", ".svelte": "Svelte",
+	".html": "HTML", ".htm": "HTML", ".css": "CSS", ".scss": "SCSS", ".sass": "Sass", ".less": "Less",
+	".sh": "Shell", ".bash": "Shell", ".zsh": "Shell", ".fish": "Shell", ".ps1": "PowerShell",
+	".bat": "Batchfile", ".cmd": "Batchfile", ".sql": "SQL", ".proto": "Protocol Buffer",
+	".graphql": "GraphQL", ".tf": "HCL", ".hcl": "HCL", ".nix": "Nix", ".cmake": "CMake",
+	".json": "JSON", ".yaml": "YAML", ".yml": "YAML", ".toml": "TOML", ".xml": "XML", ".ini": "INI",
+	".md": "Markdown", ".markdown": "Markdown", ".rst": "reStructuredText", ".tex": "TeX",
+}
+
+var languageByName = map[string]string{
+	"Makefile": "Makefile", "GNUmakefile": "Makefile", "makefile": "Makefile",
+	"Dockerfile": "Dockerfile", "CMakeLists.txt": "CMake", "Rakefile": "Ruby", "Gemfile": "Ruby",
+	"Jenkinsfile": "Groovy", "BUILD": "Starlark", "BUILD.bazel": "Starlark", "WORKSPACE": "Starlark",
+}
+
+var languageByInterpreter = map[string]string{
+	"sh": "Shell", "bash": "Shell", "zsh": "Shell", "dash": "Shell", "ksh": "Shell",
+	"python": "Python", "python2": "Python", "python3": "Python", "ruby": "Ruby", "perl": "Perl",
+	"node": "JavaScript", "deno": "TypeScript", "php": "PHP", "lua": "Lua", "Rscript": "R",
+}
+
+// DetectLanguage names the language of a file, or returns "" if it isn't
+// one it knows. The content is only read when the name isn't enough.
+func DetectLanguage(name string, b *object.Blob) string {
+	if lang, ok := languageByName[name]; ok {
+		return lang
+	}
+	if strings.HasPrefix(name, "Dockerfile.") {
+		return "Dockerfile"
+	}
+	ext := path.Ext(name)
+	if lang, ok := languageByExt[strings.ToLower(ext)]; ok {
+		return lang
+	}
+	if ext != "" || b == nil {
+		return ""
+	}
+	rd, err := b.Reader()
+	if err != nil {
+		return ""
+	}
+	defer rd.Close()
+	line, err := bufio.NewReader(io.LimitReader(rd, 256)).ReadString('\n')
+	if err != nil && line == "" || !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	// #!/usr/bin/env python3 or #!/bin/sh -e
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interp = f
+				break
+			}
+		}
+	}
+	return languageByInterpreter[interp]
+}
+
+// Languages is the visitor recording the language of each blob that has
+// one as its "language".
+type Languages struct{ NopVisitor }
+
+func (Languages) OnBlob(e object.TreeEntry, b *object.Blob, meta map[string]interface{}) error {
+	if lang := DetectLanguage(e.Name, b); lang != "" {
+		meta["language"] = lang
+	}
+	return nil
+}
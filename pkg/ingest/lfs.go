@@ -0,0 +1,71 @@
+package ingest
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// lfsPointerMaxBytes is the most a Git LFS pointer file may hold, per the
+// pointer spec; bigger blobs aren't read.
+const lfsPointerMaxBytes = 1024
+
+// lfsPointerVersion is the first line of every Git LFS pointer file.
+const lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+
+// ParseLFSPointer reads a blob that stands in for a file kept by Git LFS,
+//
+//	version https://git-lfs.github.com/spec/v1
+//	oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393
+//	size 12345
+//
+// returning the oid and the size of the real file. ok is false for any
+// other blob.
+func ParseLFSPointer(b *object.Blob) (oid string, size int64, ok bool) {
+	if b.Size > lfsPointerMaxBytes {
+		return "", 0, false
+	}
+	rd, err := b.Reader()
+	if err != nil {
+		return "", 0, false
+	}
+	defer rd.Close()
+	sc := bufio.NewScanner(io.LimitReader(rd, lfsPointerMaxBytes))
+	if !sc.Scan() || sc.Text() != lfsPointerVersion {
+		return "", 0, false
+	}
+	size = -1
+	for sc.Scan() {
+		key, value, found := strings.Cut(sc.Text(), " ")
+		if !found {
+			return "", 0, false
+		}
+		switch key {
+		case "oid":
+			oid = value
+		case "size":
+			if size, err = strconv.ParseInt(value, 10, 64); err != nil || size < 0 {
+				return "", 0, false
+			}
+		}
+	}
+	if sc.Err() != nil || !strings.HasPrefix(oid, "sha256:") || size < 0 {
+		return "", 0, false
+	}
+	return oid, size, true
+}
+
+// LFSPointers is the visitor marking blobs that are Git LFS pointers: their
+// "kind" is "lfs", with the file's "lfs_oid", and their "size" is the
+// file's, the pointer's own kept as "pointer_size".
+type LFSPointers struct{ NopVisitor }
+
+func (LFSPointers) OnBlob(e object.TreeEntry, b *object.Blob, meta map[string]interface{}) error {
+	if oid, size, ok := ParseLFSPointer(b); ok {
+		meta["kind"], meta["lfs_oid"], meta["pointer_size"], meta["size"] = "lfs", oid, b.Size, size
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package ingest
+
+// Secret scanning: text blobs are checked for credentials committed by
+// mistake, such as cloud keys, private keys and API tokens. Findings
+// record the rule and line, never the secret.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// secretScanMaxBytes is the largest blob scanned; bigger ones are rarely
+// hand-written config.
+const secretScanMaxBytes = 1 << 20
+
+// SecretRule flags lines matching Pattern. When Pattern has a capture
+// group, the captured text must also look random enough to be a key.
+type SecretRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// DefaultSecretRules are the built-in checks.
+var DefaultSecretRules = []SecretRule{
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"aws-secret-key", regexp.MustCompile(`(?i)aws.{0,20}(?:secret|key).{0,20}['"]([A-Za-z0-9/+=]{40})['"]`)},
+	{"private-key", regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )?PRIVATE KEY(?: BLOCK)?-----`)},
+	{"github-token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"stripe-key", regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{20,}\b`)},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"generic-secret", regexp.MustCompile(`(?i)(?:api[_-]?key|secret|token|passw(?:or)?d)['"]?\s*[:=]\s*['"]([^'"\s]{16,})['"]`)},
+}
+
+// DefaultSecretEntropy is the Shannon entropy, in bits per character, that
+// a rule's captured text needs to count: random keys score well above 4,
+// words and placeholders like "changeme-changeme" below 3.5.
+const DefaultSecretEntropy = 3.5
+
+// ParseSecretRules reads one rule per line, a name and a regular
+// expression separated by white space, such as
+//
+//	internal-token \bitk_[a-z0-9]{32}\b
+//
+// Blank lines and lines starting with "#" are skipped.
+func ParseSecretRules(src string) ([]SecretRule, error) {
+	var rules []SecretRule
+	sc := bufio.NewScanner(strings.NewReader(src))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: want a name and a pattern", n)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(line[i:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, SecretRule{Name: line[:i], Pattern: re})
+	}
+	return rules, sc.Err()
+}
+
+// shannonEntropy is the entropy of s in bits per character.
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	n := 0
+	for _, c := range s {
+		counts[c]++
+		n++
+	}
+	var e float64
+	for _, k := range counts {
+		p := float64(k) / float64(n)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// SecretFinding is a line of a blob that a rule flagged.
+type SecretFinding struct {
+	Rule string `json:"rule"`
+	Line int    `json:"line"`
+}
+
+// ScanSecrets checks each line of text against rules, reporting at most
+// one finding per rule and line. Captured text below minEntropy doesn't
+// count.
+func ScanSecrets(rules []SecretRule, minEntropy float64, text string) []SecretFinding {
+	var found []SecretFinding
+	for i, line := range strings.Split(text, "\n") {
+		for _, r := range rules {
+			for _, m := range r.Pattern.FindAllStringSubmatch(line, -1) {
+				if len(m) > 1 && m[1] != "" && shannonEntropy(m[1]) < minEntropy {
+					continue
+				}
+				found = append(found, SecretFinding{Rule: r.Name, Line: i + 1})
+				break
+			}
+		}
+	}
+	return found
+}
+
+// Secrets is the visitor recording what ScanSecrets finds in a text blob
+// as its "secrets". Make one with NewSecrets.
+type Secrets struct {
+	NopVisitor
+	rules      []SecretRule
+	minEntropy float64
+	// the walk reaches a blob once for every commit holding it
+	found map[plumbing.Hash][]SecretFinding
+}
+
+func NewSecrets(rules []SecretRule, minEntropy float64) *Secrets {
+	return &Secrets{rules: rules, minEntropy: minEntropy, found: make(map[plumbing.Hash][]SecretFinding)}
+}
+
+func (s *Secrets) OnBlob(e object.TreeEntry, b *object.Blob, meta map[string]interface{}) error {
+	found, ok := s.found[b.Hash]
+	if !ok {
+		found = s.scan(b)
+		s.found[b.Hash] = found
+	}
+	if len(found) > 0 {
+		meta["secrets"] = found
+	}
+	return nil
+}
+
+// scan reads b as text, skipping big blobs and, like git, those with a
+// NUL byte near the start.
+func (s *Secrets) scan(b *object.Blob) []SecretFinding {
+	if b.Size > secretScanMaxBytes {
+		return nil
+	}
+	rd, err := b.Reader()
+	if err != nil {
+		return nil
+	}
+	defer rd.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rd); err != nil {
+		return nil
+	}
+	head := buf.Bytes()
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+	return ScanSecrets(s.rules, s.minEntropy, buf.String())
+}
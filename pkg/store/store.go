@@ -0,0 +1,111 @@
+// Package store keeps graphs in a gitvis database: each upload's nodes,
+// edges and tree entries, in the tables gitvis's schema creates.
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Store reads and writes graphs through db.
+type Store struct {
+	db *sql.DB
+}
+
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Node is a nodes row. Meta is its metadata as JSON, or "".
+type Node struct {
+	ID, Type, Label, Meta string
+}
+
+// Edge is an edges row.
+type Edge struct {
+	Source, Target, Rel string
+}
+
+// Node returns a node of an upload, or sql.ErrNoRows.
+func (s *Store) Node(uploadID int, id string) (Node, error) {
+	n := Node{ID: id}
+	err := s.db.QueryRow(`SELECT type,label,meta FROM nodes WHERE id=? AND upload_id=?`, id, uploadID).Scan(&n.Type, &n.Label, &n.Meta)
+	return n, err
+}
+
+// PutNode stores n, replacing the node with its ID.
+func (s *Store) PutNode(uploadID int, n Node) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO nodes(id, upload_id, type, label, meta) VALUES(?,?,?,?,?)`,
+		n.ID, uploadID, n.Type, n.Label, n.Meta)
+	return err
+}
+
+// AddNode stores n unless the upload has a node with its ID, reporting
+// whether it did.
+func (s *Store) AddNode(uploadID int, n Node) (bool, error) {
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO nodes(id, upload_id, type, label, meta) VALUES(?,?,?,?,?)`,
+		n.ID, uploadID, n.Type, n.Label, n.Meta)
+	if err != nil {
+		return false, err
+	}
+	added, _ := res.RowsAffected()
+	return added > 0, nil
+}
+
+// AddEdge stores e unless the upload has it, reporting whether it did.
+func (s *Store) AddEdge(uploadID int, e Edge) (bool, error) {
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO edges(upload_id, source, target, rel) VALUES(?,?,?,?)`,
+		uploadID, e.Source, e.Target, e.Rel)
+	if err != nil {
+		return false, err
+	}
+	added, _ := res.RowsAffected()
+	return added > 0, nil
+}
+
+// AddTreeEntry stores an entry of a tree: its name, git file mode and
+// object hash.
+func (s *Store) AddTreeEntry(uploadID int, tree, name string, mode uint32, hash string) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO tree_entries(upload_id, tree, name, mode, hash) VALUES(?,?,?,?,?)`,
+		uploadID, tree, name, mode, hash)
+	return err
+}
+
+// EachNode calls fn for every node of an upload, in ID order.
+func (s *Store) EachNode(ctx context.Context, uploadID int, fn func(Node) error) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT id,type,label,meta FROM nodes WHERE upload_id=? ORDER BY id", uploadID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n Node
+		if err := rows.Scan(&n.ID, &n.Type, &n.Label, &n.Meta); err != nil {
+			return err
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EachEdge calls fn for every edge of an upload, in the order they were
+// stored.
+func (s *Store) EachEdge(ctx context.Context, uploadID int, fn func(Edge) error) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT source,target,rel FROM edges WHERE upload_id=? ORDER BY id", uploadID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Edge
+		if err := rows.Scan(&e.Source, &e.Target, &e.Rel); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
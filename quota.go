@@ -0,0 +1,171 @@
+package main
+
+// Upload quotas. Every upload is charged to an identity: the signed-in
+// user, else the API token, else the client IP (see clientKey). Limits:
+//
+//	GITVIS_QUOTA_UPLOADS  uploads per identity (default 100)
+//	GITVIS_QUOTA_BYTES    total archive bytes per identity, with an optional
+//	                      K/M/G suffix (default 1G)
+//	GITVIS_MAX_UPLOAD     bytes of any one archive, likewise (default 0)
+//
+// 0 disables a limit. Deleting an upload frees its share.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	quotaUploads, quotaBytes, maxUpload int64
+
+	errUploadTooLarge error
+
+	// quotaMu makes the usage check and the insert that follows it atomic
+	quotaMu sync.Mutex
+)
+
+func envSize(name string, def int64) int64 {
+	s := strings.TrimSpace(setting(name))
+	if s == "" {
+		return def
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		fatalf("%s: want a non-negative number, got %q", name, setting(name))
+	}
+	return n * mult
+}
+
+// saveUpload copies an uploaded archive into tmp, failing with
+// errUploadTooLarge past GITVIS_MAX_UPLOAD. tmp is removed on failure.
+func saveUpload(tmp *os.File, src io.Reader) (int64, error) {
+	if maxUpload > 0 {
+		src = io.LimitReader(src, maxUpload+1)
+	}
+	n, err := io.Copy(tmp, src)
+	if err == nil && maxUpload > 0 && n > maxUpload {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return n, err
+}
+
+// quotaError is returned when an upload would exceed its identity's quota.
+type quotaError struct {
+	msg string
+}
+
+func (e *quotaError) Error() string { return e.msg }
+
+// uploaderKey is the identity an upload by owner (a user ID, or 0) made
+// through r is charged to.
+func uploaderKey(r *http.Request, owner int) string {
+	if owner != 0 {
+		return fmt.Sprintf("user:%d", owner)
+	}
+	return clientKey(r)
+}
+
+type usage struct {
+	Uploads int64 `json:"uploads"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func usageOf(key string) (usage, error) {
+	var u usage
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size_bytes),0) FROM uploads WHERE uploader=?", key).Scan(&u.Uploads, &u.Bytes)
+	return u, err
+}
+
+// checkQuota reports whether key can add uploads more uploads totalling
+// bytes. Callers hold quotaMu.
+func checkQuota(key string, uploads, bytes int64) error {
+	u, err := usageOf(key)
+	if err != nil {
+		return err
+	}
+	if quotaUploads > 0 && u.Uploads+uploads > quotaUploads {
+		return &quotaError{fmt.Sprintf("upload quota exceeded: %d of %d uploads used", u.Uploads, quotaUploads)}
+	}
+	if quotaBytes > 0 && u.Bytes+bytes > quotaBytes {
+		return &quotaError{fmt.Sprintf("storage quota exceeded: %d of %d bytes used, this archive is %d", u.Bytes, quotaBytes, bytes)}
+	}
+	return nil
+}
+
+// resizeUpload charges a refreshed upload for its new archive size.
+func resizeUpload(uploadID int, size int64) error {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	var key sql.NullString
+	var old int64
+	if err := db.QueryRow("SELECT uploader, size_bytes FROM uploads WHERE id=?", uploadID).Scan(&key, &old); err != nil {
+		return err
+	}
+	if key.Valid && size > old {
+		if err := checkQuota(key.String, 0, size-old); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("UPDATE uploads SET size_bytes=? WHERE id=?", size, uploadID)
+	return err
+}
+
+// uploadFailed answers an ingest error: 403 for quota errors, 500 otherwise.
+func uploadFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(*quotaError); ok {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err == errUploadTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == errShuttingDown {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
+
+// usageHandler serves GET /api/v1/usage: what the caller has used and may use.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	owner := 0
+	if u := currentUser(r); u != nil {
+		owner = u.ID
+	}
+	key := uploaderKey(r, owner)
+	u, err := usageOf(key)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identity": key,
+		"used":     u,
+		"quota":    usage{Uploads: quotaUploads, Bytes: quotaBytes},
+	})
+}
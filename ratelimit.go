@@ -0,0 +1,122 @@
+package main
+
+// Token-bucket rate limits, per API token or (for everyone else) per client
+// IP. Limits are requests per minute with a burst of the same size:
+//
+//	GITVIS_RATE_UPLOAD  ingests: /upload, POST /api/v1/uploads, refresh, gRPC Ingest (default 10)
+//	GITVIS_RATE_API     pages, JSON, GraphQL and gRPC calls (default 600)
+//
+// 0 disables a limit.
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type rateLimiter struct {
+	perSec float64
+	burst  float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	uploadLimiter, apiLimiter *rateLimiter
+)
+
+func newRateLimiter(env string, perMin int) *rateLimiter {
+	if s := setting(env); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			fatalf("%s: want a number of requests per minute, got %q", env, s)
+		}
+		perMin = n
+	}
+	l := &rateLimiter{
+		perSec:  float64(perMin) / 60,
+		burst:   float64(perMin),
+		buckets: make(map[string]*bucket),
+	}
+	if perMin > 0 {
+		go l.sweep()
+	}
+	return l
+}
+
+// take spends a token for key, or reports how long until one is available.
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSec)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.perSec * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled, so idle clients don't pile up.
+func (l *rateLimiter) sweep() {
+	full := time.Duration(l.burst / l.perSec * float64(time.Second))
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for k, b := range l.buckets {
+			if time.Since(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// allow answers 429 and returns false when the request is over the limit.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	if l.perSec == 0 {
+		return true
+	}
+	ok, wait := l.take(clientKey(r))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+func rateLimited(l *rateLimiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.allow(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// clientKey identifies who a request counts against: its API token if it
+// has a valid one, otherwise the remote IP.
+func clientKey(r *http.Request) string {
+	if id, ok := tokenFromRequest(r); ok {
+		return fmt.Sprintf("token:%d", id)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
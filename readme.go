@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// readmeMaxBytes is the largest README kept.
+const readmeMaxBytes = 512 << 10
+
+// readmeNames are the README file names looked for at the root of a
+// tree, in order of preference, matched regardless of case.
+var readmeNames = []string{"readme.md", "readme.markdown", "readme", "readme.txt", "readme.rst"}
+
+// readmeRank is the preference of a README file name, or -1 for other
+// files.
+func readmeRank(name string) int {
+	name = strings.ToLower(name)
+	for i, n := range readmeNames {
+		if name == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// storeReadmes keeps the text of the READMEs at the roots of the upload's
+// commits, since the archive they came from is deleted after ingest.
+// Those of an earlier ingest of the upload are replaced.
+func storeReadmes(ctx context.Context, r *git.Repository, uploadID int) error {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT n.id, n.label FROM edges c
+		JOIN edges e ON e.upload_id=c.upload_id AND e.source=c.target AND e.rel='tree->blob'
+		JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+		WHERE c.upload_id=? AND c.rel='commit->tree' AND COALESCE(json_extract(n.meta,'$.size'),0) <= ?`, uploadID, readmeMaxBytes)
+	if err != nil {
+		return err
+	}
+	var blobs []string
+	for rows.Next() {
+		var id, label string
+		if err := rows.Scan(&id, &label); err != nil {
+			rows.Close()
+			return err
+		}
+		if readmeRank(label) >= 0 {
+			blobs = append(blobs, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM readmes WHERE upload_id=?", uploadID); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO readmes(upload_id, blob, text) VALUES(?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range blobs {
+		text, ok := blobText(r, plumbing.NewHash(id))
+		if !ok {
+			continue
+		}
+		if _, err := stmt.ExecContext(ctx, uploadID, id, text); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var (
+	readmeHeading   = regexp.MustCompile(`(?s)<h[1-6][^>]*>(.*?)</h[1-6]>`)
+	readmeParagraph = regexp.MustCompile(`(?s)<p[^>]*>(.*?)</p>`)
+)
+
+// readmeSummary takes a project's title and description from its
+// rendered README: the text of the first heading, and of the first
+// paragraph after it that has any, skipping rows of badges.
+func readmeSummary(rendered string) (title, description string) {
+	if loc := readmeHeading.FindStringSubmatchIndex(rendered); loc != nil {
+		title = htmlText(rendered[loc[2]:loc[3]])
+		rendered = rendered[loc[1]:]
+	}
+	for _, m := range readmeParagraph.FindAllStringSubmatch(rendered, -1) {
+		if description = htmlText(m[1]); description != "" {
+			break
+		}
+	}
+	return title, description
+}
+
+// readmeHandler serves /graph/{id}/readme: the README at the root of the
+// trunk branch's tip, or of ?ref=, rendered as sanitized HTML, with the
+// title and description it gives the project. Markdown READMEs are
+// rendered; others are shown as preformatted text.
+func readmeHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	commit, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT n.id, n.label, rm.text FROM edges c
+		JOIN edges e ON e.upload_id=c.upload_id AND e.source=c.target AND e.rel='tree->blob'
+		JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+		JOIN readmes rm ON rm.upload_id=e.upload_id AND rm.blob=e.target
+		WHERE c.upload_id=? AND c.source=? AND c.rel='commit->tree'`, uploadID, commit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	var blob, name, text string
+	for rows.Next() {
+		var id, label, t string
+		if err := rows.Scan(&id, &label, &t); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if name == "" || readmeRank(label) < readmeRank(name) {
+			blob, name, text = id, label, t
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if name == "" {
+		http.Error(w, "no readme", 404)
+		return
+	}
+
+	var rendered string
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		rendered = sanitizeHTML(renderMarkdown(text))
+	default:
+		rendered = "<pre>" + html.EscapeString(text) + "</pre>"
+	}
+	title, description := readmeSummary(rendered)
+	if description == "" {
+		// plain text: the first paragraph
+		description = strings.Join(strings.Fields(strings.SplitN(strings.TrimSpace(text), "\n\n", 2)[0]), " ")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ref":         ref,
+		"path":        "/" + name,
+		"blob":        blob,
+		"title":       title,
+		"description": description,
+		"html":        rendered,
+	})
+}
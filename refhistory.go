@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// refPosition is where a branch or tag pointed at one ingest.
+type refPosition struct {
+	Kind string
+	Name string
+	Tip  string
+}
+
+// refKind is "branch" or "tag".
+func refKind(ref *plumbing.Reference) string {
+	if ref.Name().IsTag() {
+		return "tag"
+	}
+	return "branch"
+}
+
+// storeRefHistory records positions as the upload's next ingest and
+// returns the refs rewritten since the ingest before: moved to a tip that
+// doesn't descend from their old one, by a force-push or a rebase. The
+// commits only their old tips reached, that no ref reaches now, are marked
+// "rewritten"; commits a ref reaches again lose the mark.
+func storeRefHistory(ctx context.Context, uploadID int, positions []refPosition) ([]string, error) {
+	var ingest int
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(ingest),0)+1 FROM ref_history WHERE upload_id=?", uploadID).Scan(&ingest); err != nil {
+		return nil, err
+	}
+	previous := make(map[[2]string]string)
+	rows, err := db.QueryContext(ctx, "SELECT kind, name, tip FROM ref_history WHERE upload_id=? AND ingest=?", uploadID, ingest-1)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var kind, name, tip string
+		if err := rows.Scan(&kind, &name, &tip); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		previous[[2]string{kind, name}] = tip
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flagged, err := rewrittenCommits(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	tips := make([]string, 0, len(positions))
+	for _, p := range positions {
+		tips = append(tips, p.Tip)
+	}
+	var h *history
+	var rewritten []string
+	var oldTips []string
+	orphaned := make(map[[2]string]int)
+	for _, p := range positions {
+		key := [2]string{p.Kind, p.Name}
+		old, ok := previous[key]
+		if !ok || old == p.Tip {
+			continue
+		}
+		if h == nil {
+			if h, err = loadHistory(ctx, uploadID); err != nil {
+				return nil, err
+			}
+		}
+		// a fast-forward leaves nothing of the old tip behind
+		if len(h.only([]string{old}, []string{p.Tip})) == 0 {
+			continue
+		}
+		orphaned[key] = len(h.only([]string{old}, tips))
+		oldTips = append(oldTips, old)
+		rewritten = append(rewritten, p.Name)
+	}
+	var reachable map[string]bool
+	if len(flagged) > 0 {
+		if h == nil {
+			if h, err = loadHistory(ctx, uploadID); err != nil {
+				return nil, err
+			}
+		}
+		reachable = make(map[string]bool)
+		for _, c := range h.only(tips, nil) {
+			reachable[c] = true
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO ref_history(upload_id, ingest, kind, name, tip, rewritten, orphaned) VALUES(?,?,?,?,?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	for _, p := range positions {
+		n, ok := orphaned[[2]string{p.Kind, p.Name}]
+		if _, err := stmt.ExecContext(ctx, uploadID, ingest, p.Kind, p.Name, p.Tip, ok, n); err != nil {
+			return nil, err
+		}
+	}
+	mark, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta, '$.rewritten', json('true')) WHERE upload_id=? AND id=? AND meta<>''")
+	if err != nil {
+		return nil, err
+	}
+	defer mark.Close()
+	if len(oldTips) > 0 {
+		for _, c := range h.only(oldTips, tips) {
+			if _, err := mark.ExecContext(ctx, uploadID, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	unmark, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_remove(meta, '$.rewritten') WHERE upload_id=? AND id=?")
+	if err != nil {
+		return nil, err
+	}
+	defer unmark.Close()
+	for _, c := range flagged {
+		if reachable[c] {
+			if _, err := unmark.ExecContext(ctx, uploadID, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rewritten, tx.Commit()
+}
+
+// rewrittenCommits lists the upload's commits marked rewritten.
+func rewrittenCommits(ctx context.Context, uploadID int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM nodes WHERE upload_id=? AND type='commit' AND meta<>'' AND json_extract(meta, '$.rewritten')", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		list = append(list, id)
+	}
+	return list, rows.Err()
+}
+
+// refRewrite is a ref rewritten at an ingest, as the upload lists it.
+type refRewrite struct {
+	Ingest     int    `json:"ingest"`
+	IngestedAt string `json:"ingested_at"`
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Previous   string `json:"previous"`
+	Tip        string `json:"tip"`
+	// commits no ref reaches any more
+	Orphaned int `json:"orphaned"`
+}
+
+// loadRewrites returns every ref rewrite of an upload, oldest first.
+func loadRewrites(ctx context.Context, uploadID int) ([]refRewrite, error) {
+	rows, err := db.QueryContext(ctx, `SELECT h.ingest, h.ingested_at, h.name, h.kind, p.tip, h.tip, h.orphaned
+		FROM ref_history h JOIN ref_history p ON p.upload_id=h.upload_id AND p.ingest=h.ingest-1 AND p.kind=h.kind AND p.name=h.name
+		WHERE h.upload_id=? AND h.rewritten ORDER BY h.ingest, h.kind, h.name`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []refRewrite
+	for rows.Next() {
+		var rw refRewrite
+		if err := rows.Scan(&rw.Ingest, &rw.IngestedAt, &rw.Name, &rw.Kind, &rw.Previous, &rw.Tip, &rw.Orphaned); err != nil {
+			return nil, err
+		}
+		list = append(list, rw)
+	}
+	return list, rows.Err()
+}
+
+// refMove is a ref at one ingest against the one before. Status is
+// "created", "moved", "rewritten", "same" or "deleted"; a deleted ref has
+// no tip.
+type refMove struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Tip      string `json:"tip,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Status   string `json:"status"`
+	// commits a rewrite left no ref reaching
+	Orphaned int `json:"orphaned,omitempty"`
+}
+
+// refIngest is where an upload's refs pointed at one ingest.
+type refIngest struct {
+	Ingest     int       `json:"ingest"`
+	IngestedAt string    `json:"ingested_at"`
+	Refs       []refMove `json:"refs"`
+}
+
+// refHistoryHandler serves /graph/{id}/ref-history: where each branch and
+// tag pointed at each ingest of the upload, first ingest first, with how it
+// changed since the ingest before. ?ref=main follows one ref.
+func refHistoryHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	only := r.URL.Query().Get("ref")
+	rows, err := db.QueryContext(r.Context(), `SELECT ingest, ingested_at, kind, name, tip, rewritten, orphaned FROM ref_history
+		WHERE upload_id=? ORDER BY ingest, kind, name`, uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	ingests := make([]refIngest, 0)
+	var last, cur map[[2]string]string
+	add := func(m refMove) {
+		if only == "" || m.Name == only {
+			in := &ingests[len(ingests)-1]
+			in.Refs = append(in.Refs, m)
+		}
+	}
+	// closes the current ingest with the refs it no longer has
+	flush := func() {
+		if len(ingests) == 0 {
+			return
+		}
+		var gone [][2]string
+		for key := range last {
+			if _, ok := cur[key]; !ok {
+				gone = append(gone, key)
+			}
+		}
+		sort.Slice(gone, func(i, j int) bool {
+			if gone[i][0] != gone[j][0] {
+				return gone[i][0] < gone[j][0]
+			}
+			return gone[i][1] < gone[j][1]
+		})
+		for _, key := range gone {
+			add(refMove{Name: key[1], Kind: key[0], Previous: last[key], Status: "deleted"})
+		}
+		last = cur
+	}
+	for rows.Next() {
+		var ingest int
+		var at string
+		var m refMove
+		var rewritten bool
+		if err := rows.Scan(&ingest, &at, &m.Kind, &m.Name, &m.Tip, &rewritten, &m.Orphaned); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(ingests) == 0 || ingests[len(ingests)-1].Ingest != ingest {
+			flush()
+			ingests = append(ingests, refIngest{Ingest: ingest, IngestedAt: at, Refs: make([]refMove, 0)})
+			cur = make(map[[2]string]string)
+		}
+		key := [2]string{m.Kind, m.Name}
+		cur[key] = m.Tip
+		switch prev, ok := last[key]; {
+		case !ok:
+			m.Status = "created"
+		case prev == m.Tip:
+			m.Status = "same"
+		case rewritten:
+			m.Previous, m.Status = prev, "rewritten"
+		default:
+			m.Previous, m.Status = prev, "moved"
+		}
+		add(m)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	flush()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ingests": ingests})
+}
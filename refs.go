@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// refInfo is a ref node as stored by storeRef.
+type refInfo struct {
+	Name    string `json:"name"`
+	Kind    string `json:"-"`
+	Tip     string `json:"tip"`
+	Date    string `json:"last_commit"`
+	Commits int    `json:"commits"`
+
+	TagDate    string `json:"-"`
+	TagMessage string `json:"-"`
+}
+
+// loadRefs returns the ref nodes of an upload, optionally restricted to one kind
+// ("branch" or "tag"; empty for both).
+func loadRefs(ctx context.Context, uploadID int, kind string) ([]refInfo, error) {
+	rows, err := db.QueryContext(ctx, "SELECT label,meta FROM nodes WHERE upload_id=? AND type='ref'", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make([]refInfo, 0)
+	for rows.Next() {
+		var label, metaStr string
+		if err := rows.Scan(&label, &metaStr); err != nil {
+			return nil, err
+		}
+		var meta struct {
+			Kind    string `json:"kind"`
+			Target  string `json:"target"`
+			Date    string `json:"date"`
+			Commits int    `json:"commits"`
+
+			TagDate    string `json:"tag_date"`
+			TagMessage string `json:"tag_message"`
+		}
+		_ = json.Unmarshal([]byte(metaStr), &meta)
+		if kind != "" && meta.Kind != kind {
+			continue
+		}
+		refs = append(refs, refInfo{
+			Name: label, Kind: meta.Kind, Tip: meta.Target, Date: meta.Date, Commits: meta.Commits,
+			TagDate: meta.TagDate, TagMessage: meta.TagMessage,
+		})
+	}
+	return refs, rows.Err()
+}
+
+func branchesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	branches, err := loadRefs(r.Context(), uploadID, "branch")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Name < branches[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(branches)
+}
+
+// tagInfo is the tags endpoint's view of a tag ref.
+type tagInfo struct {
+	Name      string `json:"name"`
+	Target    string `json:"target"`
+	Date      string `json:"date"`
+	Annotated bool   `json:"annotated"`
+	Message   string `json:"message,omitempty"`
+}
+
+func tagsHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	refs, err := loadRefs(r.Context(), uploadID, "tag")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(refs, func(i, j int) bool { return tagLess(refs[i].Name, refs[j].Name) })
+
+	tags := make([]tagInfo, 0, len(refs))
+	for _, ref := range refs {
+		t := tagInfo{Name: ref.Name, Target: ref.Tip, Date: ref.Date}
+		// annotated tags carry their own date; prefer it over the commit's
+		if ref.TagDate != "" {
+			t.Date = ref.TagDate
+			t.Annotated = true
+			t.Message = ref.TagMessage
+		}
+		tags = append(tags, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
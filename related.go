@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// relatedUpload is another upload sharing history with one, as the related
+// endpoint lists it.
+type relatedUpload struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// commits both have, and those only this upload or only the other has
+	SharedCommits int `json:"shared_commits"`
+	Ahead         int `json:"ahead"`
+	Behind        int `json:"behind"`
+	// the newest commits both have, where the two histories part; usually
+	// one, the fork point or the older snapshot's tip
+	Divergence []divergencePoint `json:"divergence"`
+}
+
+// divergencePoint is a commit where related uploads' histories part.
+type divergencePoint struct {
+	Hash    string `json:"hash"`
+	Message string `json:"message"`
+	Date    string `json:"date"`
+}
+
+// sharedFrontier returns the commits of shared that no other commit of
+// shared descends from, newest first in h's topological order. Shared
+// history is closed under ancestry, so these are where it ends.
+func sharedFrontier(h *history, shared map[string]bool) []string {
+	var out []string
+	for i := len(h.topo) - 1; i >= 0; i-- {
+		c := h.topo[i]
+		if !shared[c] {
+			continue
+		}
+		newest := true
+		for _, child := range h.children[c] {
+			if shared[child] {
+				newest = false
+				break
+			}
+		}
+		if newest {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// storeRelated finds the other uploads sharing commits with uploadID and
+// records the relationship both ways, replacing what an earlier ingest of
+// it recorded.
+func storeRelated(ctx context.Context, uploadID int) error {
+	rows, err := db.QueryContext(ctx, `SELECT m.upload_id, n.id FROM nodes n
+		JOIN nodes m ON m.id=n.id AND m.upload_id<>n.upload_id AND m.type='commit' AND m.meta<>''
+		WHERE n.upload_id=? AND n.type='commit' AND n.meta<>''`, uploadID)
+	if err != nil {
+		return err
+	}
+	shared := make(map[int]map[string]bool)
+	for rows.Next() {
+		var other int
+		var id string
+		if err := rows.Scan(&other, &id); err != nil {
+			rows.Close()
+			return err
+		}
+		if shared[other] == nil {
+			shared[other] = make(map[string]bool)
+		}
+		shared[other][id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var h *history
+	if len(shared) > 0 {
+		if h, err = loadHistory(ctx, uploadID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM related_uploads WHERE upload_id=?1 OR related_id=?1", uploadID); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO related_uploads(upload_id, related_id, shared_commits, divergence) VALUES(?,?,?,?),(?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for other, commits := range shared {
+		b, _ := json.Marshal(sharedFrontier(h, commits))
+		if _, err := stmt.ExecContext(ctx, uploadID, other, len(commits), string(b), other, uploadID, len(commits), string(b)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// relatedHandler serves /graph/{id}/related: the uploads sharing commits
+// with this one that the caller can see, most shared first.
+func relatedHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT rel.related_id, u.name, rel.shared_commits, rel.divergence,
+			(SELECT COUNT(*) FROM nodes WHERE upload_id=rel.upload_id AND type='commit' AND meta<>''),
+			(SELECT COUNT(*) FROM nodes WHERE upload_id=rel.related_id AND type='commit' AND meta<>'')
+		FROM related_uploads rel JOIN uploads u ON u.id=rel.related_id
+		WHERE rel.upload_id=? ORDER BY rel.shared_commits DESC, rel.related_id`, uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	type row struct {
+		relatedUpload
+		hashes []string
+	}
+	var found []row
+	for rows.Next() {
+		var rel row
+		var name sql.NullString
+		var divergence string
+		var own, theirs int
+		if err := rows.Scan(&rel.ID, &name, &rel.SharedCommits, &divergence, &own, &theirs); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		rel.Name = name.String
+		rel.Ahead, rel.Behind = own-rel.SharedCommits, theirs-rel.SharedCommits
+		json.Unmarshal([]byte(divergence), &rel.hashes)
+		found = append(found, rel)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	related := make([]relatedUpload, 0, len(found))
+	var h *history
+	for _, rel := range found {
+		if !canView(r, rel.ID) {
+			continue
+		}
+		if h == nil {
+			if h, err = loadHistory(r.Context(), uploadID); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		rel.Divergence = make([]divergencePoint, 0, len(rel.hashes))
+		for _, c := range rel.hashes {
+			if info := h.commits[c]; info != nil {
+				rel.Divergence = append(rel.Divergence, divergencePoint{Hash: c, Message: info.Message, Date: info.When.Format(time.RFC3339)})
+			}
+		}
+		related = append(related, rel.relatedUpload)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(related)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// release is one tag of the releases timeline, with what went into it
+// since the release before.
+type release struct {
+	Name         string `json:"name"`
+	Target       string `json:"target"`
+	Date         string `json:"date"`
+	Commits      int    `json:"commits"`
+	Contributors int    `json:"contributors"`
+	// whole days since the previous release; absent for the first
+	DaysSince *int `json:"days_since_previous,omitempty"`
+}
+
+// releaseTimeline orders tags by date, the tag's own for annotated tags,
+// and counts the commits each one adds to the one before, as git log
+// prev..tag lists them, and their distinct authors by email. The first
+// release counts its whole history.
+func releaseTimeline(h *history, tags []refInfo) []release {
+	type dated struct {
+		refInfo
+		when time.Time
+	}
+	list := make([]dated, 0, len(tags))
+	for _, t := range tags {
+		d := t.Date
+		if t.TagDate != "" {
+			d = t.TagDate
+		}
+		when, err := time.Parse(time.RFC3339, d)
+		if err != nil {
+			continue
+		}
+		list = append(list, dated{t, when})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].when.Equal(list[j].when) {
+			return list[i].when.Before(list[j].when)
+		}
+		return tagLess(list[i].Name, list[j].Name)
+	})
+
+	out := make([]release, 0, len(list))
+	for i, t := range list {
+		var exclude []string
+		if i > 0 {
+			exclude = []string{list[i-1].Tip}
+		}
+		commits := h.only([]string{t.Tip}, exclude)
+		authors := make(map[string]bool)
+		for _, c := range commits {
+			authors[strings.ToLower(h.commits[c].Email)] = true
+		}
+		rel := release{
+			Name: t.Name, Target: t.Tip, Date: t.when.Format(time.RFC3339),
+			Commits: len(commits), Contributors: len(authors),
+		}
+		if i > 0 {
+			days := int(t.when.Sub(list[i-1].when).Hours() / 24)
+			rel.DaysSince = &days
+		}
+		out = append(out, rel)
+	}
+	return out
+}
+
+// releasesHandler serves /graph/{id}/releases: the tags as a release
+// timeline, oldest first.
+func releasesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	tags, err := loadRefs(r.Context(), uploadID, "tag")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(releaseTimeline(h, tags))
+}
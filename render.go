@@ -0,0 +1,330 @@
+package main
+
+// Static images of the commit graph, laid out here rather than by the
+// browser, served as /graph/{id}/render.svg and /graph/{id}/render.png.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	renderDefaultLimit = 200
+	renderMaxLimit     = 1000
+
+	renderStep   = 28 // distance between neighbouring commits and lanes
+	renderMargin = 24
+	renderLabels = 90 // room above the lanes for ref labels
+	renderRadius = 6
+)
+
+// lanePalette colors lanes in turn; lane 0 is the trunk.
+var lanePalette = []color.RGBA{
+	{0x46, 0x82, 0xb4, 0xff}, // steelblue
+	{0xe0, 0x7b, 0x00, 0xff},
+	{0x2e, 0x8b, 0x57, 0xff},
+	{0xb0, 0x30, 0x60, 0xff},
+	{0x6a, 0x5a, 0xcd, 0xff},
+	{0x8b, 0x5a, 0x2b, 0xff},
+	{0x00, 0x8b, 0x8b, 0xff},
+}
+
+var refColor = color.RGBA{0x80, 0x00, 0x80, 0xff} // purple, as on the graph page
+
+// commitLayout places commits on a grid: one column per commit in
+// topological order, one row (lane) per branch. Lanes are reused once the
+// branch on them has been merged or has ended.
+type commitLayout struct {
+	*window
+	col, lane map[string]int
+	lanes     int
+	refs      map[string][]string // ref names by tip
+}
+
+func layoutCommits(ctx context.Context, uploadID, limit int) (*commitLayout, error) {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := loadRefs(ctx, uploadID, "")
+	if err != nil {
+		return nil, err
+	}
+	win := h.newest(limit)
+	branchOf, trunk := win.branches(refs)
+
+	l := &commitLayout{
+		window: win,
+		col:    make(map[string]int, len(win.order)),
+		lane:   make(map[string]int, len(win.order)),
+		refs:   make(map[string][]string),
+	}
+	for i, c := range win.order {
+		l.col[c] = i
+	}
+	for _, ref := range refs {
+		if win.included[ref.Tip] {
+			l.refs[ref.Tip] = append(l.refs[ref.Tip], ref.Name)
+		}
+	}
+
+	// a branch occupies its lane from its fork point to its last commit or
+	// the merge that takes it in, whichever is later
+	type span struct{ first, last int }
+	spans := make(map[string]*span)
+	var names []string
+	for _, c := range win.order {
+		b, i := branchOf[c], l.col[c]
+		s := spans[b]
+		if s == nil {
+			s = &span{first: i, last: i}
+			if p := win.parent(c, 0); p != "" {
+				s.first = l.col[p]
+			}
+			spans[b] = s
+			names = append(names, b)
+		}
+		s.last = i
+		for _, child := range win.children[c] {
+			if win.included[child] && branchOf[child] != b && l.col[child] > s.last {
+				s.last = l.col[child]
+			}
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if (names[i] == trunk) != (names[j] == trunk) {
+			return names[i] == trunk
+		}
+		return spans[names[i]].first < spans[names[j]].first
+	})
+	laneOf := make(map[string]int, len(names))
+	var busyUntil []int // last column used on each lane
+	for _, b := range names {
+		s := spans[b]
+		lane := -1
+		// the trunk keeps lane 0 to itself
+		for i := 1; i < len(busyUntil) && b != trunk; i++ {
+			if busyUntil[i] < s.first {
+				lane = i
+				break
+			}
+		}
+		if lane < 0 {
+			lane = len(busyUntil)
+			busyUntil = append(busyUntil, 0)
+		}
+		busyUntil[lane] = s.last
+		laneOf[b] = lane
+	}
+	for _, c := range win.order {
+		l.lane[c] = laneOf[branchOf[c]]
+	}
+	l.lanes = len(busyUntil)
+	return l, nil
+}
+
+func (l *commitLayout) size() (w, h int) {
+	cols := len(l.order)
+	if cols == 0 {
+		cols = 1
+	}
+	lanes := l.lanes
+	if lanes == 0 {
+		lanes = 1
+	}
+	// labels slant up to the right, past the last column
+	return 2*renderMargin + (cols-1)*renderStep + renderLabels, renderLabels + 2*renderMargin + (lanes-1)*renderStep
+}
+
+func (l *commitLayout) point(c string) (x, y float64) {
+	return float64(renderMargin + l.col[c]*renderStep), float64(renderLabels + renderMargin + l.lane[c]*renderStep)
+}
+
+func laneColor(lane int) color.RGBA {
+	return lanePalette[lane%len(lanePalette)]
+}
+
+// eachLink calls fn for every parent link in the window, with the lane
+// the line should be drawn in: the branch's own lane, or for a merge the
+// lane of the branch merged in.
+func (l *commitLayout) eachLink(fn func(parent, child string, lane int)) {
+	for _, c := range l.order {
+		for i, p := range l.parents[c] {
+			if !l.included[p] {
+				continue
+			}
+			lane := l.lane[c]
+			if i > 0 {
+				lane = l.lane[p]
+			}
+			fn(p, c, lane)
+		}
+	}
+}
+
+// renderHandler serves /graph/{id}/render.svg and render.png. limit
+// (default 200, at most 1000) keeps the newest commits, as in the Mermaid
+// export.
+func renderHandler(format string) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, idStr string) {
+		uploadID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "bad id", 400)
+			return
+		}
+		limit, ok := limitParam(w, r, renderDefaultLimit)
+		if !ok {
+			return
+		}
+		if limit == 0 || limit > renderMaxLimit {
+			limit = renderMaxLimit
+		}
+		if notModified(w, r, uploadID) {
+			return
+		}
+		l, err := layoutCommits(r.Context(), uploadID, limit)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="upload-%d.%s"`, uploadID, format))
+		bw := bufio.NewWriterSize(w, 64<<10)
+		defer bw.Flush()
+		switch format {
+		case "svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			err = writeSVG(bw, l, uploadName(r.Context(), uploadID))
+		case "png":
+			w.Header().Set("Content-Type", "image/png")
+			err = png.Encode(bw, drawPNG(l))
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "render", "format", format, "upload_id", uploadID, "err", err)
+		}
+	}
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func writeSVG(bw *bufio.Writer, l *commitLayout, title string) error {
+	width, height := l.size()
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Helvetica, Arial, sans-serif" font-size="11">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(bw, "<title>%s</title>\n", xmlEscape(title))
+	fmt.Fprintf(bw, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+
+	bw.WriteString(`<g fill="none" stroke-width="2">` + "\n")
+	l.eachLink(func(p, c string, lane int) {
+		px, py := l.point(p)
+		cx, cy := l.point(c)
+		if py == cy {
+			fmt.Fprintf(bw, `<line x1="%g" y1="%g" x2="%g" y2="%g" stroke="%s"/>`+"\n", px, py, cx, cy, hexColor(laneColor(lane)))
+			return
+		}
+		mx := (px + cx) / 2
+		fmt.Fprintf(bw, `<path d="M%g %g C%g %g %g %g %g %g" stroke="%s"/>`+"\n", px, py, mx, py, mx, cy, cx, cy, hexColor(laneColor(lane)))
+	})
+	bw.WriteString("</g>\n")
+
+	for _, c := range l.order {
+		x, y := l.point(c)
+		info := l.commits[c]
+		tip := c[:7] + " " + firstLine(info.Message) + "\n" + info.Author + ", " + info.When.Format("2006-01-02")
+		fmt.Fprintf(bw, `<circle cx="%g" cy="%g" r="%d" fill="%s" stroke="white" stroke-width="1.5"><title>%s</title></circle>`+"\n",
+			x, y, renderRadius, hexColor(laneColor(l.lane[c])), xmlEscape(tip))
+		if names := l.refs[c]; len(names) > 0 {
+			sort.Strings(names)
+			// labels sit above the lanes, slanted so neighbours don't overlap
+			fmt.Fprintf(bw, `<line x1="%g" y1="%g" x2="%g" y2="%g" stroke="%s" stroke-dasharray="2 3"/>`+"\n",
+				x, float64(renderLabels), x, y-renderRadius, hexColor(refColor))
+			fmt.Fprintf(bw, `<text x="%g" y="%d" fill="%s" transform="rotate(-40 %g %d)">%s</text>`+"\n",
+				x, renderLabels-4, hexColor(refColor), x, renderLabels-4, xmlEscape(strings.Join(names, ", ")))
+		}
+	}
+	_, err := bw.WriteString("</svg>\n")
+	return err
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// drawPNG rasterizes the same layout as writeSVG. There are no fonts in
+// the standard library, so refs are marked with a tick instead of a label.
+func drawPNG(l *commitLayout) image.Image {
+	width, height := l.size()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	l.eachLink(func(p, c string, lane int) {
+		px, py := l.point(p)
+		cx, cy := l.point(c)
+		col := laneColor(lane)
+		if py == cy {
+			strokeLine(img, px, py, cx, cy, col)
+			return
+		}
+		// the cubic curve of the SVG, as short segments
+		mx := (px + cx) / 2
+		const steps = 16
+		lx, ly := px, py
+		for i := 1; i <= steps; i++ {
+			t := float64(i) / steps
+			u := 1 - t
+			x := u*u*u*px + 3*u*u*t*mx + 3*u*t*t*mx + t*t*t*cx
+			y := u*u*u*py + 3*u*u*t*py + 3*u*t*t*cy + t*t*t*cy
+			strokeLine(img, lx, ly, x, y, col)
+			lx, ly = x, y
+		}
+	})
+	for _, c := range l.order {
+		x, y := l.point(c)
+		if len(l.refs[c]) > 0 {
+			strokeLine(img, x, float64(renderLabels), x, y-renderRadius, refColor)
+			fillCircle(img, x, float64(renderLabels), 3, refColor)
+		}
+		fillCircle(img, x, y, renderRadius+1.5, color.RGBA{0xff, 0xff, 0xff, 0xff})
+		fillCircle(img, x, y, renderRadius, laneColor(l.lane[c]))
+	}
+	return img
+}
+
+// strokeLine draws a line about two pixels wide by stamping small discs
+// along it.
+func strokeLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA) {
+	n := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))))
+	for i := 0; i <= n; i++ {
+		t := 0.0
+		if n > 0 {
+			t = float64(i) / float64(n)
+		}
+		fillCircle(img, x0+(x1-x0)*t, y0+(y1-y0)*t, 1, c)
+	}
+}
+
+func fillCircle(img *image.RGBA, cx, cy, r float64, c color.RGBA) {
+	for y := int(cy - r); y <= int(math.Ceil(cy+r)); y++ {
+		for x := int(cx - r); x <= int(math.Ceil(cx+r)); x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			if dx*dx+dy*dy <= r*r {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
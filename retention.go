@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadRetention is how long uploads are kept before the server deletes
+// them, or 0 to keep them.
+var uploadRetention time.Duration
+
+// parseAge reads a duration such as 12h, or 30d in days, which
+// time.ParseDuration lacks.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("want a duration such as 30d or 12h, got %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("want a duration such as 30d or 12h, got %q", s)
+	}
+	return d, nil
+}
+
+func envAge(name string) time.Duration {
+	s := strings.TrimSpace(setting(name))
+	if s == "" || s == "0" {
+		return 0
+	}
+	d, err := parseAge(s)
+	if err != nil {
+		fatalf("%s: %v", name, err)
+	}
+	return d
+}
+
+// pruneUploads deletes the uploads made more than age ago, except those
+// still being ingested, returning their IDs.
+func pruneUploads(age time.Duration) ([]int, error) {
+	ids, err := expiredUploads(age)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		if _, err := deleteUpload(id); err != nil {
+			return ids[:i], err
+		}
+	}
+	return ids, nil
+}
+
+// expiredUploads are the uploads pruneUploads would delete.
+func expiredUploads(age time.Duration) ([]int, error) {
+	cutoff := time.Now().UTC().Add(-age).Format("2006-01-02 15:04:05")
+	rows, err := db.Query(`SELECT id FROM uploads WHERE uploaded_at < ?
+		AND COALESCE(status,'') NOT IN ('queued','ingesting') ORDER BY id`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// expireUploads deletes uploads past GITVIS_RETENTION, at startup and then
+// hourly.
+func expireUploads() {
+	for {
+		ids, err := pruneUploads(uploadRetention)
+		if err != nil {
+			slog.Error("deleting expired uploads", "err", err)
+		}
+		if len(ids) > 0 {
+			slog.Info("deleted expired uploads", "uploads", len(ids), "retention", uploadRetention)
+		}
+		time.Sleep(time.Hour)
+	}
+}
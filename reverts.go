@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+// revertRef matches the line git revert writes into its message, "This
+// reverts commit <hash>.", abbreviated hashes included.
+var revertRef = regexp.MustCompile(`(?i)\bThis reverts commit ([0-9a-f]{7,40})\b`)
+
+// parseReverts returns the commits a message says it reverts, as written.
+func parseReverts(message string) []string {
+	var hashes []string
+	for _, m := range revertRef.FindAllStringSubmatch(message, -1) {
+		hashes = append(hashes, strings.ToLower(m[1]))
+	}
+	return hashes
+}
+
+// storeReverts links each commit whose message says it reverts another
+// commit of the upload to it with a "reverts" edge, and records the
+// reverted hashes as "reverts" in its meta. Where undoing the revert
+// makes the same change as the commit it names (their patch-ids match,
+// so storeCherryPicks must run first) the revert is also "revert_exact".
+// Edges from an earlier ingest of the upload are replaced.
+func storeReverts(ctx context.Context, r *git.Repository, uploadID int) error {
+	h, err := loadHistory(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	// resolve finds the commit an abbreviated hash names, if just one
+	resolve := func(prefix string) string {
+		if h.commits[prefix] != nil {
+			return prefix
+		}
+		found := ""
+		for c := range h.commits {
+			if strings.HasPrefix(c, prefix) {
+				if found != "" {
+					return ""
+				}
+				found = c
+			}
+		}
+		return found
+	}
+	reverts := make(map[string][]string)
+	for _, c := range h.topo {
+		for _, prefix := range parseReverts(h.commits[c].Message) {
+			if target := resolve(prefix); target != "" && target != c {
+				reverts[c] = append(reverts[c], target)
+			}
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM edges WHERE upload_id=? AND rel='reverts'", uploadID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE nodes SET meta=json_remove(meta,'$.reverts','$.revert_exact') WHERE upload_id=? AND type='commit' AND json_extract(meta,'$.reverts') IS NOT NULL", uploadID); err != nil {
+		return err
+	}
+	patchOf, err := tx.PrepareContext(ctx, "SELECT COALESCE(json_extract(meta,'$.patch_id'),'') FROM nodes WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer patchOf.Close()
+	mark, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.reverts',json(?),'$.revert_exact',json(?)) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer mark.Close()
+	link, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO edges(upload_id, source, target, rel) VALUES(?,?,?,'reverts')")
+	if err != nil {
+		return err
+	}
+	defer link.Close()
+	for c, targets := range reverts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		exact := false
+		if p := h.firstParent(c); p != "" && len(targets) == 1 && len(h.parents[c]) == 1 {
+			var want string
+			if err := patchOf.QueryRowContext(ctx, uploadID, targets[0]).Scan(&want); err != nil {
+				return err
+			}
+			revertTree, errR := commitTree(r, c)
+			parentTree, errP := commitTree(r, p)
+			if want != "" && errR == nil && errP == nil {
+				exact = patchID(r, revertTree, parentTree) == want
+			}
+		}
+		b, _ := json.Marshal(targets)
+		e, _ := json.Marshal(exact)
+		if _, err := mark.ExecContext(ctx, string(b), string(e), uploadID, c); err != nil {
+			return err
+		}
+		for _, t := range targets {
+			if _, err := link.ExecContext(ctx, uploadID, c, t); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
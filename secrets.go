@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+var (
+	secretsMu sync.Mutex
+	secretVal = map[string][]byte{}
+)
+
+// serverSecret returns the signing key called name: the value of env when
+// set, otherwise a random key generated on first use and kept in the
+// secrets table so that whatever it signs survives restarts.
+func serverSecret(name, env string) []byte {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if v, ok := secretVal[name]; ok {
+		return v
+	}
+	if s := setting(env); s != "" {
+		secretVal[name] = []byte(s)
+		return secretVal[name]
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO secrets(name, value) VALUES(?, ?)", name, randomToken()); err != nil {
+		slog.Error("server key", "name", name, "err", err)
+	}
+	var v string
+	if err := db.QueryRow("SELECT value FROM secrets WHERE name=?", name).Scan(&v); err != nil {
+		slog.Error("server key", "name", name, "err", err)
+		return nil
+	}
+	secretVal[name] = []byte(v)
+	return secretVal[name]
+}
@@ -0,0 +1,145 @@
+package main
+
+// Secret scanning: every text blob of an upload is checked at ingest, by
+// the ingest.Secrets visitor, for credentials committed by mistake. A file
+// named by GITVIS_SECRET_RULES can add rules.
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/example/gitvis/pkg/ingest"
+)
+
+// secretRulesPath is the file of extra rules, read on every ingest.
+var secretRulesPath string
+
+// secretEntropy is the Shannon entropy a rule's captured text needs; see
+// ingest.DefaultSecretEntropy.
+var secretEntropy float64
+
+// envFloat reads a number from the environment, or returns def.
+func envFloat(name string, def float64) float64 {
+	s := strings.TrimSpace(setting(name))
+	if s == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		fatalf("%s: want a non-negative number, got %q", name, s)
+	}
+	return f
+}
+
+// loadSecretRules returns the built-in rules with those of
+// GITVIS_SECRET_RULES. Bad rules are logged and left out rather than
+// failing every ingest.
+func loadSecretRules() []ingest.SecretRule {
+	rules := ingest.DefaultSecretRules
+	if secretRulesPath == "" {
+		return rules
+	}
+	b, err := os.ReadFile(secretRulesPath)
+	var extra []ingest.SecretRule
+	if err == nil {
+		extra, err = ingest.ParseSecretRules(string(b))
+	}
+	if err != nil {
+		slog.Warn("secret rules", "err", err)
+		return rules
+	}
+	// a rule named like a built-in one replaces it
+	replaced := make(map[string]bool)
+	for _, r := range extra {
+		replaced[r.Name] = true
+	}
+	var out []ingest.SecretRule
+	for _, r := range rules {
+		if !replaced[r.Name] {
+			out = append(out, r)
+		}
+	}
+	return append(out, extra...)
+}
+
+// ingestVisitors are the visitors of an upload's walk: ingest.Standard,
+// with secrets found by loadSecretRules and secretEntropy.
+func ingestVisitors() []ingest.Visitor {
+	visitors := ingest.Standard()
+	for i, v := range visitors {
+		if _, ok := v.(*ingest.Secrets); ok {
+			visitors[i] = ingest.NewSecrets(loadSecretRules(), secretEntropy)
+		}
+	}
+	return visitors
+}
+
+// countSecrets returns how many of the upload's blobs have findings.
+func countSecrets(ctx context.Context, uploadID int) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM nodes WHERE upload_id=? AND type='blob' AND json_extract(meta,'$.secrets') IS NOT NULL",
+		uploadID).Scan(&n)
+	return n, err
+}
+
+// secretReportEntry is one flagged line in the secrets report.
+type secretReportEntry struct {
+	Blob string `json:"blob"`
+	Path string `json:"path"`
+	ingest.SecretFinding
+}
+
+// secretsHandler serves /graph/{id}/secrets: every line of the upload's
+// history that looks like a committed secret, by path. The secrets
+// themselves aren't stored or shown.
+func secretsHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT id, COALESCE(json_extract(meta,'$.path'), label), json_extract(meta,'$.secrets')
+		FROM nodes WHERE upload_id=? AND type='blob' AND json_extract(meta,'$.secrets') IS NOT NULL`, uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	findings := make([]secretReportEntry, 0)
+	blobs := 0
+	for rows.Next() {
+		var id, path, list string
+		if err := rows.Scan(&id, &path, &list); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var found []ingest.SecretFinding
+		json.Unmarshal([]byte(list), &found)
+		for _, f := range found {
+			findings = append(findings, secretReportEntry{Blob: id, Path: path, SecretFinding: f})
+		}
+		blobs++
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Blob != b.Blob {
+			return a.Blob < b.Blob
+		}
+		return a.Line < b.Line
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"blobs": blobs, "findings": findings})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed MAJOR.MINOR.PATCH[-PRERELEASE] version; build metadata is dropped.
+type semver struct {
+	nums [3]int
+	pre  []string
+}
+
+// parseSemver accepts tags like "v1.2.10", "1.2" or "release-1.4.0-rc.1".
+// Missing minor/patch components count as zero.
+func parseSemver(tag string) (semver, bool) {
+	var v semver
+	s := tag
+	if i := strings.IndexAny(s, "0123456789"); i >= 0 {
+		prefix := s[:i]
+		if prefix != "" && prefix != "v" && prefix != "V" && !strings.HasSuffix(prefix, "-") {
+			return v, false
+		}
+		s = s[i:]
+	} else {
+		return v, false
+	}
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.nums[i] = n
+	}
+	return v, true
+}
+
+// compare returns -1, 0 or 1 following semver precedence rules.
+func (a semver) compare(b semver) int {
+	for i := range a.nums {
+		if a.nums[i] != b.nums[i] {
+			return cmpInt(a.nums[i], b.nums[i])
+		}
+	}
+	// a release sorts after any of its pre-releases
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		x, errX := strconv.Atoi(a.pre[i])
+		y, errY := strconv.Atoi(b.pre[i])
+		switch {
+		case errX == nil && errY == nil:
+			if x != y {
+				return cmpInt(x, y)
+			}
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		default:
+			if c := strings.Compare(a.pre[i], b.pre[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmpInt(len(a.pre), len(b.pre))
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// tagLess orders version-like tags by semver precedence, ahead of any
+// non-version tags, which fall back to plain name order.
+func tagLess(a, b string) bool {
+	va, okA := parseSemver(a)
+	vb, okB := parseSemver(b)
+	switch {
+	case okA && okB:
+		if c := va.compare(vb); c != 0 {
+			return c < 0
+		}
+		return a < b
+	case okA:
+		return true
+	case okB:
+		return false
+	}
+	return a < b
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Share links let anyone holding them view an upload, private or not,
+// until they expire:
+//
+//	/graph/{id}?token=<hmac>&exp=<unix seconds>
+//
+// The token is an HMAC-SHA256 of "{id}:{exp}" keyed by GITVIS_SHARE_SECRET,
+// or by a random key generated on first use and kept in the database so
+// links survive restarts. Changing the key revokes every link at once.
+
+const (
+	defaultShareTTL = 48 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+func shareKey() []byte {
+	return serverSecret("share", "GITVIS_SHARE_SECRET")
+}
+
+func shareSignature(uploadID int, exp int64) []byte {
+	mac := hmac.New(sha256.New, shareKey())
+	fmt.Fprintf(mac, "%d:%d", uploadID, exp)
+	return mac.Sum(nil)
+}
+
+// shareURL returns a link to the graph page of uploadID valid until exp.
+func shareURL(uploadID int, exp time.Time) string {
+	sig := base64.RawURLEncoding.EncodeToString(shareSignature(uploadID, exp.Unix()))
+	return fmt.Sprintf("%s/graph/%d?token=%s&exp=%d", baseURL(), uploadID, sig, exp.Unix())
+}
+
+// validShare reports whether the request carries an unexpired share link
+// for uploadID.
+func validShare(r *http.Request, uploadID int) bool {
+	q := r.URL.Query()
+	token, expStr := q.Get("token"), q.Get("exp")
+	if token == "" || expStr == "" || len(shareKey()) == 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, shareSignature(uploadID, exp))
+}
+
+// shareHandler serves POST /graph/{id}/share?hours=N for the upload's
+// owner and returns a signed link (48 hours by default, at most 30 days).
+func shareHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	a, ok, err := lookupAccess(uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !isOwner(r, a) {
+		http.Error(w, "only the owner can share an upload", http.StatusForbidden)
+		return
+	}
+	ttl := defaultShareTTL
+	if h := r.URL.Query().Get("hours"); h != "" {
+		n, err := strconv.Atoi(h)
+		if err != nil || n <= 0 || time.Duration(n)*time.Hour > maxShareTTL {
+			http.Error(w, "hours must be between 1 and 720", 400)
+			return
+		}
+		ttl = time.Duration(n) * time.Hour
+	}
+	exp := time.Now().Add(ttl).Truncate(time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url":     shareURL(uploadID, exp),
+		"expires": exp.UTC().Format(time.RFC3339),
+	})
+}
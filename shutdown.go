@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long a SIGINT or SIGTERM waits for requests
+// and ingests to finish before interrupting them.
+var shutdownTimeout time.Duration
+
+var errShuttingDown = errors.New("server is shutting down")
+
+var (
+	// draining is set once shutdown starts; no ingest starts after it
+	drainMu  sync.Mutex
+	draining bool
+	ingestWG sync.WaitGroup
+	// shuttingDown is closed when shutdown starts, ending event streams
+	shuttingDown = make(chan struct{})
+	// stopIngests is cancelled, with errShuttingDown, when ingests run
+	// past the shutdown timeout
+	stopIngests, interruptIngests = context.WithCancelCause(context.Background())
+)
+
+// isShuttingDown reports whether shutdown has started.
+func isShuttingDown() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return draining
+}
+
+// trackIngest registers an ingest about to run so shutdown waits for it,
+// failing with errShuttingDown once shutdown has started. It returns ctx
+// cancelled too when shutdown gives up waiting, and the func to call when
+// the ingest ends.
+func trackIngest(ctx context.Context) (context.Context, func(), error) {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if draining {
+		return nil, nil, errShuttingDown
+	}
+	ingestWG.Add(1)
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(stopIngests, func() { cancel(context.Cause(stopIngests)) })
+	return ctx, func() {
+		stop()
+		cancel(nil)
+		ingestWG.Done()
+	}, nil
+}
+
+// shutdown stops srv gracefully: no new connections or ingests, then up to
+// shutdownTimeout for requests in flight and running ingests to finish.
+// Ingests still running then are interrupted and fail, keeping their
+// archives so they can be retried. Trace spans still waiting are sent, and
+// the database is closed last.
+func shutdown(srv *http.Server) {
+	drainMu.Lock()
+	draining = true
+	close(shuttingDown)
+	drainMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
+	ingestsDone := make(chan struct{})
+	go func() {
+		ingestWG.Wait()
+		close(ingestsDone)
+	}()
+	select {
+	case <-ingestsDone:
+	case <-ctx.Done():
+		slog.Warn("interrupting ingests still running", "ingests", ingestsRunning.Load()+ingestsQueued.Load())
+		interruptIngests(errShuttingDown)
+		<-ingestsDone
+	}
+	// requests whose ingest was interrupted can still answer
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("closing requests still running", "err", err)
+		srv.Close()
+	}
+	if otlpEndpoint != "" {
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		flushSpans(ctx)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("closing database", "err", err)
+	}
+	slog.Info("shut down")
+}
+
+// failInterruptedIngests marks ingests a previous run left unfinished, as a
+// crash or kill would, as failed so they can be retried.
+func failInterruptedIngests() error {
+	res, err := db.Exec("UPDATE uploads SET status='failed', error='interrupted by a restart' WHERE status IN ('queued', 'ingesting')")
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Warn("ingests interrupted by a restart can be retried", "ingests", n)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// staleDefaultDays is how long a file must have gone untouched to be
+	// reported, unless ?min_days= says otherwise
+	staleDefaultDays = 365
+	// staleDefaultLimit is how many stale files are listed unless asked
+	// for more
+	staleDefaultLimit = 50
+)
+
+// fileAge is one file of the stale files report.
+type fileAge struct {
+	Path         string `json:"path"`
+	LastCommit   string `json:"last_commit"`
+	LastModified string `json:"last_modified"`
+	Author       string `json:"author"`
+	// trunk commits made since, and whole days since, the last change
+	CommitsSince int `json:"commits_since"`
+	AgeDays      int `json:"age_days"`
+}
+
+// treeFiles returns the paths of the files in commit's tree, with a
+// leading "/" as the churn pass records them. A blob goes by its node's
+// label, so identical files under different names share one.
+func treeFiles(ctx context.Context, uploadID int, commit string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `WITH RECURSIVE walk(id, type, path) AS (
+			SELECT target, 'tree', '' FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'
+			UNION
+			SELECT n.id, n.type, walk.path || '/' || n.label FROM walk
+			JOIN edges e ON e.upload_id=? AND e.source=walk.id AND e.rel IN ('tree->tree','tree->blob')
+			JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.target
+			WHERE walk.type='tree'
+		)
+		SELECT DISTINCT path FROM walk WHERE type='blob'`, uploadID, commit, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+// fileAges finds, for each of files, the newest commit in tip's history
+// that changed it and counts the commits in that history authored after
+// it. Files with no recorded change, such as those only a merge
+// introduced, are left out. Oldest change first.
+func fileAges(h *history, tip string, files []string, now time.Time) []fileAge {
+	wanted := make(map[string]bool, len(files))
+	for _, f := range files {
+		wanted[f] = true
+	}
+	reach := h.ancestors(tip)
+	last := make(map[string]string)
+	var dates []time.Time
+	// children come before parents in reverse topological order, so the
+	// first commit seen changing a file is its newest change
+	for i := len(h.topo) - 1; i >= 0; i-- {
+		c := h.topo[i]
+		if !reach[c] {
+			continue
+		}
+		dates = append(dates, h.commits[c].When)
+		for _, f := range h.commits[c].Changed {
+			if wanted[f] && last[f] == "" {
+				last[f] = c
+			}
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	ages := make([]fileAge, 0, len(last))
+	for f, c := range last {
+		info := h.commits[c]
+		since := len(dates) - sort.Search(len(dates), func(i int) bool { return dates[i].After(info.When) })
+		age := fileAge{
+			Path: f, LastCommit: c, LastModified: info.When.Format(time.RFC3339), Author: info.Author,
+			CommitsSince: since,
+		}
+		if now.After(info.When) {
+			age.AgeDays = int(now.Sub(info.When).Hours() / 24)
+		}
+		ages = append(ages, age)
+	}
+	sort.Slice(ages, func(i, j int) bool {
+		if ages[i].AgeDays != ages[j].AgeDays {
+			return ages[i].AgeDays > ages[j].AgeDays
+		}
+		return ages[i].Path < ages[j].Path
+	})
+	return ages
+}
+
+// staleFilesHandler serves /graph/{id}/analytics/stale-files: the files
+// of the trunk branch's tip, or of ?ref=, that no commit has changed for
+// at least ?min_days= days (default 365), oldest change first, at most
+// ?limit= of them (default 50, 0 for all).
+func staleFilesHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	limit, ok := limitParam(w, r, staleDefaultLimit)
+	if !ok {
+		return
+	}
+	minDays := staleDefaultDays
+	if s := r.URL.Query().Get("min_days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "min_days must be a non-negative number", 400)
+			return
+		}
+		minDays = n
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	tip, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	files, err := treeFiles(r.Context(), uploadID, tip)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	stale := make([]fileAge, 0)
+	for _, f := range fileAges(h, tip, files, time.Now()) {
+		if f.AgeDays < minDays || limit > 0 && len(stale) == limit {
+			break
+		}
+		stale = append(stale, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ref": ref, "files": stale})
+}
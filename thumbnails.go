@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	// thumbSize is the most pixels a thumbnail has on either side.
+	thumbSize = 128
+	// thumbMaxBytes and thumbMaxPixels bound the images thumbnailed, so a
+	// huge or maliciously compressed image can't stall an ingest.
+	thumbMaxBytes  = 16 << 20
+	thumbMaxPixels = 25_000_000
+)
+
+// thumbExtensions are the image file types thumbnailed: those the
+// standard library decodes.
+var thumbExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true}
+
+// thumbnail scales img down to fit in size×size pixels, averaging the
+// pixels each one covers. Images that already fit keep their size.
+func thumbnail(img image.Image, size int) *image.RGBA64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(1, h*size/w)
+		} else {
+			tw, th = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var sr, sg, sb, sa, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, b, a := img.At(sx, sy).RGBA()
+					sr, sg, sb, sa = sr+uint64(r), sg+uint64(g), sb+uint64(b), sa+uint64(a)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(sr / n), uint16(sg / n), uint16(sb / n), uint16(sa / n)})
+		}
+	}
+	return dst
+}
+
+// storeThumbnails renders a PNG thumbnail of each of the upload's PNG,
+// JPEG and GIF blobs and records the image's "image" (format, width and
+// height) in its meta. Thumbnails of an earlier ingest are replaced.
+func storeThumbnails(ctx context.Context, r *git.Repository, uploadID int) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, label FROM nodes WHERE upload_id=? AND type='blob' AND COALESCE(json_extract(meta,'$.size'),0) <= ?",
+		uploadID, thumbMaxBytes)
+	if err != nil {
+		return err
+	}
+	var images []string
+	for rows.Next() {
+		var id, label string
+		if err := rows.Scan(&id, &label); err != nil {
+			rows.Close()
+			return err
+		}
+		if thumbExtensions[strings.ToLower(path.Ext(label))] {
+			images = append(images, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM thumbnails WHERE upload_id=?", uploadID); err != nil {
+		return err
+	}
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO thumbnails(upload_id, blob, data) VALUES(?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	mark, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.image',json(?)) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer mark.Close()
+	for _, id := range images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := r.BlobObject(plumbing.NewHash(id))
+		if err != nil {
+			continue
+		}
+		rd, err := b.Reader()
+		if err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(rd)
+		rd.Close()
+		if err != nil {
+			continue
+		}
+		// the header says how big the image is before decoding it
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil || cfg.Width*cfg.Height > thumbMaxPixels {
+			continue
+		}
+		img, _, err := image.Decode(&buf)
+		if err != nil {
+			continue
+		}
+		var thumb bytes.Buffer
+		if err := png.Encode(&thumb, thumbnail(img, thumbSize)); err != nil {
+			continue
+		}
+		if _, err := insert.ExecContext(ctx, uploadID, id, thumb.Bytes()); err != nil {
+			return err
+		}
+		info, _ := json.Marshal(map[string]interface{}{"format": format, "width": cfg.Width, "height": cfg.Height})
+		if _, err := mark.ExecContext(ctx, string(info), uploadID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// thumbHandler serves /graph/{id}/blob/{hash}/thumb: a PNG thumbnail of
+// an image blob, at most 128 pixels on a side.
+func thumbHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	var data []byte
+	err = db.QueryRowContext(r.Context(), "SELECT data FROM thumbnails WHERE upload_id=? AND blob=?", uploadID, objectHash(r)).Scan(&data)
+	if err != nil {
+		http.Error(w, "no thumbnail", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	// a blob's content never changes, but the upload may be private
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(data)
+}
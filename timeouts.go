@@ -0,0 +1,75 @@
+package main
+
+// Server, query and ingest time limits, overridable with Go durations:
+//
+//	GITVIS_READ_TIMEOUT    reading a request, uploads included (default 5m)
+//	GITVIS_WRITE_TIMEOUT   writing a response (default 2m)
+//	GITVIS_IDLE_TIMEOUT    idle keep-alive connections (default 2m)
+//	GITVIS_QUERY_TIMEOUT   database work for one API request (default 30s)
+//	GITVIS_INGEST_TIMEOUT  extracting and walking one archive (default 30m)
+//
+// Event streams, WebSockets and gRPC calls lift the read/write deadlines on
+// their own connection, and synchronous ingests extend them to the ingest
+// limit.
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+var (
+	readTimeout, writeTimeout, idleTimeout time.Duration
+	queryTimeout, ingestTimeout            time.Duration
+)
+
+func envDuration(name string, def time.Duration) time.Duration {
+	s := setting(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		fatalf("%s: want a positive duration such as 30s or 5m, got %q", name, s)
+	}
+	return d
+}
+
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// queryContext bounds the database work done for one request.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+// withQueryTimeout applies queryContext to every request h serves.
+func withQueryTimeout(h func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, idStr string) {
+		ctx, cancel := queryContext(r.Context())
+		defer cancel()
+		h(w, r.WithContext(ctx), idStr)
+	}
+}
+
+// streaming lifts the server's read and write deadlines for a long-lived
+// response. Errors are ignored: not every writer supports deadlines.
+func streaming(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+// extendForIngest gives a synchronous ingest time to finish before its
+// response is written.
+func extendForIngest(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(ingestTimeout + writeTimeout))
+}
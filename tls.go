@@ -0,0 +1,83 @@
+package main
+
+// HTTPS. The server speaks TLS with the certificate and key in
+// GITVIS_TLS_CERT and GITVIS_TLS_KEY, or with certificates it obtains and
+// renews from Let's Encrypt for the names in GITVIS_TLS_DOMAINS. Either
+// way GITVIS_HTTP_ADDR, when set, serves plain HTTP that redirects to
+// HTTPS and answers Let's Encrypt's http-01 challenges.
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// configureTLS sets srv up as the TLS settings ask, stopping the program
+// when they conflict, and returns the func that serves it. It also starts
+// the redirecting HTTP server, which stops with srv.
+func configureTLS(srv *http.Server) func() error {
+	cert, key := setting("GITVIS_TLS_CERT"), setting("GITVIS_TLS_KEY")
+	var domains []string
+	for _, d := range strings.Split(setting("GITVIS_TLS_DOMAINS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if (cert == "") != (key == "") {
+		fatalf("GITVIS_TLS_CERT and GITVIS_TLS_KEY go together")
+	}
+	if cert != "" && len(domains) > 0 {
+		fatalf("GITVIS_TLS_DOMAINS obtains certificates; it can't be used with GITVIS_TLS_CERT")
+	}
+
+	serve := srv.ListenAndServe
+	redirect := http.Handler(http.HandlerFunc(redirectToHTTPS(srv.Addr)))
+	switch {
+	case cert != "":
+		slog.Info("serving HTTPS", "cert", cert)
+		serve = func() error { return srv.ListenAndServeTLS(cert, key) }
+	case len(domains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(setting("GITVIS_TLS_CACHE")),
+			Email:      setting("GITVIS_TLS_EMAIL"),
+		}
+		slog.Info("serving HTTPS with Let's Encrypt certificates", "domains", domains)
+		srv.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	default:
+		return serve
+	}
+
+	if addr := setting("GITVIS_HTTP_ADDR"); addr != "" {
+		plain := newServer(addr, redirect)
+		srv.RegisterOnShutdown(func() { plain.Close() })
+		go func() {
+			if err := plain.ListenAndServe(); err != http.ErrServerClosed {
+				fatalf("serve %s: %v", addr, err)
+			}
+		}()
+	}
+	return serve
+}
+
+// redirectToHTTPS sends requests to the same URL over HTTPS on the port of
+// httpsAddr.
+func redirectToHTTPS(httpsAddr string) func(http.ResponseWriter, *http.Request) {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
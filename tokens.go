@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// API tokens guard the endpoints that write: programmatic ingest, refresh
+// and delete. Only a SHA-256 of each token is stored; the token itself is
+// shown once, when created with `gitvis token create`.
+
+const tokenPrefix = "gv_"
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func createToken(name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	_, err := db.Exec("INSERT INTO api_tokens(name, hash) VALUES(?,?)", name, hashToken(token))
+	return token, err
+}
+
+type apiTokenKey struct{}
+
+// apiToken is the outcome of looking up a request's API token.
+type apiToken struct {
+	id int
+	ok bool
+}
+
+// withAPIToken looks up the request's API token once, for every
+// tokenFromRequest made while serving it.
+func withAPIToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := lookupToken(r)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, apiToken{id, ok})))
+	})
+}
+
+// tokenFromRequest returns the ID of the API token presented in the
+// Authorization header, or false if there is none or it isn't valid.
+func tokenFromRequest(r *http.Request) (int, bool) {
+	if t, ok := r.Context().Value(apiTokenKey{}).(apiToken); ok {
+		return t.id, t.ok
+	}
+	return lookupToken(r)
+}
+
+func lookupToken(r *http.Request) (int, bool) {
+	auth := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return 0, false
+	}
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return 0, false
+	}
+	var id int
+	err := db.QueryRow("SELECT id FROM api_tokens WHERE hash=? AND revoked_at IS NULL", hashToken(token)).Scan(&id)
+	if err != nil {
+		return 0, false
+	}
+	// a minute is as fine as `gitvis token list` needs, and spares a
+	// write for every call a busy client makes
+	db.Exec(`UPDATE api_tokens SET last_used_at=CURRENT_TIMESTAMP
+		WHERE id=? AND (last_used_at IS NULL OR last_used_at < datetime('now','-1 minute'))`, id)
+	return id, true
+}
+
+// requireToken answers 401 and returns false unless the request carries a
+// valid API token.
+func requireToken(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := tokenFromRequest(r); ok {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="gitvis"`)
+	http.Error(w, "a valid API token is required", http.StatusUnauthorized)
+	return false
+}
+
+// withToken wraps a per-upload resource handler with requireToken.
+func withToken(h func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, idStr string) {
+		if requireToken(w, r) {
+			h(w, r, idStr)
+		}
+	}
+}
+
+// runTokenCommand implements `gitvis token create|list|revoke`.
+func runTokenCommand(args []string) error {
+	usage := errors.New("usage: gitvis token create <name> | list | revoke <id>")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "create":
+		if len(args) != 2 {
+			return usage
+		}
+		token, err := createToken(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		fmt.Fprintln(os.Stderr, "store this token now; it cannot be shown again")
+		return nil
+	case "list":
+		rows, err := db.Query("SELECT id,name,created_at,last_used_at,revoked_at FROM api_tokens ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tCREATED\tLAST USED\tREVOKED")
+		for rows.Next() {
+			var id int
+			var name string
+			var created, used, revoked sql.NullString
+			if err := rows.Scan(&id, &name, &created, &used, &revoked); err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", id, name, created.String, orDash(used), orDash(revoked))
+		}
+		tw.Flush()
+		return rows.Err()
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return usage
+		}
+		res, err := db.Exec("UPDATE api_tokens SET revoked_at=CURRENT_TIMESTAMP WHERE id=? AND revoked_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("no active token with id %d", id)
+		}
+		return nil
+	}
+	return usage
+}
+
+func orDash(s sql.NullString) string {
+	if !s.Valid {
+		return "-"
+	}
+	return s.String
+}
@@ -0,0 +1,356 @@
+package main
+
+// Tracing. With GITVIS_OTLP_ENDPOINT set, requests, ingests and their
+// phases, and database queries are recorded as OpenTelemetry spans and
+// sent to that collector (Jaeger, Tempo, an OpenTelemetry Collector) over
+// OTLP/HTTP in its JSON encoding. Requests carrying a W3C traceparent
+// header continue the caller's trace. As with metrics, the little of
+// OpenTelemetry needed is implemented here rather than taken from its SDK.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	otlpEndpoint string
+	otlpHeaders  http.Header
+	// the share of traces started here that are recorded
+	traceSample float64
+)
+
+func parseOTLPHeaders(s string) http.Header {
+	h := make(http.Header)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			fatalf("GITVIS_OTLP_HEADERS: want name=value pairs, got %q", kv)
+		}
+		h.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	return h
+}
+
+// OpenTelemetry span kinds and status codes
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+
+	statusError = 2
+)
+
+// span is one timed operation of a trace.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	mu      sync.Mutex
+	attrs   map[string]interface{}
+	err     string
+}
+
+type spanKey struct{}
+
+// spanFrom is the span ctx is in, or nil.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a span as a child of the one ctx is in, or of none,
+// returning a context in it. The span is nil, and its methods do nothing,
+// when tracing is off or the trace isn't sampled.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFrom(ctx)
+	if parent == nil && !sampled() {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.id
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.id[:])
+	ctx = context.WithValue(ctx, spanKey{}, s)
+	if parent == nil {
+		ctx = withLogAttrs(ctx, slog.String("trace_id", hex.EncodeToString(s.traceID[:])))
+	}
+	return ctx, s
+}
+
+// sampled decides whether a trace starting here is recorded.
+func sampled() bool {
+	if otlpEndpoint == "" || traceSample <= 0 {
+		return false
+	}
+	if traceSample >= 1 {
+		return true
+	}
+	return mathrand.Float64() < traceSample
+}
+
+// remoteSpan is the caller's span a request's traceparent header names,
+// to parent the request's own; nil without one, or when the caller didn't
+// sample the trace.
+func remoteSpan(r *http.Request) *span {
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if otlpEndpoint == "" || len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || flags&1 == 0 {
+		return nil
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(s.id[:], []byte(parts[2])); err != nil || s.id == [8]byte{} {
+		return nil
+	}
+	return s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// end finishes the span, failed with err if that isn't nil, and queues it
+// for export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.err = err.Error()
+		s.mu.Unlock()
+	}
+	exportSpan(s.encode(time.Now()))
+}
+
+// encode renders the span as OTLP JSON.
+func (s *span) encode(end time.Time) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := make([]map[string]interface{}, 0, len(s.attrs))
+	for k, v := range s.attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]interface{}{"key": k, "value": value})
+	}
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.id[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attrs,
+	}
+	if s.parent != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		m["status"] = map[string]interface{}{"code": statusError, "message": s.err}
+	}
+	return m
+}
+
+// Finished spans are sent in batches, every few seconds or once enough
+// are waiting. If the collector falls behind, spans are dropped rather
+// than held.
+const (
+	spanBatchSize     = 512
+	spanBatchInterval = 5 * time.Second
+)
+
+var (
+	spansMu      sync.Mutex
+	pendingSpans []map[string]interface{}
+	spansWaiting = make(chan struct{}, 1)
+	spansDropped int
+)
+
+func exportSpan(s map[string]interface{}) {
+	spansMu.Lock()
+	defer spansMu.Unlock()
+	if len(pendingSpans) >= 8*spanBatchSize {
+		spansDropped++
+		return
+	}
+	pendingSpans = append(pendingSpans, s)
+	if len(pendingSpans) >= spanBatchSize {
+		select {
+		case spansWaiting <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func exportLoop() {
+	tick := time.NewTicker(spanBatchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-spansWaiting:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		flushSpans(ctx)
+		cancel()
+	}
+}
+
+// flushSpans sends the finished spans waiting.
+func flushSpans(ctx context.Context) {
+	for {
+		spansMu.Lock()
+		batch := pendingSpans[:min(len(pendingSpans), spanBatchSize)]
+		pendingSpans = pendingSpans[len(batch):]
+		dropped := spansDropped
+		spansDropped = 0
+		spansMu.Unlock()
+		if dropped > 0 {
+			slog.Warn("trace spans dropped", "spans", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := sendSpans(ctx, batch); err != nil {
+			slog.Warn("exporting trace spans", "spans", len(batch), "err", err)
+			return
+		}
+	}
+}
+
+func sendSpans(ctx context.Context, spans []map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []interface{}{
+				map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "gitvis"}},
+			}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "gitvis"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", otlpEndpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range otlpHeaders {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", res.Status)
+	}
+	return nil
+}
+
+// traced records a server span for every request h serves, named after the
+// route pattern that served it.
+func traced(h http.Handler) http.Handler {
+	if otlpEndpoint == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote := remoteSpan(r); remote != nil {
+			ctx = context.WithValue(ctx, spanKey{}, remote)
+		}
+		ctx, s := startSpan(ctx, "HTTP "+r.Method, spanServer)
+		if s == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(ctx)
+		h.ServeHTTP(rec, r)
+		// the ServeMux sets the pattern on the request it was handed
+		if r.Pattern != "" {
+			s.name = "HTTP " + r.Method + " " + r.Pattern
+			s.set("http.route", r.Pattern)
+		}
+		s.set("http.request.method", r.Method)
+		s.set("url.path", r.URL.Path)
+		s.set("http.response.status_code", rec.code())
+		s.set("gitvis.request_id", requestID(ctx))
+		var err error
+		if rec.code() >= 500 {
+			err = fmt.Errorf("%d %s", rec.code(), http.StatusText(rec.code()))
+		}
+		s.end(err)
+	})
+}
+
+// traceDB starts a client span for a database call made with ctx, if ctx
+// is in a trace, returning the func that ends it with the call's error and
+// passes that on.
+func traceDB(ctx context.Context, op, query string) func(error) error {
+	if spanFrom(ctx) == nil {
+		return func(err error) error { return err }
+	}
+	_, s := startSpan(ctx, "sqlite "+op, spanClient)
+	s.set("db.system", "sqlite")
+	s.set("db.operation.name", op)
+	s.set("db.query.text", query[:min(len(query), 2000)])
+	return func(err error) error {
+		if errors.Is(err, driver.ErrSkip) {
+			s.end(nil)
+		} else {
+			s.end(err)
+		}
+		return err
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// trailerKinds are the trailers that credit someone besides the author,
+// by their lowercased key.
+var trailerKinds = map[string]bool{"co-authored-by": true, "signed-off-by": true, "reviewed-by": true}
+
+// trailer is a person credited on a commit by a trailer.
+type trailer struct {
+	Kind  string `json:"kind"` // the lowercased key, such as co-authored-by
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// parseTrailers returns the credit trailers in the last paragraph of a
+// commit message, as "Key: Name <email>" lines. Other lines there, such
+// as other trailers, are skipped, and so is a message of one paragraph,
+// which is all subject.
+func parseTrailers(message string) []trailer {
+	paras := strings.Split(strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n")), "\n\n")
+	if len(paras) < 2 {
+		return nil
+	}
+	var out []trailer
+	for _, line := range strings.Split(paras[len(paras)-1], "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || !trailerKinds[key] {
+			continue
+		}
+		name, email, _, ok := mailmapIdentity(value)
+		if !ok || email == "" {
+			continue
+		}
+		out = append(out, trailer{Kind: key, Name: name, Email: email})
+	}
+	return out
+}
+
+// storeTrailers records the credit trailers of each commit as "trailers",
+// with identities through m as for authors. A trailer naming the commit's
+// own author, as a sign-off usually does, credits nothing and is left out.
+func storeTrailers(ctx context.Context, uploadID int, m mailmap) error {
+	rows, err := db.QueryContext(ctx, `SELECT id, label, COALESCE(json_extract(meta,'$.mailmap_email'),json_extract(meta,'$.email'),'')
+		FROM nodes WHERE upload_id=? AND type='commit' AND meta<>''`, uploadID)
+	if err != nil {
+		return err
+	}
+	credits := make(map[string][]trailer)
+	for rows.Next() {
+		var id, message, author string
+		if err := rows.Scan(&id, &message, &author); err != nil {
+			rows.Close()
+			return err
+		}
+		var list []trailer
+		for _, t := range parseTrailers(message) {
+			t.Name, t.Email = m.resolve(t.Name, t.Email)
+			if !strings.EqualFold(t.Email, author) {
+				list = append(list, t)
+			}
+		}
+		credits[id] = list
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	set, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_set(meta,'$.trailers',json(?)) WHERE upload_id=? AND id=?")
+	if err != nil {
+		return err
+	}
+	defer set.Close()
+	unset, err := tx.PrepareContext(ctx, "UPDATE nodes SET meta=json_remove(meta,'$.trailers') WHERE upload_id=? AND id=? AND json_extract(meta,'$.trailers') IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	defer unset.Close()
+	for id, list := range credits {
+		if len(list) == 0 {
+			_, err = unset.ExecContext(ctx, uploadID, id)
+		} else {
+			b, _ := json.Marshal(list)
+			_, err = set.ExecContext(ctx, string(b), uploadID, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addCredits counts the trailers crediting each contributor, adding the
+// people who appear only in trailers with no commits of their own; their
+// first and last dates are those of the commits crediting them.
+func addCredits(list []*contributor, commits []commitInfo) []*contributor {
+	byEmail := make(map[string]*contributor, len(list))
+	for _, ct := range list {
+		byEmail[strings.ToLower(ct.Email)] = ct
+	}
+	for _, c := range commits {
+		for _, t := range c.Trailers {
+			key := strings.ToLower(t.Email)
+			ct := byEmail[key]
+			if ct == nil {
+				ct = &contributor{Name: t.Name, Email: t.Email, FirstCommit: c.When, LastCommit: c.When}
+				byEmail[key] = ct
+				list = append(list, ct)
+			}
+			if ct.Commits == 0 {
+				ct.FirstCommit = minTime(ct.FirstCommit, c.When)
+				ct.LastCommit = maxTime(ct.LastCommit, c.When)
+			}
+			switch t.Kind {
+			case "co-authored-by":
+				ct.CoAuthored++
+			case "signed-off-by":
+				ct.SignedOff++
+			case "reviewed-by":
+				ct.Reviewed++
+			}
+		}
+	}
+	return list
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// storeTreeEntry records one entry of a tree, submodules included.
+func storeTreeEntry(uploadID int, tree string, e object.TreeEntry) {
+	graphStore.AddTreeEntry(uploadID, tree, e.Name, uint32(e.Mode), e.Hash.String())
+}
+
+// treeEntry is one entry of the tree endpoint's listing.
+type treeEntry struct {
+	Name string `json:"name"`
+	// "blob", "tree", or "commit" for a submodule
+	Type string `json:"type"`
+	// git's octal mode, such as 100644 or 040000
+	Mode string `json:"mode"`
+	Hash string `json:"hash"`
+	// a file's size, or the total of the files below a directory
+	Size  *int64 `json:"size,omitempty"`
+	Files *int   `json:"files,omitempty"`
+}
+
+// treeHandler serves /graph/{id}/tree/{commit}: the listing of the
+// directory at ?path= (the root by default) in a commit's tree, which may
+// also be given as a branch or tag. Directories come first, then files,
+// each by name.
+func treeHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	commit, err := resolveCommit(r.Context(), uploadID, objectHash(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("commit: %v", err), 404)
+		return
+	}
+	var tree string
+	if err := db.QueryRowContext(r.Context(), "SELECT target FROM edges WHERE upload_id=? AND source=? AND rel='commit->tree'",
+		uploadID, commit).Scan(&tree); err != nil {
+		http.Error(w, "commit has no tree", 404)
+		return
+	}
+	dir := strings.Trim(r.URL.Query().Get("path"), "/")
+	if dir != "" {
+		for _, name := range strings.Split(dir, "/") {
+			var hash string
+			var mode uint32
+			err := db.QueryRowContext(r.Context(), "SELECT hash, mode FROM tree_entries WHERE upload_id=? AND tree=? AND name=?",
+				uploadID, tree, name).Scan(&hash, &mode)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("no directory %q", dir), 404)
+				return
+			}
+			if filemode.FileMode(mode) != filemode.Dir {
+				http.Error(w, fmt.Sprintf("%q is not a directory", dir), 400)
+				return
+			}
+			tree = hash
+		}
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT e.name, e.mode, e.hash, COALESCE(n.meta,'') FROM tree_entries e
+		LEFT JOIN nodes n ON n.upload_id=e.upload_id AND n.id=e.hash
+		WHERE e.upload_id=? AND e.tree=?`, uploadID, tree)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	entries := make([]treeEntry, 0)
+	for rows.Next() {
+		var e treeEntry
+		var mode uint32
+		var meta string
+		if err := rows.Scan(&e.Name, &mode, &e.Hash, &meta); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		e.Mode = fmt.Sprintf("%06o", mode)
+		switch filemode.FileMode(mode) {
+		case filemode.Dir:
+			e.Type = "tree"
+		case filemode.Submodule:
+			e.Type = "commit"
+		default:
+			e.Type = "blob"
+		}
+		var m struct {
+			Size  *int64 `json:"size"`
+			Files *int   `json:"files"`
+		}
+		json.Unmarshal([]byte(meta), &m)
+		e.Size, e.Files = m.Size, m.Files
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if di, dj := entries[i].Type == "tree", entries[j].Type == "tree"; di != dj {
+			return di
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"commit":  commit,
+		"path":    dir,
+		"tree":    tree,
+		"entries": entries,
+	})
+}
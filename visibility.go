@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Upload visibility:
+//
+//	private   only the owner (and API tokens) can see it
+//	unlisted  anyone with the link
+//	public    anyone, and it is listed in the gallery
+//
+// Uploads made while signed in start out private; others are unlisted,
+// which is how every upload behaved before accounts existed.
+var visibilities = map[string]bool{"private": true, "unlisted": true, "public": true}
+
+type uploadAccess struct {
+	Owner      int
+	Visibility string
+}
+
+// lookupAccess returns ok=false when the upload doesn't exist.
+func lookupAccess(uploadID int) (uploadAccess, bool, error) {
+	var a uploadAccess
+	var owner sql.NullInt64
+	var vis sql.NullString
+	err := db.QueryRow("SELECT user_id, visibility FROM uploads WHERE id=?", uploadID).Scan(&owner, &vis)
+	if err == sql.ErrNoRows {
+		return a, false, nil
+	}
+	if err != nil {
+		return a, false, err
+	}
+	a.Owner = int(owner.Int64)
+	a.Visibility = vis.String
+	if a.Visibility == "" {
+		a.Visibility = "unlisted"
+	}
+	return a, true, nil
+}
+
+// canView reports whether the request may see an upload. Unknown IDs are
+// let through so handlers keep answering them as they always have.
+func canView(r *http.Request, uploadID int) bool {
+	a, ok, err := lookupAccess(uploadID)
+	if err != nil {
+		return false
+	}
+	if !ok || a.Visibility != "private" {
+		return true
+	}
+	return isOwner(r, a) || validShare(r, uploadID)
+}
+
+// isOwner reports whether the request acts for the upload's owner. API
+// tokens act for the instance, so they count as owning everything.
+func isOwner(r *http.Request, a uploadAccess) bool {
+	if _, ok := tokenFromRequest(r); ok {
+		return true
+	}
+	u := currentUser(r)
+	return u != nil && a.Owner != 0 && u.ID == a.Owner
+}
+
+// errListSignIn is eachListedUpload's error for a request that must sign
+// in before it can list uploads.
+var errListSignIn = errors.New("sign in to list uploads")
+
+// eachListedUpload calls fn for each upload the request may list, in ID
+// order: every one it can view, or with accounts enabled, the signed-in
+// user's own (API tokens still see everything). With accounts enabled and
+// neither a session nor a token, it returns errListSignIn. Unlisted
+// uploads are for those with the link, so the listings all go through it.
+func eachListedUpload(ctx context.Context, r *http.Request, fn func(id int, name, uploadedAt sql.NullString) error) error {
+	q, args := "SELECT id,name,uploaded_at FROM uploads ORDER BY id", []interface{}{}
+	if authEnabled() {
+		if _, ok := tokenFromRequest(r); !ok {
+			u := currentUser(r)
+			if u == nil {
+				return errListSignIn
+			}
+			q, args = "SELECT id,name,uploaded_at FROM uploads WHERE user_id=? ORDER BY id", []interface{}{u.ID}
+		}
+	}
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name, uploadedAt sql.NullString
+		if err := rows.Scan(&id, &name, &uploadedAt); err != nil {
+			return err
+		}
+		// without sign-in every upload is listed, so leave out the private
+		// ones the request has no share link for
+		if !canView(r, id) {
+			continue
+		}
+		if err := fn(id, name, uploadedAt); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// viewable answers 404 (so private uploads aren't revealed) and returns
+// false when the request can't see the upload named by idStr.
+func viewable(w http.ResponseWriter, r *http.Request, idStr string) bool {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		// handlers report malformed IDs themselves
+		return true
+	}
+	if !canView(r, uploadID) {
+		http.NotFound(w, r)
+		return false
+	}
+	return true
+}
+
+// updateUploadHandler serves PATCH /api/v1/uploads/{id} with a body
+// setting either or both of
+//
+//	{"visibility": "private"|"unlisted"|"public",
+//	 "issue_url": "https://host/owner/repo/issues/{n}"}
+//
+// where an empty issue_url turns issue links off.
+func updateUploadHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	a, ok, err := lookupAccess(uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !ok || (a.Visibility == "private" && !isOwner(r, a)) {
+		http.NotFound(w, r)
+		return
+	}
+	if !isOwner(r, a) {
+		http.Error(w, "only the owner can change the upload", http.StatusForbidden)
+		return
+	}
+	var body struct {
+		Visibility *string `json:"visibility"`
+		IssueURL   *string `json:"issue_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Visibility == nil && body.IssueURL == nil {
+		http.Error(w, "want a visibility or an issue_url", 400)
+		return
+	}
+	if body.Visibility != nil && !visibilities[*body.Visibility] {
+		http.Error(w, `visibility must be "private", "unlisted" or "public"`, 400)
+		return
+	}
+	if body.IssueURL != nil && *body.IssueURL != "" && !validIssueURL(*body.IssueURL) {
+		http.Error(w, `issue_url must be an http or https URL with "{n}" for the issue number`, 400)
+		return
+	}
+	if body.Visibility != nil {
+		if _, err := db.Exec("UPDATE uploads SET visibility=? WHERE id=?", *body.Visibility, uploadID); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	if body.IssueURL != nil {
+		if _, err := db.Exec("UPDATE uploads SET issue_url=NULLIF(?,'') WHERE id=?", *body.IssueURL, uploadID); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	getUploadHandler(w, r, idStr)
+}
+
+// galleryHandler serves GET /api/v1/gallery, the public uploads.
+func galleryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT id,name,uploaded_at FROM uploads WHERE visibility='public' ORDER BY id DESC")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	uploads := make([]upload, 0)
+	for rows.Next() {
+		var u upload
+		var name, uploadedAt sql.NullString
+		if err := rows.Scan(&u.ID, &name, &uploadedAt); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		u.Name, u.UploadedAt = name.String, uploadedAt.String
+		uploads = append(uploads, u)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploads)
+}
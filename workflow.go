@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rebaseSlack is how much later than its author date a commit must have
+// been committed to count as rebased; amends and quick fixups shouldn't.
+const rebaseSlack = time.Hour
+
+// integration counts how commits landed on a branch's first-parent line
+// over some period, and the style that suggests.
+type integration struct {
+	Month string `json:"month,omitempty"`
+	// commits on the first-parent line, and which of them are merges
+	Mainline int `json:"mainline"`
+	Merges   int `json:"merges"`
+	// commits the merges brought in
+	Merged int `json:"merged_commits"`
+	// non-merge commits on the line: direct pushes and fast-forwards,
+	// which look the same in the history, and of them those committed
+	// well after they were authored
+	Direct  int `json:"direct"`
+	Rebased int `json:"rebased"`
+	// runs of direct commits between merges
+	Segments       int    `json:"linear_segments"`
+	LongestSegment int    `json:"longest_segment"`
+	Style          string `json:"style"`
+}
+
+// classify names the integration style: "merge" when merges are at least
+// half the line, "mixed" when they are over a fifth, and otherwise
+// "rebase" when most direct commits were rebased or "linear" when they
+// landed as authored. An empty line has no style.
+func (s *integration) classify() {
+	switch {
+	case s.Mainline == 0:
+		s.Style = ""
+	case 2*s.Merges >= s.Mainline:
+		s.Style = "merge"
+	case 5*s.Merges > s.Mainline:
+		s.Style = "mixed"
+	case 2*s.Rebased > s.Direct:
+		s.Style = "rebase"
+	default:
+		s.Style = "linear"
+	}
+}
+
+// integrationStyle walks the first-parent line from tip, oldest first, and
+// counts it overall and per month of the commit date, when each commit
+// landed. A run of direct commits that crosses a month counts in both.
+func integrationStyle(h *history, tip string) (overall integration, months []integration) {
+	var line []string
+	for c := tip; c != "" && h.commits[c] != nil; c = h.firstParent(c) {
+		line = append(line, c)
+	}
+	byMonth := make(map[string]*integration)
+	var order []string
+	run := make(map[*integration]int) // current run of direct commits
+	add := func(s *integration, c string, merged int, rebased bool) {
+		s.Mainline++
+		if len(h.parents[c]) > 1 {
+			s.Merges++
+			s.Merged += merged
+			run[s] = 0
+			return
+		}
+		s.Direct++
+		if rebased {
+			s.Rebased++
+		}
+		if run[s] == 0 {
+			s.Segments++
+		}
+		run[s]++
+		if run[s] > s.LongestSegment {
+			s.LongestSegment = run[s]
+		}
+	}
+	for i := len(line) - 1; i >= 0; i-- {
+		c := line[i]
+		info := h.commits[c]
+		landed := info.Committed
+		if landed.IsZero() {
+			landed = info.When
+		}
+		merged := 0
+		if len(h.parents[c]) > 1 {
+			merged = len(h.only([]string{c}, h.parents[c][:1])) - 1
+		}
+		rebased := !info.Committed.IsZero() && info.Committed.Sub(info.When) > rebaseSlack
+
+		month := landed.Format("2006-01")
+		if byMonth[month] == nil {
+			byMonth[month] = &integration{Month: month}
+			order = append(order, month)
+		}
+		add(&overall, c, merged, rebased)
+		add(byMonth[month], c, merged, rebased)
+	}
+	overall.classify()
+	months = make([]integration, 0, len(order))
+	for _, m := range order {
+		byMonth[m].classify()
+		months = append(months, *byMonth[m])
+	}
+	return overall, months
+}
+
+// workflowHandler serves /graph/{id}/analytics/workflow: how work reaches
+// the trunk branch, or ?ref=, overall and month by month.
+func workflowHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	uploadID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		branches, err := loadRefs(r.Context(), uploadID, "branch")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if ref = pickTrunk(branches); ref == "" {
+			http.Error(w, "no branches", 404)
+			return
+		}
+	}
+	tip, err := resolveCommit(r.Context(), uploadID, ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ref: %v", err), 400)
+		return
+	}
+	h, err := loadHistory(r.Context(), uploadID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	overall, months := integrationStyle(h, tip)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ref": ref, "overall": overall, "months": months})
+}